@@ -0,0 +1,62 @@
+package tailscalesd
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// AddressPolicy determines which of their addresses devices are served with.
+type AddressPolicy int
+
+const (
+	// AllAddresses of devices are served as targets.
+	AllAddresses AddressPolicy = iota
+
+	// FirstIPv4Address of devices is served as their only target, falling back
+	// to their first address if they have no IPv4 address.
+	FirstIPv4Address
+
+	// FirstIPv6Address of devices is served as their only target, falling back
+	// to their first address if they have no IPv6 address.
+	FirstIPv6Address
+)
+
+var addressPolicyNames = map[string]AddressPolicy{
+	"all":      AllAddresses,
+	"first-v4": FirstIPv4Address,
+	"first-v6": FirstIPv6Address,
+}
+
+// ParseAddressPolicy from its name: "all", "first-v4" or "first-v6".
+func ParseAddressPolicy(name string) (AddressPolicy, error) {
+	if p, ok := addressPolicyNames[name]; ok {
+		return p, nil
+	}
+	return AllAddresses, fmt.Errorf("unknown address policy %q", name)
+}
+
+// Filter returns a TargetFilter applying the policy, so that devices with both
+// IPv4 and IPv6 addresses are not scraped twice. Targets which are not IP
+// addresses, such as hostnames, are treated as addresses of neither family.
+func (p AddressPolicy) Filter() TargetFilter {
+	return func(td TargetDescriptor) TargetDescriptor {
+		if p == AllAddresses || len(td.Targets) < 2 {
+			return td
+		}
+		chosen := td.Targets[0]
+		for _, target := range td.Targets {
+			addr, err := netip.ParseAddr(target)
+			if err != nil {
+				continue
+			}
+			if (p == FirstIPv4Address && addr.Is4()) || (p == FirstIPv6Address && addr.Is6()) {
+				chosen = target
+				break
+			}
+		}
+		return TargetDescriptor{
+			Targets: []string{chosen},
+			Labels:  td.Labels,
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package tailscalesd
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAddressPolicyFilter(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		policy  string
+		targets []string
+		want    []string
+	}{
+		"all": {
+			policy:  "all",
+			targets: []string{"100.2.3.4", "fd7a::1234"},
+			want:    []string{"100.2.3.4", "fd7a::1234"},
+		},
+		"first ipv4": {
+			policy:  "first-v4",
+			targets: []string{"fd7a::1234", "100.2.3.4", "100.5.6.7"},
+			want:    []string{"100.2.3.4"},
+		},
+		"first ipv6": {
+			policy:  "first-v6",
+			targets: []string{"100.2.3.4", "fd7a::1234", "fd7a::5678"},
+			want:    []string{"fd7a::1234"},
+		},
+		"falls back to first address": {
+			policy:  "first-v6",
+			targets: []string{"100.2.3.4", "100.5.6.7"},
+			want:    []string{"100.2.3.4"},
+		},
+		"hostnames are neither family": {
+			policy:  "first-v4",
+			targets: []string{"somethingclever", "100.2.3.4"},
+			want:    []string{"100.2.3.4"},
+		},
+		"no targets": {
+			policy: "first-v4",
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			policy, err := ParseAddressPolicy(tc.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := policy.Filter()(TargetDescriptor{Targets: tc.targets})
+			if diff := cmp.Diff(got.Targets, tc.want); diff != "" {
+				t.Errorf("Filter: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestParseAddressPolicyRejectsUnknownPolicies(t *testing.T) {
+	if _, err := ParseAddressPolicy("first"); err == nil {
+		t.Error("ParseAddressPolicy: want error for unknown policy")
+	}
+}
@@ -0,0 +1,173 @@
+package tailscalesd
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// AddressSelector chooses which of a device's addresses are served as its
+// targets, when translating devices to TargetDescriptors. Library consumers
+// may implement their own, and make them configurable by name with
+// RegisterAddressSelector.
+type AddressSelector interface {
+	SelectAddresses(d Device) []string
+}
+
+// AddressSelectorFunc adapts a function to an AddressSelector.
+type AddressSelectorFunc func(d Device) []string
+
+// SelectAddresses returns f(d).
+func (f AddressSelectorFunc) SelectAddresses(d Device) []string {
+	return f(d)
+}
+
+// familyOf an address, which is 4 or 6 for IP addresses, and 0 for anything
+// else, such as a hostname.
+func familyOf(address string) int {
+	addr, err := netip.ParseAddr(address)
+	switch {
+	case err != nil:
+		return 0
+	case addr.Is4() || addr.Is4In6():
+		return 4
+	}
+	return 6
+}
+
+// onlyFamily selects the addresses of the family, and any which are not IP
+// addresses.
+func onlyFamily(family int) AddressSelector {
+	return AddressSelectorFunc(func(d Device) []string {
+		var selected []string
+		for _, a := range d.Addresses {
+			if f := familyOf(a); f == family || f == 0 {
+				selected = append(selected, a)
+			}
+		}
+		return selected
+	})
+}
+
+// firstOfFamily selects the first address of the family, falling back to the
+// first address of any kind.
+func firstOfFamily(family int) AddressSelector {
+	return AddressSelectorFunc(func(d Device) []string {
+		if len(d.Addresses) == 0 {
+			return nil
+		}
+		for _, a := range d.Addresses {
+			if familyOf(a) == family {
+				return []string{a}
+			}
+		}
+		return d.Addresses[:1]
+	})
+}
+
+// Built-in AddressSelectors. Addresses which are not IP addresses, such as the
+// hostnames of devices served with HostnameNoAddress, are kept by those
+// selecting an address family.
+var (
+	// AllAddressesSelector selects every address.
+	AllAddressesSelector AddressSelector = AddressSelectorFunc(func(d Device) []string {
+		return d.Addresses
+	})
+
+	// IPv4AddressesSelector selects only IPv4 addresses.
+	IPv4AddressesSelector = onlyFamily(4)
+
+	// IPv6AddressesSelector selects only IPv6 addresses.
+	IPv6AddressesSelector = onlyFamily(6)
+
+	// FirstIPv4AddressSelector selects the first IPv4 address, falling back
+	// to the first address, so that hosts are not scraped twice.
+	FirstIPv4AddressSelector = firstOfFamily(4)
+
+	// FirstIPv6AddressSelector selects the first IPv6 address, falling back
+	// to the first address, so that hosts are not scraped twice.
+	FirstIPv6AddressSelector = firstOfFamily(6)
+
+	// PreferIPv6AddressSelector selects IPv6 addresses, falling back to every
+	// address for devices which have none.
+	PreferIPv6AddressSelector AddressSelector = AddressSelectorFunc(func(d Device) []string {
+		if selected := IPv6AddressesSelector.SelectAddresses(d); len(selected) > 0 {
+			return selected
+		}
+		return d.Addresses
+	})
+)
+
+// selectAddresses of the devices with s, returning copies of the devices with
+// only the selected addresses. The devices are returned unchanged if s is nil.
+func selectAddresses(devices []Device, s AddressSelector) []Device {
+	if s == nil {
+		return devices
+	}
+	selected := make([]Device, len(devices))
+	for i, d := range devices {
+		d.Addresses = s.SelectAddresses(d)
+		selected[i] = d
+	}
+	return selected
+}
+
+// ChainAddressSelectors returns an AddressSelector applying each of the
+// selectors in turn, each selecting from the addresses selected by the last.
+// For example, chaining IPv6AddressesSelector and FirstIPv4AddressSelector
+// selects the first IPv6 address.
+func ChainAddressSelectors(selectors ...AddressSelector) AddressSelector {
+	return AddressSelectorFunc(func(d Device) []string {
+		for _, s := range selectors {
+			d.Addresses = s.SelectAddresses(d)
+		}
+		return d.Addresses
+	})
+}
+
+var addressSelectors = struct {
+	sync.RWMutex
+	byName map[string]AddressSelector
+}{byName: map[string]AddressSelector{
+	"all":       AllAddressesSelector,
+	"ipv4":      IPv4AddressesSelector,
+	"ipv6":      IPv6AddressesSelector,
+	"first-v4":  FirstIPv4AddressSelector,
+	"first-v6":  FirstIPv6AddressSelector,
+	"prefer-v6": PreferIPv6AddressSelector,
+}}
+
+// RegisterAddressSelector makes s available from AddressSelectorNamed by the
+// name. Registering a name twice is an error.
+func RegisterAddressSelector(name string, s AddressSelector) error {
+	addressSelectors.Lock()
+	defer addressSelectors.Unlock()
+	if _, ok := addressSelectors.byName[name]; ok {
+		return fmt.Errorf("address selector %q already registered", name)
+	}
+	addressSelectors.byName[name] = s
+	return nil
+}
+
+// AddressSelectorNamed returns the AddressSelector registered with the name.
+// The built-in selectors are "all", "ipv4", "ipv6", "first-v4", "first-v6"
+// and "prefer-v6".
+func AddressSelectorNamed(name string) (AddressSelector, bool) {
+	addressSelectors.RLock()
+	defer addressSelectors.RUnlock()
+	s, ok := addressSelectors.byName[name]
+	return s, ok
+}
+
+// AddressSelectorNames registered, sorted.
+func AddressSelectorNames() []string {
+	addressSelectors.RLock()
+	defer addressSelectors.RUnlock()
+	names := make([]string, 0, len(addressSelectors.byName))
+	for name := range addressSelectors.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,79 @@
+package tailscalesd
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAddressSelectors(t *testing.T) {
+	dual := Device{Addresses: []string{"fd7a::1", "100.2.3.4", "fd7a::2", "100.2.3.5"}}
+	v4 := Device{Addresses: []string{"100.2.3.4", "100.2.3.5"}}
+	hostname := Device{Addresses: []string{"web"}}
+	for name, tc := range map[string][]struct {
+		device Device
+		want   []string
+	}{
+		"all": {
+			{device: dual, want: dual.Addresses},
+		},
+		"ipv4": {
+			{device: dual, want: []string{"100.2.3.4", "100.2.3.5"}},
+			{device: hostname, want: []string{"web"}},
+		},
+		"ipv6": {
+			{device: dual, want: []string{"fd7a::1", "fd7a::2"}},
+			{device: v4},
+		},
+		"first-v4": {
+			{device: dual, want: []string{"100.2.3.4"}},
+			{device: hostname, want: []string{"web"}},
+			{device: Device{}},
+		},
+		"first-v6": {
+			{device: dual, want: []string{"fd7a::1"}},
+			{device: v4, want: []string{"100.2.3.4"}},
+		},
+		"prefer-v6": {
+			{device: dual, want: []string{"fd7a::1", "fd7a::2"}},
+			{device: v4, want: v4.Addresses},
+		},
+	} {
+		s, ok := AddressSelectorNamed(name)
+		if !ok {
+			t.Fatalf("AddressSelectorNamed(%q): not found", name)
+		}
+		for _, c := range tc {
+			if diff := cmp.Diff(s.SelectAddresses(c.device), c.want); diff != "" {
+				t.Errorf("%v.SelectAddresses(%v): mismatch (-got, +want):\n%v", name, c.device.Addresses, diff)
+			}
+		}
+	}
+}
+
+func TestChainAddressSelectors(t *testing.T) {
+	s := ChainAddressSelectors(IPv6AddressesSelector, FirstIPv4AddressSelector)
+	got := s.SelectAddresses(Device{Addresses: []string{"100.2.3.4", "fd7a::1", "fd7a::2"}})
+	if diff := cmp.Diff(got, []string{"fd7a::1"}); diff != "" {
+		t.Errorf("ChainAddressSelectors: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestRegisterAddressSelector(t *testing.T) {
+	last := AddressSelectorFunc(func(d Device) []string {
+		return d.Addresses[len(d.Addresses)-1:]
+	})
+	if err := RegisterAddressSelector("test-last", last); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterAddressSelector("all", last); err == nil {
+		t.Error("RegisterAddressSelector: want error registering a name twice")
+	}
+	s, ok := AddressSelectorNamed("test-last")
+	if !ok {
+		t.Fatal("AddressSelectorNamed: registered selector not found")
+	}
+	if diff := cmp.Diff(s.SelectAddresses(Device{Addresses: []string{"100.2.3.4", "fd7a::1"}}), []string{"fd7a::1"}); diff != "" {
+		t.Errorf("AddressSelectorNamed: mismatch (-got, +want):\n%v", diff)
+	}
+}
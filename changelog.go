@@ -0,0 +1,187 @@
+package tailscalesd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ChangedDevice identifies a device in a ChangelogEntry.
+type ChangedDevice struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+}
+
+// ChangelogEntry describes how the devices found by one refresh differ from
+// those found by the previous refresh of the same source.
+type ChangelogEntry struct {
+	Time time.Time `json:"timestamp"`
+	// Source is the Name of the RateLimitedDiscoverer which refreshed.
+	Source  string          `json:"source,omitempty"`
+	Added   []ChangedDevice `json:"added"`
+	Removed []ChangedDevice `json:"removed"`
+	Changed []ChangedDevice `json:"changed"`
+	Total   int             `json:"total"`
+}
+
+// membershipChanged reports whether the device changed in ways which affect how
+// it's monitored. Volatile details, such as when it was last seen or whether
+// it is online, are ignored.
+func membershipChanged(a, b Device) bool {
+	return a.Hostname != b.Hostname ||
+		a.Name != b.Name ||
+		a.OS != b.OS ||
+		a.Authorized != b.Authorized ||
+		!slices.Equal(a.Addresses, b.Addresses) ||
+		!slices.Equal(a.Tags, b.Tags)
+}
+
+func changedDevice(d Device) ChangedDevice {
+	return ChangedDevice{ID: d.ID, Hostname: d.Hostname}
+}
+
+// changes between the previous and current results of a refresh.
+func changes(previous, current []Device) (added, removed, changed []ChangedDevice) {
+	was := make(map[string]Device, len(previous))
+	for _, d := range previous {
+		was[d.ID] = d
+	}
+	present := make(map[string]bool, len(current))
+	for _, d := range current {
+		present[d.ID] = true
+		p, ok := was[d.ID]
+		switch {
+		case !ok:
+			added = append(added, changedDevice(d))
+		case membershipChanged(p, d):
+			changed = append(changed, changedDevice(d))
+		}
+	}
+	for _, d := range previous {
+		if !present[d.ID] {
+			removed = append(removed, changedDevice(d))
+		}
+	}
+	return
+}
+
+// Changelog writes a JSON lines record of every refresh of
+// RateLimitedDiscoverers to a file, providing a durable audit trail of tailnet
+// membership as seen by monitoring. The file is rotated when it would exceed
+// its maximum size, keeping a number of backups suffixed .1, .2 and so on,
+// from newest to oldest.
+type Changelog struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex // protects following members
+	f    *os.File
+	size int64
+}
+
+// NewChangelog appending to the file at path, rotating it before it exceeds
+// maxBytes and keeping up to backups rotated files.
+func NewChangelog(path string, maxBytes int64, backups int) (*Changelog, error) {
+	c := &Changelog{
+		path:     path,
+		maxBytes: maxBytes,
+		backups:  backups,
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Changelog) open() error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.f = f
+	c.size = info.Size()
+	return nil
+}
+
+// rotate the file, shifting existing backups and discarding the oldest.
+func (c *Changelog) rotate() error {
+	if err := c.f.Close(); err != nil {
+		return err
+	}
+	if c.backups > 0 {
+		for i := c.backups - 1; i > 0; i-- {
+			from := fmt.Sprintf("%v.%d", c.path, i)
+			if err := os.Rename(from, fmt.Sprintf("%v.%d", c.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(c.path, c.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(c.path); err != nil {
+		return err
+	}
+	return c.open()
+}
+
+// write the entry as a line, rotating the file first if needed.
+func (c *Changelog) write(e ChangelogEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size > 0 && c.size+int64(len(b)) > c.maxBytes {
+		if err := c.rotate(); err != nil {
+			return fmt.Errorf("failed rotating: %w", err)
+		}
+	}
+	n, err := c.f.Write(b)
+	c.size += int64(n)
+	return err
+}
+
+// record the changes between the previous and current results of a refresh of
+// source at the time at. Failures are logged, rather than failing discovery. A
+// nil Changelog records nothing.
+func (c *Changelog) record(source string, previous, current []Device, at time.Time) {
+	if c == nil {
+		return
+	}
+	// Unchanged lists are written as empty, rather than null, for the benefit
+	// of consumers.
+	e := ChangelogEntry{
+		Time:    at,
+		Source:  source,
+		Added:   []ChangedDevice{},
+		Removed: []ChangedDevice{},
+		Changed: []ChangedDevice{},
+		Total:   len(current),
+	}
+	added, removed, changed := changes(previous, current)
+	e.Added = append(e.Added, added...)
+	e.Removed = append(e.Removed, removed...)
+	e.Changed = append(e.Changed, changed...)
+	if err := c.write(e); err != nil {
+		log.Printf("Failed writing changelog %q: %v", c.path, err)
+	}
+}
+
+// Close the changelog file.
+func (c *Changelog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f.Close()
+}
@@ -0,0 +1,101 @@
+package tailscalesd
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func readChangelogForTest(t *testing.T, path string) []ChangelogEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []ChangelogEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e ChangelogEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("bad changelog line %q: %v", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestChangelogRecordsRefreshes(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "changelog.jsonl")
+	c, err := NewChangelog(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.record("test", nil, []Device{
+		{ID: "one", Hostname: "foo"},
+		{ID: "two", Hostname: "bar", Online: true},
+	}, at)
+	c.record("test", []Device{
+		{ID: "one", Hostname: "foo"},
+		{ID: "two", Hostname: "bar", Online: true},
+	}, []Device{
+		{ID: "two", Hostname: "bar", Tags: []string{"tag:web"}},
+		{ID: "three", Hostname: "baz"},
+	}, at.Add(time.Minute))
+
+	want := []ChangelogEntry{
+		{
+			Time:   at,
+			Source: "test",
+			Added:  []ChangedDevice{{ID: "one", Hostname: "foo"}, {ID: "two", Hostname: "bar"}},
+			Total:  2,
+		},
+		{
+			Time:    at.Add(time.Minute),
+			Source:  "test",
+			Added:   []ChangedDevice{{ID: "three", Hostname: "baz"}},
+			Removed: []ChangedDevice{{ID: "one", Hostname: "foo"}},
+			Changed: []ChangedDevice{{ID: "two", Hostname: "bar"}},
+			Total:   2,
+		},
+	}
+	if diff := cmp.Diff(readChangelogForTest(t, path), want, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Changelog: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestChangelogRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changelog.jsonl")
+	// Small enough that every entry rotates the file.
+	c, err := NewChangelog(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 1; i <= 4; i++ {
+		c.record("test", nil, make([]Device, i), time.Time{})
+	}
+	for file, want := range map[string]int{
+		path:        4,
+		path + ".1": 3,
+		path + ".2": 2,
+	} {
+		entries := readChangelogForTest(t, file)
+		if len(entries) != 1 || entries[0].Total != want {
+			t.Errorf("Changelog: %q: got: %+v want one entry with total %d", file, entries, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Changelog: want no more than 2 backups, got error %v for a third", err)
+	}
+}
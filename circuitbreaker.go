@@ -0,0 +1,120 @@
+package tailscalesd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Defaults for CircuitBreakerDiscoverers which do not specify their own.
+const (
+	DefaultCircuitBreakerFailures = 3
+	DefaultCircuitBreakerCooldown = time.Minute
+)
+
+// ErrCircuitOpen is returned by a CircuitBreakerDiscoverer which is not
+// calling the wrapped Discoverer, and has no results to serve instead.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerDiscoverer wraps a Discoverer, such as a public API client,
+// and stops calling it for a Cooldown after Failures consecutive failures, so
+// that a struggling API is not made to struggle further. Meanwhile, and after
+// every failure, the results of the last success are returned along with an
+// error wrapping errStaleResults, so that they are served as stale. Once the
+// Cooldown has passed, a single call is let through, closing the circuit if it
+// succeeds, and opening it for another Cooldown if it fails. Whether the
+// circuit is open is exported as the tailscalesd_circuit_breaker_open metric.
+type CircuitBreakerDiscoverer struct {
+	Wrap Discoverer
+
+	// Failures opening the circuit. DefaultCircuitBreakerFailures if zero.
+	Failures int
+	// Cooldown during which the circuit stays open.
+	// DefaultCircuitBreakerCooldown if zero.
+	Cooldown time.Duration
+
+	// Name identifies the wrapped Discoverer in logs and metrics.
+	Name string
+
+	// Clock against which the Cooldown is measured. If nil, the system clock
+	// is used.
+	Clock Clock
+
+	mu        sync.Mutex // protects following members
+	failures  int
+	openUntil time.Time
+	last      []Device
+	succeeded bool
+	// probing is set while the single call after the Cooldown is made.
+	probing bool
+}
+
+func (cb *CircuitBreakerDiscoverer) now() time.Time {
+	if cb.Clock == nil {
+		return defaultClock.Now()
+	}
+	return cb.Clock.Now()
+}
+
+func (cb *CircuitBreakerDiscoverer) threshold() int {
+	if cb.Failures <= 0 {
+		return DefaultCircuitBreakerFailures
+	}
+	return cb.Failures
+}
+
+func (cb *CircuitBreakerDiscoverer) cooldown() time.Duration {
+	if cb.Cooldown <= 0 {
+		return DefaultCircuitBreakerCooldown
+	}
+	return cb.Cooldown
+}
+
+// cached results of the last success, with err marked as stale, or err alone
+// if there has never been a success. Must be called with mu held.
+func (cb *CircuitBreakerDiscoverer) cached(err error) ([]Device, error) {
+	if !cb.succeeded {
+		return nil, err
+	}
+	return slices.Clone(cb.last), fmt.Errorf("%w: %w", errStaleResults, err)
+}
+
+// Devices reported by the wrapped Discoverer, unless the circuit is open.
+func (cb *CircuitBreakerDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	cb.mu.Lock()
+	if !cb.openUntil.IsZero() {
+		if at := cb.now(); at.Before(cb.openUntil) || cb.probing {
+			defer cb.mu.Unlock()
+			return cb.cached(fmt.Errorf("%w until %v", ErrCircuitOpen, cb.openUntil.Round(0)))
+		}
+		cb.probing = true
+	}
+	cb.mu.Unlock()
+
+	devices, err := cb.Wrap.Devices(ctx)
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+	if err == nil {
+		if !cb.openUntil.IsZero() {
+			log.Printf("Closing circuit breaker for %q", cb.Name)
+		}
+		cb.failures, cb.openUntil = 0, time.Time{}
+		cb.last, cb.succeeded = devices, true
+		circuitBreakerOpenGauge.WithLabelValues(cb.Name).Set(0)
+		return devices, nil
+	}
+	cb.failures++
+	// A failure after the Cooldown reopens the circuit right away.
+	if cb.failures >= cb.threshold() || !cb.openUntil.IsZero() {
+		cb.openUntil = cb.now().Add(cb.cooldown())
+		log.Printf("Opening circuit breaker for %q for %v after %d failures: %v", cb.Name, cb.cooldown(), cb.failures, err)
+		circuitBreakerOpenGauge.WithLabelValues(cb.Name).Set(1)
+	}
+	return cb.cached(err)
+}
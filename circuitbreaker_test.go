@@ -0,0 +1,66 @@
+package tailscalesd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitBreakerDiscoverer(t *testing.T) {
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	wrapped := discovererForTest(t)
+	cb := &CircuitBreakerDiscoverer{
+		Wrap:     wrapped,
+		Failures: 2,
+		Cooldown: time.Minute,
+		Name:     "test",
+		Clock:    ClockFunc(func() time.Time { return clock }),
+	}
+	for _, step := range []struct {
+		name      string
+		advance   time.Duration
+		err       error
+		wantCalls int
+		wantOpen  float64
+		wantErr   error
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "first failure is stale", err: errRateLimitedTest, wantCalls: 2, wantErr: errStaleResults},
+		{name: "second failure opens", err: errRateLimitedTest, wantCalls: 3, wantOpen: 1, wantErr: errStaleResults},
+		{name: "open serves cache", advance: 30 * time.Second, wantCalls: 3, wantOpen: 1, wantErr: ErrCircuitOpen},
+		{name: "failure after cooldown reopens", advance: 30 * time.Second, err: errRateLimitedTest, wantCalls: 4, wantOpen: 1, wantErr: errStaleResults},
+		{name: "reopened serves cache", advance: 59 * time.Second, wantCalls: 4, wantOpen: 1, wantErr: ErrCircuitOpen},
+		{name: "success after cooldown closes", advance: time.Second, wantCalls: 5},
+	} {
+		clock = clock.Add(step.advance)
+		wrapped.err = step.err
+		devices, err := cb.Devices(context.TODO())
+		if !errors.Is(err, step.wantErr) || (step.wantErr == nil && err != nil) {
+			t.Errorf("CircuitBreakerDiscoverer(%v): error mismatch: got: %v want: %v", step.name, err, step.wantErr)
+		}
+		if diff := cmp.Diff(devices, devicesForRatelimitedTest); diff != "" {
+			t.Errorf("CircuitBreakerDiscoverer(%v): devices mismatch (-got, +want):\n%v", step.name, diff)
+		}
+		if got := wrapped.Called; got != step.wantCalls {
+			t.Errorf("CircuitBreakerDiscoverer(%v): calls mismatch: got: %d want: %d", step.name, got, step.wantCalls)
+		}
+		if got := testutil.ToFloat64(circuitBreakerOpenGauge.WithLabelValues("test")); got != step.wantOpen {
+			t.Errorf("CircuitBreakerDiscoverer(%v): open mismatch: got: %v want: %v", step.name, got, step.wantOpen)
+		}
+	}
+}
+
+func TestCircuitBreakerDiscovererWithoutCache(t *testing.T) {
+	wrapped := &testDiscoverer{err: errRateLimitedTest}
+	cb := &CircuitBreakerDiscoverer{Wrap: wrapped, Failures: 1}
+	if _, err := cb.Devices(context.TODO()); !errors.Is(err, errRateLimitedTest) || errors.Is(err, errStaleResults) {
+		t.Errorf("CircuitBreakerDiscoverer: want the wrapped error alone, got: %v", err)
+	}
+	if _, err := cb.Devices(context.TODO()); !errors.Is(err, ErrCircuitOpen) || errors.Is(err, errStaleResults) {
+		t.Errorf("CircuitBreakerDiscoverer: want ErrCircuitOpen alone, got: %v", err)
+	}
+}
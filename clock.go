@@ -0,0 +1,29 @@
+package tailscalesd
+
+import (
+	"net/http"
+	"time"
+)
+
+// Clock tells the current time. Discoverers and handlers accept a Clock so
+// that time-dependent behavior can be tested deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function, such as time.Now, to a Clock.
+type ClockFunc func() time.Time
+
+// Now returns f().
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// defaultClock is used where no Clock is provided.
+var defaultClock Clock = ClockFunc(time.Now)
+
+// HTTPDoer performs HTTP requests. It is satisfied by *http.Client, and may be
+// replaced to test discoverers without a network.
+type HTTPDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth requires requests to next to carry HTTP basic auth credentials
+// matching username and the bcrypt-hashed password.
+func basicAuth(username, passwordHash string, next http.Handler) (http.Handler, error) {
+	if _, err := bcrypt.Cost([]byte(passwordHash)); err != nil {
+		return nil, fmt.Errorf("invalid bcrypt password hash: %w", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		// Always compare the password, so timing does not reveal whether the
+		// username was correct.
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOK := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(pass)) == nil
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tailscalesd", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// readTokenFile returns the bearer token contained in path, ignoring any
+// surrounding whitespace.
+func readTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.New("token file is empty")
+	}
+	return token, nil
+}
+
+// bearerAuth requires requests to next to carry an Authorization header with
+// the bearer token, as sent by the Prometheus authorization configuration.
+func bearerAuth(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tailscalesd"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
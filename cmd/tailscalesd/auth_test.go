@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := basicAuth("prometheus", string(hash), http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	if err != nil {
+		t.Fatalf("basicAuth: unexpected error: %v", err)
+	}
+
+	for tn, tc := range map[string]struct {
+		user, pass string
+		noAuth     bool
+		want       int
+	}{
+		"no credentials": {noAuth: true, want: http.StatusUnauthorized},
+		"wrong username": {user: "grafana", pass: "hunter2", want: http.StatusUnauthorized},
+		"wrong password": {user: "prometheus", pass: "hunter3", want: http.StatusUnauthorized},
+		"correct":        {user: "prometheus", pass: "hunter2", want: http.StatusTeapot},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if !tc.noAuth {
+				r.SetBasicAuth(tc.user, tc.pass)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("basicAuth: status code mismatch: got: %v want: %v", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestBasicAuthRejectsInvalidHash(t *testing.T) {
+	if _, err := basicAuth("prometheus", "hunter2", http.NotFoundHandler()); err == nil {
+		t.Error("basicAuth: expected error for plaintext password, got none")
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	h := bearerAuth("s3cr3t", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for tn, tc := range map[string]struct {
+		header string
+		want   int
+	}{
+		"no header":    {want: http.StatusUnauthorized},
+		"wrong token":  {header: "Bearer nope", want: http.StatusUnauthorized},
+		"wrong scheme": {header: "Basic s3cr3t", want: http.StatusUnauthorized},
+		"correct":      {header: "Bearer s3cr3t", want: http.StatusTeapot},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("bearerAuth: status code mismatch: got: %v want: %v", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("  s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTokenFile(path)
+	if err != nil {
+		t.Fatalf("readTokenFile: unexpected error: %v", err)
+	}
+	if want := "s3cr3t"; got != want {
+		t.Errorf("readTokenFile: mismatch: got: %q want: %q", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// command is a subcommand of tailscalesd. Every command accepts the same flags
+// as the server.
+type command struct {
+	// summary of the command, for usage.
+	summary string
+	// run the command once the settings have been parsed from args,
+	// returning the exit code.
+	run func(ctx context.Context, args []string) int
+}
+
+// commands by name. A command name may only be given as the first argument.
+// Without one, the serve command is run, as before commands existed.
+var commands map[string]command
+
+func init() {
+	// Assigned here, as the declaration would be an initialization cycle:
+	// commands define the flags with usage, which lists the commands.
+	commands = map[string]command{
+		"serve": {
+			summary: "Serve service discovery. The default when no command is given.",
+			run:     configured(runServe),
+		},
+		"check": {
+			summary: "Check that every configured API accepts its credentials, then exit.",
+			run:     configured(runCheck),
+		},
+		"check-auth": {
+			summary: "Alias of check.",
+			run:     configured(runCheck),
+		},
+		"diff": {
+			summary: "Print the changes to the targets served with -config compared to -old_config.",
+			run:     runDiff,
+		},
+		"dump": {
+			summary: "Discover once, printing the targets or devices.",
+			run: configured(func(ctx context.Context, cfg *fileConfig) int {
+				return runDump(ctx, os.Stdout, cfg)
+			}),
+		},
+		"verify": {
+			summary: "Print the targets each job of the Prometheus at -prometheus_url would scrape.",
+			run: configured(func(ctx context.Context, cfg *fileConfig) int {
+				return runVerify(ctx, os.Stdout, cfg)
+			}),
+		},
+		"version": {
+			summary: "Print the version.",
+			run: func(context.Context, []string) int {
+				fmt.Printf("tailscalesd version %v\n", Version)
+				return 0
+			},
+		},
+		"watch": {
+			summary: "Discover every -poll interval, printing changes to the targets.",
+			run: configured(func(ctx context.Context, cfg *fileConfig) int {
+				ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+				defer stop()
+				return runWatch(ctx, os.Stdout, cfg)
+			}),
+		},
+	}
+}
+
+// commandFor the command line arguments args, returning the name of the
+// command and the arguments left for it.
+func commandFor(args []string) (string, []string) {
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			return args[0], args[1:]
+		}
+	}
+	return "serve", args
+}
+
+// configured adapts run to a command which requires valid settings, applying
+// the -config file to them first.
+func configured(run func(context.Context, *fileConfig) int) func(context.Context, []string) int {
+	return func(ctx context.Context, _ []string) int {
+		cfg, err := applyConfigFile(configFile)
+		if err != nil {
+			log.Printf("Failed loading configuration: %v", err)
+			return 2
+		}
+		if err := validateSettings(cfg); err != nil {
+			usageError(err)
+			return 2
+		}
+		return run(ctx, cfg)
+	}
+}
+
+// runCheck probes every source configured by the settings and cfg, as the
+// startup probe does, without serving. Returns the exit code: 0 if every
+// source succeeded, and 1 otherwise.
+func runCheck(ctx context.Context, cfg *fileConfig) int {
+	if err := probeSources(ctx, configuredSources(cfg)); err != nil {
+		log.Printf("Check failed: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// usage of tailscalesd, listing the commands and flags.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [command] [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s  %s\n", name, commands[name].summary)
+	}
+	fmt.Fprint(w, "\nEvery command accepts the same flags:\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// fileConfig is the YAML configuration file format understood by tailscalesd.
+// Every setting corresponds to a flag. Settings provided explicitly as flags or
+// through their environment variables take precedence over the file.
+type fileConfig struct {
+	// Address on which to serve Tailscale SD.
+	Address string `yaml:"address"`
+
+	// Poll is the max frequency with which to poll the Tailscale APIs.
+	Poll time.Duration `yaml:"poll"`
+
+	// PollJitter randomly lengthens each poll interval by up to this.
+	PollJitter time.Duration `yaml:"poll_jitter"`
+
+	// APITimeout bounds each discovery from a Tailscale API.
+	APITimeout time.Duration `yaml:"api_timeout"`
+
+	// CircuitBreakerCooldown is how long to stop calling a failing API.
+	CircuitBreakerCooldown time.Duration `yaml:"circuit_breaker_cooldown"`
+
+	// MaxStale is the maximum age of stale results served.
+	MaxStale time.Duration `yaml:"max_stale"`
+
+	// ReadinessFailures is the number of consecutive failed refreshes after
+	// which /readyz reports not ready.
+	ReadinessFailures int `yaml:"readiness_failures"`
+
+	LocalAPI struct {
+		Enabled          *bool         `yaml:"enabled"`
+		Socket           string        `yaml:"socket"`
+		NetcheckInterval time.Duration `yaml:"netcheck_interval"`
+		PeerHealthLabels *bool         `yaml:"peer_health_labels"`
+	} `yaml:"localapi"`
+
+	PublicAPI struct {
+		Tailnet      string   `yaml:"tailnet"`
+		Tailnets     []string `yaml:"tailnets"`
+		Token        string   `yaml:"token"`
+		ClientID     string   `yaml:"client_id"`
+		ClientSecret string   `yaml:"client_secret"`
+
+		APIURL            string `yaml:"api_url"`
+		PostureAttributes *bool  `yaml:"posture_attributes"`
+
+		// OAuth customizes the token requests made with the client ID and
+		// secret.
+		OAuth oauthConfig `yaml:"oauth"`
+	} `yaml:"public_api"`
+
+	// Credentials for additional tailnets, possibly belonging to different
+	// organizations. Each entry is discovered independently of the above.
+	Credentials []credentialConfig `yaml:"credentials"`
+
+	// AuthTokenFile contains a bearer token required for service discovery.
+	AuthTokenFile string `yaml:"auth_token_file"`
+
+	BasicAuth struct {
+		Username     string `yaml:"username"`
+		PasswordHash string `yaml:"password_hash"`
+	} `yaml:"basic_auth"`
+
+	TLS struct {
+		CertFile     string `yaml:"cert_file"`
+		KeyFile      string `yaml:"key_file"`
+		ClientCAFile string `yaml:"client_ca_file"`
+	} `yaml:"tls"`
+
+	// WebConfigFile is an exporter-toolkit web configuration file.
+	WebConfigFile string `yaml:"web_config_file"`
+
+	TSNet struct {
+		Enabled  *bool  `yaml:"enabled"`
+		Hostname string `yaml:"hostname"`
+		StateDir string `yaml:"state_dir"`
+	} `yaml:"tsnet"`
+
+	// StartupProbe verifies all configured APIs before serving.
+	StartupProbe *bool `yaml:"startup_probe"`
+
+	// LogEveryStale logs every response serving stale results.
+	LogEveryStale *bool `yaml:"log_every_stale"`
+
+	// ChangelogFile records every refresh as JSON lines.
+	ChangelogFile string `yaml:"changelog_file"`
+
+	// SnapshotFile persists the cached results across restarts.
+	SnapshotFile string `yaml:"snapshot_file"`
+
+	// SnapshotHistory is the number of sets of served targets retained.
+	SnapshotHistory int `yaml:"snapshot_history"`
+
+	// SnapshotPeer is another replica from which to prime the cache.
+	SnapshotPeer string `yaml:"snapshot_peer"`
+
+	Gossip struct {
+		Peers    []string      `yaml:"peers"`
+		Tag      string        `yaml:"tag"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"gossip"`
+
+	// Inventory shares discovery results between tailscalesd instances in a
+	// hub-and-spoke topology.
+	Inventory struct {
+		Hub   string   `yaml:"hub"`
+		Allow []string `yaml:"allow"`
+	} `yaml:"inventory"`
+
+	Heartbeat struct {
+		URL      string        `yaml:"url"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"heartbeat"`
+
+	// OTLPTracesURL is the OTLP/HTTP endpoint to which traces are exported.
+	OTLPTracesURL string `yaml:"otlp_traces_url"`
+
+	// UpdateCheckInterval is how often to check for a newer release.
+	UpdateCheckInterval time.Duration `yaml:"update_check_interval"`
+
+	// DedupeSharedDevices merges devices found in several tailnets.
+	DedupeSharedDevices *bool    `yaml:"dedupe_shared_devices"`
+	DedupeBy            []string `yaml:"dedupe_by"`
+	DedupePreferAPIs    []string `yaml:"dedupe_prefer_apis"`
+
+	Filters struct {
+		IPv6            *bool    `yaml:"ipv6"`
+		IPv6Only        *bool    `yaml:"ipv6_only"`
+		AddressPolicy   string   `yaml:"address_policy"`
+		AddressSelector string   `yaml:"address_selector"`
+		NoAddressPolicy string   `yaml:"no_address_policy"`
+		DuplicateHosts  string   `yaml:"duplicate_hostname_policy"`
+		OnlyOnline      *bool    `yaml:"only_online"`
+		OnlyAuthorized  *bool    `yaml:"only_authorized"`
+		DropExpiredKeys *bool    `yaml:"drop_expired_keys"`
+		IncludeTags     []string `yaml:"include_tags"`
+		ExcludeTags     []string `yaml:"exclude_tags"`
+	} `yaml:"filters"`
+
+	Output struct {
+		SplitAddressFamilies *bool    `yaml:"split_address_families"`
+		TagPortPrefix        string   `yaml:"tag_port_prefix"`
+		OSDefaultPorts       *bool    `yaml:"os_default_ports"`
+		Formats              []string `yaml:"formats"`
+		TargetFormat         string   `yaml:"target_format"`
+		TargetPorts          []uint16 `yaml:"target_ports"`
+	} `yaml:"output"`
+
+	// PortScan finds the exporters running on devices by connecting to their
+	// well-known ports.
+	PortScan struct {
+		Enabled *bool             `yaml:"enabled"`
+		Timeout time.Duration     `yaml:"timeout"`
+		Ports   map[uint16]string `yaml:"ports"`
+	} `yaml:"port_scan"`
+
+	// Exporters maps tags to the exporters running on devices carrying them.
+	Exporters map[string]exporterConfig `yaml:"exporters"`
+
+	// TagPorts maps tags to the ports on which to serve devices carrying them.
+	TagPorts map[string][]uint16 `yaml:"tag_ports"`
+
+	// OSExporters maps OSes to the exporters running on devices reporting
+	// them, for devices not given a port by their tags.
+	OSExporters map[string]exporterConfig `yaml:"os_exporters"`
+
+	// LabelRules set labels, such as job, on devices matching them.
+	LabelRules []labelRuleConfig `yaml:"label_rules"`
+
+	// LabelTemplates set labels to the results of Go templates executed
+	// against each device, such as a datacenter derived from its hostname.
+	LabelTemplates map[string]string `yaml:"label_templates"`
+
+	// StaticTargets are served alongside discovered targets, after filters
+	// have been applied. Useful for hosts which are not on the tailnet.
+	StaticTargets []tailscalesd.TargetDescriptor `yaml:"static_targets"`
+
+	// RouteTargets are services behind subnet routers, served when a device
+	// is approved to route to them.
+	RouteTargets []routeTargetConfig `yaml:"route_targets"`
+}
+
+// credentialConfig is a set of credentials for a single tailnet, using either
+// an API token or an OAuth client.
+type credentialConfig struct {
+	Tailnet      string `yaml:"tailnet"`
+	Token        string `yaml:"token"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	OAuth oauthConfig `yaml:"oauth"`
+}
+
+func (c credentialConfig) validate() error {
+	hasToken := c.Token != ""
+	hasOAuth := c.ClientID != "" || c.ClientSecret != ""
+	switch {
+	case hasToken && hasOAuth:
+		return errors.New("must use either token or client_id and client_secret, not both")
+	case hasToken && c.Tailnet == "":
+		return errors.New("token requires tailnet")
+	case hasOAuth && (c.ClientID == "" || c.ClientSecret == ""):
+		return errors.New("client_id and client_secret must be used together")
+	case !hasToken && !hasOAuth:
+		return errors.New("either token or client_id and client_secret are required")
+	}
+	if _, err := c.OAuth.options(); err != nil {
+		return fmt.Errorf("oauth: %w", err)
+	}
+	return nil
+}
+
+// oauthConfig customizes the OAuth client credentials token requests, for
+// identity setups which need more than the Tailscale defaults.
+type oauthConfig struct {
+	// TokenURL replaces the public API's token endpoint.
+	TokenURL string `yaml:"token_url"`
+	// Scopes requested, instead of "device".
+	Scopes []string `yaml:"scopes"`
+	// Audience, if set, is sent as the audience parameter.
+	Audience string `yaml:"audience"`
+	// AuthStyle is one of "auto" (the default), "header" or "params".
+	AuthStyle string `yaml:"auth_style"`
+	// ExtraParams are sent with each token request.
+	ExtraParams map[string]string `yaml:"extra_params"`
+}
+
+var oauthAuthStyles = map[string]oauth2.AuthStyle{
+	"":       oauth2.AuthStyleAutoDetect,
+	"auto":   oauth2.AuthStyleAutoDetect,
+	"header": oauth2.AuthStyleInHeader,
+	"params": oauth2.AuthStyleInParams,
+}
+
+// options configuring an OAuth API Discoverer as described.
+func (c oauthConfig) options() ([]tailscalesd.OAuthAPIOption, error) {
+	style, ok := oauthAuthStyles[c.AuthStyle]
+	if !ok {
+		return nil, fmt.Errorf("auth_style must be auto, header or params, not %q", c.AuthStyle)
+	}
+	opts := []tailscalesd.OAuthAPIOption{tailscalesd.WithOAuthAuthStyle(style)}
+	if c.TokenURL != "" {
+		if _, err := url.Parse(c.TokenURL); err != nil {
+			return nil, fmt.Errorf("bad token_url: %w", err)
+		}
+		opts = append(opts, tailscalesd.WithOAuthTokenURL(c.TokenURL))
+	}
+	if len(c.Scopes) > 0 {
+		opts = append(opts, tailscalesd.WithOAuthScopes(c.Scopes...))
+	}
+	params := make(url.Values)
+	for k, v := range c.ExtraParams {
+		params.Set(k, v)
+	}
+	if c.Audience != "" {
+		params.Set("audience", c.Audience)
+	}
+	if len(params) > 0 {
+		opts = append(opts, tailscalesd.WithOAuthEndpointParams(params))
+	}
+	return opts, nil
+}
+
+// exporterConfig is the configuration file equivalent of tailscalesd.Exporter.
+type exporterConfig struct {
+	Port        uint16 `yaml:"port"`
+	MetricsPath string `yaml:"metrics_path"`
+	Scheme      string `yaml:"scheme"`
+	Job         string `yaml:"job"`
+}
+
+// labelRuleConfig is the configuration file equivalent of
+// tailscalesd.LabelRule. Hostname is a regular expression which must match the
+// whole hostname.
+type labelRuleConfig struct {
+	Match struct {
+		Tag      string `yaml:"tag"`
+		OS       string `yaml:"os"`
+		Hostname string `yaml:"hostname"`
+	} `yaml:"match"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// labelRules from the configuration, in order.
+func (c *fileConfig) labelRules() ([]tailscalesd.LabelRule, error) {
+	var rules []tailscalesd.LabelRule
+	for i, r := range c.LabelRules {
+		if len(r.Labels) == 0 {
+			return nil, fmt.Errorf("label rule %d sets no labels", i)
+		}
+		rule := tailscalesd.LabelRule{
+			Tag:    r.Match.Tag,
+			OS:     r.Match.OS,
+			Labels: r.Labels,
+		}
+		if r.Match.Hostname != "" {
+			re, err := regexp.Compile("^(?:" + r.Match.Hostname + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("label rule %d: bad hostname pattern: %w", i, err)
+			}
+			rule.Hostname = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// labelTemplates from the configuration, keyed by label.
+func (c *fileConfig) labelTemplates() (map[string]*template.Template, error) {
+	if len(c.LabelTemplates) == 0 {
+		return nil, nil
+	}
+	templates := make(map[string]*template.Template, len(c.LabelTemplates))
+	for label, text := range c.LabelTemplates {
+		tmpl, err := tailscalesd.ParseLabelTemplate(label, text)
+		if err != nil {
+			return nil, fmt.Errorf("bad template for label %q: %w", label, err)
+		}
+		templates[label] = tmpl
+	}
+	return templates, nil
+}
+
+// routeTargetConfig is the configuration file equivalent of
+// tailscalesd.RouteTarget.
+type routeTargetConfig struct {
+	Addresses []string          `yaml:"addresses"`
+	Port      uint16            `yaml:"port"`
+	Labels    map[string]string `yaml:"labels"`
+}
+
+// routeTargets from the configuration, in order.
+func (c *fileConfig) routeTargets() ([]tailscalesd.RouteTarget, error) {
+	var rules []tailscalesd.RouteTarget
+	for i, r := range c.RouteTargets {
+		if r.Port == 0 {
+			return nil, fmt.Errorf("route target %d has no port", i)
+		}
+		rule := tailscalesd.RouteTarget{Port: r.Port, Labels: r.Labels}
+		for _, a := range r.Addresses {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("route target %d: %w", i, err)
+			}
+			rule.Addresses = append(rule.Addresses, addr)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// portScanner configured to scan the ports in the configuration, or the
+// well-known exporter ports if there are none.
+func (c *fileConfig) portScanner() *tailscalesd.PortScanner {
+	ports := c.PortScan.Ports
+	if len(ports) == 0 {
+		ports = tailscalesd.DefaultScanPorts
+	}
+	return &tailscalesd.PortScanner{
+		Ports:   ports,
+		Timeout: c.PortScan.Timeout,
+	}
+}
+
+// exporters from the configuration, keyed by tag.
+func (c *fileConfig) exporters() (map[string]tailscalesd.Exporter, error) {
+	return toExporters(c.Exporters)
+}
+
+// osExporters from the configuration, keyed by OS. With -os_default_ports,
+// they replace or extend tailscalesd.DefaultOSExporters.
+func (c *fileConfig) osExporters() (map[string]tailscalesd.Exporter, error) {
+	configured, err := toExporters(c.OSExporters)
+	if err != nil || !osDefaultPorts {
+		return configured, err
+	}
+	exporters := maps.Clone(tailscalesd.DefaultOSExporters)
+	for os, e := range configured {
+		exporters[strings.ToLower(os)] = e
+	}
+	return exporters, nil
+}
+
+// portStrings formats configured ports as flag values.
+func portStrings(ports []uint16) []string {
+	var vals []string
+	for _, p := range ports {
+		vals = append(vals, fmt.Sprint(p))
+	}
+	return vals
+}
+
+// toExporters converts configured exporters, keeping their keys.
+func toExporters(configured map[string]exporterConfig) (map[string]tailscalesd.Exporter, error) {
+	if len(configured) == 0 {
+		return nil, nil
+	}
+	exporters := make(map[string]tailscalesd.Exporter, len(configured))
+	for tag, e := range configured {
+		if e.Port == 0 {
+			return nil, fmt.Errorf("exporter for %q has no port", tag)
+		}
+		exporters[tag] = tailscalesd.Exporter{
+			Port:        e.Port,
+			MetricsPath: e.MetricsPath,
+			Scheme:      e.Scheme,
+			Job:         e.Job,
+		}
+	}
+	return exporters, nil
+}
+
+// tailnets from the configuration, accepting both a single tailnet and a
+// list.
+func (c *fileConfig) tailnets() []string {
+	var list []string
+	if c.PublicAPI.Tailnet != "" {
+		list = append(list, c.PublicAPI.Tailnet)
+	}
+	return append(list, c.PublicAPI.Tailnets...)
+}
+
+// loadConfig reads and parses the YAML configuration file at path. Unknown
+// fields are rejected, so typos don't silently fall back to defaults.
+func loadConfig(path string) (*fileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg fileConfig
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed parsing config file %q: %w", path, err)
+	}
+	if _, err := cfg.exporters(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	for tag, ports := range cfg.TagPorts {
+		if slices.Contains(ports, 0) {
+			return nil, fmt.Errorf("invalid config file %q: tag_ports: %q has port 0", path, tag)
+		}
+	}
+	if _, err := toExporters(cfg.OSExporters); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: os_exporters: %w", path, err)
+	}
+	if _, err := cfg.labelRules(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	if _, err := cfg.labelTemplates(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	if _, err := cfg.routeTargets(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	if _, err := cfg.PublicAPI.OAuth.options(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: public_api.oauth: %w", path, err)
+	}
+	for i, c := range cfg.Credentials {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("invalid config file %q: credentials entry %d: %w", path, i, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// explicitSettings records which settings were provided on the command line or
+// through the environment, and so must not be overridden by the config file.
+type explicitSettings map[string]bool
+
+// explicitlySet returns the settings explicitly provided either as a flag or
+// as one of the environment variables backing the flags.
+func explicitlySet(envKeys map[string]string) explicitSettings {
+	set := make(explicitSettings)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, key := range envKeys {
+		if _, ok := os.LookupEnv(key); ok {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+func (e explicitSettings) setString(name string, dst *string, val string) {
+	if e[name] || val == "" {
+		return
+	}
+	*dst = val
+}
+
+func (e explicitSettings) setList(name string, dst *stringList, val []string) {
+	if e[name] || len(val) == 0 {
+		return
+	}
+	*dst = val
+}
+
+func (e explicitSettings) setBool(name string, dst *bool, val *bool) {
+	if e[name] || val == nil {
+		return
+	}
+	*dst = *val
+}
+
+func (e explicitSettings) setInt(name string, dst *int, val int) {
+	if e[name] || val == 0 {
+		return
+	}
+	*dst = val
+}
+
+func (e explicitSettings) setDuration(name string, dst *time.Duration, val time.Duration) {
+	if e[name] || val == 0 {
+		return
+	}
+	*dst = val
+}
+
+// apply the configuration to the flag-backed settings which were not
+// explicitly set.
+func (c *fileConfig) apply(e explicitSettings) {
+	e.setString("address", &address, c.Address)
+	e.setDuration("poll", &pollLimit, c.Poll)
+	e.setDuration("poll_jitter", &pollJitter, c.PollJitter)
+	e.setDuration("api_timeout", &apiTimeout, c.APITimeout)
+	e.setDuration("circuit_breaker_cooldown", &circuitCooldown, c.CircuitBreakerCooldown)
+	e.setDuration("max_stale", &maxStale, c.MaxStale)
+	e.setInt("readiness_failures", &readyFailures, c.ReadinessFailures)
+	e.setBool("localapi", &useLocalAPI, c.LocalAPI.Enabled)
+	e.setString("localapi_socket", &localAPISocket, c.LocalAPI.Socket)
+	e.setDuration("netcheck_interval", &netcheckInterval, c.LocalAPI.NetcheckInterval)
+	e.setBool("peer_health_labels", &peerHealth, c.LocalAPI.PeerHealthLabels)
+	e.setList("tailnet", &tailnets, c.tailnets())
+	e.setString("token", &token, c.PublicAPI.Token)
+	e.setString("client_id", &clientId, c.PublicAPI.ClientID)
+	e.setString("client_secret", &clientSecret, c.PublicAPI.ClientSecret)
+	e.setString("api_url", &apiURL, c.PublicAPI.APIURL)
+	e.setBool("posture_attributes", &postureAttrs, c.PublicAPI.PostureAttributes)
+	e.setString("auth_token_file", &authTokenFile, c.AuthTokenFile)
+	e.setString("basic_auth_username", &basicAuthUser, c.BasicAuth.Username)
+	e.setString("basic_auth_password_hash", &basicAuthHash, c.BasicAuth.PasswordHash)
+	e.setString("tls_cert_file", &tlsCertFile, c.TLS.CertFile)
+	e.setString("tls_key_file", &tlsKeyFile, c.TLS.KeyFile)
+	e.setString("tls_client_ca_file", &tlsClientCAFile, c.TLS.ClientCAFile)
+	e.setString("web.config.file", &webConfigFile, c.WebConfigFile)
+	e.setBool("tsnet", &useTSNet, c.TSNet.Enabled)
+	e.setString("tsnet_hostname", &tsnetHostname, c.TSNet.Hostname)
+	e.setString("tsnet_state_dir", &tsnetStateDir, c.TSNet.StateDir)
+	e.setBool("startup_probe", &startupProbe, c.StartupProbe)
+	e.setBool("log_every_stale", &logEveryStale, c.LogEveryStale)
+	e.setString("changelog_file", &changelogFile, c.ChangelogFile)
+	e.setString("snapshot_file", &snapshotFile, c.SnapshotFile)
+	e.setInt("snapshot_history", &snapshotHistory, c.SnapshotHistory)
+	e.setString("snapshot_peer", &snapshotPeer, c.SnapshotPeer)
+	e.setList("gossip_peers", &gossipPeers, c.Gossip.Peers)
+	e.setString("gossip_tag", &gossipTag, c.Gossip.Tag)
+	e.setDuration("gossip_interval", &gossipInterval, c.Gossip.Interval)
+	e.setString("hub", &hubURL, c.Inventory.Hub)
+	e.setList("inventory_allow", &inventoryAllow, c.Inventory.Allow)
+	e.setString("heartbeat_url", &heartbeatURL, c.Heartbeat.URL)
+	e.setDuration("heartbeat_interval", &heartbeatInt, c.Heartbeat.Interval)
+	e.setString("otlp_traces_url", &otlpTracesURL, c.OTLPTracesURL)
+	e.setDuration("update_check_interval", &updateCheckInt, c.UpdateCheckInterval)
+	e.setBool("dedupe_shared_devices", &dedupeShared, c.DedupeSharedDevices)
+	e.setList("dedupe_by", &dedupeBy, c.DedupeBy)
+	e.setList("dedupe_prefer_api", &dedupePreferAPIs, c.DedupePreferAPIs)
+	e.setBool("ipv6", &includeIPv6, c.Filters.IPv6)
+	e.setBool("ipv6_only", &ipv6Only, c.Filters.IPv6Only)
+	e.setString("address_policy", &addressPolicy, c.Filters.AddressPolicy)
+	e.setString("address_selector", &addressSelector, c.Filters.AddressSelector)
+	e.setString("no_address_policy", &noAddress, c.Filters.NoAddressPolicy)
+	e.setString("duplicate_hostname_policy", &duplicateHosts, c.Filters.DuplicateHosts)
+	e.setBool("only_online", &onlyOnline, c.Filters.OnlyOnline)
+	e.setBool("only_authorized", &onlyAuthorized, c.Filters.OnlyAuthorized)
+	e.setBool("drop_expired_keys", &dropExpiredKeys, c.Filters.DropExpiredKeys)
+	e.setList("include_tag", &includeTags, c.Filters.IncludeTags)
+	e.setList("exclude_tag", &excludeTags, c.Filters.ExcludeTags)
+	e.setBool("split_address_families", &splitFamilies, c.Output.SplitAddressFamilies)
+	e.setString("tag_port_prefix", &tagPortPrefix, c.Output.TagPortPrefix)
+	e.setBool("os_default_ports", &osDefaultPorts, c.Output.OSDefaultPorts)
+	e.setBool("port_scan", &portScan, c.PortScan.Enabled)
+	e.setList("formats", &formats, c.Output.Formats)
+	e.setString("target_format", &targetFormat, c.Output.TargetFormat)
+	e.setList("target_port", &targetPorts, portStrings(c.Output.TargetPorts))
+}
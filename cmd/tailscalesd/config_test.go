@@ -0,0 +1,333 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+func configFileForTest(tb testing.TB, content string) string {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := configFileForTest(t, `
+address: 127.0.0.1:9999
+poll: 1m
+localapi:
+  enabled: true
+  socket: /tmp/tailscaled.sock
+public_api:
+  tailnet: example.com
+  token: secret
+filters:
+  ipv6: true
+static_targets:
+  - targets: ["legacy.example.com:9100"]
+    labels:
+      env: legacy
+`)
+	got, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: unexpected error: %v", err)
+	}
+	yes := true
+	want := &fileConfig{
+		Address: "127.0.0.1:9999",
+		Poll:    time.Minute,
+	}
+	want.LocalAPI.Enabled = &yes
+	want.LocalAPI.Socket = "/tmp/tailscaled.sock"
+	want.PublicAPI.Tailnet = "example.com"
+	want.PublicAPI.Token = "secret"
+	want.Filters.IPv6 = &yes
+	want.StaticTargets = []tailscalesd.TargetDescriptor{
+		{
+			Targets: []string{"legacy.example.com:9100"},
+			Labels:  map[string]string{"env": "legacy"},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("loadConfig: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestLoadConfigRejectsUnknownFields(t *testing.T) {
+	path := configFileForTest(t, "adress: 127.0.0.1:9999\n")
+	if _, err := loadConfig(path); err == nil {
+		t.Error("loadConfig: expected error for unknown field, got none")
+	}
+}
+
+func TestConfigApplyRespectsExplicitSettings(t *testing.T) {
+	defer func(a string, tn stringList) { address, tailnets = a, tn }(address, tailnets)
+	address, tailnets = "flag.example.com:1234", nil
+
+	var cfg fileConfig
+	cfg.Address = "file.example.com:1234"
+	cfg.PublicAPI.Tailnet = "file-tailnet"
+	cfg.PublicAPI.Tailnets = []string{"other-tailnet"}
+	cfg.apply(explicitSettings{"address": true})
+
+	if got, want := address, "flag.example.com:1234"; got != want {
+		t.Errorf("apply: address mismatch: got: %q want: %q", got, want)
+	}
+	if diff := cmp.Diff(tailnets, stringList{"file-tailnet", "other-tailnet"}); diff != "" {
+		t.Errorf("apply: tailnets mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestLoadConfigRejectsExporterWithoutPort(t *testing.T) {
+	path := configFileForTest(t, `
+exporters:
+  "tag:node-exporter":
+    job: node
+`)
+	if _, err := loadConfig(path); err == nil {
+		t.Error("loadConfig: expected error for exporter without port, got none")
+	}
+}
+
+func TestLoadConfigValidatesLabelRules(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"valid": {
+			config: "label_rules:\n  - match:\n      tag: \"tag:web\"\n      hostname: \"web-.*\"\n    labels:\n      job: web\n",
+		},
+		"no labels": {
+			config:  "label_rules:\n  - match:\n      tag: \"tag:web\"\n",
+			wantErr: true,
+		},
+		"bad hostname pattern": {
+			config:  "label_rules:\n  - match:\n      hostname: \"web-(\"\n    labels:\n      job: web\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			_, err := loadConfig(configFileForTest(t, tc.config))
+			if got := err != nil; got != tc.wantErr {
+				t.Errorf("loadConfig: error mismatch: got: %v wantErr: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLabelRulesMatchWholeHostname(t *testing.T) {
+	cfg, err := loadConfig(configFileForTest(t, "label_rules:\n  - match:\n      hostname: web\n    labels:\n      job: web\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := cfg.labelRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].Hostname.MatchString("web-1") {
+		t.Error("labelRules: hostname pattern unexpectedly matched a partial hostname")
+	}
+}
+
+func TestLoadConfigValidatesCredentials(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"token with tailnet": {
+			config: "credentials:\n  - tailnet: example.com\n    token: secret\n",
+		},
+		"oauth without tailnet": {
+			config: "credentials:\n  - client_id: id\n    client_secret: secret\n",
+		},
+		"token without tailnet": {
+			config:  "credentials:\n  - token: secret\n",
+			wantErr: true,
+		},
+		"token and oauth": {
+			config:  "credentials:\n  - tailnet: example.com\n    token: secret\n    client_id: id\n    client_secret: secret\n",
+			wantErr: true,
+		},
+		"incomplete oauth": {
+			config:  "credentials:\n  - client_id: id\n",
+			wantErr: true,
+		},
+		"empty": {
+			config:  "credentials:\n  - tailnet: example.com\n",
+			wantErr: true,
+		},
+		"oauth with audience": {
+			config: "credentials:\n  - client_id: id\n    client_secret: secret\n    oauth:\n      audience: tailscale\n      auth_style: header\n",
+		},
+		"bad oauth auth style": {
+			config:  "credentials:\n  - client_id: id\n    client_secret: secret\n    oauth:\n      auth_style: basic\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			_, err := loadConfig(configFileForTest(t, tc.config))
+			if got, want := err != nil, tc.wantErr; got != want {
+				t.Errorf("loadConfig: error mismatch: got: %v want error: %v", err, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesOAuth(t *testing.T) {
+	if _, err := loadConfig(configFileForTest(t, "public_api:\n  oauth:\n    auth_style: basic\n")); err == nil {
+		t.Error("loadConfig: want error for bad public_api.oauth.auth_style")
+	}
+}
+
+func TestOAuthConfigOptions(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		cfg  oauthConfig
+		want int
+	}{
+		"defaults": {
+			want: 1,
+		},
+		"everything": {
+			cfg: oauthConfig{
+				TokenURL:    "https://idp.example.com/token",
+				Scopes:      []string{"devices:core:read"},
+				Audience:    "tailscale",
+				AuthStyle:   "params",
+				ExtraParams: map[string]string{"resource": "api"},
+			},
+			want: 4,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			opts, err := tc.cfg.options()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(opts); got != tc.want {
+				t.Errorf("options: count mismatch: got: %d want: %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOSExporters(t *testing.T) {
+	cfg := &fileConfig{
+		OSExporters: map[string]exporterConfig{
+			"Windows": {Port: 9999, Job: "win"},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		defaults bool
+		want     map[string]tailscalesd.Exporter
+	}{
+		"configured only": {
+			want: map[string]tailscalesd.Exporter{
+				"Windows": {Port: 9999, Job: "win"},
+			},
+		},
+		"replacing defaults": {
+			defaults: true,
+			want: map[string]tailscalesd.Exporter{
+				"linux":   {Port: 9100, Job: "node"},
+				"freebsd": {Port: 9100, Job: "node"},
+				"macos":   {Port: 9100, Job: "node"},
+				"windows": {Port: 9999, Job: "win"},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			defer func(was bool) { osDefaultPorts = was }(osDefaultPorts)
+			osDefaultPorts = tc.defaults
+			got, err := cfg.osExporters()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("osExporters: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesLabelTemplates(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"valid": {
+			config: "label_templates:\n  datacenter: '{{ regexFind \"dc[0-9]+\" .Hostname }}'\n",
+		},
+		"unknown function": {
+			config:  "label_templates:\n  datacenter: '{{ nope .Hostname }}'\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			_, err := loadConfig(configFileForTest(t, tc.config))
+			if got := err != nil; got != tc.wantErr {
+				t.Errorf("loadConfig: error mismatch: got: %v wantErr: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesTagPorts(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"valid": {
+			config: "tag_ports:\n  \"tag:web\": [9100, 9115]\n",
+		},
+		"zero port": {
+			config:  "tag_ports:\n  \"tag:web\": [9100, 0]\n",
+			wantErr: true,
+		},
+		"out of range": {
+			config:  "tag_ports:\n  \"tag:web\": [70000]\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			_, err := loadConfig(configFileForTest(t, tc.config))
+			if got := err != nil; got != tc.wantErr {
+				t.Errorf("loadConfig: error mismatch: got: %v wantErr: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesRouteTargets(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"valid": {
+			config: "route_targets:\n  - addresses: [10.0.0.5, 10.0.0.6]\n    port: 9100\n",
+		},
+		"no port": {
+			config:  "route_targets:\n  - addresses: [10.0.0.5]\n",
+			wantErr: true,
+		},
+		"bad address": {
+			config:  "route_targets:\n  - addresses: [10.0.0.0/24]\n    port: 9100\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			_, err := loadConfig(configFileForTest(t, tc.config))
+			if got := err != nil; got != tc.wantErr {
+				t.Errorf("loadConfig: error mismatch: got: %v wantErr: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// targetsFrom performs discovery using the settings and cfg, returning the
+// targets which would be served.
+func targetsFrom(ctx context.Context, cfg *fileConfig) ([]tailscalesd.TargetDescriptor, error) {
+	if err := validateSettings(cfg); err != nil {
+		return nil, err
+	}
+	return fetchTargets(ctx, discoveryHandler(configuredSources(cfg), cfg), "/")
+}
+
+// fetchTargets from the discovery handler h, as requested at target, such as
+// "/?tag=prom".
+func fetchTargets(ctx context.Context, h http.Handler, target string) ([]tailscalesd.TargetDescriptor, error) {
+	r := httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return nil, fmt.Errorf("discovery failed: %v", w.Body.String())
+	}
+	var targets []tailscalesd.TargetDescriptor
+	if err := json.NewDecoder(w.Body).Decode(&targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// targetKey canonically identifies a TargetDescriptor for comparison. Volatile
+// labels are left out, as they differ between discoveries of unchanged devices.
+func targetKey(td tailscalesd.TargetDescriptor) string {
+	td = tailscalesd.WithoutVolatileLabels(td)
+	targets := slices.Clone(td.Targets)
+	sort.Strings(targets)
+	// Map keys are sorted by encoding/json.
+	b, _ := json.Marshal(tailscalesd.TargetDescriptor{
+		Targets: targets,
+		Labels:  td.Labels,
+	})
+	return string(b)
+}
+
+// diffTargets writes the target groups present only in before prefixed with "-",
+// and those present only in after prefixed with "+". Returns the number of
+// differences.
+func diffTargets(w io.Writer, before, after []tailscalesd.TargetDescriptor) int {
+	count := func(tds []tailscalesd.TargetDescriptor) map[string]int {
+		m := make(map[string]int)
+		for _, td := range tds {
+			m[targetKey(td)]++
+		}
+		return m
+	}
+	oldKeys, newKeys := count(before), count(after)
+
+	var lines []string
+	for k, n := range oldKeys {
+		for i := newKeys[k]; i < n; i++ {
+			lines = append(lines, "- "+k)
+		}
+	}
+	for k, n := range newKeys {
+		for i := oldKeys[k]; i < n; i++ {
+			lines = append(lines, "+ "+k)
+		}
+	}
+	// Sort by the target group, then removals before additions.
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i][2:] != lines[j][2:] {
+			return lines[i][2:] < lines[j][2:]
+		}
+		return lines[i] < lines[j]
+	})
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return len(lines)
+}
+
+// onceDiscoverer discovers from the wrapped Discoverer only once, returning
+// the same devices to every caller.
+type onceDiscoverer struct {
+	wrap tailscalesd.Discoverer
+
+	once    sync.Once
+	devices []tailscalesd.Device
+	err     error
+}
+
+func (d *onceDiscoverer) Devices(ctx context.Context) ([]tailscalesd.Device, error) {
+	d.once.Do(func() {
+		d.devices, d.err = d.wrap.Devices(ctx)
+	})
+	return slices.Clone(d.devices), d.err
+}
+
+// discoverOnce replaces the Discoverer of each of the sources with one which
+// discovers only once, shared by every source of the same name in discovered.
+func discoverOnce(sources []source, discovered map[string]*onceDiscoverer) []source {
+	sources = slices.Clone(sources)
+	for i, s := range sources {
+		d, ok := discovered[s.Name]
+		if !ok {
+			d = &onceDiscoverer{wrap: s.Discoverer}
+			discovered[s.Name] = d
+		}
+		sources[i].Discoverer = d
+	}
+	return sources
+}
+
+// runDiff compares the targets which would be served with the configuration
+// in -old_config and with the configuration in -config, printing the
+// differences. Devices are discovered once, and the same devices used with
+// both configurations, so that changes in the tailnet meanwhile are not
+// mistaken for the effects of the configuration. Returns the exit code: 0 if
+// there are no differences, 1 if there are, and 2 on error.
+func runDiff(ctx context.Context, args []string) int {
+	newFile, oldFile := configFile, oldConfigFile
+	if oldFile == "" {
+		log.Print("The diff subcommand requires -old_config")
+		return 2
+	}
+
+	discovered := make(map[string]*onceDiscoverer)
+	results := make([][]tailscalesd.TargetDescriptor, 2)
+	for i, path := range []string{oldFile, newFile} {
+		// Settings are parsed afresh for each configuration, so that one does
+		// not leak into the other.
+		parseSettings(args)
+		cfg, err := applyConfigFile(path)
+		if err != nil {
+			log.Printf("Failed loading configuration: %v", err)
+			return 2
+		}
+		if err := validateSettings(cfg); err != nil {
+			log.Printf("Invalid configuration %q: %v", path, err)
+			return 2
+		}
+		sources := discoverOnce(configuredSources(cfg), discovered)
+		if results[i], err = fetchTargets(ctx, discoveryHandler(sources, cfg), "/"); err != nil {
+			log.Printf("Failed discovery with configuration %q: %v", path, err)
+			return 2
+		}
+	}
+
+	n := diffTargets(os.Stdout, results[0], results[1])
+	log.Printf("%d target groups with old configuration, %d with new configuration, %d differences", len(results[0]), len(results[1]), n)
+	if n > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+func TestDiffTargets(t *testing.T) {
+	old := []tailscalesd.TargetDescriptor{
+		{Targets: []string{"100.2.3.4"}, Labels: map[string]string{"a": "1"}},
+		{Targets: []string{"100.5.6.7", "100.2.3.4"}, Labels: map[string]string{"b": "2"}},
+	}
+	after := []tailscalesd.TargetDescriptor{
+		// Target order does not matter.
+		{Targets: []string{"100.2.3.4", "100.5.6.7"}, Labels: map[string]string{"b": "2"}},
+		{Targets: []string{"100.2.3.4"}, Labels: map[string]string{"a": "2"}},
+	}
+	var buf bytes.Buffer
+	if got, want := diffTargets(&buf, old, after), 2; got != want {
+		t.Errorf("diffTargets: difference count mismatch: got: %d want: %d", got, want)
+	}
+	want := `- {"targets":["100.2.3.4"],"labels":{"a":"1"}}
++ {"targets":["100.2.3.4"],"labels":{"a":"2"}}
+`
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("diffTargets: output mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+type countingDiscoverer struct {
+	calls   int
+	devices []tailscalesd.Device
+}
+
+func (d *countingDiscoverer) Devices(context.Context) ([]tailscalesd.Device, error) {
+	d.calls++
+	return d.devices, nil
+}
+
+func TestDiscoverOnce(t *testing.T) {
+	d := &countingDiscoverer{devices: []tailscalesd.Device{{ID: "1"}}}
+	discovered := make(map[string]*onceDiscoverer)
+	for i := 0; i < 2; i++ {
+		sources := discoverOnce([]source{{Name: "test", Discoverer: d}}, discovered)
+		got, err := sources[0].Discoverer.Devices(context.Background())
+		if err != nil {
+			t.Fatalf("Devices(): unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(got, d.devices); diff != "" {
+			t.Errorf("Devices(): mismatch (-got, +want):\n%v", diff)
+		}
+	}
+	if d.calls != 1 {
+		t.Errorf("discoverOnce: got %d discoveries, want 1", d.calls)
+	}
+}
+
+func TestRunDiffRequiresOldConfig(t *testing.T) {
+	saved := oldConfigFile
+	t.Cleanup(func() { oldConfigFile = saved })
+	oldConfigFile = ""
+	if got, want := runDiff(context.Background(), nil), 2; got != want {
+		t.Errorf("runDiff: exit code mismatch: got: %d want: %d", got, want)
+	}
+}
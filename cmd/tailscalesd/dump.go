@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// ANSI escape sequences used to color table output.
+const (
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiReset = "\x1b[0m"
+)
+
+// colorful reports whether output to f should be colored: only for terminals,
+// and never when NO_COLOR is set.
+func colorful(f *os.File) bool {
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return !noColor && term.IsTerminal(int(f.Fd()))
+}
+
+// writeTable of rows, the first of which is the header, with columns padded to
+// align. color, if set, returns the escape sequence with which to color each
+// cell.
+func writeTable(w io.Writer, rows [][]string, color func(row, col int) string) {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	for r, row := range rows {
+		var line strings.Builder
+		for c, cell := range row {
+			if c > 0 {
+				line.WriteString("  ")
+			}
+			padded := cell
+			if c < len(row)-1 {
+				padded += strings.Repeat(" ", widths[c]-utf8.RuneCountInString(cell))
+			}
+			if esc := color(r, c); esc != "" {
+				padded = esc + padded + ansiReset
+			}
+			line.WriteString(padded)
+		}
+		fmt.Fprintln(w, line.String())
+	}
+}
+
+// writeDeviceTable summarizing devices for humans, sorted by hostname.
+func writeDeviceTable(w io.Writer, devices []tailscalesd.Device, useColor bool) {
+	devices = append([]tailscalesd.Device(nil), devices...)
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].Hostname < devices[j].Hostname
+	})
+
+	const onlineCol = 3
+	rows := [][]string{{"HOSTNAME", "ADDRESSES", "TAGS", "ONLINE", "LAST SEEN"}}
+	for _, d := range devices {
+		online := "no"
+		switch {
+		case d.OnlineUnknown:
+			online = "-"
+		case d.Online:
+			online = "yes"
+		}
+		lastSeen := "-"
+		if !d.LastSeen.IsZero() {
+			lastSeen = d.LastSeen.UTC().Format(time.RFC3339)
+		}
+		rows = append(rows, []string{
+			d.Hostname,
+			strings.Join(d.Addresses, ","),
+			strings.Join(d.Tags, ","),
+			online,
+			lastSeen,
+		})
+	}
+	writeTable(w, rows, func(row, col int) string {
+		switch {
+		case !useColor:
+			return ""
+		case row == 0:
+			return ansiBold
+		case col != onlineCol:
+			return ""
+		case rows[row][col] == "yes":
+			return ansiGreen
+		case rows[row][col] == "-":
+			return ""
+		}
+		return ansiRed
+	})
+}
+
+// writeJSON of v to w, indented for humans.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// dumpRawDevices discovers once from each of the sources, writing the devices
+// as reported by the Tailscale APIs to w as JSON, before any deduplication,
+// filtering or translation into targets.
+func dumpRawDevices(ctx context.Context, w io.Writer, sources []source) error {
+	var multi tailscalesd.MultiDiscoverer
+	for _, s := range sources {
+		multi = append(multi, s.Discoverer)
+	}
+	devices, err := multi.Devices(ctx)
+	if err != nil {
+		return fmt.Errorf("failed discovery: %w", err)
+	}
+	if devices == nil {
+		devices = []tailscalesd.Device{}
+	}
+	return writeJSON(w, devices)
+}
+
+// runDump performs discovery once using the settings and cfg, writing the
+// result to w in the format given by -output, or the raw devices with -raw.
+// Returns the exit code: 0 on success, and 2 on error.
+func runDump(ctx context.Context, w *os.File, cfg *fileConfig) int {
+	if rawDevices {
+		if output != "json" {
+			log.Printf("-raw prints JSON, so cannot be used with -output %q", output)
+			return 2
+		}
+		if err := dumpRawDevices(ctx, w, configuredSources(cfg)); err != nil {
+			log.Print(err)
+			return 2
+		}
+		return 0
+	}
+	switch output {
+	case "json":
+		targets, err := targetsFrom(ctx, cfg)
+		if err != nil {
+			log.Printf("Failed discovery: %v", err)
+			return 2
+		}
+		if err := writeJSON(w, targets); err != nil {
+			log.Printf("Failed writing targets: %v", err)
+			return 2
+		}
+	case "table":
+		devices, err := discoverer(configuredSources(cfg), cfg).Devices(ctx)
+		if err != nil {
+			log.Printf("Failed discovery: %v", err)
+			return 2
+		}
+		writeDeviceTable(w, devices, colorful(w))
+	default:
+		log.Printf("Unknown -output %q: must be json or table", output)
+		return 2
+	}
+	return 0
+}
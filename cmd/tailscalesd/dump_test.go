@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+func TestWriteDeviceTable(t *testing.T) {
+	devices := []tailscalesd.Device{
+		{
+			Addresses: []string{"100.2.3.5"},
+			Hostname:  "zebra",
+			Online:    true,
+		},
+		{
+			Addresses: []string{"100.2.3.4", "fd7a::1234"},
+			Hostname:  "aardvark",
+			LastSeen:  time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+			Tags:      []string{"tag:foo", "tag:bar"},
+		},
+	}
+	for tn, tc := range map[string]struct {
+		color bool
+		want  string
+	}{
+		"plain": {
+			want: "" +
+				"HOSTNAME  ADDRESSES             TAGS             ONLINE  LAST SEEN\n" +
+				"aardvark  100.2.3.4,fd7a::1234  tag:foo,tag:bar  no      2024-03-01T12:00:00Z\n" +
+				"zebra     100.2.3.5                              yes     -\n",
+		},
+		"colored": {
+			color: true,
+			want: "" +
+				"\x1b[1mHOSTNAME\x1b[0m  \x1b[1mADDRESSES           \x1b[0m  \x1b[1mTAGS           \x1b[0m  \x1b[1mONLINE\x1b[0m  \x1b[1mLAST SEEN\x1b[0m\n" +
+				"aardvark  100.2.3.4,fd7a::1234  tag:foo,tag:bar  \x1b[31mno    \x1b[0m  2024-03-01T12:00:00Z\n" +
+				"zebra     100.2.3.5                              \x1b[32myes   \x1b[0m  -\n",
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeDeviceTable(&buf, devices, tc.color)
+			if diff := cmp.Diff(buf.String(), tc.want); diff != "" {
+				t.Errorf("writeDeviceTable: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestDumpRawDevices(t *testing.T) {
+	sources := []source{
+		{Name: "one", Discoverer: staticDiscoverer([]tailscalesd.Device{{ID: "a", Hostname: "aardvark", Tags: []string{"tag:foo"}}})},
+		{Name: "two", Discoverer: staticDiscoverer([]tailscalesd.Device{{ID: "b", Hostname: "zebra"}})},
+	}
+	var buf bytes.Buffer
+	if err := dumpRawDevices(context.TODO(), &buf, sources); err != nil {
+		t.Fatal(err)
+	}
+	var got []tailscalesd.Device
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []tailscalesd.Device{
+		{ID: "a", Hostname: "aardvark", Tags: []string{"tag:foo"}},
+		{ID: "b", Hostname: "zebra"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("dumpRawDevices: mismatch (-got, +want):\n%v", diff)
+	}
+
+	buf.Reset()
+	if err := dumpRawDevices(context.TODO(), &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "[]\n"; got != want {
+		t.Errorf("dumpRawDevices: empty mismatch: got: %q want: %q", got, want)
+	}
+}
@@ -0,0 +1,252 @@
+//go:build e2e
+
+// The end-to-end suite runs tailscalesd, configured as it would be from the
+// command line, against fake Tailscale APIs. Targets are discovered from it as
+// Prometheus' HTTP SD does, and compared to golden files in testdata/e2e, so
+// that label regressions are caught before release. Run it with:
+//
+//	go test -tags e2e ./cmd/tailscalesd
+//
+// After intended changes to the served labels, rewrite the golden files by
+// passing -update, and review the difference.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var update = flag.Bool("update", false, "Rewrite the end-to-end golden files.")
+
+// volatileLabels depend on when the suite runs, so are not compared.
+var volatileLabels = []string{
+	"__meta_tailscale_device_discovered_at",
+	"__meta_tailscale_device_expires_in_seconds",
+	"__meta_tailscale_device_last_handshake_age_seconds",
+}
+
+// fakePublicAPI serves the devices in testdata/e2e/publicapi-devices.json for
+// every tailnet.
+func fakePublicAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+	devices, err := os.ReadFile(filepath.Join("testdata", "e2e", "publicapi-devices.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/devices") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(devices)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakeLocalAPI serves the status recorded on a Linux node over a Unix socket,
+// as tailscaled does. Returns the path of the socket.
+func fakeLocalAPI(t *testing.T) string {
+	t.Helper()
+	status, err := os.ReadFile(filepath.Join("..", "..", "testdata", "localapi", "linux.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/status" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(status)
+	}))
+	server.Listener = ln
+	server.Start()
+	t.Cleanup(server.Close)
+	return socket
+}
+
+// startTailscaleSD as configured by args, returning the URL on which it serves
+// discovery.
+func startTailscaleSD(t *testing.T, args []string) string {
+	t.Helper()
+	parseSettings(args)
+	t.Cleanup(func() { parseSettings(nil) })
+	cfg, err := applyConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSettings(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sources, limited := rateLimited(configuredSources(cfg), nil, nil, nil)
+	t.Cleanup(func() {
+		for _, d := range limited {
+			d.Deregister()
+		}
+	})
+	server := httptest.NewServer(discoveryHandler(sources, cfg))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// targetGroup as decoded by Prometheus' HTTP SD.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+var (
+	contentTypeRE = regexp.MustCompile(`^(?i:application\/json(;\s*charset=utf-8)?)$`)
+	labelNameRE   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// fakeAPIHost replaces the address of the fake public API, which changes on
+// every run, in the __meta_tailscale_api label.
+const fakeAPIHost = "api.tailscale.test"
+
+// discover target groups from url as Prometheus' HTTP SD does, failing the
+// test wherever Prometheus would reject the response. The fake public API at
+// apiHost is reported as fakeAPIHost.
+func discover(t *testing.T, url, apiHost string) []targetGroup {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "Prometheus/2.50.1")
+	req.Header.Set("X-Prometheus-Refresh-Interval-Seconds", "60")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("server returned HTTP status %v", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !contentTypeRE.MatchString(ct) {
+		t.Fatalf("unsupported content type %q", ct)
+	}
+	var groups []*targetGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		t.Fatalf("decoding target groups: %v", err)
+	}
+	out := make([]targetGroup, 0, len(groups))
+	for i, g := range groups {
+		if g == nil {
+			t.Fatalf("nil target group at %d", i)
+		}
+		for _, target := range g.Targets {
+			if target == "" {
+				t.Errorf("empty target in group %d", i)
+			}
+		}
+		for name, value := range g.Labels {
+			if !labelNameRE.MatchString(name) {
+				t.Errorf("invalid label name %q in group %d", name, i)
+			}
+			if !utf8.ValidString(value) {
+				t.Errorf("invalid value for label %q in group %d", name, i)
+			}
+		}
+		for _, name := range volatileLabels {
+			delete(g.Labels, name)
+		}
+		if g.Labels["__meta_tailscale_api"] == apiHost {
+			g.Labels["__meta_tailscale_api"] = fakeAPIHost
+		}
+		out = append(out, *g)
+	}
+	// Devices may be discovered in any order.
+	slices.SortFunc(out, func(a, b targetGroup) int {
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	})
+	return out
+}
+
+func TestEndToEnd(t *testing.T) {
+	api := fakePublicAPI(t)
+	apiHost := strings.TrimPrefix(api.URL, "http://")
+	socket := fakeLocalAPI(t)
+	config := filepath.Join(t.TempDir(), "tailscalesd.yaml")
+	if err := os.WriteFile(config, []byte(`
+public_api:
+  tailnet: example.com
+  token: testToken
+  api_url: `+api.URL+`
+output:
+  tag_port_prefix: "tag:prom-"
+  os_default_ports: true
+label_rules:
+  - match:
+      hostname: "db-.*"
+    labels:
+      job: postgres
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for tn, tc := range map[string]struct {
+		args  []string
+		query string
+	}{
+		"public-api": {
+			args: []string{"-token=testToken", "-tailnet=example.com", "-api_url=" + api.URL, "-tag_port_prefix=tag:prom-", "-target_port=9100"},
+		},
+		"public-api-filtered": {
+			args:  []string{"-token=testToken", "-tailnet=example.com", "-api_url=" + api.URL, "-only_authorized", "-ipv6", "-split_address_families"},
+			query: "?tag=web",
+		},
+		"local-api": {
+			args: []string{"-localapi", "-localapi_socket=" + socket, "-peer_health_labels", "-target_format=dnsname"},
+		},
+		"config-file": {
+			args: []string{"-config=" + config},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := discover(t, startTailscaleSD(t, tc.args)+"/"+tc.query, apiHost)
+			golden := filepath.Join("testdata", "e2e", tn+".golden.json")
+			if *update {
+				b, err := json.MarshalIndent(got, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, append(b, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []targetGroup
+			if err := json.NewDecoder(bytes.NewReader(b)).Decode(&want); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("discovered targets mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// Defaults for gossip settings.
+const defaultGossipInterval = time.Minute
+
+// peerScheme is the scheme on which replicas serve, assumed to be the same as
+// this one's: "https" when TLS is configured by either the -tls_* flags or the
+// -web.config.file, otherwise "http".
+func peerScheme() (string, error) {
+	if tlsCertFile != "" {
+		return "https", nil
+	}
+	if webConfigFile == "" {
+		return "http", nil
+	}
+	b, err := os.ReadFile(webConfigFile)
+	if err != nil {
+		return "", err
+	}
+	// Only whether a certificate is configured matters, as the exporter
+	// toolkit serves plain HTTP otherwise.
+	var cfg struct {
+		TLS struct {
+			Cert     string `yaml:"cert"`
+			CertFile string `yaml:"cert_file"`
+		} `yaml:"tls_server_config"`
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return "", fmt.Errorf("invalid -web.config.file: %w", err)
+	}
+	if cfg.TLS.Cert != "" || cfg.TLS.CertFile != "" {
+		return "https", nil
+	}
+	return "http", nil
+}
+
+// selfAddresses of this replica on the tailnet, as reported by the local API.
+func selfAddresses(ctx context.Context, local selfStatuser) ([]string, error) {
+	status, err := local.StatusWithoutPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(status.TailscaleIPs))
+	for i, addr := range status.TailscaleIPs {
+		addrs[i] = addr.String()
+	}
+	return addrs, nil
+}
+
+// tailnetPeers returns the URLs of the replicas among devices, identified by
+// carrying tag, other than this one, identified by its self addresses.
+// Replicas are assumed to serve on the same port and scheme as this one.
+func tailnetPeers(devices []tailscalesd.Device, tag string, self []string) ([]string, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine port of peers from address %q: %w", address, err)
+	}
+	scheme, err := peerScheme()
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine scheme of peers: %w", err)
+	}
+	var peers []string
+	for _, d := range devices {
+		if !slices.Contains(d.Tags, tag) || slices.ContainsFunc(d.Addresses, func(a string) bool { return slices.Contains(self, a) }) {
+			continue
+		}
+		for _, a := range d.Addresses {
+			if addr, err := netip.ParseAddr(a); err == nil && addr.Is4() {
+				peers = append(peers, fmt.Sprintf("%v://%v", scheme, net.JoinHostPort(a, port)))
+				break
+			}
+		}
+	}
+	return peers, nil
+}
+
+// gossipOnce pulls a snapshot from each peer, priming discoverers with any
+// results more recent than their own. The static peers are always used, and
+// when tag is set, so are the other replicas found among the cached results.
+func gossipOnce(ctx context.Context, static []string, tag, authToken string, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) {
+	peers := slices.Clone(static)
+	if tag != "" {
+		var devices []tailscalesd.Device
+		for _, d := range discoverers {
+			cached, _, _ := d.Cached()
+			devices = append(devices, cached...)
+		}
+		self, err := selfAddresses(ctx, localSelf())
+		if err != nil {
+			log.Printf("Failed identifying this replica among gossip peers: %v", err)
+		}
+		found, err := tailnetPeers(devices, tag, self)
+		if err != nil {
+			log.Printf("Failed finding gossip peers on the tailnet: %v", err)
+		}
+		peers = append(peers, found...)
+	}
+	slices.Sort(peers)
+	for _, peer := range slices.Compact(peers) {
+		n, err := primeFromPeer(ctx, peer, authToken, discoverers)
+		if err != nil {
+			log.Printf("Failed gossiping with %q: %v", peer, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Updated %d sources with more recent results from %q", n, peer)
+		}
+	}
+}
+
+// gossip with peers every interval, until ctx is done.
+func gossip(ctx context.Context, interval time.Duration, static []string, tag, authToken string, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			gossipOnce(ctx, static, tag, authToken, discoverers)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/ipn/ipnstate"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+func TestTailnetPeers(t *testing.T) {
+	defer func(a, c, w string) { address, tlsCertFile, webConfigFile = a, c, w }(address, tlsCertFile, webConfigFile)
+	address, tlsCertFile, webConfigFile = "0.0.0.0:9242", "", ""
+
+	devices := []tailscalesd.Device{
+		{Addresses: []string{"fd7a::1", "100.2.3.4"}, Tags: []string{"tag:tailscalesd"}},
+		{Addresses: []string{"100.5.6.7"}, Tags: []string{"tag:other"}},
+		{Addresses: []string{"fd7a::2"}, Tags: []string{"tag:tailscalesd"}},
+		{Addresses: []string{"100.8.9.10", "fd7a::3"}, Tags: []string{"tag:tailscalesd"}},
+	}
+	// This replica is not its own peer.
+	self := []string{"fd7a::3"}
+	got, err := tailnetPeers(devices, "tag:tailscalesd", self)
+	if err != nil {
+		t.Fatalf("tailnetPeers: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, []string{"http://100.2.3.4:9242"}); diff != "" {
+		t.Errorf("tailnetPeers: mismatch (-got, +want):\n%v", diff)
+	}
+
+	// TLS configured by the web configuration file is used with peers too.
+	webConfigFile = filepath.Join(t.TempDir(), "web.yaml")
+	if err := os.WriteFile(webConfigFile, []byte("tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err = tailnetPeers(devices, "tag:tailscalesd", self)
+	if err != nil {
+		t.Fatalf("tailnetPeers: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, []string{"https://100.2.3.4:9242"}); diff != "" {
+		t.Errorf("tailnetPeers: mismatch with -web.config.file (-got, +want):\n%v", diff)
+	}
+
+	address = "localhost"
+	if _, err := tailnetPeers(nil, "tag:tailscalesd", nil); err == nil {
+		t.Error("tailnetPeers: expected error for address without port, got nil")
+	}
+}
+
+func TestPeerScheme(t *testing.T) {
+	defer func(c, w string) { tlsCertFile, webConfigFile = c, w }(tlsCertFile, webConfigFile)
+	dir := t.TempDir()
+	for tn, tc := range map[string]struct {
+		certFile  string
+		webConfig string
+		want      string
+	}{
+		"plain":                     {want: "http"},
+		"tls flags":                 {certFile: "server.crt", want: "https"},
+		"web config without tls":    {webConfig: "basic_auth_users:\n  alice: hash\n", want: "http"},
+		"web config with cert file": {webConfig: "tls_server_config:\n  cert_file: server.crt\n", want: "https"},
+		"web config with cert":      {webConfig: "tls_server_config:\n  cert: PEM\n", want: "https"},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			tlsCertFile, webConfigFile = tc.certFile, ""
+			if tc.webConfig != "" {
+				webConfigFile = filepath.Join(dir, tn+".yaml")
+				if err := os.WriteFile(webConfigFile, []byte(tc.webConfig), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := peerScheme()
+			if err != nil {
+				t.Fatalf("peerScheme: unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("peerScheme: got: %q want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+type statusFunc func(context.Context) (*ipnstate.Status, error)
+
+func (f statusFunc) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	return f(ctx)
+}
+
+func TestSelfAddresses(t *testing.T) {
+	got, err := selfAddresses(context.Background(), statusFunc(func(context.Context) (*ipnstate.Status, error) {
+		return &ipnstate.Status{TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.2.3.4"), netip.MustParseAddr("fd7a::1")}}, nil
+	}))
+	if err != nil {
+		t.Fatalf("selfAddresses: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, []string{"100.2.3.4", "fd7a::1"}); diff != "" {
+		t.Errorf("selfAddresses: mismatch (-got, +want):\n%v", diff)
+	}
+}
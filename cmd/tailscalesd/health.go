@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// Paths on which liveness and readiness are reported.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// defaultReadinessFailures is the number of consecutive failed refreshes after
+// which a source is no longer ready.
+const defaultReadinessFailures = 3
+
+// readinessRefreshInterval is how often discoverers are refreshed in the
+// background, subject to -poll, so that readiness reflects the APIs while
+// nothing is served.
+const readinessRefreshInterval = 10 * time.Second
+
+// healthz reports that the process is up, for the liveness checks of
+// container runtimes and service managers. It does no discovery, so it stays
+// responsive however the Tailscale APIs are faring.
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// refreshForReadiness refreshes the discoverers every interval until the
+// context is done. Discovery is otherwise only performed when serving, which
+// a replica never ready to serve would not be. Refreshes remain subject to the
+// Frequency of each discoverer, and failures are reflected in the state
+// checked by readiness.
+func refreshForReadiness(ctx context.Context, interval time.Duration, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, d := range discoverers {
+			_, _ = d.Devices(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readiness of the discoverers to serve, at the time now, judged by the
+// results of their last refreshes. Each must have results, which must not be
+// older than maxStale, if set, and its last failures refreshes, if set, must
+// not all have failed. Returns why the discoverers are not ready, or nil if
+// they are.
+func readiness(discoverers map[string]*tailscalesd.RateLimitedDiscoverer, failures int, maxStale time.Duration, now time.Time) error {
+	names := make([]string, 0, len(discoverers))
+	for name := range discoverers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		d := discoverers[name]
+		_, refreshed, ok := d.Cached()
+		if !ok {
+			return fmt.Errorf("%v: no devices discovered yet", name)
+		}
+		if n := d.Failures(); failures > 0 && n >= failures {
+			return fmt.Errorf("%v: last %d refreshes failed", name, n)
+		}
+		if age := now.Sub(refreshed); maxStale > 0 && age > maxStale {
+			return fmt.Errorf("%v: results are %v old", name, age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// readinessLog logs changes in readiness, rather than the result of every
+// check.
+type readinessLog struct {
+	mu      sync.Mutex // protects following members
+	checked bool
+	ready   bool
+}
+
+// record the result of a readiness check, logging it if readiness changed.
+func (l *readinessLog) record(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ready := err == nil
+	if l.checked && ready == l.ready {
+		return
+	}
+	l.checked, l.ready = true, ready
+	if ready {
+		log.Print("Ready")
+	} else {
+		log.Printf("Not ready: %v", err)
+	}
+}
+
+// readyz reports whether the discoverers are ready to serve, for the readiness
+// checks of load balancers and orchestrators, responding 503 Service
+// Unavailable with the reason if not. Changes in readiness are logged.
+func readyz(discoverers map[string]*tailscalesd.RateLimitedDiscoverer, failures int, maxStale time.Duration) http.Handler {
+	var changes readinessLog
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err := readiness(discoverers, failures, maxStale, time.Now())
+		changes.record(err)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// withHealthChecks serves liveness at healthzPath, readiness with ready at
+// readyzPath, and all other requests with next. Health checks bypass any
+// authentication applied by next, as those making them rarely have
+// credentials.
+func withHealthChecks(ready, next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthzPath, healthz)
+	mux.Handle(readyzPath, ready)
+	mux.Handle("/", next)
+	return mux
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+func TestHealthChecksBypassAuthentication(t *testing.T) {
+	next := bearerAuth("sekret", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	for tn, tc := range map[string]struct {
+		path string
+		want int
+	}{
+		"healthz":      {path: healthzPath, want: http.StatusOK},
+		"readyz":       {path: readyzPath, want: http.StatusNotFound},
+		"other paths":  {path: "/", want: http.StatusUnauthorized},
+		"healthz only": {path: healthzPath + "/more", want: http.StatusUnauthorized},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			withHealthChecks(http.NotFoundHandler(), next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.want {
+				t.Errorf("withHealthChecks(%q): status mismatch: got: %v want: %v", tc.path, w.Code, tc.want)
+			}
+		})
+	}
+}
+
+// flakyDiscoverer fails whenever err is set.
+type flakyDiscoverer struct {
+	err error
+}
+
+func (d *flakyDiscoverer) Devices(context.Context) ([]tailscalesd.Device, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return []tailscalesd.Device{{ID: "id", Addresses: []string{"100.2.3.4"}}}, nil
+}
+
+func TestReadiness(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	wrapped := &flakyDiscoverer{err: errors.New("unreachable")}
+	d := &tailscalesd.RateLimitedDiscoverer{
+		Wrap:  wrapped,
+		Clock: tailscalesd.ClockFunc(func() time.Time { return now }),
+	}
+	discoverers := map[string]*tailscalesd.RateLimitedDiscoverer{"source": d}
+	for _, step := range []struct {
+		err     error
+		advance time.Duration
+		ready   bool
+	}{
+		{err: errors.New("unreachable")},
+		{ready: true},
+		{err: errors.New("unreachable"), advance: time.Minute, ready: true},
+		{err: errors.New("unreachable"), advance: time.Minute},
+		{ready: true},
+		{advance: time.Hour, ready: true},
+	} {
+		wrapped.err = step.err
+		now = now.Add(step.advance)
+		// As refreshForReadiness would.
+		_, _ = d.Devices(context.TODO())
+		err := readiness(discoverers, 2, 90*time.Second, now)
+		if got := err == nil; got != step.ready {
+			t.Errorf("readiness(%v): ready mismatch: got: %v (%v) want: %v", now, got, err, step.ready)
+		}
+	}
+}
+
+func TestReadinessStaleCutoff(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	d := &tailscalesd.RateLimitedDiscoverer{
+		Wrap:      &flakyDiscoverer{err: errors.New("unreachable")},
+		Frequency: time.Hour,
+		Clock:     tailscalesd.ClockFunc(func() time.Time { return now }),
+	}
+	d.Prime([]tailscalesd.Device{{ID: "id"}}, now.Add(-2*time.Minute))
+	discoverers := map[string]*tailscalesd.RateLimitedDiscoverer{"source": d}
+	if err := readiness(discoverers, 0, time.Minute, now); err == nil {
+		t.Error("readiness: want not ready with results older than the cutoff")
+	}
+	if err := readiness(discoverers, 0, 0, now); err != nil {
+		t.Errorf("readiness: want ready without a cutoff, got: %v", err)
+	}
+}
+
+func TestReadinessDoesNotDiscover(t *testing.T) {
+	d := &tailscalesd.RateLimitedDiscoverer{Wrap: &flakyDiscoverer{}}
+	discoverers := map[string]*tailscalesd.RateLimitedDiscoverer{"source": d}
+	if err := readiness(discoverers, 0, 0, time.Now()); err == nil {
+		t.Error("readiness: want not ready before any discovery")
+	}
+	if _, _, ok := d.Cached(); ok {
+		t.Error("readiness: want no discovery performed")
+	}
+}
+
+func TestReadinessLogLogsChanges(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+	var l readinessLog
+	for _, err := range []error{
+		errors.New("unreachable"),
+		errors.New("still unreachable"),
+		nil,
+		nil,
+		errors.New("unreachable again"),
+	} {
+		l.record(err)
+	}
+	want := "Not ready: unreachable\nReady\nNot ready: unreachable again\n"
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("readinessLog: logged mismatch (-got, +want):\n%v", diff)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// Defaults for heartbeat settings.
+const defaultHeartbeatInterval = time.Minute
+
+// heartbeatTimeout bounds how long each heartbeat may take to send.
+const heartbeatTimeout = 10 * time.Second
+
+// sample of a single series, to be remote written.
+type sample struct {
+	labels map[string]string
+	value  float64
+}
+
+// appendRemoteWriteRequest appends to b the samples, taken at the time at, as
+// a Prometheus remote write WriteRequest protobuf message.
+func appendRemoteWriteRequest(b []byte, samples []sample, at time.Time) []byte {
+	for _, s := range samples {
+		var series []byte
+		// Receivers require labels to be sorted by name.
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, s.labels[name])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(s.value))
+		value = protowire.AppendTag(value, 2, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(at.UnixMilli()))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, value)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, series)
+	}
+	return b
+}
+
+// heartbeatSamples describing discovery health: the version of tailscalesd
+// and the number of devices in the cached results of the discoverers.
+func heartbeatSamples(instance string, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) []sample {
+	var devices int
+	for _, d := range discoverers {
+		cached, _, _ := d.Cached()
+		devices += len(cached)
+	}
+	return []sample{
+		{
+			labels: map[string]string{
+				"__name__": "tailscalesd_heartbeat",
+				"instance": instance,
+				"job":      "tailscalesd",
+				"version":  Version,
+			},
+			value: 1,
+		},
+		{
+			labels: map[string]string{
+				"__name__": "tailscalesd_heartbeat_devices",
+				"instance": instance,
+				"job":      "tailscalesd",
+			},
+			value: float64(devices),
+		},
+	}
+}
+
+// sendHeartbeat remote writes the samples to url.
+func sendHeartbeat(ctx context.Context, url string, samples []sample, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, heartbeatTimeout)
+	defer cancel()
+	body := snappy.Encode(nil, appendRemoteWriteRequest(nil, samples, at))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode / 100) != 2 {
+		return fmt.Errorf("remote write failed: %v", resp.Status)
+	}
+	return nil
+}
+
+// heartbeat remote writes discovery health to url every interval until the
+// context is done, so that environments which cannot scrape tailscalesd still
+// have visibility of it. Failures are logged.
+func heartbeat(ctx context.Context, interval time.Duration, url string, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) {
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "tailscalesd"
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sendHeartbeat(ctx, url, heartbeatSamples(instance, discoverers), time.Now()); err != nil {
+			log.Printf("Failed sending heartbeat to %q: %v", url, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
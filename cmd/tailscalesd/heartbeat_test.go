@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// consumeMessage calls fn for each field of the protobuf message b, failing
+// the test if it is malformed.
+func consumeMessage(t *testing.T, b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		if n = fn(num, typ, b); n < 0 {
+			t.Fatalf("bad field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+}
+
+type seriesForTest struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp int64
+}
+
+// decodeWriteRequest for test, from the Prometheus remote write protobuf.
+func decodeWriteRequest(t *testing.T, b []byte) []seriesForTest {
+	t.Helper()
+	var series []seriesForTest
+	consumeMessage(t, b, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		s := seriesForTest{Labels: make(map[string]string)}
+		consumeMessage(t, ts, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case 1:
+				var name string
+				consumeMessage(t, v, func(num protowire.Number, _ protowire.Type, b []byte) int {
+					str, n := protowire.ConsumeString(b)
+					if num == 1 {
+						name = str
+					} else {
+						s.Labels[name] = str
+					}
+					return n
+				})
+			case 2:
+				consumeMessage(t, v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num == 1 {
+						bits, n := protowire.ConsumeFixed64(b)
+						s.Value = math.Float64frombits(bits)
+						return n
+					}
+					ms, n := protowire.ConsumeVarint(b)
+					s.Timestamp = int64(ms)
+					return n
+				})
+			}
+			return n
+		})
+		series = append(series, s)
+		return n
+	})
+	return series
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var got []seriesForTest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Content-Encoding"), "snappy"; got != want {
+			t.Errorf("heartbeat: Content-Encoding mismatch: got: %q want: %q", got, want)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = decodeWriteRequest(t, decoded)
+	}))
+	defer server.Close()
+
+	d := &tailscalesd.RateLimitedDiscoverer{Frequency: time.Hour}
+	d.Prime([]tailscalesd.Device{{ID: "one"}, {ID: "two"}}, time.Now())
+	samples := heartbeatSamples("test", map[string]*tailscalesd.RateLimitedDiscoverer{"source": d})
+	if err := sendHeartbeat(context.TODO(), server.URL, samples, at); err != nil {
+		t.Fatal(err)
+	}
+	want := []seriesForTest{
+		{
+			Labels: map[string]string{
+				"__name__": "tailscalesd_heartbeat",
+				"instance": "test",
+				"job":      "tailscalesd",
+				"version":  Version,
+			},
+			Value:     1,
+			Timestamp: at.UnixMilli(),
+		},
+		{
+			Labels: map[string]string{
+				"__name__": "tailscalesd_heartbeat_devices",
+				"instance": "test",
+				"job":      "tailscalesd",
+			},
+			Value:     2,
+			Timestamp: at.UnixMilli(),
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("heartbeat: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestSendHeartbeatReportsFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	if err := sendHeartbeat(context.TODO(), server.URL, nil, time.Now()); err == nil {
+		t.Error("sendHeartbeat: want error for rejected write")
+	}
+}
@@ -1,35 +1,176 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/cfunkhouser/tailscalesd"
 )
 
+// Defaults for settings which have them.
+const (
+	defaultAddress       = "0.0.0.0:9242"
+	defaultAPITimeout    = 30 * time.Second
+	defaultPollLimit     = time.Minute * 5
+	defaultTSNetHostname = "tailscalesd"
+)
+
 var (
-	address        string = "0.0.0.0:9242"
-	includeIPv6    bool
-	localAPISocket string        = tailscalesd.LocalAPISocket
-	pollLimit      time.Duration = time.Minute * 5
-	printVer       bool
-	tailnet        string
-	token          string
-	clientId       string
-	clientSecret   string
-	useLocalAPI    bool
+	address          string
+	addressPolicy    string
+	addressSelector  string
+	apiTimeout       time.Duration
+	apiURL           string
+	authTokenFile    string
+	basicAuthUser    string
+	basicAuthHash    string
+	changelogFile    string
+	circuitCooldown  time.Duration
+	configFile       string
+	dedupeBy         stringList
+	dedupePreferAPIs stringList
+	dedupeShared     bool
+	dropExpiredKeys  bool
+	duplicateHosts   string
+	excludeTags      stringList
+	formats          stringList
+	gossipInterval   time.Duration
+	gossipPeers      stringList
+	gossipTag        string
+	heartbeatInt     time.Duration
+	heartbeatURL     string
+	hubURL           string
+	includeIPv6      bool
+	includeTags      stringList
+	ipv6Only         bool
+	inventoryAllow   stringList
+	localAPISocket   string
+	logEveryStale    bool
+	maxStale         time.Duration
+	netcheckInterval time.Duration
+	noAddress        string
+	oldConfigFile    string
+	onlyAuthorized   bool
+	onlyOnline       bool
+	osDefaultPorts   bool
+	otlpTracesURL    string
+	output           string
+	peerHealth       bool
+	pollJitter       time.Duration
+	pollLimit        time.Duration
+	portScan         bool
+	postureAttrs     bool
+	printVer         bool
+	prometheusURL    string
+	rawDevices       bool
+	readyFailures    int
+	snapshotFile     string
+	snapshotHistory  int
+	snapshotPeer     string
+	splitFamilies    bool
+	startupProbe     bool
+	tagPortPrefix    string
+	targetFormat     string
+	targetPorts      stringList
+	tailnets         stringList
+	tlsCertFile      string
+	tlsKeyFile       string
+	tlsClientCAFile  string
+	token            string
+	tsnetHostname    string
+	tsnetStateDir    string
+	updateCheckInt   time.Duration
+	useTSNet         bool
+	webConfigFile    string
+	clientId         string
+	clientSecret     string
+	useLocalAPI      bool
 
 	// Version of tailscalesd. Set at build time to something meaningful.
 	Version = "development"
 )
 
+// flagEnvVars maps flag names to the environment variables which may also be
+// used to set them.
+var flagEnvVars = map[string]string{
+	"address":                   "LISTEN",
+	"address_policy":            "ADDRESS_POLICY",
+	"address_selector":          "ADDRESS_SELECTOR",
+	"api_timeout":               "API_TIMEOUT",
+	"api_url":                   "TAILSCALE_API_URL",
+	"auth_token_file":           "AUTH_TOKEN_FILE",
+	"basic_auth_password_hash":  "BASIC_AUTH_PASSWORD_HASH",
+	"basic_auth_username":       "BASIC_AUTH_USERNAME",
+	"changelog_file":            "CHANGELOG_FILE",
+	"circuit_breaker_cooldown":  "CIRCUIT_BREAKER_COOLDOWN",
+	"client_id":                 "TAILSCALE_CLIENT_ID",
+	"client_secret":             "TAILSCALE_CLIENT_SECRET",
+	"dedupe_by":                 "DEDUPE_BY",
+	"dedupe_prefer_api":         "DEDUPE_PREFER_APIS",
+	"dedupe_shared_devices":     "DEDUPE_SHARED_DEVICES",
+	"drop_expired_keys":         "DROP_EXPIRED_KEYS",
+	"duplicate_hostname_policy": "DUPLICATE_HOSTNAME_POLICY",
+	"exclude_tag":               "EXCLUDE_TAGS",
+	"formats":                   "FORMATS",
+	"gossip_interval":           "GOSSIP_INTERVAL",
+	"gossip_peers":              "GOSSIP_PEERS",
+	"gossip_tag":                "GOSSIP_TAG",
+	"heartbeat_interval":        "HEARTBEAT_INTERVAL",
+	"heartbeat_url":             "HEARTBEAT_URL",
+	"hub":                       "HUB_URL",
+	"include_tag":               "INCLUDE_TAGS",
+	"inventory_allow":           "INVENTORY_ALLOW",
+	"ipv6":                      "EXPOSE_IPV6",
+	"ipv6_only":                 "IPV6_ONLY",
+	"localapi":                  "TAILSCALE_USE_LOCAL_API",
+	"log_every_stale":           "LOG_EVERY_STALE",
+	"max_stale":                 "MAX_STALE",
+	"netcheck_interval":         "NETCHECK_INTERVAL",
+	"no_address_policy":         "NO_ADDRESS_POLICY",
+	"only_authorized":           "ONLY_AUTHORIZED",
+	"only_online":               "ONLY_ONLINE",
+	"os_default_ports":          "OS_DEFAULT_PORTS",
+	"otlp_traces_url":           "OTLP_TRACES_URL",
+	"peer_health_labels":        "PEER_HEALTH_LABELS",
+	"localapi_socket":           "TAILSCALE_LOCAL_API_SOCKET",
+	"poll":                      "TAILSCALE_API_POLL_LIMIT",
+	"poll_jitter":               "TAILSCALE_API_POLL_JITTER",
+	"port_scan":                 "PORT_SCAN",
+	"posture_attributes":        "POSTURE_ATTRIBUTES",
+	"readiness_failures":        "READINESS_FAILURES",
+	"snapshot_file":             "SNAPSHOT_FILE",
+	"snapshot_history":          "SNAPSHOT_HISTORY",
+	"snapshot_peer":             "SNAPSHOT_PEER",
+	"split_address_families":    "SPLIT_ADDRESS_FAMILIES",
+	"startup_probe":             "STARTUP_PROBE",
+	"tailnet":                   "TAILNET",
+	"tag_port_prefix":           "TAG_PORT_PREFIX",
+	"target_format":             "TARGET_FORMAT",
+	"target_port":               "TARGET_PORT",
+	"tls_cert_file":             "TLS_CERT_FILE",
+	"tls_client_ca_file":        "TLS_CLIENT_CA_FILE",
+	"tls_key_file":              "TLS_KEY_FILE",
+	"tsnet":                     "TSNET",
+	"tsnet_hostname":            "TSNET_HOSTNAME",
+	"tsnet_state_dir":           "TSNET_STATE_DIR",
+	"update_check_interval":     "UPDATE_CHECK_INTERVAL",
+	"web.config.file":           "WEB_CONFIG_FILE",
+	"token":                     "TAILSCALE_API_TOKEN",
+}
+
 func envVarWithDefault(key, def string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
@@ -45,6 +186,55 @@ func boolEnvVarWithDefault(key string, def bool) bool {
 	return def
 }
 
+// stringList is a flag.Value accepting repeated and/or comma-separated values.
+type stringList []string
+
+func splitList(val string) []string {
+	var list []string
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(val string) error {
+	*l = append(*l, splitList(val)...)
+	return nil
+}
+
+// listEnvVarIfUnset populates l from the environment, unless the flag was
+// provided on the command line. This must be called after flags are parsed,
+// because repeated flags append to the list.
+func listEnvVarIfUnset(l *stringList, name, key string) {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	if val, ok := os.LookupEnv(key); ok && !set {
+		*l = splitList(val)
+	}
+}
+
+func intEnvVarWithDefault(key string, def int) int {
+	if val, ok := os.LookupEnv(key); ok {
+		n, err := strconv.Atoi(val)
+		if err == nil {
+			return n
+		}
+		log.Printf("Integer parsing failed, using default %d: %v", def, err)
+	}
+	return def
+}
+
 func durationEnvVarWithDefault(key string, def time.Duration) time.Duration {
 	if val, ok := os.LookupEnv(key); ok {
 		d, err := time.ParseDuration(val)
@@ -56,16 +246,88 @@ func durationEnvVarWithDefault(key string, def time.Duration) time.Duration {
 	return def
 }
 
+// defineFlags on a new flag.CommandLine, resetting all settings to their
+// defaults or environment variable values.
 func defineFlags() {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flag.CommandLine.Usage = usage
+	tailnets = nil
+	formats = nil
+	gossipPeers = nil
+	includeTags = nil
+	excludeTags = nil
+	inventoryAllow = nil
+	targetPorts = nil
+	dedupeBy = nil
+	dedupePreferAPIs = nil
 	flag.BoolVar(&printVer, "version", false, "Print the version and exit.")
 	flag.BoolVar(&includeIPv6, "ipv6", boolEnvVarWithDefault("EXPOSE_IPV6", false), "Include IPv6 target addresses.")
+	flag.BoolVar(&ipv6Only, "ipv6_only", boolEnvVarWithDefault("IPV6_ONLY", false), "Serve only IPv6 target addresses, dropping IPv4 addresses. Implies -ipv6.")
+	flag.Var(&includeTags, "include_tag", "Only serve devices carrying at least one of these tags. May be repeated, or comma-separated. (default $INCLUDE_TAGS)")
+	flag.Var(&excludeTags, "exclude_tag", "Never serve devices carrying any of these tags, even if included by -include_tag. May be repeated, or comma-separated. (default $EXCLUDE_TAGS)")
+	flag.BoolVar(&onlyAuthorized, "only_authorized", boolEnvVarWithDefault("ONLY_AUTHORIZED", false), "Only serve devices which are authorized to join the tailnet. Unauthorized devices are unreachable.")
+	flag.BoolVar(&onlyOnline, "only_online", boolEnvVarWithDefault("ONLY_ONLINE", false), "Only serve devices which the API reports as online. Not supported when using OAuth clients, which do not report it.")
+	flag.BoolVar(&dropExpiredKeys, "drop_expired_keys", boolEnvVarWithDefault("DROP_EXPIRED_KEYS", false), "Do not serve devices whose node keys have expired, which cannot be connected to.")
+	flag.StringVar(&addressPolicy, "address_policy", envVarWithDefault("ADDRESS_POLICY", "all"), "Which addresses of each device to serve as targets: all of them, or only the first IPv4 or IPv6 address, so that hosts are not scraped once per address family. One of all, first-v4 or first-v6. first-v6 implies -ipv6.")
+	flag.StringVar(&addressSelector, "address_selector", os.Getenv("ADDRESS_SELECTOR"), fmt.Sprintf("Which addresses of each device to serve as targets, replacing -ipv6, -ipv6_only and -address_policy. One of %v.", strings.Join(tailscalesd.AddressSelectorNames(), ", ")))
+	flag.StringVar(&noAddress, "no_address_policy", envVarWithDefault("NO_ADDRESS_POLICY", "drop"), "How to serve devices reporting no addresses: drop them, use their hostname as the target, or drop them and count an error in the tailscalesd_device_address_errors metric. One of drop, hostname or error.")
+	flag.StringVar(&duplicateHosts, "duplicate_hostname_policy", envVarWithDefault("DUPLICATE_HOSTNAME_POLICY", "all"), "How to serve devices sharing a hostname, such as reinstalled machines: serve all of them, only the online or most recently seen, or all labeled with their index among them, oldest first. One of all, last-seen or index.")
+	flag.BoolVar(&dedupeShared, "dedupe_shared_devices", boolEnvVarWithDefault("DEDUPE_SHARED_DEVICES", false), "Merge duplicate devices, such as those found in several tailnets or by both the local and public APIs, into one, preferring tailnets in the order given by -tailnet and merging their tags.")
+	flag.Var(&dedupeBy, "dedupe_by", "How -dedupe_shared_devices identifies duplicates: any of node_key, id and address. Devices sharing any of them are duplicates. May be repeated, or comma-separated. (default $DEDUPE_BY, or node_key)")
+	flag.Var(&dedupePreferAPIs, "dedupe_prefer_api", "APIs whose devices -dedupe_shared_devices keeps, in order of preference, such as \"localhost\" for the local API or \"api.tailscale.com\" for the public API. May be repeated, or comma-separated. (default $DEDUPE_PREFER_APIS)")
+	flag.BoolVar(&splitFamilies, "split_address_families", boolEnvVarWithDefault("SPLIT_ADDRESS_FAMILIES", false), "Serve separate target groups for each device's IPv4 and IPv6 addresses, labeled with the address family.")
 	flag.BoolVar(&useLocalAPI, "localapi", boolEnvVarWithDefault("TAILSCALE_USE_LOCAL_API", false), "Use the Tailscale local API exported by the local node's tailscaled")
-	flag.DurationVar(&pollLimit, "poll", durationEnvVarWithDefault("TAILSCALE_API_POLL_LIMIT", pollLimit), "Max frequency with which to poll the Tailscale API. Cached results are served between intervals.")
-	flag.StringVar(&address, "address", envVarWithDefault("LISTEN", address), "Address on which to serve Tailscale SD")
-	flag.StringVar(&localAPISocket, "localapi_socket", envVarWithDefault("TAILSCALE_LOCAL_API_SOCKET", localAPISocket), "Unix Domain Socket to use for communication with the local tailscaled API.")
-	flag.StringVar(&tailnet, "tailnet", os.Getenv("TAILNET"), "Tailnet name.")
+	flag.BoolVar(&peerHealth, "peer_health_labels", boolEnvVarWithDefault("PEER_HEALTH_LABELS", false), "Label devices discovered using the local API with their health problems as seen by the local node, such as expired keys.")
+	flag.BoolVar(&logEveryStale, "log_every_stale", boolEnvVarWithDefault("LOG_EVERY_STALE", false), "Log every response which serves stale results, rather than only when starting and stopping serving stale results.")
+	flag.DurationVar(&netcheckInterval, "netcheck_interval", durationEnvVarWithDefault("NETCHECK_INTERVAL", 0), "How often to check this node's connectivity to the tailnet, exporting the results as metrics. Requires -localapi. Disabled when zero.")
+	flag.DurationVar(&updateCheckInt, "update_check_interval", durationEnvVarWithDefault("UPDATE_CHECK_INTERVAL", 0), "How often to check for a newer published release of tailscalesd, exporting the result as the tailscalesd_update_available metric. Disabled when zero.")
+	flag.DurationVar(&pollLimit, "poll", durationEnvVarWithDefault("TAILSCALE_API_POLL_LIMIT", defaultPollLimit), "Max frequency with which to poll the Tailscale API. Cached results are served between intervals.")
+	flag.DurationVar(&circuitCooldown, "circuit_breaker_cooldown", durationEnvVarWithDefault("CIRCUIT_BREAKER_COOLDOWN", 0), fmt.Sprintf("How long to stop calling an API after %d consecutive failures, serving its last results as stale meanwhile. Disabled when zero.", tailscalesd.DefaultCircuitBreakerFailures))
+	flag.DurationVar(&maxStale, "max_stale", durationEnvVarWithDefault("MAX_STALE", 0), "Maximum age of the stale results served when an API cannot be reached. Once older, requests fail with 503 Service Unavailable instead, and /readyz reports not ready. Disabled when zero.")
+	flag.IntVar(&readyFailures, "readiness_failures", intEnvVarWithDefault("READINESS_FAILURES", defaultReadinessFailures), "Number of consecutive failed refreshes of any API after which /readyz reports not ready. Disabled when zero.")
+	flag.DurationVar(&apiTimeout, "api_timeout", durationEnvVarWithDefault("API_TIMEOUT", defaultAPITimeout), "How long each discovery from a Tailscale API may take, including all of the requests it makes, before failing. Unbounded when zero.")
+	flag.DurationVar(&pollJitter, "poll_jitter", durationEnvVarWithDefault("TAILSCALE_API_POLL_JITTER", 0), "Lengthen each -poll interval by a random duration up to this, so that replicas started together do not poll the Tailscale API in lockstep.")
+	flag.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "Path to a YAML configuration file. Flags and environment variables take precedence over its contents.")
+	flag.BoolVar(&startupProbe, "startup_probe", boolEnvVarWithDefault("STARTUP_PROBE", false), "Verify connectivity and credentials for all configured APIs before serving, exiting if any fail.")
+	flag.StringVar(&address, "address", envVarWithDefault("LISTEN", defaultAddress), "Address on which to serve Tailscale SD")
+	flag.StringVar(&localAPISocket, "localapi_socket", envVarWithDefault("TAILSCALE_LOCAL_API_SOCKET", tailscalesd.LocalAPISocket), "Unix Domain Socket to use for communication with the local tailscaled API.")
+	flag.Var(&tailnets, "tailnet", "Tailnet name. May be repeated, or comma-separated, to discover several tailnets using the same token. (default $TAILNET)")
 	flag.StringVar(&clientId, "client_id", os.Getenv("TAILSCALE_CLIENT_ID"), "Tailscale OAuth Client ID")
 	flag.StringVar(&clientSecret, "client_secret", os.Getenv("TAILSCALE_CLIENT_SECRET"), "Tailscale OAuth Client Secret")
+	flag.StringVar(&apiURL, "api_url", os.Getenv("TAILSCALE_API_URL"), "Base URL of the Tailscale public API, such as \"https://api.tailscale.com\". Useful for testing against mock APIs. (default https://"+tailscalesd.PublicAPIHost+")")
+	flag.BoolVar(&postureAttrs, "posture_attributes", boolEnvVarWithDefault("POSTURE_ATTRIBUTES", false), "Fetch the posture attributes of each device from the public API, labeling targets with their custom attributes. Makes an additional API request per device.")
+	flag.StringVar(&authTokenFile, "auth_token_file", os.Getenv("AUTH_TOKEN_FILE"), "Path to a file containing a token which requests for service discovery must present as an Authorization: Bearer header.")
+	flag.StringVar(&basicAuthUser, "basic_auth_username", os.Getenv("BASIC_AUTH_USERNAME"), "Username required via HTTP basic auth for all endpoints. Requires -basic_auth_password_hash.")
+	flag.StringVar(&basicAuthHash, "basic_auth_password_hash", os.Getenv("BASIC_AUTH_PASSWORD_HASH"), "bcrypt hash of the password required via HTTP basic auth for all endpoints.")
+	flag.StringVar(&changelogFile, "changelog_file", os.Getenv("CHANGELOG_FILE"), "Path to a file to which a JSON lines record of the devices added, removed and changed by every refresh is appended. Rotated at 10MiB, keeping 3 old files.")
+	flag.StringVar(&snapshotFile, "snapshot_file", os.Getenv("SNAPSHOT_FILE"), "Path to a file in which the cached discovery results are saved after each refresh, and from which they are loaded on startup.")
+	flag.IntVar(&snapshotHistory, "snapshot_history", intEnvVarWithDefault("SNAPSHOT_HISTORY", 0), "Number of distinct sets of served targets to retain in memory and serve at /debug/snapshots/, for comparing targets before and after unexpected changes. Disabled when 0.")
+	flag.StringVar(&snapshotPeer, "snapshot_peer", os.Getenv("SNAPSHOT_PEER"), "URL of another tailscalesd replica, such as \"http://tailscalesd-0:9242\", from which to prime the cache on startup.")
+	flag.Var(&gossipPeers, "gossip_peers", "URLs of other tailscalesd replicas with which to share discovery results. May be repeated, or comma-separated. (default $GOSSIP_PEERS)")
+	flag.StringVar(&gossipTag, "gossip_tag", os.Getenv("GOSSIP_TAG"), "Tag, such as \"tag:tailscalesd\", identifying other tailscalesd replicas on the tailnet with which to share discovery results.")
+	flag.DurationVar(&gossipInterval, "gossip_interval", durationEnvVarWithDefault("GOSSIP_INTERVAL", defaultGossipInterval), "How often to pull discovery results from replicas given by -gossip_peers and -gossip_tag.")
+	flag.StringVar(&heartbeatURL, "heartbeat_url", os.Getenv("HEARTBEAT_URL"), "Prometheus remote write endpoint to which to send tailscalesd_heartbeat and tailscalesd_heartbeat_devices series, for environments which cannot scrape /metrics. Basic auth credentials may be included in the URL.")
+	flag.DurationVar(&heartbeatInt, "heartbeat_interval", durationEnvVarWithDefault("HEARTBEAT_INTERVAL", defaultHeartbeatInterval), "How often to send heartbeats to -heartbeat_url.")
+	flag.StringVar(&otlpTracesURL, "otlp_traces_url", os.Getenv("OTLP_TRACES_URL"), "OTLP/HTTP endpoint, such as http://otel-collector:4318/v1/traces, to which to export traces of serving discovery and of the Tailscale API requests made. Disabled when empty.")
+	flag.StringVar(&hubURL, "hub", os.Getenv("HUB_URL"), "URL of another tailscalesd, such as \"http://tailscalesd-hub:9242\", whose discovery results to serve rather than using the Tailscale APIs. The hub must allow this node with -inventory_allow.")
+	flag.Var(&inventoryAllow, "inventory_allow", "Tags, or login names of users, of the tailnet nodes allowed to fetch this tailscalesd's discovery results as spokes using -hub. Identified via the local API, or the tsnet node when using -tsnet. May be repeated, or comma-separated. (default $INVENTORY_ALLOW)")
+	flag.StringVar(&tagPortPrefix, "tag_port_prefix", os.Getenv("TAG_PORT_PREFIX"), "Tag prefix followed by a port number, such as \"tag:prom-\", from which to derive target ports.")
+	flag.BoolVar(&osDefaultPorts, "os_default_ports", boolEnvVarWithDefault("OS_DEFAULT_PORTS", false), "Serve devices not given a port by their tags with the conventional exporter port for their OS: 9100 (node_exporter) for Linux, FreeBSD and macOS, and 9182 (windows_exporter) for Windows.")
+	flag.BoolVar(&portScan, "port_scan", boolEnvVarWithDefault("PORT_SCAN", false), "Find the exporters running on each device by connecting to well-known exporter ports on every refresh, serving one target per open port labeled with the exporter's name.")
+	flag.Var(&formats, "formats", "Additional encodings of the SD payload, any of yaml, msgpack and protobuf, selected by the Accept header of requests. JSON is always served. May be repeated, or comma-separated. (default $FORMATS)")
+	flag.StringVar(&targetFormat, "target_format", envVarWithDefault("TARGET_FORMAT", "ip"), "Format of served targets: ip for the device's Tailscale addresses, or dnsname for its MagicDNS name.")
+	flag.Var(&targetPorts, "target_port", "Ports appended to targets which are not given one by their tags, exporters or port scanning, so that they're served as ip:port. Devices are served once for each port. May be repeated, or comma-separated. (default $TARGET_PORT)")
+	flag.StringVar(&tlsCertFile, "tls_cert_file", os.Getenv("TLS_CERT_FILE"), "Path to a PEM-encoded TLS certificate. Enables serving over HTTPS.")
+	flag.StringVar(&tlsKeyFile, "tls_key_file", os.Getenv("TLS_KEY_FILE"), "Path to the PEM-encoded private key for -tls_cert_file.")
+	flag.StringVar(&tlsClientCAFile, "tls_client_ca_file", os.Getenv("TLS_CLIENT_CA_FILE"), "Path to a PEM-encoded CA bundle. When set, clients must present a certificate signed by one of its CAs.")
+	flag.StringVar(&webConfigFile, "web.config.file", os.Getenv("WEB_CONFIG_FILE"), "Path to a Prometheus exporter-toolkit web configuration file, configuring TLS and basic auth in place of the -tls_* and -basic_auth_* flags.")
+	flag.BoolVar(&useTSNet, "tsnet", boolEnvVarWithDefault("TSNET", false), "Join the tailnet as its own node and serve only on its Tailscale addresses. Set TS_AUTHKEY to authenticate non-interactively.")
+	flag.StringVar(&tsnetHostname, "tsnet_hostname", envVarWithDefault("TSNET_HOSTNAME", defaultTSNetHostname), "Hostname with which to join the tailnet when using -tsnet.")
+	flag.StringVar(&tsnetStateDir, "tsnet_state_dir", os.Getenv("TSNET_STATE_DIR"), "Directory in which to keep tailnet node state when using -tsnet. Defaults to a directory under the user's config directory.")
+	flag.StringVar(&oldConfigFile, "old_config", "", "Only used by the diff subcommand: configuration file against which to compare -config.")
+	flag.StringVar(&prometheusURL, "prometheus_url", "", "Only used by the verify subcommand: URL of the Prometheus server whose relabeling to apply to the targets.")
+	flag.StringVar(&output, "output", "json", "Only used by the dump subcommand: json to print the targets which would be served, or table to print the discovered devices.")
+	flag.BoolVar(&rawDevices, "raw", false, "Only used by the dump subcommand: print the devices as reported by the Tailscale APIs, as JSON, instead of the targets which would be served.")
 	flag.StringVar(&token, "token", os.Getenv("TAILSCALE_API_TOKEN"), "Tailscale API Token")
 }
 
@@ -78,6 +340,299 @@ func (w *logWriter) Write(data []byte) (int, error) {
 	return fmt.Printf("%v %v", time.Now().In(w.TZ).Format(w.Format), string(data))
 }
 
+// parseSettings from the command line arguments and environment, resetting
+// any previously parsed settings.
+func parseSettings(args []string) {
+	defineFlags()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		// The CommandLine FlagSet exits on error; this is unreachable.
+		panic(err)
+	}
+	listEnvVarIfUnset(&tailnets, "tailnet", "TAILNET")
+	listEnvVarIfUnset(&formats, "formats", "FORMATS")
+	listEnvVarIfUnset(&gossipPeers, "gossip_peers", "GOSSIP_PEERS")
+	listEnvVarIfUnset(&includeTags, "include_tag", "INCLUDE_TAGS")
+	listEnvVarIfUnset(&excludeTags, "exclude_tag", "EXCLUDE_TAGS")
+	listEnvVarIfUnset(&inventoryAllow, "inventory_allow", "INVENTORY_ALLOW")
+	listEnvVarIfUnset(&targetPorts, "target_port", "TARGET_PORT")
+	listEnvVarIfUnset(&dedupeBy, "dedupe_by", "DEDUPE_BY")
+	listEnvVarIfUnset(&dedupePreferAPIs, "dedupe_prefer_api", "DEDUPE_PREFER_APIS")
+}
+
+// applyConfigFile at path, if any, to the settings which were not explicitly
+// provided. Returns the loaded configuration, which is empty if path is.
+func applyConfigFile(path string) (*fileConfig, error) {
+	if path == "" {
+		return &fileConfig{}, nil
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.apply(explicitlySet(flagEnvVars))
+	return cfg, nil
+}
+
+// validateSettings checks that enough settings are provided, either directly or
+// in cfg, to discover devices.
+func validateSettings(cfg *fileConfig) error {
+	hasToken := !(token == "" || len(tailnets) == 0)
+	hasOAuth := clientId != "" && clientSecret != ""
+	hasCredentials := len(cfg.Credentials) > 0
+	if !useLocalAPI && !hasToken && !hasOAuth && !hasCredentials && hubURL == "" {
+		return errors.New("Either -token and -tailnet or -client_id and -client_secret are required when using the public API")
+	}
+	if useLocalAPI && localAPISocket == "" {
+		return errors.New("-localapi_socket must not be empty when using the local API.")
+	}
+	if _, err := parsePorts(targetPorts); err != nil {
+		return fmt.Errorf("invalid -target_port: %w", err)
+	}
+	if targetFormat != "ip" && targetFormat != "dnsname" {
+		return fmt.Errorf("-target_format must be ip or dnsname, not %q", targetFormat)
+	}
+	for _, by := range dedupeBy {
+		if _, ok := dedupeKeys[by]; !ok {
+			return fmt.Errorf("unknown key %q in -dedupe_by", by)
+		}
+	}
+	if _, err := tailscalesd.ParseAddressPolicy(addressPolicy); err != nil {
+		return fmt.Errorf("invalid -address_policy: %w", err)
+	}
+	if _, ok := tailscalesd.AddressSelectorNamed(addressSelector); addressSelector != "" && !ok {
+		return fmt.Errorf("unknown -address_selector %q: must be one of %v", addressSelector, strings.Join(tailscalesd.AddressSelectorNames(), ", "))
+	}
+	if _, err := tailscalesd.ParseNoAddressPolicy(noAddress); err != nil {
+		return fmt.Errorf("invalid -no_address_policy: %w", err)
+	}
+	if _, err := tailscalesd.ParseDuplicateHostnamePolicy(duplicateHosts); err != nil {
+		return fmt.Errorf("invalid -duplicate_hostname_policy: %w", err)
+	}
+	for _, f := range formats {
+		if _, ok := tailscalesd.SerializerNamed(f); !ok {
+			return fmt.Errorf("unknown format %q in -formats", f)
+		}
+	}
+	if apiURL != "" {
+		if _, err := parseAPIURL(apiURL); err != nil {
+			return fmt.Errorf("invalid -api_url: %w", err)
+		}
+	}
+	if hubURL != "" {
+		if _, err := parseAPIURL(hubURL); err != nil {
+			return fmt.Errorf("invalid -hub: %w", err)
+		}
+	}
+	if heartbeatURL != "" && heartbeatInt <= 0 {
+		return errors.New("-heartbeat_interval must be positive")
+	}
+	if maxStale < 0 {
+		return errors.New("-max_stale must not be negative")
+	}
+	if apiTimeout < 0 {
+		return errors.New("-api_timeout must not be negative")
+	}
+	if readyFailures < 0 {
+		return errors.New("-readiness_failures must not be negative")
+	}
+	if snapshotHistory < 0 {
+		return errors.New("-snapshot_history must not be negative")
+	}
+	return nil
+}
+
+// parsePorts given as flag values, which must be non-zero port numbers.
+func parsePorts(vals []string) ([]uint16, error) {
+	ports := make([]uint16, len(vals))
+	for i, v := range vals {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("%q is not a port number", v)
+		}
+		ports[i] = uint16(port)
+	}
+	return ports, nil
+}
+
+// parseAPIURL parses the base URL of the public API, which must be HTTP(S).
+func parseAPIURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	return u, nil
+}
+
+// dedupeKeys maps the names accepted by -dedupe_by to the keys they select.
+var dedupeKeys = map[string]tailscalesd.DeviceKey{
+	"node_key": tailscalesd.NodeKey,
+	"id":       tailscalesd.DeviceID,
+	"address":  tailscalesd.DeviceAddresses,
+}
+
+// discoverer of devices from all sources, according to the current settings
+// and cfg.
+func discoverer(sources []source, cfg *fileConfig) tailscalesd.Discoverer {
+	var multi tailscalesd.MultiDiscoverer
+	for _, s := range sources {
+		multi = append(multi, s.Discoverer)
+	}
+	middleware := []tailscalesd.Middleware{tailscalesd.StableIDs()}
+	if dedupeShared {
+		prefer := slices.Clone(tailnets)
+		for _, c := range cfg.Credentials {
+			prefer = append(prefer, c.Tailnet)
+		}
+		var keys []tailscalesd.DeviceKey
+		for _, by := range dedupeBy {
+			// Keys were checked when validating settings.
+			keys = append(keys, dedupeKeys[by])
+		}
+		middleware = append(middleware, func(d tailscalesd.Discoverer) tailscalesd.Discoverer {
+			return &tailscalesd.DedupingDiscoverer{
+				Wrap:           d,
+				Keys:           keys,
+				PreferTailnets: prefer,
+				PreferAPIs:     dedupePreferAPIs,
+			}
+		})
+	}
+	var filters []tailscalesd.DeviceFilter
+	if onlyOnline {
+		if clientId != "" || slices.ContainsFunc(cfg.Credentials, func(c credentialConfig) bool { return c.ClientID != "" }) {
+			log.Print("WARNING: -only_online keeps every device discovered using OAuth clients, which do not report whether devices are online")
+		}
+		filters = append(filters, tailscalesd.NamedDeviceFilter("only_online", tailscalesd.OnlineDevices))
+	}
+	if onlyAuthorized {
+		filters = append(filters, tailscalesd.NamedDeviceFilter("only_authorized", tailscalesd.AuthorizedDevices))
+	}
+	if dropExpiredKeys {
+		filters = append(filters, tailscalesd.NamedDeviceFilter("drop_expired_keys", tailscalesd.UnexpiredKeys(tailscalesd.ClockFunc(time.Now))))
+	}
+	if len(filters) > 0 {
+		middleware = append(middleware, tailscalesd.Filter(filters...))
+	}
+	if len(includeTags) > 0 || len(excludeTags) > 0 {
+		middleware = append(middleware, tailscalesd.FilterTags(includeTags, excludeTags))
+	}
+	return tailscalesd.Chain(multi, middleware...)
+}
+
+// scanning wraps the Discoverer of each source to scan discovered devices for
+// open exporter ports, as configured in cfg. It should be wrapped in turn by
+// rate limiting, so that devices are only scanned on refresh.
+func scanning(sources []source, cfg *fileConfig) []source {
+	scan := tailscalesd.Enrich(cfg.portScanner(), 0)
+	scanned := make([]source, len(sources))
+	for i, s := range sources {
+		scanned[i] = s
+		scanned[i].Discoverer = scan(s.Discoverer)
+	}
+	return scanned
+}
+
+// addresses selector configured by -address_selector, or otherwise by the
+// -ipv6, -ipv6_only and -address_policy flags.
+func addresses() tailscalesd.AddressSelector {
+	// Names were checked when validating settings.
+	if addressSelector != "" {
+		s, _ := tailscalesd.AddressSelectorNamed(addressSelector)
+		return s
+	}
+	policy, _ := tailscalesd.ParseAddressPolicy(addressPolicy)
+	family := tailscalesd.IPv4AddressesSelector
+	switch {
+	case ipv6Only:
+		family = tailscalesd.IPv6AddressesSelector
+	case includeIPv6 || policy == tailscalesd.FirstIPv6Address:
+		family = tailscalesd.AllAddressesSelector
+	}
+	switch policy {
+	case tailscalesd.FirstIPv4Address:
+		return tailscalesd.ChainAddressSelectors(family, tailscalesd.FirstIPv4AddressSelector)
+	case tailscalesd.FirstIPv6Address:
+		return tailscalesd.ChainAddressSelectors(family, tailscalesd.FirstIPv6AddressSelector)
+	}
+	return family
+}
+
+// discoveryHandler serves service discovery from sources, according to the
+// current settings and cfg, and any further opts. Sources are expected to be
+// rate limited.
+func discoveryHandler(sources []source, cfg *fileConfig, opts ...tailscalesd.HandlerOption) http.Handler {
+	ts := discoverer(sources, cfg)
+
+	var filters []tailscalesd.TargetFilter
+	if targetFormat == "dnsname" {
+		filters = append(filters, tailscalesd.NamedFilter("dnsname", tailscalesd.DNSNameTargets))
+	}
+
+	var expanders []tailscalesd.TargetExpander
+	if tagPortPrefix != "" {
+		expanders = append(expanders, tailscalesd.PortsFromTags(tagPortPrefix))
+	}
+	// Errors were checked when loading the configuration.
+	if exporters, _ := cfg.exporters(); len(exporters) > 0 {
+		expanders = append(expanders, tailscalesd.ExportersFromTags(exporters))
+	}
+	if len(cfg.TagPorts) > 0 {
+		expanders = append(expanders, tailscalesd.PortsForTags(cfg.TagPorts))
+	}
+	if exporters, _ := cfg.osExporters(); len(exporters) > 0 {
+		expanders = append(expanders, tailscalesd.ExportersFromOS(exporters))
+	}
+	if ports, _ := parsePorts(targetPorts); len(ports) > 0 {
+		expanders = append(expanders, tailscalesd.DefaultPorts(ports...))
+	}
+	if rules, _ := cfg.labelRules(); len(rules) > 0 {
+		expanders = append(expanders, tailscalesd.LabelRules(rules...))
+	}
+	if templates, _ := cfg.labelTemplates(); len(templates) > 0 {
+		expanders = append(expanders, tailscalesd.LabelTemplates(templates))
+	}
+	if splitFamilies {
+		expanders = append(expanders, tailscalesd.SplitAddressFamilies)
+	}
+
+	var serializers []tailscalesd.Serializer
+	for _, f := range formats {
+		// Formats were checked when validating settings.
+		if s, ok := tailscalesd.SerializerNamed(f); ok {
+			serializers = append(serializers, s)
+		}
+	}
+
+	// The policy was checked when validating settings.
+	policy, _ := tailscalesd.ParseNoAddressPolicy(noAddress)
+	duplicates, _ := tailscalesd.ParseDuplicateHostnamePolicy(duplicateHosts)
+	// Route targets were checked when loading the config file.
+	routes, _ := cfg.routeTargets()
+
+	return tailscalesd.Handler(ts, append([]tailscalesd.HandlerOption{
+		tailscalesd.WithNoAddressPolicy(policy),
+		tailscalesd.WithAddressSelector(addresses()),
+		tailscalesd.WithDuplicateHostnamePolicy(duplicates),
+		tailscalesd.WithSerializers(serializers...),
+		tailscalesd.WithFilters(filters...),
+		tailscalesd.WithExpanders(expanders...),
+		tailscalesd.WithStaticTargets(cfg.StaticTargets...),
+		tailscalesd.WithRouteTargets(routes...),
+		tailscalesd.WithRefreshInterval(pollLimit),
+		tailscalesd.WithStaleLogEveryRequest(logEveryStale),
+	}, opts...)...)
+}
+
+func usageError(err error) {
+	if _, err := fmt.Fprintln(os.Stderr, err); err != nil {
+		panic(err)
+	}
+	flag.CommandLine.Usage()
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetOutput(&logWriter{
@@ -85,66 +640,171 @@ func main() {
 		Format: time.RFC3339,
 	})
 
-	defineFlags()
-	flag.Parse()
-
+	name, args := commandFor(os.Args[1:])
+	parseSettings(args)
 	if printVer {
-		fmt.Printf("tailscalesd version %v\n", Version)
-		return
+		name = "version"
 	}
+	if name == "serve" && flag.NArg() > 0 {
+		usageError(fmt.Errorf("unknown command %q", flag.Arg(0)))
+		os.Exit(2)
+	}
+	os.Exit(commands[name].run(context.Background(), args))
+}
 
-	hasToken := !(token == "" || tailnet == "")
-	hasOAuth := clientId != "" && clientSecret != ""
-
-	if !useLocalAPI && !hasToken && !hasOAuth {
-		if _, err := fmt.Fprintln(os.Stderr, "Either -token and -tailnet or -client_id and -client_secret are required when using the public API"); err != nil {
-			panic(err)
+// runServe serves service discovery using the settings and cfg until the
+// server fails, after running the startup probe if enabled. Returns the exit
+// code, which is 1 when serving could not start or failed.
+func runServe(ctx context.Context, cfg *fileConfig) int {
+	sources := configuredSources(cfg)
+	if startupProbe {
+		if err := probeSources(ctx, sources); err != nil {
+			log.Printf("Startup probe failed: %v", err)
+			return 1
 		}
-		flag.Usage()
-		return
 	}
 
-	if useLocalAPI && localAPISocket == "" {
-		if _, err := fmt.Fprintln(os.Stderr, "-localapi_socket must not be empty when using the local API."); err != nil {
-			panic(err)
+	var (
+		authToken string
+		err       error
+	)
+	if authTokenFile != "" {
+		// Both schemes use the Authorization header, so cannot be combined.
+		if basicAuthUser != "" || basicAuthHash != "" {
+			log.Print("-auth_token_file cannot be used with basic auth")
+			return 1
+		}
+		if authToken, err = readTokenFile(authTokenFile); err != nil {
+			log.Printf("Failed reading -auth_token_file: %v", err)
+			return 1
 		}
-		flag.Usage()
-		return
 	}
 
-	var ts tailscalesd.MultiDiscoverer
-	if useLocalAPI {
-		ts = append(ts, &tailscalesd.RateLimitedDiscoverer{
-			Wrap:      tailscalesd.LocalAPI(localAPISocket),
-			Frequency: pollLimit,
-		})
+	if otlpTracesURL != "" {
+		shutdown, err := setupTracing(ctx, otlpTracesURL)
+		if err != nil {
+			log.Printf("Failed configuring tracing: %v", err)
+			return 1
+		}
+		defer func() {
+			if err := shutdown(ctx); err != nil {
+				log.Printf("Failed exporting remaining spans: %v", err)
+			}
+		}()
 	}
 
-	if token != "" && tailnet != "" {
-		ts = append(ts, &tailscalesd.RateLimitedDiscoverer{
-			Wrap:      tailscalesd.PublicAPI(tailnet, token),
-			Frequency: pollLimit,
-		})
+	history := tailscalesd.NewHistory(historyLimit)
+	removed := tailscalesd.NewRemovedDevices(removedRefreshes)
+	var changelog *tailscalesd.Changelog
+	if changelogFile != "" {
+		if changelog, err = tailscalesd.NewChangelog(changelogFile, changelogMaxBytes, changelogBackups); err != nil {
+			log.Printf("Failed opening -changelog_file: %v", err)
+			return 1
+		}
+		defer changelog.Close()
+	}
+	if portScan {
+		sources = scanning(sources, cfg)
+	}
+	sources, limited := rateLimited(sources, history, removed, changelog)
+	if snapshotFile != "" {
+		n, err := primeFromFile(snapshotFile, limited)
+		if err != nil {
+			log.Printf("Failed priming cache from %q, continuing cold: %v", snapshotFile, err)
+		} else {
+			log.Printf("Primed %d of %d sources from %q", n, len(limited), snapshotFile)
+		}
+		go persistSnapshots(ctx, snapshotFile, limited)
+	}
+	if snapshotPeer != "" {
+		n, err := primeFromPeer(ctx, snapshotPeer, authToken, limited)
+		if err != nil {
+			log.Printf("Failed priming cache from %q, continuing cold: %v", snapshotPeer, err)
+		} else {
+			log.Printf("Primed %d of %d sources from %q", n, len(limited), snapshotPeer)
+		}
 	}
 
-	if clientId != "" && clientSecret != "" {
-		ts = append(ts, &tailscalesd.RateLimitedDiscoverer{
-			Wrap:      tailscalesd.OAuthAPI(clientId, clientSecret),
-			Frequency: pollLimit,
-		})
+	go refreshForReadiness(ctx, readinessRefreshInterval, limited)
+	if netcheckInterval > 0 {
+		if !useLocalAPI {
+			log.Print("-netcheck_interval requires -localapi")
+			return 1
+		}
+		go netcheckEvery(ctx, netcheckInterval, localAPISocket)
+	}
+	if len(gossipPeers) > 0 || gossipTag != "" {
+		go gossip(ctx, gossipInterval, gossipPeers, gossipTag, authToken, limited)
+	}
+	if heartbeatURL != "" {
+		go heartbeat(ctx, heartbeatInt, heartbeatURL, limited)
+	}
+	if updateCheckInt > 0 {
+		go checkForUpdates(ctx, updateCheckInt, latestReleaseURL)
 	}
 
-	var filters []tailscalesd.TargetFilter
-	if !includeIPv6 {
-		filters = append(filters, tailscalesd.FilterIPv6Addresses)
+	// Metrics concerning tailscalesd itself are served from /metrics, as
+	// OpenMetrics when requested, which is needed to expose exemplars.
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	// Service discovery is served at /, and for each tag under
+	// tailscalesd.TagViewPath. Cached results for other replicas at
+	// snapshotPath, recent tag changes at historyPath and recently removed
+	// devices at removedPath. Recently served targets at
+	// tailscalesd.TargetSnapshotsPath, if retained. Spokes allowed by
+	// -inventory_allow fetch results from tailscalesd.InventoryPath.
+	targetSnapshots := tailscalesd.NewTargetSnapshots(snapshotHistory)
+	sd := discoveryHandler(sources, cfg, tailscalesd.WithTargetSnapshots(targetSnapshots))
+	snapshot := tailscalesd.SnapshotHandler(limited)
+	historyHandler := tailscalesd.HistoryHandler(history)
+	removedHandler := tailscalesd.RemovedDevicesHandler(removed)
+	targetSnapshotsHandler := tailscalesd.TargetSnapshotsHandler(targetSnapshots)
+	if authToken != "" {
+		sd = bearerAuth(authToken, sd)
+		snapshot = bearerAuth(authToken, snapshot)
+		historyHandler = bearerAuth(authToken, historyHandler)
+		removedHandler = bearerAuth(authToken, removedHandler)
+		targetSnapshotsHandler = bearerAuth(authToken, targetSnapshotsHandler)
+	}
+	http.Handle("/", sd)
+	http.Handle(tailscalesd.TagViewPath, tailscalesd.TagViews(sd))
+	http.Handle(snapshotPath, snapshot)
+	http.Handle(historyPath, historyHandler)
+	http.Handle(removedPath, removedHandler)
+	if snapshotHistory > 0 {
+		http.Handle(tailscalesd.TargetSnapshotsPath, targetSnapshotsHandler)
+	}
+	if len(inventoryAllow) > 0 {
+		http.Handle(tailscalesd.InventoryPath, whoIsAuth(localWhoIs, inventoryAllow, tailscalesd.SnapshotHandler(limited)))
 	}
 
-	// Metrics concerning tailscalesd itself are served from /metrics
-	http.Handle("/metrics", promhttp.Handler())
-	// Service discovery is served at /
-	http.Handle("/", tailscalesd.Export(ts, filters...))
+	var handler http.Handler = http.DefaultServeMux
+	if basicAuthUser != "" || basicAuthHash != "" {
+		if basicAuthUser == "" || basicAuthHash == "" {
+			log.Print("-basic_auth_username and -basic_auth_password_hash must be used together")
+			return 1
+		}
+		if handler, err = basicAuth(basicAuthUser, basicAuthHash, handler); err != nil {
+			log.Printf("Failed configuring basic auth: %v", err)
+			return 1
+		}
+	}
+	handler = withHealthChecks(readyz(limited, readyFailures, maxStale), handler)
 
-	log.Printf("Serving Tailscale service discovery on %q", address)
-	log.Print(http.ListenAndServe(address, nil))
+	if err := validateWebConfig(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	ln, err := listen(ctx, address)
+	if err != nil {
+		log.Printf("Failed listening: %v", err)
+		return 1
+	}
+	log.Printf("Serving Tailscale service discovery on %q", ln.Addr())
+	if err := serve(ln, handler); err != nil {
+		log.Printf("Failed serving: %v", err)
+		return 1
+	}
 	log.Print("Done")
+	return 0
 }
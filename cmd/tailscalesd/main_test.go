@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+func TestStringListSet(t *testing.T) {
+	var l stringList
+	for _, v := range []string{"one, two", "three", ""} {
+		if err := l.Set(v); err != nil {
+			t.Fatalf("Set: unexpected error: %v", err)
+		}
+	}
+	if diff := cmp.Diff(l, stringList{"one", "two", "three"}); diff != "" {
+		t.Errorf("Set: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestValidateSettingsRejectsUnknownFormat(t *testing.T) {
+	parseSettings([]string{"-localapi", "-formats", "yaml,xml"})
+	defer parseSettings(nil)
+	if err := validateSettings(&fileConfig{}); err == nil {
+		t.Error("validateSettings: expected error for unknown format, got nil")
+	}
+}
+
+func TestValidateSettingsRejectsBadAPIURL(t *testing.T) {
+	for _, u := range []string{"api.tailscale.com", "ftp://api.tailscale.com", "https://"} {
+		parseSettings([]string{"-localapi", "-api_url", u})
+		if err := validateSettings(&fileConfig{}); err == nil {
+			t.Errorf("validateSettings(-api_url %q): expected error, got nil", u)
+		}
+	}
+	parseSettings(nil)
+}
+
+func TestRunServeFailsWithNonZeroExitCode(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "absent.sock")
+	parseSettings([]string{"-localapi", "-localapi_socket", socket, "-startup_probe"})
+	defer parseSettings(nil)
+	if got := runServe(context.Background(), &fileConfig{}); got != 1 {
+		t.Errorf("runServe: exit code mismatch: got: %d want: 1", got)
+	}
+}
+
+func TestServesCachedTargetsWhenRefreshFails(t *testing.T) {
+	parseSettings([]string{"-localapi", "-poll", "0"})
+	defer parseSettings(nil)
+	cfg := &fileConfig{}
+	wrapped := &flakyDiscoverer{}
+	sources, limited := rateLimited([]source{{Name: "source", Discoverer: wrapped}}, nil, nil, nil)
+	t.Cleanup(func() {
+		for _, d := range limited {
+			d.Deregister()
+		}
+	})
+	handler := discoveryHandler(sources, cfg)
+	for _, err := range []error{nil, errors.New("unreachable")} {
+		wrapped.err = err
+		targets, err := fetchTargets(context.Background(), handler, "/")
+		if err != nil {
+			t.Fatalf("fetchTargets: unexpected error: %v", err)
+		}
+		if len(targets) != 1 || !slices.Equal(targets[0].Targets, []string{"100.2.3.4"}) {
+			t.Errorf("fetchTargets: got targets %v, want the cached device", targets)
+		}
+	}
+}
+
+func TestAddressesFromFlags(t *testing.T) {
+	device := tailscalesd.Device{Addresses: []string{"fd7a::1", "100.2.3.4", "fd7a::2", "100.2.3.5"}}
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{want: []string{"100.2.3.4", "100.2.3.5"}},
+		{args: []string{"-ipv6"}, want: device.Addresses},
+		{args: []string{"-ipv6_only"}, want: []string{"fd7a::1", "fd7a::2"}},
+		{args: []string{"-address_policy", "first-v4"}, want: []string{"100.2.3.4"}},
+		{args: []string{"-address_policy", "first-v6"}, want: []string{"fd7a::1"}},
+		{args: []string{"-ipv6_only", "-address_policy", "first-v4"}, want: []string{"fd7a::1"}},
+		{args: []string{"-ipv6", "-address_selector", "prefer-v6"}, want: []string{"fd7a::1", "fd7a::2"}},
+	} {
+		parseSettings(append([]string{"-localapi"}, tc.args...))
+		if err := validateSettings(&fileConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(addresses().SelectAddresses(device), tc.want); diff != "" {
+			t.Errorf("addresses(%v): mismatch (-got, +want):\n%v", tc.args, diff)
+		}
+	}
+	parseSettings(nil)
+}
+
+func TestValidateSettingsRejectsUnknownAddressSelector(t *testing.T) {
+	parseSettings([]string{"-localapi", "-address_selector", "nearest"})
+	defer parseSettings(nil)
+	if err := validateSettings(&fileConfig{}); err == nil {
+		t.Error("validateSettings: expected error for unknown address selector, got nil")
+	}
+}
+
+func TestCommandFor(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		args     []string
+		wantName string
+		wantArgs []string
+	}{
+		"bare":            {wantName: "serve"},
+		"flags only":      {args: []string{"-localapi"}, wantName: "serve", wantArgs: []string{"-localapi"}},
+		"explicit serve":  {args: []string{"serve", "-localapi"}, wantName: "serve", wantArgs: []string{"-localapi"}},
+		"dump":            {args: []string{"dump", "-raw"}, wantName: "dump", wantArgs: []string{"-raw"}},
+		"check-auth":      {args: []string{"check-auth"}, wantName: "check-auth", wantArgs: []string{}},
+		"command as flag": {args: []string{"-localapi", "dump"}, wantName: "serve", wantArgs: []string{"-localapi", "dump"}},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			name, args := commandFor(tc.args)
+			if name != tc.wantName {
+				t.Errorf("commandFor(%q): name mismatch: got: %q want: %q", tc.args, name, tc.wantName)
+			}
+			if diff := cmp.Diff(args, tc.wantArgs); diff != "" {
+				t.Errorf("commandFor(%q): args mismatch (-got, +want):\n%v", tc.args, diff)
+			}
+		})
+	}
+}
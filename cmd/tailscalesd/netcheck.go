@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// netcheckTimeout bounds how long a single netcheck may take.
+const netcheckTimeout = time.Minute
+
+var (
+	netcheckUDPGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_netcheck_udp",
+			Help: "Whether UDP was usable from this node on the most recent netcheck (1) or blocked (0).",
+		})
+
+	netcheckIPv4Gauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_netcheck_ipv4",
+			Help: "Whether IPv4 was usable from this node on the most recent netcheck (1) or not (0).",
+		})
+
+	netcheckIPv6Gauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_netcheck_ipv6",
+			Help: "Whether IPv6 was usable from this node on the most recent netcheck (1) or not (0).",
+		})
+
+	netcheckDERPLatencyGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_netcheck_derp_latency_ms",
+			Help: "Latency from this node to each DERP region on the most recent netcheck, in milliseconds. Labeled with the region code.",
+		},
+		[]string{"region"})
+
+	netcheckPreferredDERPGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_netcheck_preferred_derp",
+			Help: "The DERP region preferred by this node on the most recent netcheck, which has the value 1. Labeled with the region code.",
+		},
+		[]string{"region"})
+
+	netcheckErrorCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_netcheck_errors",
+			Help: "Counter of netchecks which failed to complete.",
+		})
+)
+
+func boolGauge(g prometheus.Gauge, v bool) {
+	if v {
+		g.Set(1)
+		return
+	}
+	g.Set(0)
+}
+
+// recordNetcheck exports the report as metrics, naming DERP regions as in dm.
+func recordNetcheck(dm *tailcfg.DERPMap, report *netcheck.Report) {
+	regionCode := func(id int) string {
+		if r, ok := dm.Regions[id]; ok && r != nil {
+			return r.RegionCode
+		}
+		return fmt.Sprint(id)
+	}
+	boolGauge(netcheckUDPGauge, report.UDP)
+	boolGauge(netcheckIPv4Gauge, report.IPv4)
+	boolGauge(netcheckIPv6Gauge, report.IPv6)
+	netcheckDERPLatencyGauge.Reset()
+	for id, latency := range report.RegionLatency {
+		netcheckDERPLatencyGauge.WithLabelValues(regionCode(id)).Set(float64(latency.Microseconds()) / 1000)
+	}
+	netcheckPreferredDERPGauge.Reset()
+	if report.PreferredDERP != 0 {
+		netcheckPreferredDERPGauge.WithLabelValues(regionCode(report.PreferredDERP)).Set(1)
+	}
+}
+
+// runNetcheck once, using the DERP map from the local API at socket.
+func runNetcheck(ctx context.Context, c *netcheck.Client, socket string) error {
+	ctx, cancel := context.WithTimeout(ctx, netcheckTimeout)
+	defer cancel()
+	lc := &tailscale.LocalClient{Socket: socket, UseSocketOnly: true}
+	dm, err := lc.CurrentDERPMap(ctx)
+	if err != nil {
+		return fmt.Errorf("failed getting DERP map: %w", err)
+	}
+	report, err := c.GetReport(ctx, dm, nil)
+	if err != nil {
+		return err
+	}
+	recordNetcheck(dm, report)
+	return nil
+}
+
+// netcheckEvery interval, exporting the connectivity of this node as metrics,
+// until ctx is done. This distinguishes network problems affecting
+// tailscalesd from those affecting its targets.
+func netcheckEvery(ctx context.Context, interval time.Duration, socket string) {
+	c := &netcheck.Client{Logf: logger.Discard}
+	if err := c.Standalone(ctx, ""); err != nil {
+		log.Printf("Netcheck UDP test failure: %v", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := runNetcheck(ctx, c, socket); err != nil {
+			netcheckErrorCounter.Inc()
+			log.Printf("Netcheck failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+)
+
+func TestRecordNetcheck(t *testing.T) {
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "nyc"},
+			2: {RegionID: 2, RegionCode: "sfo"},
+		},
+	}
+	recordNetcheck(dm, &netcheck.Report{
+		UDP:           true,
+		IPv4:          true,
+		PreferredDERP: 2,
+		RegionLatency: map[int]time.Duration{
+			1: 40 * time.Millisecond,
+			2: 1500 * time.Microsecond,
+		},
+	})
+	for name, tc := range map[string]struct {
+		got, want float64
+	}{
+		"udp":            {testutil.ToFloat64(netcheckUDPGauge), 1},
+		"ipv4":           {testutil.ToFloat64(netcheckIPv4Gauge), 1},
+		"ipv6":           {testutil.ToFloat64(netcheckIPv6Gauge), 0},
+		"nyc latency":    {testutil.ToFloat64(netcheckDERPLatencyGauge.WithLabelValues("nyc")), 40},
+		"sfo latency":    {testutil.ToFloat64(netcheckDERPLatencyGauge.WithLabelValues("sfo")), 1.5},
+		"preferred derp": {testutil.ToFloat64(netcheckPreferredDERPGauge.WithLabelValues("sfo")), 1},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("recordNetcheck: %v mismatch: got: %v want: %v", name, tc.got, tc.want)
+		}
+	}
+	if got := testutil.CollectAndCount(netcheckPreferredDERPGauge); got != 1 {
+		t.Errorf("recordNetcheck: preferred DERP series mismatch: got: %v want: 1", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// whoIser identifies the tailnet node and user behind a remote address, as
+// does the Tailscale local API.
+type whoIser interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// tsnetLocalClient reaches the local API of the tsnet node joined by listen,
+// when -tsnet is used.
+var tsnetLocalClient *tailscale.LocalClient
+
+// localWhoIs returns the local API which knows the tailnet peers connecting to
+// this tailscalesd: that of the tsnet node if there is one, otherwise that of
+// the host's tailscaled.
+func localWhoIs() whoIser {
+	if tsnetLocalClient != nil {
+		return tsnetLocalClient
+	}
+	return &tailscale.LocalClient{Socket: localAPISocket}
+}
+
+// selfStatuser reports the status of this tailnet node, as does the Tailscale
+// local API.
+type selfStatuser interface {
+	StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// localSelf returns the local API of this tailnet node: that of the tsnet node
+// if there is one, otherwise that of the host's tailscaled.
+func localSelf() selfStatuser {
+	if tsnetLocalClient != nil {
+		return tsnetLocalClient
+	}
+	return &tailscale.LocalClient{Socket: localAPISocket}
+}
+
+// whoIsAllowed reports whether the node identified by who carries one of the
+// allowed tags or, if it is untagged, is owned by one of the allowed users.
+func whoIsAllowed(who *apitype.WhoIsResponse, allowed []string) bool {
+	if who == nil || who.Node == nil {
+		return false
+	}
+	if who.Node.IsTagged() {
+		for _, tag := range who.Node.Tags {
+			if slices.Contains(allowed, tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return who.UserProfile != nil && slices.Contains(allowed, who.UserProfile.LoginName)
+}
+
+// whoIsAuth only allows requests to next from tailnet nodes carrying one of
+// the allowed tags, or owned by one of the allowed users, as identified by
+// whois. Requests from outside the tailnet are refused.
+func whoIsAuth(whois func() whoIser, allowed []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, err := whois().WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			log.Printf("Refusing inventory to %v, which could not be identified: %v", r.RemoteAddr, err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !whoIsAllowed(who, allowed) {
+			log.Printf("Refusing inventory to %v, which is not allowed", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
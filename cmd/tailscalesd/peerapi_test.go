@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// whoIsForTest identifies remote addresses from a fixed map.
+type whoIsForTest map[string]*apitype.WhoIsResponse
+
+func (w whoIsForTest) WhoIs(_ context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if who, ok := w[remoteAddr]; ok {
+		return who, nil
+	}
+	return nil, errors.New("no match for IP:port")
+}
+
+func TestWhoIsAuth(t *testing.T) {
+	whois := whoIsForTest{
+		"100.64.0.1:1234": {
+			Node:        &tailcfg.Node{Name: "spoke.example.ts.net.", Tags: []string{"tag:tailscalesd"}},
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		},
+		"100.64.0.2:1234": {
+			Node:        &tailcfg.Node{Name: "web.example.ts.net.", Tags: []string{"tag:web"}},
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		},
+		"100.64.0.3:1234": {
+			Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		},
+		"100.64.0.4:1234": {
+			Node:        &tailcfg.Node{Name: "other.example.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"},
+		},
+	}
+	handler := whoIsAuth(func() whoIser { return whois }, []string{"tag:tailscalesd", "alice@example.com"},
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	for tn, tc := range map[string]struct {
+		remoteAddr string
+		want       int
+	}{
+		"allowed tag":         {remoteAddr: "100.64.0.1:1234", want: http.StatusOK},
+		"other tag":           {remoteAddr: "100.64.0.2:1234", want: http.StatusForbidden},
+		"allowed user":        {remoteAddr: "100.64.0.3:1234", want: http.StatusOK},
+		"other user":          {remoteAddr: "100.64.0.4:1234", want: http.StatusForbidden},
+		"outside the tailnet": {remoteAddr: "192.0.2.1:1234", want: http.StatusForbidden},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/-/inventory", nil)
+			r.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("whoIsAuth: status mismatch: got: %v want: %v", w.Code, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// probeTimeout bounds how long each source may take to respond to a probe.
+const probeTimeout = 30 * time.Second
+
+// source of devices, as configured by the user.
+type source struct {
+	// Name describing the source in human-friendly terms for log messages.
+	Name       string
+	Discoverer tailscalesd.Discoverer
+
+	// Precheck, if set, is run by probes before the Discoverer is used, to
+	// provide clearer explanations of failures.
+	Precheck func() error
+}
+
+// configuredSources returns the sources of devices enabled by the settings
+// and the credentials in cfg.
+func configuredSources(cfg *fileConfig) []source {
+	var (
+		sources    []source
+		publicOpts = []tailscalesd.PublicAPIOption{tailscalesd.WithAPITimeout(apiTimeout)}
+		oauthOpts  = []tailscalesd.OAuthAPIOption{tailscalesd.WithOAuthAPITimeout(apiTimeout)}
+	)
+	if postureAttrs {
+		publicOpts = append(publicOpts, tailscalesd.WithPostureAttributes())
+		oauthOpts = append(oauthOpts, tailscalesd.WithOAuthPostureAttributes())
+	}
+	if apiURL != "" {
+		// The URL was checked when validating settings.
+		if u, err := parseAPIURL(apiURL); err == nil {
+			publicOpts = append(publicOpts, tailscalesd.WithAPIURL(u))
+			oauthOpts = append(oauthOpts, tailscalesd.WithOAuthAPIURL(u))
+		}
+	}
+	if useLocalAPI {
+		localOpts := []tailscalesd.LocalAPIOption{tailscalesd.WithLocalAPITimeout(apiTimeout)}
+		if peerHealth {
+			localOpts = append(localOpts, tailscalesd.WithLocalAPIPeerHealth())
+		}
+		sources = append(sources, source{
+			Name:       fmt.Sprintf("local API via %q", localAPISocket),
+			Discoverer: tailscalesd.LocalAPI(localAPISocket, localOpts...),
+			Precheck: func() error {
+				return checkLocalAPISocket(localAPISocket)
+			},
+		})
+	}
+	if hubURL != "" {
+		sources = append(sources, source{
+			Name:       fmt.Sprintf("hub at %q", hubURL),
+			Discoverer: tailscalesd.Hub(hubURL, nil),
+		})
+	}
+	if token != "" {
+		for _, tailnet := range tailnets {
+			sources = append(sources, source{
+				Name:       fmt.Sprintf("public API for tailnet %q using an API token", tailnet),
+				Discoverer: tailscalesd.PublicAPI(tailnet, token, publicOpts...),
+			})
+		}
+	}
+	if clientId != "" && clientSecret != "" {
+		// The OAuth configuration was checked when it was loaded.
+		extra, _ := cfg.PublicAPI.OAuth.options()
+		sources = append(sources, source{
+			Name:       fmt.Sprintf("public API using OAuth client %q", clientId),
+			Discoverer: tailscalesd.OAuthAPI(clientId, clientSecret, append(slices.Clone(oauthOpts), extra...)...),
+		})
+	}
+	for _, c := range cfg.Credentials {
+		if c.Token != "" {
+			sources = append(sources, source{
+				Name:       fmt.Sprintf("public API for tailnet %q using an API token", c.Tailnet),
+				Discoverer: tailscalesd.PublicAPI(c.Tailnet, c.Token, publicOpts...),
+			})
+			continue
+		}
+		extra, _ := c.OAuth.options()
+		opts := append(slices.Clone(oauthOpts), extra...)
+		if c.Tailnet != "" {
+			opts = append(opts, tailscalesd.WithOAuthTailnet(c.Tailnet))
+		}
+		sources = append(sources, source{
+			Name:       fmt.Sprintf("public API using OAuth client %q", c.ClientID),
+			Discoverer: tailscalesd.OAuthAPI(c.ClientID, c.ClientSecret, opts...),
+		})
+	}
+	return sources
+}
+
+// checkLocalAPISocket explains the most common reasons the local API socket
+// cannot be used, which are otherwise reported as opaque dial errors.
+func checkLocalAPISocket(path string) error {
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("socket %q does not exist; is tailscaled running on this host?", path)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("permission denied accessing socket %q; does this user have access to it?", path)
+	case err != nil:
+		return err
+	case info.Mode()&fs.ModeSocket == 0:
+		return fmt.Errorf("%q exists but is not a Unix domain socket", path)
+	}
+	return nil
+}
+
+// probe a single source, returning the number of devices discovered.
+func probe(ctx context.Context, s source) (int, error) {
+	if s.Precheck != nil {
+		if err := s.Precheck(); err != nil {
+			return 0, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	devices, err := s.Discoverer.Devices(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(devices), nil
+}
+
+// probeSources checks that every source is reachable and accepts the
+// configured credentials. Each failure is logged, and an error is returned if
+// any source failed.
+func probeSources(ctx context.Context, sources []source) error {
+	var failed int
+	for _, s := range sources {
+		n, err := probe(ctx, s)
+		if err != nil {
+			log.Printf("Probe of %v failed: %v", s.Name, err)
+			failed++
+			continue
+		}
+		log.Printf("Probe of %v succeeded: discovered %d devices", s.Name, n)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sources failed probing", failed, len(sources))
+	}
+	return nil
+}
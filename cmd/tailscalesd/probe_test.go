@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLocalAPISocket(t *testing.T) {
+	dir := t.TempDir()
+
+	regular := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regular, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "tailscaled.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for tn, tc := range map[string]struct {
+		path    string
+		wantErr bool
+	}{
+		"missing socket": {
+			path:    filepath.Join(dir, "missing"),
+			wantErr: true,
+		},
+		"regular file": {
+			path:    regular,
+			wantErr: true,
+		},
+		"socket": {
+			path: socket,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			err := checkLocalAPISocket(tc.path)
+			if got, want := err != nil, tc.wantErr; got != want {
+				t.Errorf("checkLocalAPISocket: error mismatch: got: %v want error: %v", err, want)
+			}
+		})
+	}
+}
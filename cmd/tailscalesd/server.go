@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/prometheus/exporter-toolkit/web"
+	"tailscale.com/tsnet"
+)
+
+// tlsConfig for the server, or nil if TLS is not configured. When a client CA
+// bundle is configured, clients must present a certificate signed by one of
+// its CAs.
+func tlsConfig() (*tls.Config, error) {
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		if tlsClientCAFile != "" {
+			return nil, errors.New("-tls_client_ca_file requires -tls_cert_file and -tls_key_file")
+		}
+		return nil, nil
+	}
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return nil, errors.New("-tls_cert_file and -tls_key_file must be used together")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading TLS key pair: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if tlsClientCAFile != "" {
+		pem, err := os.ReadFile(tlsClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA bundle %q", tlsClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket
+// activation. See sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+// activationListener returns the listener passed by systemd socket activation,
+// or nil if the process was not socket activated.
+func activationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("expected a single socket from systemd, got %d", n)
+	}
+	// Don't pass the sockets on to any child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(sdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed using socket from systemd: %w", err)
+	}
+	return ln, nil
+}
+
+// listen on addr, either on the host's network or, when enabled, on the
+// tailnet only using tsnet. When socket activated by systemd, the socket it
+// passes is used instead of addr.
+func listen(ctx context.Context, addr string) (net.Listener, error) {
+	if !useTSNet {
+		ln, err := activationListener()
+		if err != nil || ln != nil {
+			return ln, err
+		}
+		return net.Listen("tcp", addr)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ts := &tsnet.Server{
+		Hostname: tsnetHostname,
+		Dir:      tsnetStateDir,
+		// The backend logs are very chatty. User-facing messages, such as
+		// login URLs, are still logged.
+		Logf: func(string, ...any) {},
+	}
+	status, err := ts.Up(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed joining the tailnet: %w", err)
+	}
+	if status.Self != nil {
+		log.Printf("Joined the tailnet as %q", status.Self.DNSName)
+	}
+	if tsnetLocalClient, err = ts.LocalClient(); err != nil {
+		return nil, err
+	}
+	return ts.Listen("tcp", ":"+port)
+}
+
+// validateWebConfig checks the -web.config.file, if any, which configures TLS
+// and basic auth in place of the flags for them.
+func validateWebConfig() error {
+	if webConfigFile == "" {
+		return nil
+	}
+	if tlsCertFile != "" || tlsKeyFile != "" || tlsClientCAFile != "" || basicAuthUser != "" || basicAuthHash != "" {
+		return errors.New("-web.config.file cannot be used with the -tls_* or -basic_auth_* flags")
+	}
+	if err := web.Validate(webConfigFile); err != nil {
+		return fmt.Errorf("invalid -web.config.file: %w", err)
+	}
+	return nil
+}
+
+// serve handler on ln, using TLS if configured. With -web.config.file, TLS and
+// basic auth are configured by the exporter-toolkit web configuration file
+// instead, which is reloaded as it changes, as in other Prometheus exporters.
+func serve(ln net.Listener, handler http.Handler) error {
+	if webConfigFile != "" {
+		srv := &http.Server{Handler: handler}
+		return web.Serve(ln, srv, &web.FlagConfig{WebConfigFile: &webConfigFile}, kitlog.NewLogfmtLogger(log.Writer()))
+	}
+	tc, err := tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:   handler,
+		TLSConfig: tc,
+	}
+	if tc == nil {
+		return srv.Serve(ln)
+	}
+	// Certificates are already loaded into the TLSConfig.
+	return srv.ServeTLS(ln, "", "")
+}
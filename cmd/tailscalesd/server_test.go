@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTLSConfigRejectsIncompleteSettings(t *testing.T) {
+	defer func(c, k, ca string) {
+		tlsCertFile, tlsKeyFile, tlsClientCAFile = c, k, ca
+	}(tlsCertFile, tlsKeyFile, tlsClientCAFile)
+
+	for tn, tc := range map[string]struct {
+		cert, key, ca string
+		wantErr       bool
+	}{
+		"nothing configured":    {},
+		"cert without key":      {cert: "cert.pem", wantErr: true},
+		"key without cert":      {key: "key.pem", wantErr: true},
+		"client CA without tls": {ca: "ca.pem", wantErr: true},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			tlsCertFile, tlsKeyFile, tlsClientCAFile = tc.cert, tc.key, tc.ca
+			cfg, err := tlsConfig()
+			if got, want := err != nil, tc.wantErr; got != want {
+				t.Errorf("tlsConfig: error mismatch: got: %v want error: %v", err, want)
+			}
+			if cfg != nil {
+				t.Errorf("tlsConfig: unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestActivationListenerIgnoresOtherProcesses(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	ln, err := activationListener()
+	if err != nil {
+		t.Fatalf("activationListener: unexpected error: %v", err)
+	}
+	if ln != nil {
+		t.Errorf("activationListener: unexpected listener for another process: %v", ln.Addr())
+	}
+}
+
+// webConfigForTest writes a web configuration file requiring basic auth as
+// user "prometheus" with password "secret".
+func webConfigForTest(t *testing.T) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "web.yml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateWebConfig(t *testing.T) {
+	defer func(w, c, u string) {
+		webConfigFile, tlsCertFile, basicAuthUser = w, c, u
+	}(webConfigFile, tlsCertFile, basicAuthUser)
+	valid := webConfigForTest(t)
+	missing := filepath.Join(t.TempDir(), "missing.yml")
+
+	for tn, tc := range map[string]struct {
+		file, cert, user string
+		wantErr          bool
+	}{
+		"not configured":     {},
+		"valid":              {file: valid},
+		"missing file":       {file: missing, wantErr: true},
+		"with TLS flags":     {file: valid, cert: "cert.pem", wantErr: true},
+		"with basic auth":    {file: valid, user: "prometheus", wantErr: true},
+		"flags without file": {cert: "cert.pem", user: "prometheus"},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			webConfigFile, tlsCertFile, basicAuthUser = tc.file, tc.cert, tc.user
+			err := validateWebConfig()
+			if got, want := err != nil, tc.wantErr; got != want {
+				t.Errorf("validateWebConfig: error mismatch: got: %v want error: %v", err, want)
+			}
+		})
+	}
+}
+
+func TestServeWithWebConfig(t *testing.T) {
+	defer func(w string) { webConfigFile = w }(webConfigFile)
+	webConfigFile = webConfigForTest(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serve(ln, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	for tn, tc := range map[string]struct {
+		user, password string
+		want           int
+	}{
+		"no credentials": {want: http.StatusUnauthorized},
+		"wrong password": {user: "prometheus", password: "wrong", want: http.StatusUnauthorized},
+		"authorized":     {user: "prometheus", password: "secret", want: http.StatusOK},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("serve: status mismatch: got: %v want: %v", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
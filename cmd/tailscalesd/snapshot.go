@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// snapshotTimeout bounds how long to wait for a peer's snapshot on startup.
+const snapshotTimeout = 10 * time.Second
+
+// snapshotPath is the path on which snapshots are served to peers.
+const snapshotPath = "/-/snapshot"
+
+// snapshotFileInterval is how often to check whether the -snapshot_file needs
+// saving. It is only written when results have been refreshed.
+const snapshotFileInterval = 10 * time.Second
+
+// historyPath is the path on which recent tag changes are served.
+const historyPath = "/debug/history"
+
+// historyLimit is the number of tag changes retained for each device.
+const historyLimit = 32
+
+// removedPath is the path on which recently removed devices are served.
+const removedPath = "/debug/recently-removed"
+
+// removedRefreshes is the number of refreshes for which removed devices are
+// remembered.
+const removedRefreshes = 10
+
+// Rotation of the -changelog_file.
+const (
+	changelogMaxBytes = 10 << 20
+	changelogBackups  = 3
+)
+
+// rateLimited wraps the Discoverer of each source to poll no more frequently
+// than the poll limit, recording tag changes in history, disappearing devices
+// in removed and every refresh in changelog. The wrapping discoverers are also
+// returned keyed by source name, for use in snapshots.
+func rateLimited(sources []source, history *tailscalesd.History, removed *tailscalesd.RemovedDevices, changelog *tailscalesd.Changelog) ([]source, map[string]*tailscalesd.RateLimitedDiscoverer) {
+	limited := make([]source, len(sources))
+	byName := make(map[string]*tailscalesd.RateLimitedDiscoverer, len(sources))
+	for i, s := range sources {
+		wrapped := s.Discoverer
+		if circuitCooldown > 0 {
+			wrapped = &tailscalesd.CircuitBreakerDiscoverer{
+				Wrap:     wrapped,
+				Cooldown: circuitCooldown,
+				Name:     s.Name,
+			}
+		}
+		d := &tailscalesd.RateLimitedDiscoverer{
+			Wrap:      wrapped,
+			Frequency: pollLimit,
+			Jitter:    pollJitter,
+			MaxStale:  maxStale,
+			Timeout:   apiTimeout,
+			History:   history,
+			Removed:   removed,
+			Changelog: changelog,
+			Name:      s.Name,
+		}
+		limited[i] = s
+		limited[i].Discoverer = d
+		byName[s.Name] = d
+	}
+	return limited, byName
+}
+
+// primeFromPeer fetches a snapshot from the tailscalesd serving at peer,
+// priming discoverers with it. authToken is presented as a bearer token, if
+// set. Returns the number of discoverers primed.
+func primeFromPeer(ctx context.Context, peer, authToken string, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+	url := strings.TrimSuffix(peer, "/") + snapshotPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("peer responded %v", resp.Status)
+	}
+	snapshot, err := tailscalesd.ReadSnapshot(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return snapshot.Prime(discoverers), nil
+}
+
+// primeFromFile primes discoverers with the snapshot saved at path by a
+// previous run. A missing file primes none, without error. Returns the number
+// of discoverers primed.
+func primeFromFile(path string, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) (int, error) {
+	snapshot, err := tailscalesd.ReadSnapshotFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return snapshot.Prime(discoverers), nil
+}
+
+// saveSnapshot of discoverers to path, unless it is unchanged since saved,
+// the previously saved snapshot. Returns the snapshot now saved.
+func saveSnapshot(path string, saved tailscalesd.Snapshot, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) (tailscalesd.Snapshot, error) {
+	snapshot := tailscalesd.TakeSnapshot(discoverers)
+	if len(snapshot) == 0 || maps.EqualFunc(snapshot, saved, func(a, b tailscalesd.SnapshotEntry) bool {
+		return a.Refreshed.Equal(b.Refreshed)
+	}) {
+		return saved, nil
+	}
+	if err := tailscalesd.WriteSnapshotFile(path, snapshot); err != nil {
+		return saved, err
+	}
+	return snapshot, nil
+}
+
+// persistSnapshots saves a snapshot of discoverers to path whenever their
+// results are refreshed, until the context is done, so that a restart while
+// the Tailscale APIs are unavailable still serves the last known devices.
+// Failures are logged.
+func persistSnapshots(ctx context.Context, path string, discoverers map[string]*tailscalesd.RateLimitedDiscoverer) {
+	ticker := time.NewTicker(snapshotFileInterval)
+	defer ticker.Stop()
+	var saved tailscalesd.Snapshot
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var err error
+		if saved, err = saveSnapshot(path, saved, discoverers); err != nil {
+			log.Printf("Failed saving snapshot to %q: %v", path, err)
+		}
+	}
+}
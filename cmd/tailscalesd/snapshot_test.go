@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+type staticDiscoverer []tailscalesd.Device
+
+func (d staticDiscoverer) Devices(context.Context) ([]tailscalesd.Device, error) {
+	return d, nil
+}
+
+func TestPrimeFromPeer(t *testing.T) {
+	warm := &tailscalesd.RateLimitedDiscoverer{
+		Wrap:      staticDiscoverer{{ID: "id"}},
+		Frequency: time.Hour,
+	}
+	if _, err := warm.Devices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(snapshotPath, bearerAuth("sekret", tailscalesd.SnapshotHandler(
+		map[string]*tailscalesd.RateLimitedDiscoverer{"source": warm})))
+	peer := httptest.NewServer(mux)
+	defer peer.Close()
+
+	if _, err := primeFromPeer(context.Background(), peer.URL, "wrong", nil); err == nil {
+		t.Error("primeFromPeer: expected error with the wrong token, got nil")
+	}
+
+	cold := &tailscalesd.RateLimitedDiscoverer{
+		Wrap:      staticDiscoverer{},
+		Frequency: time.Hour,
+	}
+	n, err := primeFromPeer(context.Background(), peer.URL+"/", "sekret",
+		map[string]*tailscalesd.RateLimitedDiscoverer{"source": cold})
+	if err != nil {
+		t.Fatalf("primeFromPeer: unexpected error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("primeFromPeer: primed mismatch: got: %v want: 1", n)
+	}
+	if devices, _, _ := cold.Cached(); len(devices) != 1 {
+		t.Errorf("primeFromPeer: cached devices mismatch: got: %v want: 1", len(devices))
+	}
+}
+
+func TestSnapshotFileSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	cold := func() map[string]*tailscalesd.RateLimitedDiscoverer {
+		return map[string]*tailscalesd.RateLimitedDiscoverer{"source": {
+			Wrap:      staticDiscoverer{},
+			Frequency: time.Hour,
+		}}
+	}
+	if n, err := primeFromFile(path, cold()); err != nil || n != 0 {
+		t.Errorf("primeFromFile: want nothing primed without error from missing file, got: %v, %v", n, err)
+	}
+
+	warm := &tailscalesd.RateLimitedDiscoverer{
+		Wrap:      staticDiscoverer{{ID: "id"}},
+		Frequency: time.Hour,
+	}
+	discoverers := map[string]*tailscalesd.RateLimitedDiscoverer{"source": warm}
+	saved, err := saveSnapshot(path, nil, discoverers)
+	if err != nil || saved != nil {
+		t.Fatalf("saveSnapshot: want nothing saved before the first refresh, got: %v, %v", saved, err)
+	}
+	if _, err := warm.Devices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err = saveSnapshot(path, saved, discoverers); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 {
+		t.Fatalf("saveSnapshot: saved mismatch: got: %v want: 1 entry", saved)
+	}
+	// Unchanged results are not written again.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err = saveSnapshot(path, saved, discoverers); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("saveSnapshot: want unchanged snapshot not rewritten, got: %v", err)
+	}
+	if _, err := saveSnapshot(path, nil, discoverers); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := cold()
+	n, err := primeFromFile(path, restarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("primeFromFile: primed mismatch: got: %v want: 1", n)
+	}
+	if devices, _, _ := restarted["source"].Cached(); len(devices) != 1 {
+		t.Errorf("primeFromFile: cached devices mismatch: got: %v want: 1", len(devices))
+	}
+}
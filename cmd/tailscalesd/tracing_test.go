@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetupTracingExportsSpans(t *testing.T) {
+	exported := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case exported <- r.URL.Path:
+		default:
+		}
+	}))
+	defer collector.Close()
+
+	tp, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagator)
+	}()
+	shutdown, err := setupTracing(context.TODO(), collector.URL+"/v1/traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(context.TODO(), "test")
+	span.End()
+	if err := shutdown(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case path := <-exported:
+		if want := "/v1/traces"; path != want {
+			t.Errorf("setupTracing: export path mismatch: got: %q want: %q", path, want)
+		}
+	default:
+		t.Error("setupTracing: no spans exported on shutdown")
+	}
+}
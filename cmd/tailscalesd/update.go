@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// latestReleaseURL of the GitHub API, describing the latest published release.
+const latestReleaseURL = "https://api.github.com/repos/cfunkhouser/tailscalesd/releases/latest"
+
+// updateCheckTimeout bounds how long each update check may take.
+const updateCheckTimeout = 30 * time.Second
+
+var updateAvailableGauge = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "tailscalesd_update_available",
+		Help: "Whether a release newer than the running version was published (1) or not (0), as of the most recent check. Labeled with the running and latest versions.",
+	},
+	[]string{"version", "latest"})
+
+// latestRelease published, such as "v0.5.0", according to the GitHub API at
+// url.
+func latestRelease(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, updateCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode / 100) != 2 {
+		return "", fmt.Errorf("release lookup failed: %v", resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	if release.TagName == "" {
+		return "", fmt.Errorf("release has no tag")
+	}
+	return release.TagName, nil
+}
+
+// parseVersion such as "v1.2.3" or "1.2.3-rc.1" into its numeric components,
+// ignoring any pre-release or build suffix.
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// newerVersion reports whether latest is newer than running. Versions which
+// cannot be compared, such as development builds, are never outdated.
+func newerVersion(running, latest string) bool {
+	r, ok := parseVersion(running)
+	if !ok {
+		return false
+	}
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	for i := range r {
+		if l[i] != r[i] {
+			return l[i] > r[i]
+		}
+	}
+	return false
+}
+
+// checkForUpdate once, comparing the running version against the latest
+// release at url, and exporting the result as tailscalesd_update_available.
+func checkForUpdate(ctx context.Context, url string) error {
+	latest, err := latestRelease(ctx, url)
+	if err != nil {
+		return err
+	}
+	available := newerVersion(Version, latest)
+	updateAvailableGauge.Reset()
+	boolGauge(updateAvailableGauge.WithLabelValues(Version, latest), available)
+	if available {
+		log.Printf("tailscalesd %v is available, running %v", latest, Version)
+	}
+	return nil
+}
+
+// checkForUpdates every interval until ctx is done, so that outdated
+// instances can be noticed from their metrics. Failures are logged.
+func checkForUpdates(ctx context.Context, interval time.Duration, url string) {
+	if _, ok := parseVersion(Version); !ok {
+		log.Printf("Not checking for updates of version %q, which is not a release", Version)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := checkForUpdate(ctx, url); err != nil {
+			log.Printf("Failed checking for updates: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		running, latest string
+		want            bool
+	}{
+		{running: "v0.4.0", latest: "v0.5.0", want: true},
+		{running: "v0.4.9", latest: "v0.4.10", want: true},
+		{running: "0.4.0", latest: "v1.0.0", want: true},
+		{running: "v0.5.0", latest: "v0.5.0"},
+		{running: "v0.6.0", latest: "v0.5.0"},
+		{running: "v0.5.0-rc.1", latest: "v0.5.0"},
+		{running: "development", latest: "v0.5.0"},
+		{running: "v0.5.0", latest: "nightly"},
+	} {
+		if got := newerVersion(tc.running, tc.latest); got != tc.want {
+			t.Errorf("newerVersion(%q, %q): got: %v want: %v", tc.running, tc.latest, got, tc.want)
+		}
+	}
+}
+
+func TestCheckForUpdate(t *testing.T) {
+	latest := "v0.5.0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintf(w, `{"tag_name":%q,"name":"tailscalesd %v"}`, latest, latest)
+	}))
+	defer server.Close()
+	was := Version
+	defer func() { Version = was }()
+	Version = "v0.4.0"
+
+	if err := checkForUpdate(context.TODO(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(updateAvailableGauge.WithLabelValues("v0.4.0", "v0.5.0")); got != 1 {
+		t.Errorf("checkForUpdate: tailscalesd_update_available mismatch: got: %v want: 1", got)
+	}
+
+	Version = "v0.5.0"
+	if err := checkForUpdate(context.TODO(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(updateAvailableGauge); got != 1 {
+		t.Errorf("checkForUpdate: want only the latest check exported, got %d series", got)
+	}
+	if got := testutil.ToFloat64(updateAvailableGauge.WithLabelValues("v0.5.0", "v0.5.0")); got != 0 {
+		t.Errorf("checkForUpdate: tailscalesd_update_available mismatch: got: %v want: 0", got)
+	}
+}
+
+func TestCheckForUpdateReportsFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	if err := checkForUpdate(context.TODO(), server.URL); err == nil {
+		t.Error("checkForUpdate: want error for failed release lookup")
+	}
+}
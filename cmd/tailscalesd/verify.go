@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v3"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// verifyTimeout bounds how long fetching the configuration of Prometheus may
+// take.
+const verifyTimeout = 10 * time.Second
+
+// scrapeConfig is the subset of a Prometheus scrape configuration needed to
+// determine the targets it would scrape from HTTP service discovery.
+type scrapeConfig struct {
+	JobName       string `yaml:"job_name"`
+	Scheme        string `yaml:"scheme"`
+	MetricsPath   string `yaml:"metrics_path"`
+	HTTPSDConfigs []struct {
+		URL string `yaml:"url"`
+	} `yaml:"http_sd_configs"`
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+}
+
+// fetchScrapeConfigs from the running configuration of the Prometheus server
+// at prometheusURL.
+func fetchScrapeConfigs(ctx context.Context, prometheusURL string) ([]scrapeConfig, error) {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(prometheusURL, "/")+"/api/v1/status/config", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode / 100) != 2 {
+		return nil, fmt.Errorf("fetching configuration failed: %v", resp.Status)
+	}
+	var status struct {
+		Data struct {
+			YAML string `json:"yaml"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return parseScrapeConfigs(status.Data.YAML)
+}
+
+// parseScrapeConfigs from the YAML configuration of a Prometheus server.
+func parseScrapeConfigs(text string) ([]scrapeConfig, error) {
+	var config struct {
+		ScrapeConfigs []scrapeConfig `yaml:"scrape_configs"`
+	}
+	if err := yaml.Unmarshal([]byte(text), &config); err != nil {
+		return nil, fmt.Errorf("parsing configuration: %w", err)
+	}
+	return config.ScrapeConfigs, nil
+}
+
+// scrapeTargets returns the label sets of the targets which Prometheus would
+// scrape for the discovered target groups, after applying the relabeling
+// configuration of sc in the same way. Targets which are relabeled to have the
+// same labels are scraped once, so are returned once.
+func scrapeTargets(sc scrapeConfig, groups []tailscalesd.TargetDescriptor) []labels.Labels {
+	scheme, metricsPath := sc.Scheme, sc.MetricsPath
+	if scheme == "" {
+		scheme = "http"
+	}
+	if metricsPath == "" {
+		metricsPath = "/metrics"
+	}
+	seen := make(map[uint64]bool)
+	var scraped []labels.Labels
+	for _, td := range groups {
+		for _, target := range td.Targets {
+			lb := labels.NewBuilder(labels.FromMap(td.Labels))
+			lb.Set("__address__", target)
+			for name, value := range map[string]string{
+				"job":              sc.JobName,
+				"__scheme__":       scheme,
+				"__metrics_path__": metricsPath,
+			} {
+				if lb.Get(name) == "" {
+					lb.Set(name, value)
+				}
+			}
+			if !relabel.ProcessBuilder(lb, sc.RelabelConfigs...) || lb.Get("__address__") == "" {
+				continue
+			}
+			// As in Prometheus, meta labels are only available to relabeling,
+			// and the instance defaults to the address.
+			lbls := lb.Labels()
+			lbls.Range(func(l labels.Label) {
+				if strings.HasPrefix(l.Name, "__meta_") {
+					lb.Del(l.Name)
+				}
+			})
+			if lb.Get(labels.InstanceName) == "" {
+				lb.Set(labels.InstanceName, lb.Get("__address__"))
+			}
+			lbls = lb.Labels()
+			if h := lbls.Hash(); !seen[h] {
+				seen[h] = true
+				scraped = append(scraped, lbls)
+			}
+		}
+	}
+	return scraped
+}
+
+// discoveryRequest returns the request target at which the tailscalesd HTTP
+// service discovery URL sdURL is served, such as "/?tag=prom".
+func discoveryRequest(sdURL string) (string, error) {
+	u, err := url.Parse(sdURL)
+	if err != nil {
+		return "", err
+	}
+	return u.RequestURI(), nil
+}
+
+// verifyJobs writes a table of the number of targets discovered and finally
+// scraped by each job in scrapeConfigs using HTTP service discovery, when
+// discovering from h. Returns the number of jobs left without any targets.
+func verifyJobs(ctx context.Context, w io.Writer, h http.Handler, scrapeConfigs []scrapeConfig) (int, error) {
+	empty := 0
+	rows := [][]string{{"JOB", "DISCOVERED", "DROPPED", "TARGETS"}}
+	for _, sc := range scrapeConfigs {
+		if len(sc.HTTPSDConfigs) == 0 {
+			continue
+		}
+		var discovered, scraped int
+		for _, sd := range sc.HTTPSDConfigs {
+			target, err := discoveryRequest(sd.URL)
+			if err != nil {
+				return 0, fmt.Errorf("job %q: %w", sc.JobName, err)
+			}
+			groups, err := fetchTargets(ctx, h, target)
+			if err != nil {
+				return 0, fmt.Errorf("job %q: %w", sc.JobName, err)
+			}
+			for _, td := range groups {
+				discovered += len(td.Targets)
+			}
+			scraped += len(scrapeTargets(sc, groups))
+		}
+		if scraped == 0 {
+			empty++
+		}
+		rows = append(rows, []string{
+			sc.JobName,
+			strconv.Itoa(discovered),
+			strconv.Itoa(discovered - scraped),
+			strconv.Itoa(scraped),
+		})
+	}
+	if len(rows) == 1 {
+		return 0, fmt.Errorf("no jobs use HTTP service discovery")
+	}
+	writeTable(w, rows, func(row, _ int) string { return "" })
+	return empty, nil
+}
+
+// runVerify performs discovery once using the settings and cfg, then applies
+// the relabeling configured in the Prometheus server at -prometheus_url to the
+// targets, printing how many each job using HTTP service discovery would
+// scrape. Every such job is assumed to discover from tailscalesd. Returns the
+// exit code: 0 on success, 1 if any job would scrape no targets, and 2 on
+// error.
+func runVerify(ctx context.Context, w io.Writer, cfg *fileConfig) int {
+	if prometheusURL == "" {
+		log.Print("The verify subcommand requires -prometheus_url")
+		return 2
+	}
+	scrapeConfigs, err := fetchScrapeConfigs(ctx, prometheusURL)
+	if err != nil {
+		log.Printf("Failed fetching Prometheus configuration: %v", err)
+		return 2
+	}
+	sd := discoveryHandler(configuredSources(cfg), cfg)
+	mux := http.NewServeMux()
+	mux.Handle("/", sd)
+	mux.Handle(tailscalesd.TagViewPath, tailscalesd.TagViews(sd))
+	empty, err := verifyJobs(ctx, w, mux, scrapeConfigs)
+	if err != nil {
+		log.Printf("Failed verification: %v", err)
+		return 2
+	}
+	if empty > 0 {
+		log.Printf("%d jobs would scrape no targets", empty)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+const prometheusConfigForTest = `
+global:
+  scrape_interval: 1m
+scrape_configs:
+- job_name: prometheus
+  static_configs:
+  - targets: [localhost:9090]
+- job_name: node
+  http_sd_configs:
+  - url: http://tailscalesd:9242/targets/tag/node
+  relabel_configs:
+  - source_labels: [__meta_tailscale_device_hostname]
+    target_label: instance
+- job_name: misconfigured
+  http_sd_configs:
+  - url: http://tailscalesd:9242/?os=linux
+  relabel_configs:
+  - source_labels: [__meta_tailscale_device_os]
+    regex: windows
+    action: keep
+`
+
+func TestVerifyJobs(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/status/config" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"status": "success",
+			"data":   map[string]string{"yaml": prometheusConfigForTest},
+		})
+	}))
+	defer prometheus.Close()
+
+	scrapeConfigs, err := fetchScrapeConfigs(context.TODO(), prometheus.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := tailscalesd.Export(staticDiscoverer([]tailscalesd.Device{
+		{Hostname: "one", OS: "linux", Addresses: []string{"100.2.3.4"}, Tags: []string{"tag:node"}},
+		{Hostname: "two", OS: "linux", Addresses: []string{"100.2.3.5"}},
+	}))
+	mux := http.NewServeMux()
+	mux.Handle("/", sd)
+	mux.Handle(tailscalesd.TagViewPath, tailscalesd.TagViews(sd))
+
+	var buf bytes.Buffer
+	empty, err := verifyJobs(context.TODO(), &buf, mux, scrapeConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := empty, 1; got != want {
+		t.Errorf("verifyJobs: empty job count mismatch: got: %d want: %d", got, want)
+	}
+	want := `JOB            DISCOVERED  DROPPED  TARGETS
+node           1           0        1
+misconfigured  2           2        0
+`
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("verifyJobs: output mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestScrapeTargetsDeduplicatesRelabeledTargets(t *testing.T) {
+	scrapeConfigs, err := parseScrapeConfigs(`
+scrape_configs:
+- job_name: dedupe
+  http_sd_configs:
+  - url: http://tailscalesd:9242/
+  relabel_configs:
+  - target_label: __address__
+    replacement: same:9100
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := []tailscalesd.TargetDescriptor{
+		{Targets: []string{"100.2.3.4", "100.2.3.5"}, Labels: map[string]string{}},
+	}
+	got := scrapeTargets(scrapeConfigs[0], groups)
+	if len(got) != 1 {
+		t.Fatalf("scrapeTargets: want 1 target, got: %v", got)
+	}
+	want := map[string]string{
+		"__address__":      "same:9100",
+		"__metrics_path__": "/metrics",
+		"__scheme__":       "http",
+		"instance":         "same:9100",
+		"job":              "dedupe",
+	}
+	if diff := cmp.Diff(got[0].Map(), want); diff != "" {
+		t.Errorf("scrapeTargets: labels mismatch (-got, +want):\n%v", diff)
+	}
+}
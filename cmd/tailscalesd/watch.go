@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+// watchTargets calls discover every interval until ctx is done, writing the
+// differences between consecutive results to w as they happen.
+func watchTargets(ctx context.Context, w io.Writer, interval time.Duration, discover func(context.Context) ([]tailscalesd.TargetDescriptor, error)) {
+	var last []tailscalesd.TargetDescriptor
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		targets, err := discover(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Failed discovery: %v", err)
+		case first:
+			log.Printf("Watching %d target groups for changes every %v", len(targets), interval)
+			last = targets
+		default:
+			if n := diffTargets(w, last, targets); n > 0 {
+				log.Printf("%d differences, now %d target groups", n, len(targets))
+			}
+			last = targets
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runWatch performs discovery using the settings and cfg every -poll interval,
+// printing differences in the targets which would be served, until ctx is
+// done. Returns the exit code.
+func runWatch(ctx context.Context, w io.Writer, cfg *fileConfig) int {
+	watchTargets(ctx, w, pollLimit, func(ctx context.Context) ([]tailscalesd.TargetDescriptor, error) {
+		return targetsFrom(ctx, cfg)
+	})
+	return 0
+}
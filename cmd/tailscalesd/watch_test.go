@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cfunkhouser/tailscalesd"
+)
+
+func TestWatchTargets(t *testing.T) {
+	results := []struct {
+		targets []tailscalesd.TargetDescriptor
+		err     error
+	}{
+		{targets: []tailscalesd.TargetDescriptor{{Targets: []string{"100.2.3.4"}}}},
+		{err: errors.New("discovery failed")},
+		{targets: []tailscalesd.TargetDescriptor{{Targets: []string{"100.2.3.4"}}}},
+		{targets: []tailscalesd.TargetDescriptor{{Targets: []string{"100.2.3.5"}}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls int
+	var buf bytes.Buffer
+	watchTargets(ctx, &buf, time.Millisecond, func(context.Context) ([]tailscalesd.TargetDescriptor, error) {
+		r := results[calls]
+		if calls++; calls == len(results) {
+			cancel()
+		}
+		return r.targets, r.err
+	})
+
+	want := "" +
+		`- {"targets":["100.2.3.4"]}` + "\n" +
+		`+ {"targets":["100.2.3.5"]}` + "\n"
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("watchTargets: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestDiffIgnoresVolatileLabels(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	device := tailscalesd.Device{
+		ID:        "one",
+		Hostname:  "foo",
+		Addresses: []string{"100.2.3.4"},
+		Expires:   at.Add(24 * time.Hour),
+	}
+	// Discover and serve the unchanged device at two different times.
+	var results [][]tailscalesd.TargetDescriptor
+	for _, now := range []time.Time{at, at.Add(1100 * time.Millisecond)} {
+		d := device
+		d.DiscoveredAt = now
+		h := tailscalesd.Handler(staticDiscoverer{d}, tailscalesd.WithClock(tailscalesd.ClockFunc(func() time.Time { return now })))
+		targets, err := fetchTargets(context.TODO(), h, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, targets)
+	}
+	if cmp.Equal(results[0], results[1]) {
+		t.Fatalf("translate: want volatile labels to differ, got: %v", results[0])
+	}
+	var buf bytes.Buffer
+	if n := diffTargets(&buf, results[0], results[1]); n != 0 {
+		t.Errorf("diffTargets: want no differences for unchanged devices, got %d:\n%v", n, buf.String())
+	}
+}
@@ -0,0 +1,130 @@
+package tailscalesd
+
+import (
+	"context"
+	"slices"
+)
+
+// DeviceKey returns the keys identifying a device, any one of which it shares
+// with its duplicates. Devices which cannot be identified have no keys.
+type DeviceKey func(Device) []string
+
+// NodeKey identifies devices by their node key, which both APIs report
+// identically for the same node, including when it is shared into several
+// tailnets.
+func NodeKey(d Device) []string {
+	if d.NodeKey == "" {
+		return nil
+	}
+	return []string{"nodekey:" + d.NodeKey}
+}
+
+// DeviceID identifies devices by their ID. The local and public APIs report
+// different IDs for the same device, so this only finds duplicates from
+// overlapping configurations of the same API.
+func DeviceID(d Device) []string {
+	if d.ID == "" {
+		return nil
+	}
+	return []string{"id:" + d.API + "/" + d.ID}
+}
+
+// DeviceAddresses identifies devices by each of their addresses.
+func DeviceAddresses(d Device) []string {
+	keys := make([]string, len(d.Addresses))
+	for i, a := range d.Addresses {
+		keys[i] = "address:" + a
+	}
+	return keys
+}
+
+// DedupingDiscoverer wraps a Discoverer, merging duplicate devices, such as
+// those found by both the local and public APIs, or by overlapping tailnet
+// configurations. By default, devices are duplicates if they share a node
+// key, which happens when the same machine is shared into several of the
+// discovered tailnets. The device from the most preferred tailnet, then API,
+// is kept, and the tags from all of the duplicates are merged into it. Devices
+// without any key are never merged.
+type DedupingDiscoverer struct {
+	Wrap Discoverer
+
+	// Keys identifying duplicate devices, which are duplicates if they share
+	// any key. If empty, NodeKey is used.
+	Keys []DeviceKey
+
+	// PreferTailnets lists tailnets in order of preference. Devices from
+	// tailnets which are not listed are less preferred than those which are,
+	// and otherwise preferred in the order the wrapped Discoverer returns them.
+	PreferTailnets []string
+
+	// PreferAPIs lists the APIs reporting devices, as in their API field, in
+	// order of preference among devices from equally preferred tailnets. For
+	// example, "localhost" prefers devices from the local API.
+	PreferAPIs []string
+}
+
+// rank of v in the preferences, which are preferred over unlisted values.
+func rank(prefer []string, v string) int {
+	if i := slices.Index(prefer, v); i >= 0 {
+		return i
+	}
+	return len(prefer)
+}
+
+func (dd *DedupingDiscoverer) keys(d Device) []string {
+	if len(dd.Keys) == 0 {
+		return NodeKey(d)
+	}
+	var keys []string
+	for _, k := range dd.Keys {
+		keys = append(keys, k(d)...)
+	}
+	return keys
+}
+
+// Devices reported by the wrapped Discoverer, deduplicated.
+func (dd *DedupingDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	devices, err := dd.Wrap.Devices(ctx)
+	if len(devices) == 0 {
+		return devices, err
+	}
+
+	ranked := slices.Clone(devices)
+	slices.SortStableFunc(ranked, func(a, b Device) int {
+		if c := rank(dd.PreferTailnets, a.Tailnet) - rank(dd.PreferTailnets, b.Tailnet); c != 0 {
+			return c
+		}
+		return rank(dd.PreferAPIs, a.API) - rank(dd.PreferAPIs, b.API)
+	})
+	kept := make(map[string]int) // key to index in deduped
+	var deduped []Device
+	for _, d := range ranked {
+		keys := dd.keys(d)
+		i, ok := -1, false
+		for _, k := range keys {
+			if i, ok = kept[k]; ok {
+				break
+			}
+		}
+		if !ok {
+			i = len(deduped)
+			d.Tags = slices.Clone(d.Tags)
+			deduped = append(deduped, d)
+		} else {
+			dedupedDevicesCounter.Inc()
+			for _, tag := range d.Tags {
+				if !slices.Contains(deduped[i].Tags, tag) {
+					deduped[i].Tags = append(deduped[i].Tags, tag)
+				}
+			}
+		}
+		// Keys of duplicates also identify the kept device, so that devices
+		// sharing different keys with each are merged too.
+		for _, k := range keys {
+			if _, ok := kept[k]; !ok {
+				kept[k] = i
+			}
+		}
+	}
+	return deduped, err
+}
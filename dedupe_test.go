@@ -0,0 +1,108 @@
+package tailscalesd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestDedupingDiscoverer(t *testing.T) {
+	devices := []Device{
+		{ID: "a1", NodeKey: "nodekey:a", Tailnet: "one", Tags: []string{"tag:foo"}},
+		{ID: "b1", NodeKey: "nodekey:b", Tailnet: "one"},
+		{ID: "nokey1", Tailnet: "one"},
+		{ID: "a2", NodeKey: "nodekey:a", Tailnet: "two", Tags: []string{"tag:foo", "tag:bar"}},
+		{ID: "nokey2", Tailnet: "two"},
+	}
+	for tn, tc := range map[string]struct {
+		prefer []string
+		want   []Device
+	}{
+		"discovery order wins without preferences": {
+			want: []Device{
+				{ID: "a1", NodeKey: "nodekey:a", Tailnet: "one", Tags: []string{"tag:foo", "tag:bar"}},
+				{ID: "b1", NodeKey: "nodekey:b", Tailnet: "one"},
+				{ID: "nokey1", Tailnet: "one"},
+				{ID: "nokey2", Tailnet: "two"},
+			},
+		},
+		"preferred tailnet wins": {
+			prefer: []string{"two"},
+			want: []Device{
+				{ID: "a2", NodeKey: "nodekey:a", Tailnet: "two", Tags: []string{"tag:foo", "tag:bar"}},
+				{ID: "nokey2", Tailnet: "two"},
+				{ID: "b1", NodeKey: "nodekey:b", Tailnet: "one"},
+				{ID: "nokey1", Tailnet: "one"},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			d := &DedupingDiscoverer{
+				Wrap:           &testDiscoverer{discovered: devices},
+				PreferTailnets: tc.prefer,
+			}
+			got, err := d.Devices(context.TODO())
+			if err != nil {
+				t.Fatalf("DedupingDiscoverer: unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("DedupingDiscoverer: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+	// The wrapped Discoverer's results must not be modified.
+	if diff := cmp.Diff(devices[0].Tags, []string{"tag:foo"}); diff != "" {
+		t.Errorf("DedupingDiscoverer: modified wrapped results (-got, +want):\n%v", diff)
+	}
+}
+
+func TestDedupingDiscovererAcrossAPIs(t *testing.T) {
+	devices := []Device{
+		{ID: "1001", API: "api.tailscale.com", Addresses: []string{"100.64.0.1", "fd7a::1"}, Tags: []string{"tag:web"}},
+		{ID: "1002", API: "api.tailscale.com", Addresses: []string{"100.64.0.2"}},
+		{ID: "1002", API: "api.tailscale.com", Addresses: []string{"100.64.0.2"}, Tags: []string{"tag:db"}},
+		{ID: "nOneCNTRL", API: "localhost", Addresses: []string{"100.64.0.1"}, Tags: []string{"tag:prom"}},
+		{ID: "nTwoCNTRL", API: "localhost", Addresses: []string{"100.64.0.3"}},
+	}
+	for tn, tc := range map[string]struct {
+		keys   []DeviceKey
+		prefer []string
+		want   []Device
+	}{
+		"by id": {
+			keys: []DeviceKey{DeviceID},
+			want: []Device{
+				{ID: "1001", API: "api.tailscale.com", Addresses: []string{"100.64.0.1", "fd7a::1"}, Tags: []string{"tag:web"}},
+				{ID: "1002", API: "api.tailscale.com", Addresses: []string{"100.64.0.2"}, Tags: []string{"tag:db"}},
+				{ID: "nOneCNTRL", API: "localhost", Addresses: []string{"100.64.0.1"}, Tags: []string{"tag:prom"}},
+				{ID: "nTwoCNTRL", API: "localhost", Addresses: []string{"100.64.0.3"}},
+			},
+		},
+		"by address preferring the local API": {
+			keys:   []DeviceKey{DeviceAddresses},
+			prefer: []string{"localhost"},
+			want: []Device{
+				{ID: "nOneCNTRL", API: "localhost", Addresses: []string{"100.64.0.1"}, Tags: []string{"tag:prom", "tag:web"}},
+				{ID: "nTwoCNTRL", API: "localhost", Addresses: []string{"100.64.0.3"}},
+				{ID: "1002", API: "api.tailscale.com", Addresses: []string{"100.64.0.2"}, Tags: []string{"tag:db"}},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			d := &DedupingDiscoverer{
+				Wrap:       &testDiscoverer{discovered: devices},
+				Keys:       tc.keys,
+				PreferAPIs: tc.prefer,
+			}
+			got, err := d.Devices(context.TODO())
+			if err != nil {
+				t.Fatalf("DedupingDiscoverer: unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(got, tc.want, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("DedupingDiscoverer: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package tailscalesd
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxTagSeries bounds the number of tags for which devices are counted in
+// tagDevicesGauge. Devices carrying less common tags are counted under
+// otherTags, once for each such tag, so that a tailnet with many tags cannot
+// overwhelm Prometheus.
+const maxTagSeries = 100
+
+// otherTags labels the devices in tagDevicesGauge carrying tags beyond the
+// maxTagSeries most common. It cannot be confused with a tag, as those are
+// always prefixed with "tag:".
+const otherTags = "other"
+
+// onlineUnknown labels the devices in devicesGauge whose online status is
+// not reported, such as those discovered using OAuth clients.
+const onlineUnknown = "unknown"
+
+// osStatus of a device, identifying a series of devicesGauge. online is
+// "true", "false" or onlineUnknown.
+type osStatus struct {
+	os     string
+	online string
+}
+
+// onlineStatus of the device, as labeled in devicesGauge.
+func onlineStatus(d Device) string {
+	if d.OnlineUnknown {
+		return onlineUnknown
+	}
+	return strconv.FormatBool(d.Online)
+}
+
+// exportDeviceCounts of the devices by OS and online status in devicesGauge,
+// and by tag in tagDevicesGauge, for observing the fleet without a separate
+// exporter.
+func exportDeviceCounts(byStatus map[osStatus]int, byTag map[string]int) {
+	devicesGauge.Reset()
+	for status, n := range byStatus {
+		devicesGauge.WithLabelValues(status.os, status.online).Set(float64(n))
+	}
+
+	tagDevicesGauge.Reset()
+	var other int
+	kept := mostCommon(byTag, maxTagSeries, strings.Compare)
+	for tag, n := range byTag {
+		if !slices.Contains(kept, tag) {
+			other += n
+			continue
+		}
+		tagDevicesGauge.WithLabelValues(tag).Set(float64(n))
+	}
+	if other > 0 {
+		tagDevicesGauge.WithLabelValues(otherTags).Set(float64(other))
+	}
+}
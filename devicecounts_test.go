@@ -0,0 +1,64 @@
+package tailscalesd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordDeviceCounts(t *testing.T) {
+	resetFleetCounts()
+	local, public := &RateLimitedDiscoverer{}, &RateLimitedDiscoverer{}
+	recordFleetCounts(local, []Device{
+		{OS: "linux", Online: true, Tags: []string{"tag:web", "tag:prom", "tag:web"}},
+		{OS: "Linux", Online: true, Tags: []string{"tag:prom"}},
+		{OS: "windows"},
+	})
+	recordFleetCounts(public, []Device{
+		{OS: "linux", Tags: []string{"tag:web"}},
+		{OS: "linux", OnlineUnknown: true, Tags: []string{"tag:web"}},
+	})
+	// Refreshes replace the discoverer's previous counts.
+	recordFleetCounts(local, []Device{
+		{OS: "linux", Online: true, Tags: []string{"tag:web", "tag:prom", "tag:web"}},
+		{OS: "windows"},
+	})
+	for status, want := range map[[2]string]float64{
+		{"linux", "true"}:    1,
+		{"linux", "false"}:   1,
+		{"windows", "false"}: 1,
+		{"linux", "unknown"}: 1,
+	} {
+		if got := testutil.ToFloat64(devicesGauge.WithLabelValues(status[0], status[1])); got != want {
+			t.Errorf("recordFleetCounts: devices %v mismatch: got: %v want: %v", status, got, want)
+		}
+	}
+	for tag, want := range map[string]float64{
+		"tag:web":  3,
+		"tag:prom": 1,
+		"":         1,
+	} {
+		if got := testutil.ToFloat64(tagDevicesGauge.WithLabelValues(tag)); got != want {
+			t.Errorf("recordFleetCounts: devices tagged %q mismatch: got: %v want: %v", tag, got, want)
+		}
+	}
+}
+
+func TestRecordDeviceCountsBoundsTags(t *testing.T) {
+	resetFleetCounts()
+	var devices []Device
+	for i := 0; i < maxTagSeries+10; i++ {
+		devices = append(devices, Device{Tags: []string{"tag:common", fmt.Sprintf("tag:rare%03d", i)}})
+	}
+	recordFleetCounts(&RateLimitedDiscoverer{}, devices)
+	if got := testutil.CollectAndCount(tagDevicesGauge); got != maxTagSeries+1 {
+		t.Errorf("recordFleetCounts: series count mismatch: got: %v want: %v", got, maxTagSeries+1)
+	}
+	if got := testutil.ToFloat64(tagDevicesGauge.WithLabelValues("tag:common")); got != maxTagSeries+10 {
+		t.Errorf("recordFleetCounts: common tag count mismatch: got: %v want: %v", got, maxTagSeries+10)
+	}
+	if got := testutil.ToFloat64(tagDevicesGauge.WithLabelValues(otherTags)); got != 11 {
+		t.Errorf("recordFleetCounts: other tags count mismatch: got: %v want: 11", got)
+	}
+}
@@ -0,0 +1,78 @@
+package tailscalesd
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DeviceFilter reports whether a discovered device should be served.
+type DeviceFilter func(Device) bool
+
+// NamedDeviceFilter associates a name with a DeviceFilter, so that the devices
+// it drops are counted in metrics under that name.
+func NamedDeviceFilter(name string, filter DeviceFilter) DeviceFilter {
+	lv := prometheus.Labels{"filter": name}
+	return func(d Device) bool {
+		if filter(d) {
+			return true
+		}
+		deviceFilterDroppedCounter.With(lv).Inc()
+		return false
+	}
+}
+
+// FilteringDiscoverer wraps a Discoverer, keeping only the devices accepted by
+// all of its Filters.
+type FilteringDiscoverer struct {
+	Wrap    Discoverer
+	Filters []DeviceFilter
+}
+
+func (fd *FilteringDiscoverer) keep(d Device) bool {
+	for _, f := range fd.Filters {
+		if !f(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// Devices reported by the wrapped Discoverer, filtered.
+func (fd *FilteringDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	devices, err := fd.Wrap.Devices(ctx)
+	var kept []Device
+	for _, d := range devices {
+		if fd.keep(d) {
+			kept = append(kept, d)
+		}
+	}
+	return kept, err
+}
+
+// OnlineDevices is a DeviceFilter keeping only devices reported as online, so
+// that dead targets aren't scraped between refreshes. Devices whose online
+// status is unknown, such as those discovered using OAuth clients, are kept,
+// as they may well be online.
+func OnlineDevices(d Device) bool {
+	return d.Online || d.OnlineUnknown
+}
+
+// AuthorizedDevices is a DeviceFilter keeping only devices authorized to join
+// the tailnet. Unauthorized devices are unreachable, so scraping them only
+// produces failures. The local API reports all peers as authorized.
+func AuthorizedDevices(d Device) bool {
+	return d.Authorized
+}
+
+// UnexpiredKeys returns a DeviceFilter dropping devices whose node keys have
+// expired according to the clock, since they cannot be connected to regardless
+// of when they were last seen. Devices whose keys never expire are kept.
+func UnexpiredKeys(clock Clock) DeviceFilter {
+	return func(d Device) bool {
+		if d.KeyExpiryDisabled || d.Expires.IsZero() {
+			return true
+		}
+		return d.Expires.After(clock.Now())
+	}
+}
@@ -0,0 +1,107 @@
+package tailscalesd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFilteringDiscoverer(t *testing.T) {
+	devices := []Device{
+		{ID: "online", Online: true},
+		{ID: "offline", Authorized: true},
+		{ID: "unknown", OnlineUnknown: true},
+	}
+	for tn, tc := range map[string]struct {
+		filters []DeviceFilter
+		want    []string
+	}{
+		"no filters keeps all": {
+			want: []string{"online", "offline", "unknown"},
+		},
+		"online keeps unknown": {
+			filters: []DeviceFilter{OnlineDevices},
+			want:    []string{"online", "unknown"},
+		},
+		"authorized": {
+			filters: []DeviceFilter{AuthorizedDevices},
+			want:    []string{"offline"},
+		},
+		"all filters must keep": {
+			filters: []DeviceFilter{OnlineDevices, AuthorizedDevices},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			d := &FilteringDiscoverer{
+				Wrap:    &testDiscoverer{discovered: devices},
+				Filters: tc.filters,
+			}
+			got, err := d.Devices(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, d := range got {
+				ids = append(ids, d.ID)
+			}
+			if diff := cmp.Diff(ids, tc.want); diff != "" {
+				t.Errorf("FilteringDiscoverer: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestUnexpiredKeys(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	keep := UnexpiredKeys(ClockFunc(func() time.Time { return now }))
+	for tn, tc := range map[string]struct {
+		device Device
+		want   bool
+	}{
+		"unknown expiry": {
+			want: true,
+		},
+		"expires later": {
+			device: Device{Expires: now.Add(time.Hour)},
+			want:   true,
+		},
+		"expired": {
+			device: Device{Expires: now.Add(-time.Hour)},
+		},
+		"expiry disabled": {
+			device: Device{Expires: now.Add(-time.Hour), KeyExpiryDisabled: true},
+			want:   true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := keep(tc.device); got != tc.want {
+				t.Errorf("UnexpiredKeys: got: %v want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNamedDeviceFilterCountsDrops(t *testing.T) {
+	before := testutil.ToFloat64(deviceFilterDroppedCounter.WithLabelValues("test_online"))
+	d := &FilteringDiscoverer{
+		Wrap: &testDiscoverer{discovered: []Device{
+			{ID: "online", Online: true},
+			{ID: "offline"},
+			{ID: "also offline"},
+		}},
+		Filters: []DeviceFilter{NamedDeviceFilter("test_online", OnlineDevices)},
+	}
+	got, err := d.Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Errorf("NamedDeviceFilter: want 1 device kept, got: %v", got)
+	}
+	if got := testutil.ToFloat64(deviceFilterDroppedCounter.WithLabelValues("test_online")) - before; got != 2 {
+		t.Errorf("NamedDeviceFilter: dropped count mismatch: got: %v want: 2", got)
+	}
+}
@@ -0,0 +1,108 @@
+package tailscalesd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DuplicateHostnamePolicy determines how devices sharing a hostname, such as
+// reinstalled machines which rejoined the tailnet, are served.
+type DuplicateHostnamePolicy int
+
+const (
+	// KeepAllDuplicates devices, serving each as usual.
+	KeepAllDuplicates DuplicateHostnamePolicy = iota
+
+	// KeepLastSeenDuplicate device, preferring online devices, then the most
+	// recently seen, then the most recently created.
+	KeepLastSeenDuplicate
+
+	// IndexDuplicates devices, serving each labeled with its position among
+	// the devices sharing its hostname, oldest first, in
+	// LabelMetaDeviceHostnameIndex.
+	IndexDuplicates
+)
+
+var duplicateHostnamePolicyNames = map[string]DuplicateHostnamePolicy{
+	"all":       KeepAllDuplicates,
+	"last-seen": KeepLastSeenDuplicate,
+	"index":     IndexDuplicates,
+}
+
+// ParseDuplicateHostnamePolicy from its name: "all", "last-seen" or "index".
+func ParseDuplicateHostnamePolicy(name string) (DuplicateHostnamePolicy, error) {
+	if p, ok := duplicateHostnamePolicyNames[name]; ok {
+		return p, nil
+	}
+	return KeepAllDuplicates, fmt.Errorf("unknown policy for duplicate hostnames %q", name)
+}
+
+// compareRecency of devices, ordering the most recently active first.
+func compareRecency(a, b Device) int {
+	if a.Online != b.Online {
+		if a.Online {
+			return -1
+		}
+		return 1
+	}
+	if c := b.LastSeen.Compare(a.LastSeen); c != 0 {
+		return c
+	}
+	if c := b.LastHandshake.Compare(a.LastHandshake); c != 0 {
+		return c
+	}
+	return b.Created.Compare(a.Created)
+}
+
+// applyDuplicateHostnamePolicy to the devices sharing hostnames, compared
+// case-insensitively, returning the devices to serve in the order given.
+// Devices without hostnames are never duplicates.
+func applyDuplicateHostnamePolicy(devices []Device, policy DuplicateHostnamePolicy) []Device {
+	if policy == KeepAllDuplicates {
+		return devices
+	}
+	sharing := make(map[string][]int) // hostname to indexes in devices
+	for i, d := range devices {
+		if d.Hostname != "" {
+			host := strings.ToLower(d.Hostname)
+			sharing[host] = append(sharing[host], i)
+		}
+	}
+	drop := make(map[int]bool)
+	out := slices.Clone(devices)
+	for _, indexes := range sharing {
+		if len(indexes) < 2 {
+			continue
+		}
+		switch policy {
+		case KeepLastSeenDuplicate:
+			kept := slices.MinFunc(indexes, func(a, b int) int {
+				return compareRecency(devices[a], devices[b])
+			})
+			for _, i := range indexes {
+				if i != kept {
+					drop[i] = true
+				}
+			}
+		case IndexDuplicates:
+			oldest := slices.Clone(indexes)
+			slices.SortStableFunc(oldest, func(a, b int) int {
+				return devices[a].Created.Compare(devices[b].Created)
+			})
+			for n, i := range oldest {
+				out[i].HostnameIndex = n + 1
+			}
+		}
+	}
+	if len(drop) == 0 {
+		return out
+	}
+	kept := out[:0]
+	for i, d := range out {
+		if !drop[i] {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,72 @@
+package tailscalesd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApplyDuplicateHostnamePolicy(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	devices := []Device{
+		{ID: "reinstalled", Hostname: "web", Created: created.Add(time.Hour), LastSeen: created.Add(2 * time.Hour)},
+		{ID: "unique", Hostname: "db"},
+		{ID: "original", Hostname: "Web", Created: created, LastSeen: created.Add(time.Hour)},
+		{ID: "anonymous-1"},
+		{ID: "anonymous-2"},
+	}
+	for tn, tc := range map[string]struct {
+		policy DuplicateHostnamePolicy
+		want   []string
+		index  map[string]int
+	}{
+		"all": {
+			policy: KeepAllDuplicates,
+			want:   []string{"reinstalled", "unique", "original", "anonymous-1", "anonymous-2"},
+		},
+		"last seen": {
+			policy: KeepLastSeenDuplicate,
+			want:   []string{"reinstalled", "unique", "anonymous-1", "anonymous-2"},
+		},
+		"index": {
+			policy: IndexDuplicates,
+			want:   []string{"reinstalled", "unique", "original", "anonymous-1", "anonymous-2"},
+			index:  map[string]int{"original": 1, "reinstalled": 2},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			var got []string
+			index := make(map[string]int)
+			for _, d := range applyDuplicateHostnamePolicy(devices, tc.policy) {
+				got = append(got, d.ID)
+				if d.HostnameIndex > 0 {
+					index[d.ID] = d.HostnameIndex
+				}
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("applyDuplicateHostnamePolicy: devices mismatch (-got, +want):\n%v", diff)
+			}
+			if tc.index == nil {
+				tc.index = make(map[string]int)
+			}
+			if diff := cmp.Diff(index, tc.index); diff != "" {
+				t.Errorf("applyDuplicateHostnamePolicy: index mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+	if devices[0].HostnameIndex != 0 {
+		t.Error("applyDuplicateHostnamePolicy: modified its input")
+	}
+}
+
+func TestApplyDuplicateHostnamePolicyPrefersOnline(t *testing.T) {
+	devices := []Device{
+		{ID: "seen", Hostname: "web", LastSeen: time.Now()},
+		{ID: "online", Hostname: "web", Online: true},
+	}
+	got := applyDuplicateHostnamePolicy(devices, KeepLastSeenDuplicate)
+	if len(got) != 1 || got[0].ID != "online" {
+		t.Errorf("applyDuplicateHostnamePolicy: want only the online device kept, got: %v", got)
+	}
+}
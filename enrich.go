@@ -0,0 +1,77 @@
+package tailscalesd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// DefaultEnrichmentParallelism is the number of concurrent enrichment calls
+// made by an EnrichingDiscoverer which does not specify its own.
+const DefaultEnrichmentParallelism = 8
+
+// Enricher adds details to a Device which are not available from discovery
+// alone. Typically this requires an additional API call per device.
+type Enricher interface {
+	Enrich(context.Context, *Device) error
+}
+
+// EnricherFunc adapts a function to the Enricher interface.
+type EnricherFunc func(context.Context, *Device) error
+
+// Enrich the device by calling f.
+func (f EnricherFunc) Enrich(ctx context.Context, d *Device) error {
+	return f(ctx, d)
+}
+
+// EnrichingDiscoverer wraps a Discoverer, enriching each discovered Device with
+// at most Parallelism concurrent calls to the Enricher. Devices which fail
+// enrichment are still returned, without the additional details.
+type EnrichingDiscoverer struct {
+	Wrap        Discoverer
+	Enricher    Enricher
+	Parallelism int
+}
+
+func (e *EnrichingDiscoverer) parallelism() int {
+	if e.Parallelism < 1 {
+		return DefaultEnrichmentParallelism
+	}
+	return e.Parallelism
+}
+
+// Devices reported by the wrapped Discoverer, enriched.
+func (e *EnrichingDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	devices, err := e.Wrap.Devices(ctx)
+	if err != nil && !errors.Is(err, errStaleResults) {
+		return devices, err
+	}
+
+	n := len(devices)
+	enrichmentPendingGauge.Add(float64(n))
+	sem := make(chan struct{}, e.parallelism())
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := range devices {
+		go func(d *Device) {
+			defer wg.Done()
+			defer enrichmentPendingGauge.Dec()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				enrichmentErrorCounter.Inc()
+				return
+			}
+			defer func() { <-sem }()
+			if err := e.Enricher.Enrich(ctx, d); err != nil {
+				enrichmentErrorCounter.Inc()
+				log.Printf("Failed enriching device %q: %v", d.ID, err)
+				return
+			}
+			enrichmentCompletedCounter.Inc()
+		}(&devices[i])
+	}
+	wg.Wait()
+	return devices, err
+}
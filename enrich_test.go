@@ -0,0 +1,92 @@
+package tailscalesd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type concurrencyTrackingEnricher struct {
+	mu      sync.Mutex
+	current int
+	max     int
+	release chan struct{}
+}
+
+func (e *concurrencyTrackingEnricher) Enrich(_ context.Context, d *Device) error {
+	e.mu.Lock()
+	e.current++
+	if e.current > e.max {
+		e.max = e.current
+	}
+	e.mu.Unlock()
+
+	<-e.release
+
+	e.mu.Lock()
+	e.current--
+	e.mu.Unlock()
+	if d.ID == "fails" {
+		return errors.New("this is a test error")
+	}
+	d.OS = "enriched"
+	return nil
+}
+
+func TestEnrichingDiscovererBoundsParallelism(t *testing.T) {
+	devices := make([]Device, 20)
+	enricher := &concurrencyTrackingEnricher{release: make(chan struct{})}
+	d := &EnrichingDiscoverer{
+		Wrap:        &testDiscoverer{discovered: devices},
+		Enricher:    enricher,
+		Parallelism: 3,
+	}
+	go func() {
+		for range devices {
+			enricher.release <- struct{}{}
+		}
+	}()
+	if _, err := d.Devices(context.TODO()); err != nil {
+		t.Fatalf("EnrichingDiscoverer: unexpected error: %v", err)
+	}
+	if got, want := enricher.max, 3; got > want {
+		t.Errorf("EnrichingDiscoverer: parallelism exceeded: got: %d want at most: %d", got, want)
+	}
+}
+
+func TestEnrichingDiscovererKeepsDevicesWhichFailEnrichment(t *testing.T) {
+	enricher := &concurrencyTrackingEnricher{release: make(chan struct{})}
+	close(enricher.release)
+	d := &EnrichingDiscoverer{
+		Wrap: &testDiscoverer{discovered: []Device{
+			{ID: "fails"},
+			{ID: "succeeds"},
+		}},
+		Enricher: enricher,
+	}
+	got, err := d.Devices(context.TODO())
+	if err != nil {
+		t.Fatalf("EnrichingDiscoverer: unexpected error: %v", err)
+	}
+	want := []Device{
+		{ID: "fails"},
+		{ID: "succeeds", OS: "enriched"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("EnrichingDiscoverer: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestEnrichingDiscovererReturnsWrappedErrors(t *testing.T) {
+	wantErr := errors.New("this is a test error")
+	d := &EnrichingDiscoverer{
+		Wrap:     &testDiscoverer{err: wantErr},
+		Enricher: EnricherFunc(func(context.Context, *Device) error { return nil }),
+	}
+	if _, err := d.Devices(context.TODO()); !errors.Is(err, wantErr) {
+		t.Errorf("EnrichingDiscoverer: error mismatch: got: %v want: %v", err, wantErr)
+	}
+}
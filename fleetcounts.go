@@ -0,0 +1,108 @@
+package tailscalesd
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// refreshCounts of the devices refreshed by a RateLimitedDiscoverer, from
+// which the gauges describing the fleet are exported.
+type refreshCounts struct {
+	byStatus      map[osStatus]int
+	byTag         map[string]int
+	byCombination map[tagCombination]int
+}
+
+// countDevices by OS and online status, by tag and by combination of tags.
+// Untagged devices are counted under the empty tag.
+func countDevices(devices []Device) refreshCounts {
+	counts := refreshCounts{
+		byStatus:      make(map[osStatus]int),
+		byTag:         make(map[string]int),
+		byCombination: make(map[tagCombination]int),
+	}
+	for _, d := range devices {
+		counts.byStatus[osStatus{os: strings.ToLower(d.OS), online: onlineStatus(d)}]++
+		if len(d.Tags) == 0 {
+			counts.byTag[""]++
+		}
+		tags := slices.Clone(d.Tags)
+		slices.Sort(tags)
+		for _, tag := range slices.Compact(tags) {
+			counts.byTag[tag]++
+		}
+		counts.byCombination[tagCombination{tailnet: d.Tailnet, tags: combinationOf(d.Tags)}]++
+	}
+	return counts
+}
+
+// fleetCounts registers the counts of the devices last refreshed by each
+// RateLimitedDiscoverer, until it is deregistered. The gauges describing the
+// fleet export their totals, so devices discovered by several discoverers are
+// counted once by each.
+var fleetCounts = struct {
+	sync.Mutex
+	counts map[*RateLimitedDiscoverer]refreshCounts
+}{counts: make(map[*RateLimitedDiscoverer]refreshCounts)}
+
+// recordFleetCounts of the devices just refreshed by c, replacing those of its
+// previous refresh, and export the new totals.
+func recordFleetCounts(c *RateLimitedDiscoverer, devices []Device) {
+	counts := countDevices(devices)
+	fleetCounts.Lock()
+	defer fleetCounts.Unlock()
+	fleetCounts.counts[c] = counts
+	exportFleetCounts()
+}
+
+// forgetFleetCounts of c, which is no longer counted, and export the new
+// totals.
+func forgetFleetCounts(c *RateLimitedDiscoverer) {
+	fleetCounts.Lock()
+	defer fleetCounts.Unlock()
+	if _, ok := fleetCounts.counts[c]; !ok {
+		return
+	}
+	delete(fleetCounts.counts, c)
+	exportFleetCounts()
+}
+
+// exportFleetCounts totalled across discoverers. fleetCounts must be locked.
+func exportFleetCounts() {
+	var (
+		byStatus      = make(map[osStatus]int)
+		byTag         = make(map[string]int)
+		byCombination = make(map[tagCombination]int)
+	)
+	for _, counts := range fleetCounts.counts {
+		addCounts(byStatus, counts.byStatus)
+		addCounts(byTag, counts.byTag)
+		addCounts(byCombination, counts.byCombination)
+	}
+	exportDeviceCounts(byStatus, byTag)
+	exportTagCombinations(byCombination)
+}
+
+// addCounts to totals.
+func addCounts[K comparable](totals, counts map[K]int) {
+	for k, n := range counts {
+		totals[k] += n
+	}
+}
+
+// mostCommon returns the limit keys with the highest counts, breaking ties
+// with compare.
+func mostCommon[K comparable](counts map[K]int, limit int, compare func(a, b K) int) []K {
+	keys := make([]K, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return compare(a, b)
+	})
+	return keys[:min(limit, len(keys))]
+}
@@ -0,0 +1,56 @@
+package tailscalesd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// resetFleetCounts forgets the counts recorded by other tests, which share
+// the gauges.
+func resetFleetCounts() {
+	fleetCounts.Lock()
+	defer fleetCounts.Unlock()
+	clear(fleetCounts.counts)
+}
+
+func TestDeregisterForgetsFleetCounts(t *testing.T) {
+	resetFleetCounts()
+	kept, discarded := &RateLimitedDiscoverer{}, &RateLimitedDiscoverer{}
+	recordFleetCounts(kept, []Device{{Tailnet: "fleetcounts.example", OS: "linux", Tags: []string{"tag:web"}}})
+	recordFleetCounts(discarded, []Device{
+		{Tailnet: "fleetcounts.example", OS: "linux", Tags: []string{"tag:web"}},
+		{Tailnet: "fleetcounts.example", OS: "windows", Tags: []string{"tag:db"}},
+	})
+	discarded.Deregister()
+	for name, tc := range map[string]struct {
+		got, want float64
+	}{
+		"linux devices":          {testutil.ToFloat64(devicesGauge.WithLabelValues("linux", "false")), 1},
+		"os series":              {float64(testutil.CollectAndCount(devicesGauge)), 1},
+		"web devices":            {testutil.ToFloat64(tagDevicesGauge.WithLabelValues("tag:web")), 1},
+		"tag series":             {float64(testutil.CollectAndCount(tagDevicesGauge)), 1},
+		"web combination":        {testutil.ToFloat64(tagCombinationDevicesGauge.WithLabelValues("fleetcounts.example", "tag:web")), 1},
+		"tag combination series": {float64(testutil.CollectAndCount(tagCombinationDevicesGauge)), 1},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("Deregister: %v mismatch: got: %v want: %v", name, tc.got, tc.want)
+		}
+	}
+	// Deregistering again, or deregistering a discoverer which never
+	// refreshed, changes nothing.
+	discarded.Deregister()
+	(&RateLimitedDiscoverer{}).Deregister()
+	if got := testutil.CollectAndCount(devicesGauge); got != 1 {
+		t.Errorf("Deregister: os series mismatch: got: %v want: 1", got)
+	}
+}
+
+func TestMostCommon(t *testing.T) {
+	got := mostCommon(map[string]int{"tag:b": 2, "tag:a": 2, "tag:c": 3, "tag:d": 1}, 3, strings.Compare)
+	if diff := cmp.Diff(got, []string{"tag:c", "tag:a", "tag:b"}); diff != "" {
+		t.Errorf("mostCommon: mismatch (-got, +want):\n%v", diff)
+	}
+}
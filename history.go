@@ -0,0 +1,124 @@
+package tailscalesd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// TagChange to a device between two refreshes.
+type TagChange struct {
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Added    []string  `json:"added,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+}
+
+// History of the tag changes to devices observed by RateLimitedDiscoverers,
+// bounded to the most recent changes to each device.
+type History struct {
+	limit int
+
+	mu      sync.Mutex // protects following members
+	changes map[string][]TagChange
+}
+
+// NewHistory retaining up to limit changes for each device.
+func NewHistory(limit int) *History {
+	return &History{
+		limit:   limit,
+		changes: make(map[string][]TagChange),
+	}
+}
+
+// tagDifference returns the tags in a but not b.
+func tagDifference(a, b []string) (diff []string) {
+	for _, t := range a {
+		if !slices.Contains(b, t) {
+			diff = append(diff, t)
+		}
+	}
+	return
+}
+
+// record the tag changes between the previous and current results of a
+// refresh at the time at. Devices not present in both are not recorded. A nil
+// History records nothing.
+func (h *History) record(previous, current []Device, at time.Time) {
+	if h == nil {
+		return
+	}
+	tagsWere := make(map[string][]string, len(previous))
+	for _, d := range previous {
+		tagsWere[d.ID] = d.Tags
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, d := range current {
+		was, ok := tagsWere[d.ID]
+		if !ok {
+			continue
+		}
+		change := TagChange{
+			Time:     at,
+			Hostname: d.Hostname,
+			Added:    tagDifference(d.Tags, was),
+			Removed:  tagDifference(was, d.Tags),
+		}
+		if len(change.Added) == 0 && len(change.Removed) == 0 {
+			continue
+		}
+		changes := append(h.changes[d.ID], change)
+		if len(changes) > h.limit {
+			changes = changes[len(changes)-h.limit:]
+		}
+		h.changes[d.ID] = changes
+	}
+}
+
+// Changes recorded for each device, keyed by device ID, oldest first.
+func (h *History) Changes() map[string][]TagChange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changes := make(map[string][]TagChange, len(h.changes))
+	for id, c := range h.changes {
+		changes[id] = slices.Clone(c)
+	}
+	return changes
+}
+
+type historyHandler struct {
+	h *History
+}
+
+func (hh historyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	changes := hh.h.Changes()
+	if device := r.URL.Query().Get("device"); device != "" {
+		for id, c := range changes {
+			if id != device && c[len(c)-1].Hostname != device {
+				delete(changes, id)
+			}
+		}
+	}
+	b, err := json.Marshal(changes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		serveAndLog(w, fmt.Sprintf("Failed encoding history: %v", err))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(b); err != nil {
+		log.Printf("Failed sending history to the client: %v", err)
+	}
+}
+
+// HistoryHandler serves the changes recorded in h as JSON, keyed by device
+// ID. The device query parameter limits the response to the device with that
+// ID or current hostname.
+func HistoryHandler(h *History) http.Handler {
+	return historyHandler{h}
+}
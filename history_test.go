@@ -0,0 +1,87 @@
+package tailscalesd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	first := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+
+	h := NewHistory(1)
+	h.record([]Device{
+		{ID: "loses", Hostname: "loser", Tags: []string{"tag:prometheus", "tag:foo"}},
+		{ID: "unchanged", Tags: []string{"tag:foo"}},
+		{ID: "removed", Tags: []string{"tag:foo"}},
+	}, []Device{
+		{ID: "loses", Hostname: "loser", Tags: []string{"tag:foo", "tag:bar"}},
+		{ID: "unchanged", Tags: []string{"tag:foo"}},
+		{ID: "added", Tags: []string{"tag:foo"}},
+	}, first)
+	h.record([]Device{
+		{ID: "added", Hostname: "added", Tags: []string{"tag:foo"}},
+	}, []Device{
+		{ID: "added", Hostname: "added"},
+	}, second)
+
+	want := map[string][]TagChange{
+		"loses": {
+			{
+				Time:     first,
+				Hostname: "loser",
+				Added:    []string{"tag:bar"},
+				Removed:  []string{"tag:prometheus"},
+			},
+		},
+		"added": {
+			{
+				Time:     second,
+				Hostname: "added",
+				Removed:  []string{"tag:foo"},
+			},
+		},
+	}
+	if diff := cmp.Diff(h.Changes(), want); diff != "" {
+		t.Errorf("History: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	h := NewHistory(2)
+	tags := [][]string{{"tag:a"}, {"tag:b"}, {"tag:c"}, {"tag:d"}}
+	for i := 1; i < len(tags); i++ {
+		h.record([]Device{{ID: "id", Tags: tags[i-1]}}, []Device{{ID: "id", Tags: tags[i]}}, time.Time{})
+	}
+	changes := h.Changes()["id"]
+	if got, want := len(changes), 2; got != want {
+		t.Fatalf("History: length mismatch: got: %v want: %v", got, want)
+	}
+	if diff := cmp.Diff(changes[1].Added, []string{"tag:d"}); diff != "" {
+		t.Errorf("History: latest change mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h := NewHistory(10)
+	h.record([]Device{
+		{ID: "one", Hostname: "foo", Tags: []string{"tag:a"}},
+		{ID: "two", Hostname: "bar", Tags: []string{"tag:a"}},
+	}, []Device{
+		{ID: "one", Hostname: "foo"},
+		{ID: "two", Hostname: "bar"},
+	}, at)
+
+	r := httptest.NewRequest(http.MethodGet, "/debug/history?device=foo", nil)
+	w := httptest.NewRecorder()
+	HistoryHandler(h).ServeHTTP(w, r)
+	want := `{"one":[{"time":"2024-03-01T12:00:00Z","hostname":"foo","removed":["tag:a"]}]}`
+	if diff := cmp.Diff(w.Body.String(), want); diff != "" {
+		t.Errorf("HistoryHandler: content mismatch (-got, +want):\n%v", diff)
+	}
+}
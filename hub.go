@@ -0,0 +1,61 @@
+package tailscalesd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// InventoryPath is the path on which a hub tailscalesd serves the Snapshot of
+// its discovery results to spokes.
+const InventoryPath = "/-/inventory"
+
+type hubDiscoverer struct {
+	url    string
+	client HTTPDoer
+}
+
+// Devices in the inventory of the hub, from each of its sources in turn.
+func (h *hubDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hub responded %v", resp.Status)
+	}
+	snapshot, err := ReadSnapshot(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var devices []Device
+	for _, name := range names {
+		devices = append(devices, snapshot[name].Devices...)
+	}
+	return devices, nil
+}
+
+// Hub Discoverer fetches the devices discovered by another tailscalesd, the
+// hub, from its InventoryPath at hubURL. Spokes using it need no Tailscale API
+// credentials of their own. If client is nil, http.DefaultClient is used.
+func Hub(hubURL string, client HTTPDoer) Discoverer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &hubDiscoverer{
+		url:    strings.TrimSuffix(hubURL, "/") + InventoryPath,
+		client: client,
+	}
+}
@@ -0,0 +1,49 @@
+package tailscalesd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHubServesInventory(t *testing.T) {
+	refreshed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	a := &RateLimitedDiscoverer{Frequency: time.Hour}
+	a.Prime([]Device{{ID: "a1", Hostname: "one"}}, refreshed)
+	b := &RateLimitedDiscoverer{Frequency: time.Hour}
+	b.Prime([]Device{{ID: "b1", Hostname: "two"}, {ID: "b2", Hostname: "three"}}, refreshed)
+	mux := http.NewServeMux()
+	mux.Handle(InventoryPath, SnapshotHandler(map[string]*RateLimitedDiscoverer{
+		"b": b,
+		"a": a,
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	got, err := Hub(server.URL+"/", nil).Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{
+		{ID: "a1", Hostname: "one"},
+		{ID: "b1", Hostname: "two"},
+		{ID: "b2", Hostname: "three"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Hub: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestHubReportsRefusal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+	if _, err := Hub(server.URL, nil).Devices(context.TODO()); err == nil {
+		t.Error("Hub: want error when the hub refuses the spoke")
+	}
+}
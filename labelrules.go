@@ -0,0 +1,51 @@
+package tailscalesd
+
+import (
+	"maps"
+	"regexp"
+)
+
+// LabelRule sets Labels on descriptors matching all of its conditions. Empty
+// conditions match every descriptor.
+type LabelRule struct {
+	// Tag which the descriptor must carry, in LabelMetaDeviceTag.
+	Tag string
+	// OS which the device must report, in LabelMetaDeviceOS.
+	OS string
+	// Hostname, if set, must match the device's hostname, in
+	// LabelMetaDeviceHostname.
+	Hostname *regexp.Regexp
+
+	// Labels set on matching descriptors.
+	Labels map[string]string
+}
+
+func (r LabelRule) matches(td TargetDescriptor) bool {
+	switch {
+	case r.Tag != "" && td.Labels[LabelMetaDeviceTag] != r.Tag:
+		return false
+	case r.OS != "" && td.Labels[LabelMetaDeviceOS] != r.OS:
+		return false
+	case r.Hostname != nil && !r.Hostname.MatchString(td.Labels[LabelMetaDeviceHostname]):
+		return false
+	}
+	return true
+}
+
+// LabelRules returns a TargetExpander which sets the labels of every rule
+// matching each descriptor, such as a job label derived from its tags. Where
+// several matching rules set the same label, the last one wins.
+func LabelRules(rules ...LabelRule) TargetExpander {
+	return func(td TargetDescriptor) []TargetDescriptor {
+		out := TargetDescriptor{
+			Targets: td.Targets,
+			Labels:  copyLabels(td.Labels),
+		}
+		for _, r := range rules {
+			if r.matches(td) {
+				maps.Copy(out.Labels, r.Labels)
+			}
+		}
+		return []TargetDescriptor{out}
+	}
+}
@@ -0,0 +1,71 @@
+package tailscalesd
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLabelRules(t *testing.T) {
+	expander := LabelRules(
+		LabelRule{
+			Tag:    "tag:web",
+			Labels: map[string]string{"job": "web", "team": "frontend"},
+		},
+		LabelRule{
+			OS:       "linux",
+			Hostname: regexp.MustCompile(`^web-canary`),
+			Labels:   map[string]string{"job": "web-canary"},
+		},
+	)
+	for tn, tc := range map[string]struct {
+		labels map[string]string
+		want   map[string]string
+	}{
+		"no rules match": {
+			labels: map[string]string{LabelMetaDeviceTag: "tag:db"},
+			want:   map[string]string{LabelMetaDeviceTag: "tag:db"},
+		},
+		"tag rule matches": {
+			labels: map[string]string{LabelMetaDeviceTag: "tag:web"},
+			want: map[string]string{
+				LabelMetaDeviceTag: "tag:web",
+				"job":              "web",
+				"team":             "frontend",
+			},
+		},
+		"all conditions must match": {
+			labels: map[string]string{
+				LabelMetaDeviceHostname: "web-canary-1",
+				LabelMetaDeviceOS:       "windows",
+			},
+			want: map[string]string{
+				LabelMetaDeviceHostname: "web-canary-1",
+				LabelMetaDeviceOS:       "windows",
+			},
+		},
+		"later rules win": {
+			labels: map[string]string{
+				LabelMetaDeviceHostname: "web-canary-1",
+				LabelMetaDeviceOS:       "linux",
+				LabelMetaDeviceTag:      "tag:web",
+			},
+			want: map[string]string{
+				LabelMetaDeviceHostname: "web-canary-1",
+				LabelMetaDeviceOS:       "linux",
+				LabelMetaDeviceTag:      "tag:web",
+				"job":                   "web-canary",
+				"team":                  "frontend",
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			in := TargetDescriptor{Targets: []string{"100.2.3.4"}, Labels: tc.labels}
+			want := []TargetDescriptor{{Targets: []string{"100.2.3.4"}, Labels: tc.want}}
+			if diff := cmp.Diff(expander(in), want); diff != "" {
+				t.Errorf("LabelRules: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package tailscalesd
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// LabelTemplateFuncs are the functions available to label templates, in
+// addition to the text/template builtins.
+var LabelTemplateFuncs = template.FuncMap{
+	"regexFind": func(pattern, s string) (string, error) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", err
+		}
+		return re.FindString(s), nil
+	},
+	"regexReplaceAll": func(pattern, s, repl string) (string, error) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, repl), nil
+	},
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+}
+
+// ParseLabelTemplate parses text as a label template, with
+// LabelTemplateFuncs available.
+func ParseLabelTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(LabelTemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// labelTemplateData is the data against which label templates are executed,
+// derived from a descriptor's labels.
+type labelTemplateData struct {
+	Hostname string
+	Name     string
+	ID       string
+	OS       string
+	Tag      string
+	Tailnet  string
+	User     string
+	// Labels of the descriptor, including those set by earlier expanders.
+	Labels map[string]string
+}
+
+func templateData(td TargetDescriptor) labelTemplateData {
+	return labelTemplateData{
+		Hostname: td.Labels[LabelMetaDeviceHostname],
+		Name:     td.Labels[LabelMetaDeviceName],
+		ID:       td.Labels[LabelMetaDeviceID],
+		OS:       td.Labels[LabelMetaDeviceOS],
+		Tag:      td.Labels[LabelMetaDeviceTag],
+		Tailnet:  td.Labels[LabelMetaTailnet],
+		User:     td.Labels[LabelMetaDeviceUser],
+		Labels:   td.Labels,
+	}
+}
+
+// LabelTemplates returns a TargetExpander which sets each label to the result
+// of executing its template against each descriptor, such as a datacenter
+// label derived from hostnames:
+//
+//	{{ regexFind "dc[0-9]+" .Hostname }}
+//
+// Templates may refer to the device's Hostname, Name, ID, OS, Tag, Tailnet and
+// User, or to any of its Labels. Labels whose templates produce nothing, or
+// fail, are not set; failures are logged.
+func LabelTemplates(templates map[string]*template.Template) TargetExpander {
+	return func(td TargetDescriptor) []TargetDescriptor {
+		out := TargetDescriptor{
+			Targets: td.Targets,
+			Labels:  copyLabels(td.Labels),
+		}
+		data := templateData(td)
+		for label, tmpl := range templates {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, data); err != nil {
+				log.Printf("Failed executing template for label %q: %v", label, err)
+				continue
+			}
+			setIfNotEmpty(out.Labels, label, strings.TrimSpace(b.String()))
+		}
+		return []TargetDescriptor{out}
+	}
+}
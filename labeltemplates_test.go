@@ -0,0 +1,65 @@
+package tailscalesd
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLabelTemplates(t *testing.T) {
+	templates := make(map[string]*template.Template)
+	for label, text := range map[string]string{
+		"datacenter": `{{ regexFind "dc[0-9]+" .Hostname }}`,
+		"rack":       `{{ regexReplaceAll "^.*-(r[0-9]+)$" .Hostname "${1}" | regexFind "^r[0-9]+$" | upper }}`,
+		"env":        `{{ if eq .Tag "tag:prod" }}production{{ end }}`,
+		"team":       `{{ .Labels.owner }}`,
+	} {
+		tmpl, err := ParseLabelTemplate(label, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates[label] = tmpl
+	}
+	expander := LabelTemplates(templates)
+	for tn, tc := range map[string]struct {
+		labels map[string]string
+		want   map[string]string
+	}{
+		"all labels": {
+			labels: map[string]string{
+				LabelMetaDeviceHostname: "web-dc3-r12",
+				LabelMetaDeviceTag:      "tag:prod",
+				"owner":                 "frontend",
+			},
+			want: map[string]string{
+				LabelMetaDeviceHostname: "web-dc3-r12",
+				LabelMetaDeviceTag:      "tag:prod",
+				"owner":                 "frontend",
+				"datacenter":            "dc3",
+				"rack":                  "R12",
+				"env":                   "production",
+				"team":                  "frontend",
+			},
+		},
+		"empty results are not set": {
+			labels: map[string]string{LabelMetaDeviceHostname: "laptop"},
+			want: map[string]string{
+				LabelMetaDeviceHostname: "laptop",
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := expander(TargetDescriptor{Labels: tc.labels})
+			if diff := cmp.Diff(got[0].Labels, tc.want); diff != "" {
+				t.Errorf("LabelTemplates: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestParseLabelTemplateRejectsBadTemplates(t *testing.T) {
+	if _, err := ParseLabelTemplate("bad", `{{ regexFind "dc" .Hostname `); err == nil {
+		t.Error("ParseLabelTemplate: want error for unterminated action")
+	}
+}
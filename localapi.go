@@ -5,9 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,6 +30,7 @@ const LocalAPISocket = "/run/tailscale/tailscaled.sock"
 // https://pkg.go.dev/tailscale.com@v1.22.2/ipn/ipnstate?utm_source=gopls#Status
 type interestingStatusSubset struct {
 	TailscaleIPs []netip.Addr // Tailscale IP(s) assigned to this node
+	Health       []string     // Health check problems of this node
 	Self         *interestingPeerStatusSubset
 	Peer         map[string]*interestingPeerStatusSubset
 }
@@ -31,28 +38,124 @@ type interestingStatusSubset struct {
 // interestingPeerStatusSubset is the PeerStatus equivalent of
 // interestingStatusSubset.
 type interestingPeerStatusSubset struct {
-	ID           string
-	HostName     string
-	DNSName      string
-	OS           string
-	TailscaleIPs []netip.Addr
-	Tags         []string `json:",omitempty"`
+	ID             string
+	PublicKey      string
+	HostName       string
+	DNSName        string
+	OS             string
+	TailscaleIPs   []netip.Addr
+	CurAddr        string
+	Relay          string
+	Tags           []string                   `json:",omitempty"`
+	Capabilities   []string                   `json:",omitempty"`
+	CapMap         map[string]json.RawMessage `json:",omitempty"`
+	KeyExpiry      *time.Time                 `json:",omitempty"`
+	LastHandshake  time.Time
+	Online         bool
+	ExitNode       bool
+	ExitNodeOption bool
+	// Older clients do not report whether peers are tracked by each
+	// subsystem, which is not the same as reporting that they are not.
+	InNetworkMap *bool `json:",omitempty"`
+	InMagicSock  *bool `json:",omitempty"`
+	InEngine     *bool `json:",omitempty"`
+	Expired      bool  `json:",omitempty"`
+	// PrimaryRoutes are the subnet routes for which the peer is currently
+	// the router.
+	PrimaryRoutes []string `json:",omitempty"`
+}
+
+// localStatus provides the status of the local tailscaled. It is abstracted
+// from the local API so that status payloads recorded on each platform may
+// stand in for tailscaled in tests.
+type localStatus interface {
+	Status(context.Context) (interestingStatusSubset, error)
 }
 
 type localAPIClient struct {
-	client *http.Client
+	source localStatus
+	clock  Clock
+
+	// peerHealth populates the Health of discovered devices.
+	peerHealth bool
+
+	// timeout bounds each discovery, including any retries.
+	timeout time.Duration
+
+	// retries is the number of times a status request is retried while the
+	// local API is unreachable, waiting backoff before the first retry and
+	// doubling the wait each subsequent time.
+	retries int
+	backoff time.Duration
+
+	unavailable atomic.Bool
+}
+
+const (
+	// localAPIRetries is enough to ride out a typical tailscaled restart
+	// within a single request, given localAPIBackoff.
+	localAPIRetries = 4
+	localAPIBackoff = 250 * time.Millisecond
+)
+
+var (
+	errFailedLocalAPIRequest = errors.New("failed local API request")
+	errLocalAPIUnavailable   = errors.New("local API unavailable; is tailscaled running or restarting?")
+)
+
+// isDialError reports whether err resulted from failing to connect to the
+// local API, as happens when tailscaled is stopped or restarting.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// statusWithRetry requests the status from the local API, retrying with
+// backoff if the local API is unreachable.
+func (a *localAPIClient) statusWithRetry(ctx context.Context) (interestingStatusSubset, error) {
+	backoff := a.backoff
+	for attempt := 0; ; attempt++ {
+		status, err := a.source.Status(ctx)
+		if err == nil {
+			if a.unavailable.Swap(false) {
+				log.Print("Local API is available again")
+			}
+			localAPIAvailableGauge.Set(1)
+			recordHealth(status.Health)
+			return status, nil
+		}
+		if !isDialError(err) {
+			return status, err
+		}
+		if attempt >= a.retries {
+			if !a.unavailable.Swap(true) {
+				log.Printf("Local API became unavailable: %v", err)
+			}
+			localAPIAvailableGauge.Set(0)
+			return status, fmt.Errorf("%w: %v", errLocalAPIUnavailable, err)
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
-var errFailedLocalAPIRequest = errors.New("failed local API request")
+// httpLocalStatus requests the status from the local API over HTTP.
+type httpLocalStatus struct {
+	client HTTPDoer
+}
 
-func (a *localAPIClient) status(ctx context.Context) (interestingStatusSubset, error) {
+func (h *httpLocalStatus) Status(ctx context.Context) (interestingStatusSubset, error) {
 	start := time.Now()
 	lv := prometheus.Labels{
 		"api":  "local",
 		"host": "localhost",
 	}
 	defer func() {
-		apiRequestLatencyHistogram.With(lv).Observe(float64(time.Since(start).Milliseconds()))
+		observeLatency(ctx, apiRequestLatencyHistogram.With(lv), start)
 	}()
 
 	var status interestingStatusSubset
@@ -62,7 +165,7 @@ func (a *localAPIClient) status(ctx context.Context) (interestingStatusSubset, e
 	}
 
 	apiRequestCounter.With(lv).Inc()
-	resp, err := a.client.Do(req)
+	resp, err := tracedAPI{api: "local", next: h.client.Do}.Do(req)
 	if err != nil {
 		apiRequestErrorCounter.With(lv).Inc()
 		return status, err
@@ -73,11 +176,68 @@ func (a *localAPIClient) status(ctx context.Context) (interestingStatusSubset, e
 	}
 	defer resp.Body.Close()
 
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+	status, err = decodeStatus(resp.Body)
+	if err != nil {
 		apiPayloadErrorCounter.With(lv).Inc()
-		return status, err
 	}
-	return status, nil
+	return status, err
+}
+
+// decodeStatus from a local API status payload.
+func decodeStatus(r io.Reader) (interestingStatusSubset, error) {
+	var status interestingStatusSubset
+	err := json.NewDecoder(r).Decode(&status)
+	return status, err
+}
+
+// peerCapabilities returns the sorted, deduplicated capabilities advertised by
+// the peer. Newer clients report some capabilities only as CapMap keys.
+func peerCapabilities(p *interestingPeerStatusSubset) []string {
+	var caps []string
+	caps = append(caps, p.Capabilities...)
+	for c := range p.CapMap {
+		caps = append(caps, c)
+	}
+	if len(caps) == 0 {
+		return nil
+	}
+	sort.Strings(caps)
+	return slices.Compact(caps)
+}
+
+// recordHealth problems reported by the local node as metrics.
+func recordHealth(warnings []string) {
+	localAPIHealthWarningsGauge.Set(float64(len(warnings)))
+	localAPIHealthWarningGauge.Reset()
+	for _, w := range warnings {
+		localAPIHealthWarningGauge.WithLabelValues(w).Set(1)
+	}
+}
+
+// Health hints describing problems with peers, as reported by the local API.
+const (
+	PeerHealthNotInNetworkMap = "not-in-network-map"
+	PeerHealthNotInMagicSock  = "not-in-magicsock"
+	PeerHealthNotInEngine     = "not-in-engine"
+	PeerHealthKeyExpired      = "key-expired"
+)
+
+// peerHealth returns the health hints for the peer, empty if it is healthy.
+func peerHealth(p *interestingPeerStatusSubset) []string {
+	var hints []string
+	if p.InNetworkMap != nil && !*p.InNetworkMap {
+		hints = append(hints, PeerHealthNotInNetworkMap)
+	}
+	if p.InMagicSock != nil && !*p.InMagicSock {
+		hints = append(hints, PeerHealthNotInMagicSock)
+	}
+	if p.InEngine != nil && !*p.InEngine {
+		hints = append(hints, PeerHealthNotInEngine)
+	}
+	if p.Expired {
+		hints = append(hints, PeerHealthKeyExpired)
+	}
+	return hints
 }
 
 func translatePeerToDevice(p *interestingPeerStatusSubset, d *Device) {
@@ -86,22 +246,46 @@ func translatePeerToDevice(p *interestingPeerStatusSubset, d *Device) {
 	}
 	d.API = "localhost"
 	d.Authorized = true // localapi returned peer; assume it's authorized enough
+	d.Capabilities = peerCapabilities(p)
+	d.CurAddr = p.CurAddr
+	// The local API does not report every approved route, only those which
+	// each router is currently serving, which are what matters to reach them.
+	d.EnabledRoutes = p.PrimaryRoutes
+	if p.KeyExpiry != nil {
+		d.Expires = *p.KeyExpiry
+	}
 	d.Hostname = p.HostName
+	d.LastHandshake = p.LastHandshake
 	d.ID = p.ID
+	// The local API reports fully-qualified names, with a trailing dot, which
+	// the public API does not.
+	d.Name = strings.TrimSuffix(p.DNSName, ".")
+	d.NodeKey = p.PublicKey
+	d.Online = p.Online
+	d.ExitNodeInUse = p.ExitNode
+	d.ExitNodeOption = p.ExitNodeOption
 	d.OS = p.OS
+	d.Relay = p.Relay
 	d.Tags = p.Tags[:]
 }
 
 // Devices reported by the Tailscale local API as peers of the local host.
 func (a *localAPIClient) Devices(ctx context.Context) ([]Device, error) {
-	status, err := a.status(ctx)
+	ctx, cancel := withAPITimeout(ctx, a.timeout)
+	defer cancel()
+	status, err := a.statusWithRetry(ctx)
 	if err != nil {
 		return nil, err
 	}
 	devices := make([]Device, len(status.Peer))
+	discovered := a.clock.Now()
 	var i int
 	for _, peer := range status.Peer {
 		translatePeerToDevice(peer, &devices[i])
+		if a.peerHealth {
+			devices[i].Health = peerHealth(peer)
+		}
+		devices[i].DiscoveredAt = discovered
 		i++
 	}
 	return devices, nil
@@ -129,9 +313,53 @@ func defaultHTTPClientWithDialer(dc dialContext) *http.Client {
 	}
 }
 
+// LocalAPIOption configures the LocalAPI Discoverer.
+type LocalAPIOption func(*localAPIClient)
+
+// WithLocalAPIHTTPClient is a LocalAPIOption which replaces the HTTP client
+// used to reach the local API, ignoring the socket. Requests are made to the
+// host "local-tailscaled.sock".
+func WithLocalAPIHTTPClient(client HTTPDoer) LocalAPIOption {
+	return func(a *localAPIClient) {
+		a.source = &httpLocalStatus{client: client}
+	}
+}
+
+// WithLocalAPIClock is a LocalAPIOption which sets the Clock used to timestamp
+// discovered devices. If not used, the system clock is used.
+func WithLocalAPIClock(clock Clock) LocalAPIOption {
+	return func(a *localAPIClient) {
+		a.clock = clock
+	}
+}
+
+// WithLocalAPIPeerHealth is a LocalAPIOption which reports the health hints
+// of each peer, such as PeerHealthKeyExpired, as seen by the local node. They
+// are served in the LabelMetaDeviceHealth label.
+func WithLocalAPIPeerHealth() LocalAPIOption {
+	return func(a *localAPIClient) {
+		a.peerHealth = true
+	}
+}
+
+// WithLocalAPITimeout is a LocalAPIOption which bounds each discovery,
+// including any retries while the local API is unreachable, to timeout.
+func WithLocalAPITimeout(timeout time.Duration) LocalAPIOption {
+	return func(a *localAPIClient) {
+		a.timeout = timeout
+	}
+}
+
 // LocalAPI Discoverer interrogates the Tailscale localapi for peer devices.
-func LocalAPI(socket string) Discoverer {
-	return &localAPIClient{
-		client: defaultHTTPClientWithDialer(unixSocketDialer(socket)),
+func LocalAPI(socket string, opts ...LocalAPIOption) Discoverer {
+	a := &localAPIClient{
+		source:  &httpLocalStatus{client: defaultHTTPClientWithDialer(unixSocketDialer(socket))},
+		clock:   defaultClock,
+		retries: localAPIRetries,
+		backoff: localAPIBackoff,
+	}
+	for _, opt := range opts {
+		opt(a)
 	}
+	return a
 }
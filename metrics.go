@@ -37,6 +37,64 @@ var (
 		},
 		[]string{"api", "host"})
 
+	credentialsRejectedGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_public_api_credentials_rejected",
+			Help: "Whether the public API rejected the credentials for the tailnet on the most recent request (1) or not (0).",
+		},
+		[]string{"tailnet"})
+
+	tokenExpiryGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_public_api_token_expiry_timestamp_seconds",
+			Help: "Unix time at which the API token used for the tailnet expires, when known.",
+		},
+		[]string{"tailnet"})
+
+	localAPIAvailableGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_localapi_available",
+			Help: "Whether the local API was reachable on the most recent attempt (1) or not (0).",
+		})
+
+	localAPIHealthWarningsGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_localapi_health_warnings",
+			Help: "Number of health problems reported by the local node on the most recent successful local API request.",
+		})
+
+	localAPIHealthWarningGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_localapi_health_warning",
+			Help: "Health problems reported by the local node on the most recent successful local API request, each with the value 1. Labeled with the message.",
+		},
+		[]string{"message"})
+
+	deviceAddressErrorCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_device_address_errors",
+			Help: "Counter of devices discovered without any addresses, when using the error policy for them.",
+		})
+
+	onlineTransitionsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_device_online_transitions_total",
+			Help: "Counter of devices changing online state between refreshes. Labeled with the state to which they changed, online or offline.",
+		},
+		[]string{"to"})
+
+	removedDevicesGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_removed_devices",
+			Help: "Number of devices which disappeared from discovery results within the last few refreshes.",
+		})
+
+	removedDevicesReappearedCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_removed_devices_reappeared",
+			Help: "Counter of recently removed devices which reappeared in discovery results, which suggests discovery glitches rather than decommissions.",
+		})
+
 	multiDiscovererRequestCounter = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "tailscalesd_tailscale_multi_requests",
@@ -62,12 +120,132 @@ var (
 			Help: "Counter of requests to a rate limited discoverer which result in a data refresh.",
 		})
 
+	rateLimitedCoalescedRefreshes = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_tailscale_rate_limited_coalesced_refreshes",
+			Help: "Counter of requests to a rate limited discoverer which share the results of a refresh already in flight.",
+		})
+
 	rateLimitedStaleResults = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "tailscalesd_tailscale_rate_limited_stale",
 			Help: "Counter of requests to a rate limited discoverer which result a return of stale results.",
 		})
 
+	rateLimitedTooStaleResults = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_tailscale_rate_limited_too_stale",
+			Help: "Counter of requests to a rate limited discoverer which fail because the cached results exceed the staleness cutoff.",
+		})
+
+	circuitBreakerOpenGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_circuit_breaker_open",
+			Help: "Whether the circuit breaker is open (1), so that the discoverer is not being called, or closed (0). Labeled with the discoverer's name.",
+		},
+		[]string{"name"})
+
+	dedupedDevicesCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_deduped_devices",
+			Help: "Counter of duplicate devices merged into another device sharing its node key.",
+		})
+
+	enrichmentPendingGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_enrichment_pending",
+			Help: "Gauge of devices waiting for, or undergoing, enrichment.",
+		})
+
+	enrichmentCompletedCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_enrichment_completed",
+			Help: "Counter of devices successfully enriched.",
+		})
+
+	enrichmentErrorCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_enrichment_errors",
+			Help: "Counter of devices which failed enrichment.",
+		})
+
+	filterDroppedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_filter_dropped",
+			Help: "Counter of target descriptors left without targets by a filter, labeled with the filter name.",
+		},
+		[]string{"filter"})
+
+	deviceFilterDroppedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_device_filter_dropped",
+			Help: "Counter of devices dropped by a device filter, labeled with the filter name.",
+		},
+		[]string{"filter"})
+
+	filterModifiedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tailscalesd_filter_modified",
+			Help: "Counter of target descriptors modified by a filter, labeled with the filter name.",
+		},
+		[]string{"filter"})
+
+	filterLatencyHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "tailscalesd_filter_latency_ms",
+			Help: "Histogram of time spent applying all filters to a set of " +
+				"discovery results, measured in milliseconds.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		})
+
+	discoveryLatencyHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "tailscalesd_discovery_latency_ms",
+			Help: "Histogram of time spent serving discovery requests, from " +
+				"discovering devices through translating and encoding targets, " +
+				"measured in milliseconds. Bucketted geometrically.",
+			Buckets: []float64{1, 2.75, 7.5625, 20.7969, 57.1914, 157.2764, 432.5100, 1189.4025, 3270.8569, 8994.8566},
+		})
+
+	targetGroupsGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_target_groups",
+			Help: "Gauge of target groups translated from discovery results by the most recent request, before selection by query parameters or pagination.",
+		})
+
+	targetsServedGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_targets_served",
+			Help: "Gauge of targets served in response to the most recent discovery request.",
+		})
+
+	servingStaleGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_serving_stale",
+			Help: "Whether the most recent discovery response served stale results (1) or not (0).",
+		})
+
+	devicesGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_devices",
+			Help: "Gauge of discovered devices, as of the most recent refreshes, labeled with their lowercased OS and whether they are online, or \"unknown\" when not reported.",
+		},
+		[]string{"os", "online"})
+
+	tagDevicesGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_tag_devices",
+			Help: "Gauge of discovered devices carrying each tag, as of the most recent refreshes. Untagged devices have an empty tag. Tags beyond the 100 most common are counted together as \"other\".",
+		},
+		[]string{"tag"})
+
+	tagCombinationDevicesGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tailscalesd_tag_combination_devices",
+			Help: "Gauge of devices carrying each combination of tags, as of the most recent refreshes, labeled with the tailnet and the sorted, comma-separated tags. Untagged devices have empty tags.",
+		},
+		[]string{"tailnet", "tags"})
+
 	tailnetDevicesFoundCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "tailscalesd_public_api_devices_found",
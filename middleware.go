@@ -0,0 +1,97 @@
+package tailscalesd
+
+import "time"
+
+// Middleware wraps a Discoverer, adding behavior such as rate limiting,
+// filtering or enrichment to it. The Discoverer wrappers of this package are
+// each available as Middleware, so that pipelines may be assembled with Chain.
+type Middleware func(Discoverer) Discoverer
+
+// Chain wraps d in each of the middleware in turn. The first middleware is
+// innermost, seeing devices first, and the last is outermost. For example,
+//
+//	Chain(PublicAPI(tailnet, token), Enrich(enricher, 0), RateLimit(time.Minute))
+//
+// enriches devices only when the rate limited results are refreshed.
+func Chain(d Discoverer, middleware ...Middleware) Discoverer {
+	for _, m := range middleware {
+		d = m(d)
+	}
+	return d
+}
+
+// RateLimit is Middleware wrapping Discoverers in a RateLimitedDiscoverer
+// with the frequency.
+func RateLimit(frequency time.Duration) Middleware {
+	return func(d Discoverer) Discoverer {
+		return &RateLimitedDiscoverer{
+			Wrap:      d,
+			Frequency: frequency,
+		}
+	}
+}
+
+// CircuitBreak is Middleware wrapping Discoverers in a
+// CircuitBreakerDiscoverer which opens after the failures, for the cooldown.
+func CircuitBreak(failures int, cooldown time.Duration) Middleware {
+	return func(d Discoverer) Discoverer {
+		return &CircuitBreakerDiscoverer{
+			Wrap:     d,
+			Failures: failures,
+			Cooldown: cooldown,
+		}
+	}
+}
+
+// Filter is Middleware wrapping Discoverers in a FilteringDiscoverer with the
+// filters.
+func Filter(filters ...DeviceFilter) Middleware {
+	return func(d Discoverer) Discoverer {
+		return &FilteringDiscoverer{
+			Wrap:    d,
+			Filters: filters,
+		}
+	}
+}
+
+// FilterTags is Middleware wrapping Discoverers in a TagFilteringDiscoverer
+// which includes and excludes the tags.
+func FilterTags(include, exclude []string) Middleware {
+	return func(d Discoverer) Discoverer {
+		return &TagFilteringDiscoverer{
+			Wrap:    d,
+			Include: include,
+			Exclude: exclude,
+		}
+	}
+}
+
+// Dedupe is Middleware wrapping Discoverers in a DedupingDiscoverer which
+// prefers the tailnets in the order given.
+func Dedupe(preferTailnets ...string) Middleware {
+	return func(d Discoverer) Discoverer {
+		return &DedupingDiscoverer{
+			Wrap:           d,
+			PreferTailnets: preferTailnets,
+		}
+	}
+}
+
+// StableIDs is Middleware wrapping Discoverers in a StableIDDiscoverer.
+func StableIDs() Middleware {
+	return func(d Discoverer) Discoverer {
+		return &StableIDDiscoverer{Wrap: d}
+	}
+}
+
+// Enrich is Middleware wrapping Discoverers in an EnrichingDiscoverer with the
+// enricher and parallelism.
+func Enrich(enricher Enricher, parallelism int) Middleware {
+	return func(d Discoverer) Discoverer {
+		return &EnrichingDiscoverer{
+			Wrap:        d,
+			Enricher:    enricher,
+			Parallelism: parallelism,
+		}
+	}
+}
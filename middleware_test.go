@@ -0,0 +1,47 @@
+package tailscalesd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChain(t *testing.T) {
+	wrapped := &testDiscoverer{
+		discovered: []Device{
+			{ID: "a", NodeKey: "nodekey:a", Tailnet: "one", Authorized: true, Tags: []string{"tag:prom"}},
+			{ID: "b", NodeKey: "nodekey:a", Tailnet: "two", Authorized: true, Tags: []string{"tag:web"}},
+			{ID: "c", NodeKey: "nodekey:c", Tailnet: "one", Tags: []string{"tag:prom"}},
+			{ID: "d", NodeKey: "nodekey:d", Tailnet: "one", Authorized: true, Tags: []string{"tag:other"}},
+		},
+	}
+	var enriched int
+	d := Chain(wrapped,
+		Dedupe("two", "one"),
+		Filter(AuthorizedDevices),
+		FilterTags([]string{"tag:prom"}, nil),
+		Enrich(EnricherFunc(func(_ context.Context, d *Device) error {
+			enriched++
+			d.User = "enriched"
+			return nil
+		}), 1),
+		RateLimit(time.Hour),
+	)
+	for i := 0; i < 2; i++ {
+		got, err := d.Devices(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Device{
+			{ID: "b", NodeKey: "nodekey:a", Tailnet: "two", Authorized: true, Tags: []string{"tag:web", "tag:prom"}, User: "enriched"},
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("Chain: mismatch (-got, +want):\n%v", diff)
+		}
+	}
+	if wrapped.Called != 1 || enriched != 1 {
+		t.Errorf("Chain: rate limited middleware called inner discoverers %d times and enriched %d devices, want once each", wrapped.Called, enriched)
+	}
+}
@@ -2,6 +2,7 @@ package tailscalesd
 
 import (
 	"context"
+	"errors"
 	"sync"
 )
 
@@ -14,7 +15,9 @@ type discoveryResult struct {
 }
 
 // Devices aggregates the results of calling Devices on each contained
-// Discoverer. Returns the first encountered error.
+// Discoverer. Devices returned along with an error, such as the stale results
+// served by a RateLimitedDiscoverer which failed to refresh, are included.
+// Returns the most severe error encountered, as ranked by errorSeverity.
 func (md MultiDiscoverer) Devices(ctx context.Context) ([]Device, error) {
 	multiDiscovererRequestCounter.Inc()
 	var wg sync.WaitGroup
@@ -29,13 +32,34 @@ func (md MultiDiscoverer) Devices(ctx context.Context) ([]Device, error) {
 	}
 	wg.Wait()
 
-	var ret []Device
+	var (
+		ret []Device
+		err error
+	)
 	for i := range results {
-		if err := results[i].err; err != nil {
+		if results[i].err != nil {
 			multiDiscovererErrorCounter.Inc()
-			return ret, err
+			if errorSeverity(results[i].err) > errorSeverity(err) {
+				err = results[i].err
+			}
 		}
 		ret = append(ret, results[i].devices...)
 	}
-	return ret, nil
+	return ret, err
+}
+
+// errorSeverity ranks errors from discovery: stale results are less severe
+// than results too stale to serve, which are less severe than any other
+// failure. A nil error ranks lowest.
+func errorSeverity(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrTooStale):
+		return 2
+	case errors.Is(err, errStaleResults):
+		return 1
+	default:
+		return 3
+	}
 }
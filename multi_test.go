@@ -0,0 +1,55 @@
+package tailscalesd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMultiDiscovererKeepsStaleResults(t *testing.T) {
+	stale := fmt.Errorf("%w: unreachable", errStaleResults)
+	tooStale := fmt.Errorf("%w: unreachable", ErrTooStale)
+	failed := errors.New("unreachable")
+	for tn, tc := range map[string]struct {
+		errs    []error
+		want    []Device
+		wantErr error
+	}{
+		"no errors": {
+			errs: []error{nil, nil},
+			want: []Device{{ID: "0"}, {ID: "1"}},
+		},
+		"stale": {
+			errs:    []error{stale, nil},
+			want:    []Device{{ID: "0"}, {ID: "1"}},
+			wantErr: stale,
+		},
+		"too stale over stale": {
+			errs:    []error{stale, tooStale, nil},
+			want:    []Device{{ID: "0"}, {ID: "1"}, {ID: "2"}},
+			wantErr: tooStale,
+		},
+		"failure over too stale": {
+			errs:    []error{tooStale, failed, stale},
+			want:    []Device{{ID: "0"}, {ID: "1"}, {ID: "2"}},
+			wantErr: failed,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			var md MultiDiscoverer
+			for i, err := range tc.errs {
+				md = append(md, &testDiscoverer{discovered: []Device{{ID: fmt.Sprint(i)}}, err: err})
+			}
+			got, err := md.Devices(context.TODO())
+			if err != tc.wantErr {
+				t.Errorf("Devices(): error mismatch: got: %v want: %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("Devices(): mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package tailscalesd
+
+import "fmt"
+
+// NoAddressPolicy determines how devices which report no addresses are served.
+type NoAddressPolicy int
+
+const (
+	// DropNoAddress devices, serving no targets for them.
+	DropNoAddress NoAddressPolicy = iota
+
+	// HostnameNoAddress devices are served with their hostname as the target.
+	HostnameNoAddress
+
+	// ErrorNoAddress devices are dropped, and counted as errors in the
+	// tailscalesd_device_address_errors metric.
+	ErrorNoAddress
+)
+
+var noAddressPolicyNames = map[string]NoAddressPolicy{
+	"drop":     DropNoAddress,
+	"hostname": HostnameNoAddress,
+	"error":    ErrorNoAddress,
+}
+
+// ParseNoAddressPolicy from its name: "drop", "hostname" or "error".
+func ParseNoAddressPolicy(name string) (NoAddressPolicy, error) {
+	if p, ok := noAddressPolicyNames[name]; ok {
+		return p, nil
+	}
+	return DropNoAddress, fmt.Errorf("unknown policy for devices without addresses %q", name)
+}
+
+// applyNoAddressPolicy to the devices without addresses, returning the
+// devices to serve.
+func applyNoAddressPolicy(devices []Device, policy NoAddressPolicy) []Device {
+	out := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		if len(d.Addresses) > 0 {
+			out = append(out, d)
+			continue
+		}
+		switch policy {
+		case HostnameNoAddress:
+			if d.Hostname != "" {
+				d.Addresses = []string{d.Hostname}
+				out = append(out, d)
+			}
+		case ErrorNoAddress:
+			deviceAddressErrorCounter.Inc()
+		}
+	}
+	return out
+}
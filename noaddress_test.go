@@ -0,0 +1,72 @@
+package tailscalesd
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplyNoAddressPolicy(t *testing.T) {
+	devices := []Device{
+		{Addresses: []string{"100.2.3.4"}, Hostname: "addressed"},
+		{Hostname: "unaddressed"},
+		{ID: "anonymous"},
+	}
+	for tn, tc := range map[string]struct {
+		policy     NoAddressPolicy
+		want       []Device
+		wantErrors float64
+	}{
+		"drop": {
+			policy: DropNoAddress,
+			want: []Device{
+				{Addresses: []string{"100.2.3.4"}, Hostname: "addressed"},
+			},
+		},
+		"hostname": {
+			policy: HostnameNoAddress,
+			want: []Device{
+				{Addresses: []string{"100.2.3.4"}, Hostname: "addressed"},
+				{Addresses: []string{"unaddressed"}, Hostname: "unaddressed"},
+			},
+		},
+		"error": {
+			policy: ErrorNoAddress,
+			want: []Device{
+				{Addresses: []string{"100.2.3.4"}, Hostname: "addressed"},
+			},
+			wantErrors: 2,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			before := testutil.ToFloat64(deviceAddressErrorCounter)
+			got := applyNoAddressPolicy(devices, tc.policy)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("applyNoAddressPolicy: mismatch (-got, +want):\n%v", diff)
+			}
+			if got := testutil.ToFloat64(deviceAddressErrorCounter) - before; got != tc.wantErrors {
+				t.Errorf("applyNoAddressPolicy: errors mismatch: got: %v want: %v", got, tc.wantErrors)
+			}
+		})
+	}
+}
+
+func TestParseNoAddressPolicy(t *testing.T) {
+	for name, want := range map[string]NoAddressPolicy{
+		"drop":     DropNoAddress,
+		"hostname": HostnameNoAddress,
+		"error":    ErrorNoAddress,
+	} {
+		got, err := ParseNoAddressPolicy(name)
+		if err != nil {
+			t.Errorf("ParseNoAddressPolicy(%q): unexpected error: %v", name, err)
+		}
+		if got != want {
+			t.Errorf("ParseNoAddressPolicy(%q): mismatch: got: %v want: %v", name, got, want)
+		}
+	}
+	if _, err := ParseNoAddressPolicy("keep"); err == nil {
+		t.Error("ParseNoAddressPolicy: expected error for unknown policy, got nil")
+	}
+}
@@ -0,0 +1,93 @@
+package tailscalesd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// customAttributePrefix identifies the posture attributes set by tailnet
+// admins, which are reported as labels.
+const customAttributePrefix = "custom:"
+
+type postureAttributesResponse struct {
+	Attributes map[string]any `json:"attributes"`
+}
+
+// fetchPostureAttributes of the device with the ID from the public API at
+// base, such as "https://api.tailscale.com". Values are formatted as strings.
+func fetchPostureAttributes(ctx context.Context, client HTTPDoer, base, id string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/v2/device/"+url.PathEscape(id)+"/attributes", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode / 100) != 2 {
+		return nil, fmt.Errorf("%w: %v", errFailedAPIRequest, resp.Status)
+	}
+	var r postureAttributesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%w: bad payload from API: %v", errFailedAPIRequest, err)
+	}
+	attrs := make(map[string]string, len(r.Attributes))
+	for k, v := range r.Attributes {
+		attrs[k] = fmt.Sprint(v)
+	}
+	return attrs, nil
+}
+
+// postureAttributes is an Enricher fetching the posture attributes of devices
+// from the public API at base, such as "https://api.tailscale.com".
+type postureAttributes struct {
+	client HTTPDoer
+	base   string
+	lv     prometheus.Labels
+}
+
+func (p postureAttributes) Enrich(ctx context.Context, d *Device) error {
+	apiRequestCounter.With(p.lv).Inc()
+	attrs, err := fetchPostureAttributes(ctx, p.client, p.base, d.ID)
+	if err != nil {
+		apiRequestErrorCounter.With(p.lv).Inc()
+		return fmt.Errorf("failed fetching posture attributes: %w", err)
+	}
+	d.Attributes = attrs
+	return nil
+}
+
+// discoveredDevices is a Discoverer of devices which have already been
+// discovered, so that they may be passed through Middleware.
+type discoveredDevices []Device
+
+func (d discoveredDevices) Devices(context.Context) ([]Device, error) {
+	return d, nil
+}
+
+// addPostureAttributes fetches the posture attributes of each device in place,
+// enriching them in parallel with Enrich. Devices whose attributes cannot be
+// fetched are logged and served without them, rather than failing discovery
+// of the whole tailnet.
+func addPostureAttributes(ctx context.Context, client HTTPDoer, base string, devices []Device, lv prometheus.Labels) {
+	enrich := Enrich(postureAttributes{client: client, base: base, lv: lv}, DefaultEnrichmentParallelism)
+	_, _ = enrich(discoveredDevices(devices)).Devices(ctx)
+}
+
+// attributeLabel returns the label reporting the custom posture attribute,
+// such as "__meta_tailscale_device_attr_team" for "custom:team", and false for
+// attributes which are not custom.
+func attributeLabel(attribute string) (string, bool) {
+	name, ok := strings.CutPrefix(attribute, customAttributePrefix)
+	if !ok {
+		return "", false
+	}
+	return LabelMetaDeviceAttributePrefix + labelSafe(name), true
+}
@@ -0,0 +1,82 @@
+package tailscalesd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAttributeLabel(t *testing.T) {
+	for attribute, want := range map[string]string{
+		"custom:team":      "__meta_tailscale_device_attr_team",
+		"custom:scrape-at": "__meta_tailscale_device_attr_scrape_at",
+		"node:os":          "",
+	} {
+		got, ok := attributeLabel(attribute)
+		if got != want || ok != (want != "") {
+			t.Errorf("attributeLabel(%q): mismatch: got: %q, %v want: %q", attribute, got, ok, want)
+		}
+	}
+}
+
+func TestPublicAPIWithPostureAttributes(t *testing.T) {
+	d := PublicAPI("testTailnet", "testToken", WithPostureAttributes(), WithHTTPClient(doerFunc(func(r *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		switch r.URL.Path {
+		case "/api/v2/tailnet/testTailnet/devices":
+			fmt.Fprint(rec, `{"devices":[{"id":"one"},{"id":"two"}]}`)
+		case "/api/v2/device/one/attributes":
+			fmt.Fprint(rec, `{"attributes":{"custom:team":"sre","custom:port":9100,"node:os":"linux"}}`)
+		default:
+			rec.WriteHeader(http.StatusNotFound)
+		}
+		return rec.Result(), nil
+	})))
+	completed, failed := testutil.ToFloat64(enrichmentCompletedCounter), testutil.ToFloat64(enrichmentErrorCounter)
+	got, err := d.Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Attributes are fetched by enrichment, and counted in its metrics.
+	if got := testutil.ToFloat64(enrichmentCompletedCounter) - completed; got != 1 {
+		t.Errorf("PublicAPI: got %v devices enriched, want 1", got)
+	}
+	if got := testutil.ToFloat64(enrichmentErrorCounter) - failed; got != 1 {
+		t.Errorf("PublicAPI: got %v devices failing enrichment, want 1", got)
+	}
+	want := []Device{
+		{
+			API: PublicAPIHost,
+			Attributes: map[string]string{
+				"custom:port": "9100",
+				"custom:team": "sre",
+				"node:os":     "linux",
+			},
+			ID:      "one",
+			Tailnet: "testTailnet",
+		},
+		{
+			// Failing to fetch attributes does not fail discovery.
+			API:     PublicAPIHost,
+			ID:      "two",
+			Tailnet: "testTailnet",
+		},
+	}
+	if diff := cmp.Diff(got, want, cmpopts.IgnoreFields(Device{}, "DiscoveredAt")); diff != "" {
+		t.Errorf("PublicAPI: mismatch (-got, +want):\n%v", diff)
+	}
+
+	targets := translate(got[0].DiscoveredAt, got[:1])
+	if diff := cmp.Diff(targets[0].Labels["__meta_tailscale_device_attr_team"], "sre"); diff != "" {
+		t.Errorf("translate: attribute label mismatch (-got, +want):\n%v", diff)
+	}
+	if _, ok := targets[0].Labels["__meta_tailscale_device_attr_os"]; ok {
+		t.Error("translate: unexpected label for non-custom attribute")
+	}
+}
@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 	"tailscale.com/client/tailscale"
 )
@@ -19,25 +23,54 @@ type deviceAPIResponse struct {
 }
 
 type publicAPIDiscoverer struct {
-	client  *http.Client
-	apiBase string
-	tailnet string
-	token   string
+	client HTTPDoer
+	clock  Clock
+	// The API is reached at scheme://apiBase/pathPrefix.
+	scheme     string
+	apiBase    string
+	pathPrefix string
+	tailnet    string
+	token      string
+
+	// posture attributes are fetched for each device when set.
+	posture bool
+
+	// timeout bounds all of the API requests made by each discovery.
+	timeout time.Duration
+
+	credentials *credentialState
 }
 
 var errFailedAPIRequest = errors.New("failed API request")
 
+// withAPITimeout returns a copy of ctx which is cancelled after timeout, if it
+// is positive, so that a hung API connection fails discovery promptly.
+func withAPITimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// baseURL of the API, including the token.
+func (a *publicAPIDiscoverer) baseURL() string {
+	return fmt.Sprintf("%v://%v@%v%v", a.scheme, a.token, a.apiBase, a.pathPrefix)
+}
+
 func (a *publicAPIDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	ctx, cancel := withAPITimeout(ctx, a.timeout)
+	defer cancel()
 	start := time.Now()
 	lv := prometheus.Labels{
 		"api":  "public",
 		"host": a.apiBase,
 	}
 	defer func() {
-		apiRequestLatencyHistogram.With(lv).Observe(float64(time.Since(start).Milliseconds()))
+		observeLatency(ctx, apiRequestLatencyHistogram.With(lv), start)
 	}()
 
-	url := fmt.Sprintf("https://%v@%v/api/v2/tailnet/%v/devices", a.token, a.apiBase, a.tailnet)
+	client := tracedAPI{api: "public", next: a.client.Do}
+	url := fmt.Sprintf("%v/api/v2/tailnet/%v/devices?fields=all", a.baseURL(), a.tailnet)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
@@ -47,83 +80,160 @@ func (a *publicAPIDiscoverer) Devices(ctx context.Context) ([]Device, error) {
 		"api":  "public",
 		"host": a.apiBase,
 	}).Inc()
-	resp, err := a.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		apiRequestErrorCounter.With(lv).Inc()
 		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		apiRequestErrorCounter.With(lv).Inc()
+		err := fmt.Errorf("%w: %w: %v", errFailedAPIRequest, errUnauthorized, resp.Status)
+		a.credentials.observe(err)
+		return nil, err
+	}
 	if (resp.StatusCode / 100) != 2 {
 		apiRequestErrorCounter.With(lv).Inc()
 		return nil, fmt.Errorf("%w: %v", errFailedAPIRequest, resp.Status)
 	}
-	defer resp.Body.Close()
+	a.credentials.observe(nil)
 	var d deviceAPIResponse
 	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
 		apiPayloadErrorCounter.With(lv).Inc()
 		return nil, fmt.Errorf("%w: bad payload from API: %v", errFailedAPIRequest, err)
 	}
 	tailnetDevicesFoundCounter.With(prometheus.Labels{"tailnet": a.tailnet}).Inc()
+	discovered := a.clock.Now()
 	for i := range d.Devices {
+		d.Devices[i].DiscoveredAt = discovered
+		d.Devices[i].ExitNodeOption = isExitNode(d.Devices[i].EnabledRoutes)
 		d.Devices[i].API = a.apiBase
 		d.Devices[i].Tailnet = a.tailnet
 	}
+	if a.posture {
+		addPostureAttributes(ctx, client, a.baseURL(), d.Devices, lv)
+	}
+	a.checkTokenExpiry(ctx, discovered, lv)
 	return d.Devices, nil
 }
 
+// checkTokenExpiry looks up when the API token expires, if it's due to be
+// checked. Failures are logged, rather than failing discovery.
+func (a *publicAPIDiscoverer) checkTokenExpiry(ctx context.Context, at time.Time, lv prometheus.Labels) {
+	id, ok := apiTokenKeyID(a.token)
+	if !ok || !a.credentials.shouldCheckExpiry(at) {
+		return
+	}
+	apiRequestCounter.With(lv).Inc()
+	expiry, err := fetchKeyExpiry(ctx, tracedAPI{api: "public", next: a.client.Do}, a.baseURL(), a.tailnet, id)
+	if err != nil {
+		apiRequestErrorCounter.With(lv).Inc()
+		log.Printf("Failed looking up the expiry of the API token for tailnet %q: %v", a.tailnet, err)
+		return
+	}
+	a.credentials.expires(expiry, at)
+}
+
 type OAuthPublicAPIDiscoverer struct {
+	// The API is reached at scheme://apiBase/pathPrefix.
+	scheme       string
 	apiBase      string
+	pathPrefix   string
 	clientId     string
 	clientSecret string
+	tailnet      string
+	clock        Clock
+
+	// posture attributes are fetched for each device when set.
+	posture bool
+
+	// timeout bounds all of the API requests made by each discovery.
+	timeout time.Duration
+
+	// tokenURL, if set, replaces the API's token endpoint.
+	tokenURL string
+	// scopes requested with each token.
+	scopes []string
+	// endpointParams are sent with each token request, in addition to the
+	// standard client credentials parameters.
+	endpointParams url.Values
+	authStyle      oauth2.AuthStyle
+
+	credentials *credentialState
 }
 
 func (a *OAuthPublicAPIDiscoverer) Devices(ctx context.Context) ([]Device, error) {
 	tailscale.I_Acknowledge_This_API_Is_Unstable = true // needed in order to use API clients.
 
+	ctx, cancel := withAPITimeout(ctx, a.timeout)
+	defer cancel()
 	start := time.Now()
 	lv := prometheus.Labels{
 		"api":  "public",
 		"host": a.apiBase,
 	}
 	defer func() {
-		apiRequestLatencyHistogram.With(lv).Observe(float64(time.Since(start).Milliseconds()))
+		observeLatency(ctx, apiRequestLatencyHistogram.With(lv), start)
 	}()
 
-	client := tailscale.NewClient("-", nil)
-	client.BaseURL = "https://" + a.apiBase
+	client := tailscale.NewClient(a.tailnet, nil)
+	client.BaseURL = a.scheme + "://" + a.apiBase + a.pathPrefix
 
 	credentials := clientcredentials.Config{
-		ClientID:     a.clientId,
-		ClientSecret: a.clientSecret,
-		TokenURL:     client.BaseURL + "/api/v2/oauth/token",
-		Scopes:       []string{"device"},
+		ClientID:       a.clientId,
+		ClientSecret:   a.clientSecret,
+		TokenURL:       a.tokenURL,
+		Scopes:         a.scopes,
+		EndpointParams: a.endpointParams,
+		AuthStyle:      a.authStyle,
+	}
+	if credentials.TokenURL == "" {
+		credentials.TokenURL = client.BaseURL + "/api/v2/oauth/token"
 	}
 
 	client.HTTPClient = credentials.Client(ctx)
+	client.HTTPClient.Transport = tracedAPI{api: "public", next: client.HTTPClient.Transport.RoundTrip}
 
 	tailnet := client.Tailnet()
 
-	apiDevices, err := client.Devices(ctx, &tailscale.DeviceFieldsOpts{})
+	apiDevices, err := client.Devices(ctx, tailscale.DeviceAllFields)
+	a.credentials.observe(err)
 	if err != nil {
 		apiRequestErrorCounter.With(lv).Inc()
 		return nil, err
 	}
 
 	devices := make([]Device, len(apiDevices))
+	discovered := a.clock.Now()
 
 	for i, device := range apiDevices {
 		devices[i] = Device{
-			Addresses:     device.Addresses,
-			API:           a.apiBase,
-			Authorized:    device.Authorized,
-			ClientVersion: device.ClientVersion,
-			Hostname:      device.Hostname,
-			ID:            device.DeviceID,
-			Name:          device.Name,
-			OS:            device.OS,
-			Tailnet:       tailnet,
-			Tags:          device.Tags,
+			Addresses:         device.Addresses,
+			API:               a.apiBase,
+			Authorized:        device.Authorized,
+			ClientVersion:     device.ClientVersion,
+			Created:           parseTime(device.Created),
+			DiscoveredAt:      discovered,
+			EnabledRoutes:     device.EnabledRoutes,
+			ExitNodeOption:    isExitNode(device.EnabledRoutes),
+			Expires:           parseTime(device.Expires),
+			Hostname:          device.Hostname,
+			ID:                device.DeviceID,
+			IsExternal:        device.IsExternal,
+			KeyExpiryDisabled: device.KeyExpiryDisabled,
+			LastSeen:          parseTime(device.LastSeen),
+			Name:              device.Name,
+			NodeKey:           device.NodeKey,
+			OnlineUnknown:     true,
+			OS:                device.OS,
+			Tailnet:           tailnet,
+			Tags:              device.Tags,
+			User:              device.User,
 		}
 	}
+	if a.posture {
+		addPostureAttributes(ctx, client.HTTPClient, client.BaseURL, devices, lv)
+	}
 	return devices, nil
 }
 
@@ -138,14 +248,125 @@ func WithAPIHost(host string) PublicAPIOption {
 	}
 }
 
+// WithAPIURL sets the base URL, such as "https://api.tailscale.com", against
+// which the PublicAPI Discoverer will attempt discovery. Unlike WithAPIHost,
+// the scheme and any path prefix are also used. Useful for testing against
+// mock APIs.
+func WithAPIURL(u *url.URL) PublicAPIOption {
+	return func(api *publicAPIDiscoverer) {
+		api.scheme = u.Scheme
+		api.apiBase = u.Host
+		api.pathPrefix = strings.TrimSuffix(u.Path, "/")
+	}
+}
+
+// WithOAuthAPIURL is the OAuthAPIOption equivalent of WithAPIURL.
+func WithOAuthAPIURL(u *url.URL) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.scheme = u.Scheme
+		api.apiBase = u.Host
+		api.pathPrefix = strings.TrimSuffix(u.Path, "/")
+	}
+}
+
 // WithHTTPClient is a PublicAPIOption which allows callers to provide a HTTP
 // client to PublicAPI instances. If not used, the defaultHTTPClient is used.
-func WithHTTPClient(client *http.Client) PublicAPIOption {
+func WithHTTPClient(client HTTPDoer) PublicAPIOption {
 	return func(api *publicAPIDiscoverer) {
 		api.client = client
 	}
 }
 
+// WithAPIClock is a PublicAPIOption which sets the Clock used to timestamp
+// discovered devices. If not used, the system clock is used.
+func WithAPIClock(clock Clock) PublicAPIOption {
+	return func(api *publicAPIDiscoverer) {
+		api.clock = clock
+	}
+}
+
+// WithPostureAttributes is a PublicAPIOption which fetches the posture
+// attributes of each device, reporting custom attributes as labels. This
+// makes an additional API request per device.
+func WithPostureAttributes() PublicAPIOption {
+	return func(api *publicAPIDiscoverer) {
+		api.posture = true
+	}
+}
+
+// WithOAuthPostureAttributes is the OAuthAPIOption equivalent of
+// WithPostureAttributes.
+func WithOAuthPostureAttributes() OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.posture = true
+	}
+}
+
+// WithAPITimeout is a PublicAPIOption which bounds each discovery, including
+// all of the API requests it makes, to timeout. If not used, discovery is only
+// bounded by the HTTP client and the context passed to Devices.
+func WithAPITimeout(timeout time.Duration) PublicAPIOption {
+	return func(api *publicAPIDiscoverer) {
+		api.timeout = timeout
+	}
+}
+
+// WithOAuthAPITimeout is the OAuthAPIOption equivalent of WithAPITimeout.
+func WithOAuthAPITimeout(timeout time.Duration) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.timeout = timeout
+	}
+}
+
+// WithOAuthClock is an OAuthAPIOption which sets the Clock used to timestamp
+// discovered devices. If not used, the system clock is used.
+func WithOAuthClock(clock Clock) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.clock = clock
+	}
+}
+
+// WithOAuthTokenURL is an OAuthAPIOption which requests tokens from tokenURL,
+// rather than the API's own token endpoint.
+func WithOAuthTokenURL(tokenURL string) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.tokenURL = tokenURL
+	}
+}
+
+// WithOAuthScopes is an OAuthAPIOption which requests tokens with scopes. If
+// not used, the "device" scope is requested.
+func WithOAuthScopes(scopes ...string) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.scopes = scopes
+	}
+}
+
+// WithOAuthEndpointParams is an OAuthAPIOption which sends additional
+// parameters, such as an audience, with each token request.
+func WithOAuthEndpointParams(params url.Values) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.endpointParams = params
+	}
+}
+
+// WithOAuthAuthStyle is an OAuthAPIOption which determines how the client
+// credentials are presented to the token endpoint. If not used, the style is
+// detected automatically.
+func WithOAuthAuthStyle(style oauth2.AuthStyle) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.authStyle = style
+	}
+}
+
+// WithOAuthTailnet sets the tailnet which the OAuthAPI Discoverer will
+// enumerate. If not used, defaults to the tailnet which owns the OAuth client.
+func WithOAuthTailnet(tailnet string) OAuthAPIOption {
+	return func(api *OAuthPublicAPIDiscoverer) {
+		api.tailnet = tailnet
+	}
+}
+
 // PublicAPIHost host for Tailscale.
 const PublicAPIHost = "api.tailscale.com"
 
@@ -164,6 +385,8 @@ var defaultHTTPClient = &http.Client{
 // PublicAPI Discoverer polls the public Tailscale API for hosts in the tailnet.
 func PublicAPI(tailnet, token string, opts ...PublicAPIOption) Discoverer {
 	api := &publicAPIDiscoverer{
+		clock:   defaultClock,
+		scheme:  "https",
 		apiBase: PublicAPIHost,
 		tailnet: tailnet,
 		token:   token,
@@ -174,19 +397,25 @@ func PublicAPI(tailnet, token string, opts ...PublicAPIOption) Discoverer {
 	if api.client == nil {
 		api.client = defaultHTTPClient
 	}
+	api.credentials = newCredentialState(fmt.Sprintf("the API token for tailnet %q", tailnet), tailnet)
 	return api
 }
 
 // The OAuthAPI Discoverer polls the public Tailscale API for hosts in the tailnet.
 func OAuthAPI(clientID string, clientSecret string, opts ...OAuthAPIOption) Discoverer {
 	api := &OAuthPublicAPIDiscoverer{
+		scheme:       "https",
 		apiBase:      PublicAPIHost,
 		clientId:     clientID,
 		clientSecret: clientSecret,
+		clock:        defaultClock,
+		scopes:       []string{"device"},
+		// The tailnet which owns the OAuth client.
+		tailnet: "-",
 	}
 	for _, opt := range opts {
 		opt(api)
 	}
-
+	api.credentials = newCredentialState(fmt.Sprintf("OAuth client %q", clientID), api.tailnet)
 	return api
 }
@@ -8,9 +8,11 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"golang.org/x/oauth2"
 )
 
 func apiBaseForTest(tb testing.TB, surl string) string {
@@ -23,6 +25,8 @@ func apiBaseForTest(tb testing.TB, surl string) string {
 }
 
 func TestPublicAPIDiscovererDevices(t *testing.T) {
+	discovered := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+
 	var wantPath = "/api/v2/tailnet/testTailnet/devices"
 	for tn, tc := range map[string]struct {
 		responder func(w http.ResponseWriter)
@@ -42,16 +46,35 @@ func TestPublicAPIDiscovererDevices(t *testing.T) {
 			},
 			wantErr: errFailedAPIRequest,
 		},
+		"accepts empty timestamps for external devices": {
+			responder: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/json; encoding=utf-8")
+				_, _ = w.Write([]byte(`{"devices": [{"hostname":"shared","created":"","expires":"2024-03-01T12:00:00Z","isExternal":true}]}`))
+			},
+			want: []Device{
+				{
+					DiscoveredAt: discovered,
+					Expires:      time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+					Hostname:     "shared",
+					IsExternal:   true,
+					Tailnet:      "testTailnet",
+				},
+			},
+		},
 		"returns devices when the server responds with valid JSON": {
 			responder: func(w http.ResponseWriter) {
 				w.Header().Set("Content-Type", "application/json; encoding=utf-8")
-				_, _ = w.Write([]byte(`{"devices": [{"hostname":"testhostname","os":"beos"}]}`))
+				_, _ = w.Write([]byte(`{"devices": [{"hostname":"testhostname","os":"beos","user":"amelie@example.com","lastSeen":"2024-03-01T12:00:00Z","created":"2023-01-02T03:04:05Z"}]}`))
 			},
 			want: []Device{
 				{
-					Hostname: "testhostname",
-					OS:       "beos",
-					Tailnet:  "testTailnet",
+					Created:      time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+					DiscoveredAt: discovered,
+					Hostname:     "testhostname",
+					LastSeen:     time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+					OS:           "beos",
+					Tailnet:      "testTailnet",
+					User:         "amelie@example.com",
 				},
 			},
 		},
@@ -65,7 +88,10 @@ func TestPublicAPIDiscovererDevices(t *testing.T) {
 			}))
 			defer server.Close()
 
-			d := PublicAPI("testTailnet", "testToken", WithHTTPClient(server.Client()), WithAPIHost(apiBaseForTest(t, server.URL)))
+			d := PublicAPI("testTailnet", "testToken",
+				WithHTTPClient(server.Client()),
+				WithAPIHost(apiBaseForTest(t, server.URL)),
+				WithAPIClock(ClockFunc(func() time.Time { return discovered })))
 			got, err := d.Devices(context.TODO())
 			if got, want := err, tc.wantErr; !errors.Is(got, want) {
 				t.Errorf("Devices: error mismatch: got: %q want: %q", got, want)
@@ -97,6 +123,113 @@ func TestWithHTTPClient(t *testing.T) {
 	}
 }
 
+// doerFunc is an HTTPDoer which responds to requests without a network.
+type doerFunc func(*http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestPublicAPIWithHTTPDoer(t *testing.T) {
+	d := PublicAPI("testTailnet", "testToken", WithHTTPClient(doerFunc(func(r *http.Request) (*http.Response, error) {
+		if got, want := r.URL.Host, PublicAPIHost; got != want {
+			t.Errorf("Devices: request host mismatch: got: %q want: %q", got, want)
+		}
+		rec := httptest.NewRecorder()
+		fmt.Fprint(rec, `{"devices":[{"id":"id","hostname":"somethingclever"}]}`)
+		return rec.Result(), nil
+	})))
+	got, err := d.Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{
+		{
+			API:      PublicAPIHost,
+			Hostname: "somethingclever",
+			ID:       "id",
+			Tailnet:  "testTailnet",
+		},
+	}
+	if diff := cmp.Diff(got, want, cmpopts.IgnoreFields(Device{}, "DiscoveredAt")); diff != "" {
+		t.Errorf("PublicAPI: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestPublicAPIWithAPIURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/mock/api/v2/tailnet/testTailnet/devices"; got != want {
+			t.Errorf("Devices: request URL path mismatch: got: %q want: %q", got, want)
+		}
+		fmt.Fprint(w, `{"devices":[{"id":"id"}]}`)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/mock/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := PublicAPI("testTailnet", "testToken", WithAPIURL(u)).Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].API != u.Host {
+		t.Errorf("Devices: mismatch: got: %+v want one device from API %q", got, u.Host)
+	}
+}
+
+func TestOAuthAPIWithTokenRequestOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range map[string]string{
+				"audience":      "tailscale",
+				"scope":         "devices:core:read",
+				"client_id":     "testID",
+				"client_secret": "testSecret",
+			} {
+				if got := r.PostForm.Get(k); got != want {
+					t.Errorf("token request: %s mismatch: got: %q want: %q", k, got, want)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token":"testAccessToken","token_type":"bearer"}`)
+		case "/api/v2/tailnet/-/devices":
+			if got, want := r.Header.Get("Authorization"), "Bearer testAccessToken"; got != want {
+				t.Errorf("Devices: authorization mismatch: got: %q want: %q", got, want)
+			}
+			fmt.Fprint(w, `{"devices":[{"id":"id"}]}`)
+		default:
+			t.Errorf("unexpected request for %q", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := OAuthAPI("testID", "testSecret",
+		WithOAuthAPIURL(u),
+		WithOAuthTokenURL(server.URL+"/token"),
+		WithOAuthScopes("devices:core:read"),
+		WithOAuthEndpointParams(url.Values{"audience": {"tailscale"}}),
+		WithOAuthAuthStyle(oauth2.AuthStyleInParams)).Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Devices: mismatch: got: %+v want one device", got)
+	}
+	if !got[0].OnlineUnknown {
+		t.Error("Devices: want online status unknown, as OAuth clients do not report it")
+	}
+}
+
 type publicAPIOptTester struct {
 	called int
 }
@@ -109,6 +242,7 @@ func (t *publicAPIOptTester) Opt() PublicAPIOption {
 
 func publicAPIDiscovererComparer(l, r *publicAPIDiscoverer) bool {
 	return l.client == r.client &&
+		l.scheme == r.scheme &&
 		l.apiBase == r.apiBase &&
 		l.tailnet == r.tailnet &&
 		l.token == r.token
@@ -121,6 +255,7 @@ func TestPublicAPISetsDefaults(t *testing.T) {
 	}
 	want := &publicAPIDiscoverer{
 		client:  defaultHTTPClient,
+		scheme:  "https",
 		apiBase: PublicAPIHost,
 		tailnet: "testTailnet",
 		token:   "testToken",
@@ -146,3 +281,21 @@ func TestPublicAPIInvokesAllOptionsExactlyOnce(t *testing.T) {
 		}
 	}
 }
+
+func TestAPITimeoutBoundsDiscovery(t *testing.T) {
+	// hung never responds, as when an API connection hangs.
+	hung := doerFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+	for tn, d := range map[string]Discoverer{
+		"public API": PublicAPI("testTailnet", "testToken", WithHTTPClient(hung), WithAPITimeout(10*time.Millisecond)),
+		"local API":  LocalAPI("", WithLocalAPIHTTPClient(hung), WithLocalAPITimeout(10*time.Millisecond)),
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if _, err := d.Devices(context.TODO()); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Devices: error mismatch: got: %v want: %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package tailscalesd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// queryLabels maps the query parameters by which requests may select target
+// groups to the labels they match.
+var queryLabels = map[string]string{
+	"tag":        LabelMetaDeviceTag,
+	"os":         LabelMetaDeviceOS,
+	"online":     LabelMetaDeviceOnline,
+	"authorized": LabelMetaDeviceAuthorized,
+	"tailnet":    LabelMetaTailnet,
+}
+
+// targetSelector keeps target groups whose labels match one of the values
+// given for each selecting label.
+type targetSelector map[string][]string
+
+// parseSelector from the query parameters of a request, such as
+// "?tag=prom&os=linux&online=true". Parameters may be repeated to select any of
+// several values. Tags may omit their "tag:" prefix, OSes are matched
+// case-insensitively, and online and authorized must be booleans.
+func parseSelector(query url.Values) (targetSelector, error) {
+	sel := make(targetSelector)
+	for param, label := range queryLabels {
+		for _, v := range query[param] {
+			switch param {
+			case "tag":
+				if !strings.HasPrefix(v, "tag:") {
+					v = "tag:" + v
+				}
+			case "os":
+				v = strings.ToLower(v)
+			case "online", "authorized":
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("%v must be true or false", param)
+				}
+				v = fmt.Sprint(b)
+			}
+			sel[label] = append(sel[label], v)
+		}
+	}
+	return sel, nil
+}
+
+func (s targetSelector) matches(td TargetDescriptor) bool {
+	for label, values := range s {
+		v := td.Labels[label]
+		if label == LabelMetaDeviceOS {
+			v = strings.ToLower(v)
+		}
+		if !slices.Contains(values, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectTargets returns the target groups matching the selector.
+func selectTargets(targets []TargetDescriptor, s targetSelector) []TargetDescriptor {
+	if len(s) == 0 {
+		return targets
+	}
+	var selected []TargetDescriptor
+	for _, td := range targets {
+		if s.matches(td) {
+			selected = append(selected, td)
+		}
+	}
+	return selected
+}
+
+// TagViewPath is the path prefix under which TagViews serves the target groups
+// for each tag, such as "/targets/tag/web".
+const TagViewPath = "/targets/tag/"
+
+// TagViews wraps a discovery Handler, serving at TagViewPath followed by a tag
+// only the target groups for that tag, as if selected with the tag query
+// parameter. Tags may omit their "tag:" prefix. Other query parameters still
+// apply, so one Prometheus job per tag needs no relabeling.
+func TagViews(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tag := strings.TrimPrefix(r.URL.Path, TagViewPath)
+		if tag == "" || tag == r.URL.Path || strings.Contains(tag, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		query.Set("tag", tag)
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = query.Encode()
+		h.ServeHTTP(w, r)
+	})
+}
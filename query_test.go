@@ -0,0 +1,130 @@
+package tailscalesd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandlerSelectsTargetsByQuery(t *testing.T) {
+	h := Handler(&testDiscoverer{
+		discovered: []Device{
+			{Addresses: []string{"100.2.3.4"}, ID: "linux-prom", OS: "linux", Online: true, Tags: []string{"tag:prom", "tag:web"}},
+			{Addresses: []string{"100.2.3.5"}, ID: "linux-offline", OS: "linux", Tags: []string{"tag:prom"}},
+			{Addresses: []string{"100.2.3.6"}, ID: "windows", OS: "windows", Online: true, Tags: []string{"tag:prom"}},
+		},
+	})
+	for tn, tc := range map[string]struct {
+		query      string
+		want       []string
+		wantStatus int
+	}{
+		"no selection": {
+			want:       []string{"linux-offline", "linux-prom", "linux-prom", "windows"},
+			wantStatus: http.StatusOK,
+		},
+		"tag without prefix": {
+			query:      "tag=web",
+			want:       []string{"linux-prom"},
+			wantStatus: http.StatusOK,
+		},
+		"all parameters must match": {
+			query:      "tag=prom&os=Linux&online=true",
+			want:       []string{"linux-prom"},
+			wantStatus: http.StatusOK,
+		},
+		"repeated parameters match any": {
+			query:      "tag=prom&os=linux&os=windows&online=1",
+			want:       []string{"linux-prom", "windows"},
+			wantStatus: http.StatusOK,
+		},
+		"bad boolean": {
+			query:      "online=maybe",
+			wantStatus: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+tc.query, nil))
+			if got := w.Code; got != tc.wantStatus {
+				t.Fatalf("Handler: status mismatch: got: %v want: %v", got, tc.wantStatus)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var targets []TargetDescriptor
+			if err := json.Unmarshal(w.Body.Bytes(), &targets); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, td := range targets {
+				ids = append(ids, td.Labels[LabelMetaDeviceID])
+			}
+			if diff := cmp.Diff(ids, tc.want); diff != "" {
+				t.Errorf("Handler: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTagViews(t *testing.T) {
+	h := TagViews(Handler(&testDiscoverer{
+		discovered: []Device{
+			{Addresses: []string{"100.2.3.4"}, ID: "web", Online: true, Tags: []string{"tag:web", "tag:prom"}},
+			{Addresses: []string{"100.2.3.5"}, ID: "db", Tags: []string{"tag:db"}},
+		},
+	}))
+	for tn, tc := range map[string]struct {
+		path       string
+		want       []string
+		wantStatus int
+	}{
+		"tag": {
+			path:       "/targets/tag/web",
+			want:       []string{"web"},
+			wantStatus: http.StatusOK,
+		},
+		"tag with prefix": {
+			path:       "/targets/tag/tag:db",
+			want:       []string{"db"},
+			wantStatus: http.StatusOK,
+		},
+		"other parameters apply": {
+			path:       "/targets/tag/prom?online=false",
+			wantStatus: http.StatusOK,
+		},
+		"no tag": {
+			path:       "/targets/tag/",
+			wantStatus: http.StatusNotFound,
+		},
+		"nested path": {
+			path:       "/targets/tag/web/more",
+			wantStatus: http.StatusNotFound,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if got := w.Code; got != tc.wantStatus {
+				t.Fatalf("TagViews: status mismatch: got: %v want: %v", got, tc.wantStatus)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var targets []TargetDescriptor
+			if err := json.Unmarshal(w.Body.Bytes(), &targets); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, td := range targets {
+				ids = append(ids, td.Labels[LabelMetaDeviceID])
+			}
+			if diff := cmp.Diff(ids, tc.want); diff != "" {
+				t.Errorf("TagViews: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
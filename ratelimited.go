@@ -4,12 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var errStaleResults = errors.New("stale discovery results")
 
+// ErrTooStale is returned by a RateLimitedDiscoverer which fails to refresh
+// when its cached results are older than its MaxStale.
+var ErrTooStale = errors.New("discovery results too stale to serve")
+
 // RateLimitedDiscoverer wraps a Discoverer and limits calls to it to be no more
 // frequent than once per Frequency, returning cached values if more frequent
 // calls are made.
@@ -17,9 +25,90 @@ type RateLimitedDiscoverer struct {
 	Wrap      Discoverer
 	Frequency time.Duration
 
-	mu       sync.RWMutex // protects following members
-	earliest time.Time
-	last     []Device
+	// Jitter, if set, lengthens each interval between refreshes by a random
+	// duration up to Jitter, so that replicas started together do not poll the
+	// APIs in lockstep.
+	Jitter time.Duration
+
+	// MaxStale, if set, bounds the age of the cached results served when
+	// refreshing fails. Once they are older, ErrTooStale is returned instead,
+	// so that a broken integration is not masked by serving old results
+	// forever.
+	MaxStale time.Duration
+
+	// Timeout, if set, bounds each refresh. Refreshes are shared by the
+	// callers arriving while they are in flight, so are not cancelled along
+	// with the ctx of any one of them.
+	Timeout time.Duration
+
+	// History, if set, records tag changes between refreshes.
+	History *History
+
+	// Removed, if set, tracks devices which disappear between refreshes.
+	Removed *RemovedDevices
+
+	// Changelog, if set, records the changes found by every refresh.
+	Changelog *Changelog
+	// Name identifies the wrapped Discoverer in the Changelog.
+	Name string
+
+	// Clock against which the Frequency is measured. If nil, the system clock
+	// is used.
+	Clock Clock
+
+	mu sync.RWMutex // protects following members
+	// refreshed is when the last successful refresh happened, according to
+	// now. It carries a monotonic clock reading when set by a refresh.
+	refreshed time.Time
+	last      []Device
+	// jitter lengthening the interval following the last refresh.
+	jitter time.Duration
+	// failures of refreshes since the last successful one.
+	failures int
+	// refreshing is the refresh in flight, if any.
+	refreshing *refresh
+}
+
+// refresh of a RateLimitedDiscoverer, the results of which are shared by all
+// callers arriving while it is in flight.
+type refresh struct {
+	done    chan struct{}
+	devices []Device
+	err     error
+}
+
+// randomJitter returns a random duration in [0, max).
+var randomJitter = func(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
+
+// expired reports whether results are older than frequency, given the time
+// elapsed since their refresh by the monotonic and wall clocks. The monotonic
+// clock is immune to the wall clock being stepped, but stops while the host is
+// suspended, so results also expire once the wall clock has advanced by
+// frequency. At worst, a forward step of the wall clock causes one early
+// refresh.
+func expired(elapsed, wallElapsed, frequency time.Duration) bool {
+	return elapsed < 0 || elapsed >= frequency || wallElapsed >= frequency
+}
+
+// stale reports whether the cached results should be refreshed at the time at.
+func (c *RateLimitedDiscoverer) stale(at time.Time) bool {
+	if c.refreshed.IsZero() {
+		return true
+	}
+	return expired(at.Sub(c.refreshed), at.Round(0).Sub(c.refreshed.Round(0)), c.Frequency+c.jitter)
+}
+
+// now according to the Clock.
+func (c *RateLimitedDiscoverer) now() time.Time {
+	if c.Clock == nil {
+		return defaultClock.Now()
+	}
+	return c.Clock.Now()
 }
 
 func (c *RateLimitedDiscoverer) refreshDevices(ctx context.Context) ([]Device, error) {
@@ -27,28 +116,181 @@ func (c *RateLimitedDiscoverer) refreshDevices(ctx context.Context) ([]Device, e
 
 	devices, err := c.Wrap.Devices(ctx)
 	if err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.failures++
+		if c.refreshed.IsZero() {
+			// There has never been a successful refresh, so there is nothing
+			// stale to serve.
+			return nil, err
+		}
+		if at := c.now(); c.MaxStale > 0 && expired(at.Sub(c.refreshed), at.Round(0).Sub(c.refreshed.Round(0)), c.MaxStale) {
+			rateLimitedTooStaleResults.Inc()
+			return nil, fmt.Errorf("%w: %v", ErrTooStale, err)
+		}
 		rateLimitedStaleResults.Inc()
-		return devices, fmt.Errorf("%w: %v", errStaleResults, err)
+		last := make([]Device, len(c.last))
+		_ = copy(last, c.last)
+		return last, fmt.Errorf("%w: %v", errStaleResults, err)
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.refreshed = c.now()
+	c.jitter = randomJitter(c.Jitter)
+	c.failures = 0
+	countOnlineTransitions(c.last, devices)
+	recordFleetCounts(c, devices)
+	c.History.record(c.last, devices, c.refreshed.Round(0))
+	c.Removed.record(c, c.last, devices, c.refreshed.Round(0))
+	c.Changelog.record(c.Name, c.last, devices, c.refreshed.Round(0))
 	c.last = devices
-	c.earliest = time.Now().Add(c.Frequency)
 	return devices, nil
 }
 
+// coalescedRefresh refreshes the devices, unless a refresh is already in
+// flight, in which case its results are shared. This way, many scrapers
+// arriving together once the results expire cause one call to the wrapped
+// Discoverer rather than one each. The refresh is not cancelled with the ctx
+// of the caller which started it, so that the callers sharing it are not
+// failed by one which gives up; every caller may instead stop waiting when its
+// own ctx is done.
+func (c *RateLimitedDiscoverer) coalescedRefresh(ctx context.Context) ([]Device, error) {
+	c.mu.Lock()
+	r := c.refreshing
+	if r != nil {
+		c.mu.Unlock()
+		rateLimitedCoalescedRefreshes.Inc()
+	} else {
+		r = &refresh{done: make(chan struct{})}
+		c.refreshing = r
+		c.mu.Unlock()
+		go c.runRefresh(context.WithoutCancel(ctx), r)
+	}
+	select {
+	case <-r.done:
+		return slices.Clone(r.devices), r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runRefresh performs the refresh r, bounded by the Timeout.
+func (c *RateLimitedDiscoverer) runRefresh(ctx context.Context, r *refresh) {
+	ctx, cancel := withAPITimeout(ctx, c.Timeout)
+	defer cancel()
+	r.devices, r.err = c.refreshDevices(ctx)
+	c.mu.Lock()
+	c.refreshing = nil
+	c.mu.Unlock()
+	close(r.done)
+}
+
+// forceRefreshKey is the context key marking forced refreshes.
+type forceRefreshKey struct{}
+
+// ForceRefresh returns a copy of ctx with which RateLimitedDiscoverers refresh
+// their results regardless of their Frequency. It is intended for internal
+// callers which know the results to be outdated, such as a webhook reporting
+// a tailnet change or an administrative reload, while requests from scrapers
+// stay rate limited.
+func ForceRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceRefreshKey{}, true)
+}
+
+// forcingRefresh reports whether ctx was returned by ForceRefresh.
+func forcingRefresh(ctx context.Context) bool {
+	forced, _ := ctx.Value(forceRefreshKey{}).(bool)
+	return forced
+}
+
+// Devices reported by the wrapped Discoverer, refreshed at most once per
+// Frequency unless the ctx was returned by ForceRefresh. Concurrent callers
+// share a single refresh.
 func (c *RateLimitedDiscoverer) Devices(ctx context.Context) ([]Device, error) {
 	rateLimitedRequests.Inc()
 
 	c.mu.RLock()
-	expired := time.Now().After(c.earliest)
+	stale := forcingRefresh(ctx) || c.stale(c.now())
 	last := make([]Device, len(c.last))
 	_ = copy(last, c.last)
 	c.mu.RUnlock()
 
-	if expired {
-		return c.refreshDevices(ctx)
+	if stale {
+		return c.coalescedRefresh(ctx)
 	}
 	return last, nil
 }
+
+// Cached returns the results of the last successful refresh, and when it
+// happened. ok is false if there has never been a successful refresh.
+func (c *RateLimitedDiscoverer) Cached() (devices []Device, refreshed time.Time, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.refreshed.IsZero() {
+		return nil, time.Time{}, false
+	}
+	devices = make([]Device, len(c.last))
+	_ = copy(devices, c.last)
+	return devices, c.refreshed.Round(0), true
+}
+
+// Failures returns the number of consecutive refreshes which have failed since
+// the last successful one.
+func (c *RateLimitedDiscoverer) Failures() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.failures
+}
+
+// Deregister c from the metrics aggregated across RateLimitedDiscoverers, such
+// as tailscalesd_devices and tailscalesd_tag_combination_devices, which no
+// longer count the devices it last refreshed. Discoverers which are discarded
+// should be deregistered.
+func (c *RateLimitedDiscoverer) Deregister() {
+	forgetFleetCounts(c)
+}
+
+// Prime the cache with devices discovered at refreshed, typically by another
+// instance, unless the cached results are at least as recent. The next
+// refresh happens when it would have following refreshed. Returns whether the
+// cache was primed.
+func (c *RateLimitedDiscoverer) Prime(devices []Device, refreshed time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.refreshed.IsZero() && !refreshed.After(c.refreshed) {
+		return false
+	}
+	// Anchor the refresh time to the monotonic clock, so that it is tracked
+	// the same way as local refreshes. Results from the future, according to
+	// the local clock, are treated as just refreshed.
+	at := c.now()
+	age := max(at.Round(0).Sub(refreshed), 0)
+	c.last = devices
+	c.refreshed = at.Add(-age)
+	c.jitter = randomJitter(c.Jitter)
+	return true
+}
+
+// countOnlineTransitions between the previous and current results of a
+// refresh. Devices not present in both, or whose online status is unknown,
+// are not counted.
+func countOnlineTransitions(previous, current []Device) {
+	wasOnline := make(map[string]bool, len(previous))
+	for _, d := range previous {
+		if !d.OnlineUnknown {
+			wasOnline[d.ID] = d.Online
+		}
+	}
+	for _, d := range current {
+		was, ok := wasOnline[d.ID]
+		if !ok || d.OnlineUnknown || was == d.Online {
+			continue
+		}
+		to := "offline"
+		if d.Online {
+			to = "online"
+		}
+		onlineTransitionsCounter.With(prometheus.Labels{"to": to}).Inc()
+	}
+}
@@ -3,10 +3,12 @@ package tailscalesd
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var devicesForRatelimitedTest = []Device{
@@ -29,6 +31,8 @@ var devicesForRatelimitedTest = []Device{
 	},
 }
 
+var errRateLimitedTest = errors.New("this is a test error")
+
 func discovererForTest(tb testing.TB) *testDiscoverer {
 	tb.Helper()
 	return &testDiscoverer{
@@ -62,7 +66,7 @@ func TestRateLimitedDiscoverer(t *testing.T) {
 		},
 		"rate limited discoverer which is expired calls Discover": {
 			discoverer: &RateLimitedDiscoverer{
-				earliest: time.Now().Add(-30 * time.Hour),
+				refreshed: time.Now().Add(-30 * time.Hour),
 			},
 			wrapped: discovererForTest(t),
 			want: rateLimitedDiscovererTestWant{
@@ -72,7 +76,8 @@ func TestRateLimitedDiscoverer(t *testing.T) {
 		},
 		"rate limited discoverer which is not expired returns cached results": {
 			discoverer: &RateLimitedDiscoverer{
-				earliest: time.Now().Add(30 * time.Hour),
+				Frequency: 30 * time.Hour,
+				refreshed: time.Now(),
 				last: []Device{
 					{ID: "ratelimittest"},
 				},
@@ -86,7 +91,8 @@ func TestRateLimitedDiscoverer(t *testing.T) {
 		},
 		"rate limited discoverer which is expired returns cached results on error": {
 			discoverer: &RateLimitedDiscoverer{
-				earliest: time.Now().Add(30 * time.Hour),
+				Frequency: 30 * time.Hour,
+				refreshed: time.Now(),
 				last: []Device{
 					{ID: "ratelimittest"},
 				},
@@ -100,6 +106,34 @@ func TestRateLimitedDiscoverer(t *testing.T) {
 				},
 			},
 		},
+		"rate limited discoverer which is expired returns stale cached results on refresh error": {
+			discoverer: &RateLimitedDiscoverer{
+				refreshed: time.Now().Add(-30 * time.Hour),
+				last: []Device{
+					{ID: "ratelimittest"},
+				},
+			},
+			wrapped: &testDiscoverer{
+				err: errRateLimitedTest,
+			},
+			want: rateLimitedDiscovererTestWant{
+				called: 1,
+				err:    errStaleResults,
+				devices: []Device{
+					{ID: "ratelimittest"},
+				},
+			},
+		},
+		"rate limited discoverer which has never succeeded returns refresh error": {
+			discoverer: &RateLimitedDiscoverer{},
+			wrapped: &testDiscoverer{
+				err: errRateLimitedTest,
+			},
+			want: rateLimitedDiscovererTestWant{
+				called: 1,
+				err:    errRateLimitedTest,
+			},
+		},
 	} {
 		t.Run(tn, func(t *testing.T) {
 			tc.discoverer.Wrap = tc.wrapped
@@ -116,3 +150,309 @@ func TestRateLimitedDiscoverer(t *testing.T) {
 		})
 	}
 }
+
+func TestCountOnlineTransitions(t *testing.T) {
+	onlineBefore := testutil.ToFloat64(onlineTransitionsCounter.WithLabelValues("online"))
+	offlineBefore := testutil.ToFloat64(onlineTransitionsCounter.WithLabelValues("offline"))
+
+	countOnlineTransitions([]Device{
+		{ID: "comes-online"},
+		{ID: "goes-offline", Online: true},
+		{ID: "stays-online", Online: true},
+		{ID: "removed", Online: true},
+	}, []Device{
+		{ID: "comes-online", Online: true},
+		{ID: "goes-offline"},
+		{ID: "stays-online", Online: true},
+		{ID: "added", Online: true},
+	})
+
+	if got := testutil.ToFloat64(onlineTransitionsCounter.WithLabelValues("online")) - onlineBefore; got != 1 {
+		t.Errorf("countOnlineTransitions: online transitions mismatch: got: %v want: 1", got)
+	}
+	if got := testutil.ToFloat64(onlineTransitionsCounter.WithLabelValues("offline")) - offlineBefore; got != 1 {
+		t.Errorf("countOnlineTransitions: offline transitions mismatch: got: %v want: 1", got)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		elapsed     time.Duration
+		wallElapsed time.Duration
+		want        bool
+	}{
+		"within frequency": {
+			elapsed:     time.Minute,
+			wallElapsed: time.Minute,
+		},
+		"after frequency": {
+			elapsed:     5 * time.Minute,
+			wallElapsed: 5 * time.Minute,
+			want:        true,
+		},
+		"wall clock stepped backwards": {
+			elapsed:     time.Minute,
+			wallElapsed: -time.Hour,
+		},
+		"wall clock stepped backwards before frequency": {
+			elapsed:     5 * time.Minute,
+			wallElapsed: -time.Hour,
+			want:        true,
+		},
+		"resumed from suspend": {
+			elapsed:     time.Minute,
+			wallElapsed: time.Hour,
+			want:        true,
+		},
+		"refreshed in the future": {
+			elapsed:     -time.Hour,
+			wallElapsed: -time.Hour,
+			want:        true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := expired(tc.elapsed, tc.wallElapsed, 5*time.Minute); got != tc.want {
+				t.Errorf("expired: mismatch: got: %v want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedDiscovererFollowsFakeClock(t *testing.T) {
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	wrapped := discovererForTest(t)
+	d := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: time.Minute,
+		Clock:     ClockFunc(func() time.Time { return clock }),
+	}
+	for _, step := range []struct {
+		advance time.Duration
+		called  int
+	}{
+		{called: 1},
+		{advance: 30 * time.Second, called: 1},
+		{advance: -time.Hour, called: 2},
+		{advance: 59 * time.Second, called: 2},
+		{advance: time.Second, called: 3},
+	} {
+		clock = clock.Add(step.advance)
+		if _, err := d.Devices(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		if got := wrapped.Called; got != step.called {
+			t.Errorf("RateLimitedDiscoverer(%v): mismatched Discover call count: got: %d want: %d", clock, got, step.called)
+		}
+	}
+}
+
+func TestRateLimitedDiscovererForcedRefresh(t *testing.T) {
+	wrapped := discovererForTest(t)
+	d := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: time.Hour,
+	}
+	for _, step := range []struct {
+		ctx    context.Context
+		called int
+	}{
+		{ctx: context.TODO(), called: 1},
+		{ctx: context.TODO(), called: 1},
+		{ctx: ForceRefresh(context.TODO()), called: 2},
+		{ctx: context.TODO(), called: 2},
+	} {
+		if _, err := d.Devices(step.ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := wrapped.Called; got != step.called {
+			t.Errorf("RateLimitedDiscoverer: mismatched Discover call count: got: %d want: %d", got, step.called)
+		}
+	}
+}
+
+func TestRateLimitedDiscovererJitter(t *testing.T) {
+	was := randomJitter
+	defer func() { randomJitter = was }()
+	randomJitter = func(max time.Duration) time.Duration { return max / 2 }
+
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	wrapped := discovererForTest(t)
+	d := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: time.Minute,
+		Jitter:    time.Minute,
+		Clock:     ClockFunc(func() time.Time { return clock }),
+	}
+	for _, step := range []struct {
+		advance time.Duration
+		called  int
+	}{
+		{called: 1},
+		{advance: time.Minute, called: 1},
+		{advance: 29 * time.Second, called: 1},
+		{advance: time.Second, called: 2},
+	} {
+		clock = clock.Add(step.advance)
+		if _, err := d.Devices(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		if got := wrapped.Called; got != step.called {
+			t.Errorf("RateLimitedDiscoverer(%v): mismatched Discover call count: got: %d want: %d", clock, got, step.called)
+		}
+	}
+}
+
+func TestRandomJitter(t *testing.T) {
+	if got := randomJitter(0); got != 0 {
+		t.Errorf("randomJitter(0): got: %v want: 0", got)
+	}
+	for i := 0; i < 100; i++ {
+		if got := randomJitter(time.Second); got < 0 || got >= time.Second {
+			t.Fatalf("randomJitter(1s): got %v, out of range", got)
+		}
+	}
+}
+
+// blockingDiscoverer reports devices once released, counting its calls.
+type blockingDiscoverer struct {
+	called  atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDiscoverer) Devices(context.Context) ([]Device, error) {
+	d.called.Add(1)
+	d.started <- struct{}{}
+	<-d.release
+	return devicesForRatelimitedTest, nil
+}
+
+func TestRateLimitedDiscovererCoalescesRefreshes(t *testing.T) {
+	wrapped := &blockingDiscoverer{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	d := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: time.Hour,
+	}
+	const callers = 5
+	coalesced := testutil.ToFloat64(rateLimitedCoalescedRefreshes)
+	results := make(chan []Device, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			devices, err := d.Devices(context.TODO())
+			if err != nil {
+				t.Error(err)
+			}
+			results <- devices
+		}()
+		if i == 0 {
+			<-wrapped.started
+		}
+	}
+	// Release the refresh once every other caller is waiting for it.
+	for testutil.ToFloat64(rateLimitedCoalescedRefreshes)-coalesced < callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(wrapped.release)
+	for i := 0; i < callers; i++ {
+		if diff := cmp.Diff(<-results, devicesForRatelimitedTest); diff != "" {
+			t.Errorf("RateLimitedDiscoverer: mismatch (-got, +want):\n%v", diff)
+		}
+	}
+	if got := wrapped.called.Load(); got != 1 {
+		t.Errorf("RateLimitedDiscoverer: mismatched Discover call count: got: %d want: 1", got)
+	}
+}
+
+func TestRateLimitedDiscovererAbandonsCoalescedRefresh(t *testing.T) {
+	wrapped := &blockingDiscoverer{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	defer close(wrapped.release)
+	d := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: time.Hour,
+	}
+	go d.Devices(context.TODO())
+	<-wrapped.started
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if _, err := d.Devices(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("RateLimitedDiscoverer: want context.Canceled, got: %v", err)
+	}
+}
+
+func TestRateLimitedDiscovererSharesRefreshAbandonedByLeader(t *testing.T) {
+	wrapped := &blockingDiscoverer{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	d := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	leader := make(chan error)
+	go func() {
+		_, err := d.Devices(ctx)
+		leader <- err
+	}()
+	<-wrapped.started
+	coalesced := testutil.ToFloat64(rateLimitedCoalescedRefreshes)
+	waiter := make(chan []Device)
+	go func() {
+		devices, err := d.Devices(context.TODO())
+		if err != nil {
+			t.Error(err)
+		}
+		waiter <- devices
+	}()
+	for testutil.ToFloat64(rateLimitedCoalescedRefreshes) == coalesced {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("RateLimitedDiscoverer: want context.Canceled for the leader, got: %v", err)
+	}
+	close(wrapped.release)
+	if diff := cmp.Diff(<-waiter, devicesForRatelimitedTest); diff != "" {
+		t.Errorf("RateLimitedDiscoverer: mismatch (-got, +want):\n%v", diff)
+	}
+	if got := d.Failures(); got != 0 {
+		t.Errorf("RateLimitedDiscoverer: got %d failures, want 0", got)
+	}
+}
+
+func TestRateLimitedDiscovererMaxStale(t *testing.T) {
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	wrapped := discovererForTest(t)
+	d := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: time.Minute,
+		MaxStale:  time.Hour,
+		Clock:     ClockFunc(func() time.Time { return clock }),
+	}
+	if _, err := d.Devices(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	wrapped.err = errRateLimitedTest
+	for _, step := range []struct {
+		advance time.Duration
+		want    error
+	}{
+		{advance: 59 * time.Minute, want: errStaleResults},
+		{advance: time.Minute, want: ErrTooStale},
+	} {
+		clock = clock.Add(step.advance)
+		devices, err := d.Devices(context.TODO())
+		if !errors.Is(err, step.want) {
+			t.Errorf("RateLimitedDiscoverer(%v): want error %v, got: %v", clock, step.want, err)
+		}
+		if errors.Is(err, ErrTooStale) && devices != nil {
+			t.Errorf("RateLimitedDiscoverer(%v): want no devices beyond MaxStale, got: %v", clock, devices)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package tailscalesd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RemovedDevice is a device which disappeared from discovery results.
+type RemovedDevice struct {
+	ID       string    `json:"id"`
+	Hostname string    `json:"hostname"`
+	Tags     []string  `json:"tags"`
+	Removed  time.Time `json:"removed"`
+}
+
+type removal struct {
+	RemovedDevice
+
+	// source is the RateLimitedDiscoverer from whose results the device
+	// disappeared. Only its refreshes age the removal, or find the device
+	// reappeared.
+	source any
+	// refreshesLeft before the removal is forgotten.
+	refreshesLeft int
+}
+
+// RemovedDevices tracks the devices which disappeared from the results of
+// RateLimitedDiscoverers within their last few refreshes. Devices which
+// reappear are forgotten, and counted in the
+// tailscalesd_removed_devices_reappeared metric; frequent reappearances
+// suggest discovery glitches, rather than intentional decommissions.
+type RemovedDevices struct {
+	refreshes int
+
+	mu       sync.Mutex // protects following members
+	removals []removal
+}
+
+// NewRemovedDevices remembering devices for the given number of refreshes
+// after their removal.
+func NewRemovedDevices(refreshes int) *RemovedDevices {
+	return &RemovedDevices{refreshes: refreshes}
+}
+
+// record the devices removed between the previous and current results of a
+// refresh of source at the time at. A nil RemovedDevices records nothing.
+func (r *RemovedDevices) record(source any, previous, current []Device, at time.Time) {
+	if r == nil {
+		return
+	}
+	present := make(map[string]bool, len(current))
+	for _, d := range current {
+		present[d.ID] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := r.removals[:0]
+	for _, rm := range r.removals {
+		if rm.source != source {
+			kept = append(kept, rm)
+			continue
+		}
+		if present[rm.ID] {
+			removedDevicesReappearedCounter.Inc()
+			continue
+		}
+		if rm.refreshesLeft--; rm.refreshesLeft > 0 {
+			kept = append(kept, rm)
+		}
+	}
+	r.removals = kept
+	for _, d := range previous {
+		if present[d.ID] {
+			continue
+		}
+		r.removals = append(r.removals, removal{
+			RemovedDevice: RemovedDevice{
+				ID:       d.ID,
+				Hostname: d.Hostname,
+				Tags:     d.Tags,
+				Removed:  at,
+			},
+			source:        source,
+			refreshesLeft: r.refreshes,
+		})
+	}
+	removedDevicesGauge.Set(float64(len(r.removals)))
+}
+
+// Devices removed recently, in the order they were removed.
+func (r *RemovedDevices) Devices() []RemovedDevice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	devices := make([]RemovedDevice, len(r.removals))
+	for i, rm := range r.removals {
+		devices[i] = rm.RemovedDevice
+	}
+	return devices
+}
+
+type removedDevicesHandler struct {
+	r *RemovedDevices
+}
+
+func (h removedDevicesHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b, err := json.Marshal(h.r.Devices())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		serveAndLog(w, fmt.Sprintf("Failed encoding removed devices: %v", err))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(b); err != nil {
+		log.Printf("Failed sending removed devices to the client: %v", err)
+	}
+}
+
+// RemovedDevicesHandler serves the devices recently removed as JSON.
+func RemovedDevicesHandler(r *RemovedDevices) http.Handler {
+	return removedDevicesHandler{r}
+}
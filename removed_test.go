@@ -0,0 +1,78 @@
+package tailscalesd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRemovedDevices(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	source, other := new(int), new(int)
+	r := NewRemovedDevices(2)
+
+	r.record(source, []Device{
+		{ID: "one", Hostname: "foo", Tags: []string{"tag:a"}},
+		{ID: "two", Hostname: "bar"},
+		{ID: "three", Hostname: "baz"},
+	}, []Device{
+		{ID: "three", Hostname: "baz"},
+	}, at)
+	want := []RemovedDevice{
+		{ID: "one", Hostname: "foo", Tags: []string{"tag:a"}, Removed: at},
+		{ID: "two", Hostname: "bar", Removed: at},
+	}
+	if diff := cmp.Diff(r.Devices(), want); diff != "" {
+		t.Errorf("RemovedDevices: mismatch (-got, +want):\n%v", diff)
+	}
+
+	// Refreshes of other sources neither age removals nor find them
+	// reappeared.
+	r.record(other, nil, []Device{{ID: "two"}}, at)
+	if diff := cmp.Diff(r.Devices(), want); diff != "" {
+		t.Errorf("RemovedDevices: mismatch after other source refreshed (-got, +want):\n%v", diff)
+	}
+
+	reappeared := testutil.ToFloat64(removedDevicesReappearedCounter)
+	r.record(source, []Device{{ID: "three"}}, []Device{{ID: "two"}, {ID: "three"}}, at)
+	if got := testutil.ToFloat64(removedDevicesReappearedCounter) - reappeared; got != 1 {
+		t.Errorf("RemovedDevices: reappeared mismatch: got: %v want: 1", got)
+	}
+	if diff := cmp.Diff(r.Devices(), want[:1]); diff != "" {
+		t.Errorf("RemovedDevices: mismatch after reappearance (-got, +want):\n%v", diff)
+	}
+
+	r.record(source, []Device{{ID: "two"}, {ID: "three"}}, []Device{{ID: "two"}, {ID: "three"}}, at)
+	if got := r.Devices(); len(got) != 0 {
+		t.Errorf("RemovedDevices: expected removals to be forgotten, got: %v", got)
+	}
+	if got := testutil.ToFloat64(removedDevicesGauge); got != 0 {
+		t.Errorf("RemovedDevices: gauge mismatch: got: %v want: 0", got)
+	}
+}
+
+func TestRateLimitedDiscovererRecordsRemovals(t *testing.T) {
+	wrapped := &testDiscoverer{discovered: []Device{{ID: "one"}, {ID: "two"}}}
+	removed := NewRemovedDevices(10)
+	d := &RateLimitedDiscoverer{Wrap: wrapped, Removed: removed}
+	if _, err := d.Devices(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	wrapped.discovered = []Device{{ID: "one"}}
+	if _, err := d.Devices(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/debug/recently-removed", nil)
+	w := httptest.NewRecorder()
+	RemovedDevicesHandler(removed).ServeHTTP(w, r)
+	if got, want := w.Body.String(), `[{"id":"two","hostname":"","tags":null,"removed":`; !strings.HasPrefix(got, want) {
+		t.Errorf("RemovedDevicesHandler: content mismatch: got: %q want prefix: %q", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+package tailscalesd
+
+import (
+	"maps"
+	"net/netip"
+	"strconv"
+)
+
+// RouteTarget describes services on addresses behind subnet routers, which
+// are not themselves on the tailnet. Each address is served as a target when
+// a device is approved to route to it, labeled with that router.
+type RouteTarget struct {
+	// Addresses of the services, such as RFC1918 addresses of a LAN.
+	Addresses []netip.Addr
+	// Port on which the services are scraped.
+	Port uint16
+
+	// Labels set on the targets.
+	Labels map[string]string
+}
+
+// router approved to route to an address, and the route it uses.
+type router struct {
+	device *Device
+	route  netip.Prefix
+}
+
+// routerFor the address among devices: the one with the most specific approved
+// route to it, preferring online devices, then devices in the order given.
+// Default routes, approved for exit nodes, are ignored.
+func routerFor(addr netip.Addr, devices []Device) (router, bool) {
+	var found router
+	for i := range devices {
+		d := &devices[i]
+		for _, r := range d.EnabledRoutes {
+			route, err := netip.ParsePrefix(r)
+			if err != nil || route.Bits() == 0 || !route.Contains(addr) {
+				continue
+			}
+			switch {
+			case found.device == nil,
+				route.Bits() > found.route.Bits(),
+				route.Bits() == found.route.Bits() && d.Online && !found.device.Online:
+				found = router{device: d, route: route}
+			}
+		}
+	}
+	return found, found.device != nil
+}
+
+// routeTargets served for the rules, given the devices discovered. Addresses
+// to which no device is approved to route are not served.
+func routeTargets(devices []Device, rules []RouteTarget) []TargetDescriptor {
+	var found []TargetDescriptor
+	for _, rule := range rules {
+		for _, addr := range rule.Addresses {
+			r, ok := routerFor(addr, devices)
+			if !ok {
+				continue
+			}
+			td := TargetDescriptor{
+				Targets: []string{netip.AddrPortFrom(addr, rule.Port).String()},
+				Labels:  maps.Clone(rule.Labels),
+			}
+			if td.Labels == nil {
+				td.Labels = make(map[string]string)
+			}
+			td.Labels[LabelMetaAPI] = r.device.API
+			td.Labels[LabelMetaPort] = strconv.Itoa(int(rule.Port))
+			td.Labels[LabelMetaRoute] = r.route.String()
+			td.Labels[LabelMetaRouterHostname] = r.device.Hostname
+			td.Labels[LabelMetaRouterID] = r.device.ID
+			setIfNotEmpty(td.Labels, LabelMetaTailnet, r.device.Tailnet)
+			found = append(found, td)
+		}
+	}
+	return found
+}
@@ -0,0 +1,60 @@
+package tailscalesd
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRouteTargets(t *testing.T) {
+	devices := []Device{
+		{ID: "exit", Hostname: "exit", EnabledRoutes: []string{"0.0.0.0/0", "::/0"}, Online: true},
+		{ID: "wide", Hostname: "wide", API: "api.tailscale.com", Tailnet: "example.com", EnabledRoutes: []string{"10.0.0.0/16"}, Online: true},
+		{ID: "offline", Hostname: "offline", API: "api.tailscale.com", Tailnet: "example.com", EnabledRoutes: []string{"10.0.1.0/24"}},
+		{ID: "online", Hostname: "online", API: "api.tailscale.com", Tailnet: "example.com", EnabledRoutes: []string{"10.0.1.0/24"}, Online: true},
+	}
+	rules := []RouteTarget{
+		{
+			Addresses: []netip.Addr{
+				netip.MustParseAddr("10.0.1.5"),
+				netip.MustParseAddr("10.0.2.5"),
+				netip.MustParseAddr("192.168.0.5"),
+			},
+			Port:   9100,
+			Labels: map[string]string{"job": "lan"},
+		},
+	}
+	want := []TargetDescriptor{
+		{
+			Targets: []string{"10.0.1.5:9100"},
+			Labels: map[string]string{
+				"job":                   "lan",
+				LabelMetaAPI:            "api.tailscale.com",
+				LabelMetaPort:           "9100",
+				LabelMetaRoute:          "10.0.1.0/24",
+				LabelMetaRouterHostname: "online",
+				LabelMetaRouterID:       "online",
+				LabelMetaTailnet:        "example.com",
+			},
+		},
+		{
+			Targets: []string{"10.0.2.5:9100"},
+			Labels: map[string]string{
+				"job":                   "lan",
+				LabelMetaAPI:            "api.tailscale.com",
+				LabelMetaPort:           "9100",
+				LabelMetaRoute:          "10.0.0.0/16",
+				LabelMetaRouterHostname: "wide",
+				LabelMetaRouterID:       "wide",
+				LabelMetaTailnet:        "example.com",
+			},
+		},
+	}
+	if diff := cmp.Diff(routeTargets(devices, rules), want); diff != "" {
+		t.Errorf("routeTargets: mismatch (-got, +want):\n%v", diff)
+	}
+	if rules[0].Labels["job"] != "lan" || len(rules[0].Labels) != 1 {
+		t.Error("routeTargets: modified the rule's labels")
+	}
+}
@@ -0,0 +1,131 @@
+package tailscalesd
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LabelExporter is the name of the exporter found listening on the target's
+// port by a PortScanner.
+const LabelExporter = "exporter"
+
+// DefaultScanPorts are the ports on which well-known Prometheus exporters
+// listen, keyed to the exporters' names.
+var DefaultScanPorts = map[uint16]string{
+	9100: "node",
+	9104: "mysqld",
+	9113: "nginx",
+	9121: "redis",
+	9182: "windows",
+	9187: "postgres",
+	9256: "process",
+}
+
+// DefaultScanTimeout bounds each connection attempt of a PortScanner which
+// does not specify its own.
+const DefaultScanTimeout = time.Second
+
+// OpenPort on a device, found by a PortScanner.
+type OpenPort struct {
+	Port     uint16 `json:"port"`
+	Exporter string `json:"exporter"`
+}
+
+// PortScanner is an Enricher which finds the exporters running on devices, by
+// attempting to connect to each of their Ports. Devices with open ports are
+// served with one target per open port, labeled with the exporter's name in
+// LabelExporter. Only the first address of each device is scanned, preferring
+// IPv4.
+type PortScanner struct {
+	// Ports to scan, keyed to the names of the exporters conventionally
+	// listening on them.
+	Ports map[uint16]string
+	// Timeout of each connection attempt. DefaultScanTimeout if zero.
+	Timeout time.Duration
+	// Dial connects to addresses. If nil, the host's network is used.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (s *PortScanner) dial(ctx context.Context, address string) (net.Conn, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScanTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if s.Dial != nil {
+		return s.Dial(ctx, "tcp", address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// scanAddress returns the address of the device to scan, preferring IPv4.
+func scanAddress(d *Device) (netip.Addr, bool) {
+	var found netip.Addr
+	for _, a := range d.Addresses {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			continue
+		}
+		if addr.Is4() {
+			return addr, true
+		}
+		if !found.IsValid() {
+			found = addr
+		}
+	}
+	return found, found.IsValid()
+}
+
+// Enrich the device with its open ports.
+func (s *PortScanner) Enrich(ctx context.Context, d *Device) error {
+	addr, ok := scanAddress(d)
+	if !ok {
+		return nil
+	}
+	var (
+		mu   sync.Mutex
+		open []OpenPort
+		wg   sync.WaitGroup
+	)
+	for port, exporter := range s.Ports {
+		wg.Add(1)
+		go func(port uint16, exporter string) {
+			defer wg.Done()
+			conn, err := s.dial(ctx, net.JoinHostPort(addr.String(), strconv.Itoa(int(port))))
+			if err != nil {
+				return
+			}
+			conn.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			open = append(open, OpenPort{Port: port, Exporter: exporter})
+		}(port, exporter)
+	}
+	wg.Wait()
+	slices.SortFunc(open, func(a, b OpenPort) int {
+		return int(a.Port) - int(b.Port)
+	})
+	d.OpenPorts = open
+	return ctx.Err()
+}
+
+// withOpenPorts returns one copy of td for each open port, ready to scrape
+// the exporter listening on it. td is returned alone if there are none.
+func withOpenPorts(td TargetDescriptor, open []OpenPort) []TargetDescriptor {
+	if len(open) == 0 {
+		return []TargetDescriptor{td}
+	}
+	out := make([]TargetDescriptor, len(open))
+	for i, p := range open {
+		out[i] = withPorts(td, p.Port)
+		out[i].Labels[LabelExporter] = p.Exporter
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package tailscalesd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// portForTest returns a local port, which is listening if open.
+func portForTest(t *testing.T, open bool) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open {
+		t.Cleanup(func() { ln.Close() })
+	} else {
+		ln.Close()
+	}
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestPortScanner(t *testing.T) {
+	open, closed := portForTest(t, true), portForTest(t, false)
+	s := &PortScanner{
+		Ports: map[uint16]string{
+			open:   "test",
+			closed: "closed",
+		},
+		Timeout: time.Second,
+	}
+	d := Device{Addresses: []string{"::1", "127.0.0.1"}}
+	if err := s.Enrich(context.TODO(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(d.OpenPorts, []OpenPort{{Port: open, Exporter: "test"}}); diff != "" {
+		t.Errorf("PortScanner: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestTranslateOpenPorts(t *testing.T) {
+	got := translate(time.Time{}, []Device{{
+		Addresses: []string{"100.2.3.4"},
+		OpenPorts: []OpenPort{{Port: 9100, Exporter: "node"}, {Port: 9187, Exporter: "postgres"}},
+	}}, filterEmptyLabels)
+	var targets []string
+	for _, td := range got {
+		targets = append(targets, td.Targets...)
+		if td.Labels[LabelExporter] == "" {
+			t.Errorf("translate: target group %v has no exporter label", td.Targets)
+		}
+	}
+	if diff := cmp.Diff(targets, []string{"100.2.3.4:9100", "100.2.3.4:9187"}); diff != "" {
+		t.Errorf("translate: mismatch (-got, +want):\n%v", diff)
+	}
+}
@@ -0,0 +1,174 @@
+package tailscalesd
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/yaml.v3"
+)
+
+// Serializer encodes the target groups served by the discovery handler.
+type Serializer interface {
+	// ContentType of the encoded payload. Its media type is matched against
+	// the Accept header of requests to select a Serializer.
+	ContentType() string
+
+	// Serialize the targets to w.
+	Serialize(w io.Writer, targets []TargetDescriptor) error
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+func (jsonSerializer) Serialize(w io.Writer, targets []TargetDescriptor) error {
+	return json.NewEncoder(w).Encode(targets)
+}
+
+type yamlSerializer struct{}
+
+func (yamlSerializer) ContentType() string {
+	return "application/yaml"
+}
+
+func (yamlSerializer) Serialize(w io.Writer, targets []TargetDescriptor) error {
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(targets); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackSerializer) Serialize(w io.Writer, targets []TargetDescriptor) error {
+	enc := msgpack.NewEncoder(w)
+	// Use the same field names as JSON, and encode maps deterministically.
+	enc.SetCustomStructTag("json")
+	enc.SetSortMapKeys(true)
+	return enc.Encode(targets)
+}
+
+type protobufSerializer struct{}
+
+func (protobufSerializer) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// Serialize the targets as the following protobuf message:
+//
+//	message TargetGroups {
+//	  message TargetGroup {
+//	    repeated string targets = 1;
+//	    map<string, string> labels = 2;
+//	  }
+//	  repeated TargetGroup groups = 1;
+//	}
+func (protobufSerializer) Serialize(w io.Writer, targets []TargetDescriptor) error {
+	var b []byte
+	for _, td := range targets {
+		var group []byte
+		for _, t := range td.Targets {
+			group = protowire.AppendTag(group, 1, protowire.BytesType)
+			group = protowire.AppendString(group, t)
+		}
+		keys := make([]string, 0, len(td.Labels))
+		for k := range td.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var entry []byte
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendString(entry, k)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, td.Labels[k])
+			group = protowire.AppendTag(group, 2, protowire.BytesType)
+			group = protowire.AppendBytes(group, entry)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, group)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// Built-in Serializers. JSON is the format expected by Prometheus.
+var (
+	JSONSerializer     Serializer = jsonSerializer{}
+	YAMLSerializer     Serializer = yamlSerializer{}
+	MsgpackSerializer  Serializer = msgpackSerializer{}
+	ProtobufSerializer Serializer = protobufSerializer{}
+)
+
+var serializersByName = map[string]Serializer{
+	"json":     JSONSerializer,
+	"yaml":     YAMLSerializer,
+	"msgpack":  MsgpackSerializer,
+	"protobuf": ProtobufSerializer,
+}
+
+// SerializerNamed returns the built-in Serializer with the name "json",
+// "yaml", "msgpack" or "protobuf".
+func SerializerNamed(name string) (Serializer, bool) {
+	s, ok := serializersByName[name]
+	return s, ok
+}
+
+// mediaType of the content type, without parameters.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// negotiate the Serializer best matching the Accept header, preferring
+// earlier serializers when the client has no preference between them. The
+// first serializer is used when none match.
+func negotiate(accept string, serializers []Serializer) Serializer {
+	type acceptable struct {
+		mediaType string
+		q         float64
+	}
+	var accepted []acceptable
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, acceptable{mt, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].q > accepted[j].q
+	})
+	for _, a := range accepted {
+		for _, s := range serializers {
+			if a.mediaType == "*/*" || a.mediaType == mediaType(s.ContentType()) {
+				return s
+			}
+		}
+	}
+	return serializers[0]
+}
@@ -0,0 +1,131 @@
+package tailscalesd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+var serializerTestTargets = []TargetDescriptor{
+	{
+		Targets: []string{"100.2.3.4"},
+		Labels:  map[string]string{"__meta_tailscale_device_os": "beos"},
+	},
+}
+
+func TestNegotiate(t *testing.T) {
+	serializers := []Serializer{JSONSerializer, YAMLSerializer, MsgpackSerializer}
+	for tn, tc := range map[string]struct {
+		accept string
+		want   Serializer
+	}{
+		"no accept header uses first": {
+			want: JSONSerializer,
+		},
+		"unmatched uses first": {
+			accept: "text/html",
+			want:   JSONSerializer,
+		},
+		"exact match": {
+			accept: "application/msgpack",
+			want:   MsgpackSerializer,
+		},
+		"wildcard uses first": {
+			accept: "*/*",
+			want:   JSONSerializer,
+		},
+		"order respected among equal quality": {
+			accept: "text/html, application/yaml, application/json",
+			want:   YAMLSerializer,
+		},
+		"higher quality preferred": {
+			accept: "application/yaml;q=0.5, application/msgpack",
+			want:   MsgpackSerializer,
+		},
+		"zero quality is never chosen": {
+			accept: "application/yaml;q=0, application/msgpack;q=0.1",
+			want:   MsgpackSerializer,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := negotiate(tc.accept, serializers); got != tc.want {
+				t.Errorf("negotiate(%q): mismatch: got: %v want: %v", tc.accept, got.ContentType(), tc.want.ContentType())
+			}
+		})
+	}
+}
+
+func TestYAMLSerializerRoundTrips(t *testing.T) {
+	var buf bytes.Buffer
+	if err := YAMLSerializer.Serialize(&buf, serializerTestTargets); err != nil {
+		t.Fatal(err)
+	}
+	var got []TargetDescriptor
+	if err := yaml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, serializerTestTargets); diff != "" {
+		t.Errorf("YAMLSerializer: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestMsgpackSerializerRoundTrips(t *testing.T) {
+	var buf bytes.Buffer
+	if err := MsgpackSerializer.Serialize(&buf, serializerTestTargets); err != nil {
+		t.Fatal(err)
+	}
+	// Field names match the JSON encoding.
+	var got []map[string]any
+	if err := msgpack.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]any{
+		{
+			"targets": []any{"100.2.3.4"},
+			"labels":  map[string]any{"__meta_tailscale_device_os": "beos"},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("MsgpackSerializer: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestProtobufSerializer(t *testing.T) {
+	var buf bytes.Buffer
+	err := ProtobufSerializer.Serialize(&buf, []TargetDescriptor{
+		{
+			Targets: []string{"a"},
+			Labels:  map[string]string{"k": "v"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "\n\v\n\x01a\x12\x06\n\x01k\x12\x01v"; got != want {
+		t.Errorf("ProtobufSerializer: mismatch: got: %q want: %q", got, want)
+	}
+}
+
+func TestHandlerNegotiatesSerializer(t *testing.T) {
+	h := Handler(&testDiscoverer{
+		discovered: []Device{{Addresses: []string{"100.2.3.4"}, OS: "beos"}},
+	}, WithSerializers(YAMLSerializer))
+	for accept, want := range map[string]string{
+		"":                 "application/json; charset=utf-8",
+		"application/json": "application/json; charset=utf-8",
+		"application/yaml": "application/yaml",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("Handler(Accept: %q): Content-Type mismatch: got: %q want: %q", accept, got, want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package tailscalesd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotEntry is the cached results of a single RateLimitedDiscoverer.
+type SnapshotEntry struct {
+	Devices   []Device
+	Refreshed time.Time
+}
+
+// Snapshot of the cached results of several RateLimitedDiscoverers, keyed by
+// a name identifying each. Replicas sharing the same configuration use
+// snapshots to prime their caches from one another, rather than each
+// querying the Tailscale APIs on startup.
+type Snapshot map[string]SnapshotEntry
+
+// TakeSnapshot of the discoverers, skipping any without cached results.
+func TakeSnapshot(discoverers map[string]*RateLimitedDiscoverer) Snapshot {
+	s := make(Snapshot, len(discoverers))
+	for name, d := range discoverers {
+		if devices, refreshed, ok := d.Cached(); ok {
+			s[name] = SnapshotEntry{Devices: devices, Refreshed: refreshed}
+		}
+	}
+	return s
+}
+
+// Prime the discoverers with the snapshot entries of the same names, where
+// they are more recent than the cached results. Returns the number of
+// discoverers primed.
+func (s Snapshot) Prime(discoverers map[string]*RateLimitedDiscoverer) int {
+	var primed int
+	for name, d := range discoverers {
+		if e, ok := s[name]; ok && d.Prime(e.Devices, e.Refreshed) {
+			primed++
+		}
+	}
+	return primed
+}
+
+// WriteSnapshot to w, gob-encoded.
+func WriteSnapshot(w io.Writer, s Snapshot) error {
+	return gob.NewEncoder(w).Encode(s)
+}
+
+// ReadSnapshot written by WriteSnapshot from r.
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	var s Snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("bad snapshot: %w", err)
+	}
+	return s, nil
+}
+
+// WriteSnapshotFile at path, replacing any snapshot written there previously.
+// The snapshot is written to a temporary file which is then renamed, so that
+// a crash while writing leaves the previous snapshot intact.
+func WriteSnapshotFile(path string, s Snapshot) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := WriteSnapshot(f, s); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadSnapshotFile written by WriteSnapshotFile at path.
+func ReadSnapshotFile(path string) (Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSnapshot(f)
+}
+
+type snapshotHandler map[string]*RateLimitedDiscoverer
+
+func (h snapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, TakeSnapshot(h)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		serveAndLog(w, fmt.Sprintf("Failed encoding snapshot: %v", err))
+		return
+	}
+	w.Header().Add("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, &buf); err != nil {
+		log.Printf("Failed sending snapshot to the client: %v", err)
+	}
+}
+
+// SnapshotHandler serves a Snapshot of the discoverers, for other replicas to
+// prime their caches with.
+func SnapshotHandler(discoverers map[string]*RateLimitedDiscoverer) http.Handler {
+	return snapshotHandler(discoverers)
+}
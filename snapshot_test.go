@@ -0,0 +1,84 @@
+package tailscalesd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnapshotPrimesReplica(t *testing.T) {
+	warm := &RateLimitedDiscoverer{
+		Wrap:      discovererForTest(t),
+		Frequency: 30 * time.Hour,
+	}
+	if _, err := warm.Devices(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/-/snapshot", nil)
+	w := httptest.NewRecorder()
+	SnapshotHandler(map[string]*RateLimitedDiscoverer{
+		"warm":  warm,
+		"empty": {Wrap: discovererForTest(t), Frequency: time.Hour},
+	}).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("SnapshotHandler: status mismatch: got: %v want: %v", w.Code, http.StatusOK)
+	}
+	snapshot, err := ReadSnapshot(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshot["empty"]; ok {
+		t.Errorf("SnapshotHandler: unexpected entry for discoverer which never refreshed")
+	}
+
+	wrapped := discovererForTest(t)
+	cold := &RateLimitedDiscoverer{
+		Wrap:      wrapped,
+		Frequency: 30 * time.Hour,
+	}
+	if got, want := snapshot.Prime(map[string]*RateLimitedDiscoverer{"warm": cold}), 1; got != want {
+		t.Errorf("Prime: primed mismatch: got: %v want: %v", got, want)
+	}
+	got, err := cold.Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, devicesForRatelimitedTest); diff != "" {
+		t.Errorf("Devices: mismatch (-got, +want):\n%v", diff)
+	}
+	if wrapped.Called != 0 {
+		t.Errorf("Devices: primed discoverer refreshed %d times, want 0", wrapped.Called)
+	}
+}
+
+func TestPrimeOnlyReplacesOlderResults(t *testing.T) {
+	d := &RateLimitedDiscoverer{
+		Wrap:      discovererForTest(t),
+		Frequency: 30 * time.Hour,
+	}
+	if _, err := d.Devices(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	_, refreshed, _ := d.Cached()
+
+	if d.Prime([]Device{{ID: "older"}}, refreshed.Add(-time.Minute)) {
+		t.Error("Prime: older results replaced the cache")
+	}
+	got, _, _ := d.Cached()
+	if diff := cmp.Diff(got, devicesForRatelimitedTest); diff != "" {
+		t.Errorf("Cached: mismatch (-got, +want):\n%v", diff)
+	}
+
+	newer := []Device{{ID: "newer"}}
+	if !d.Prime(newer, refreshed.Add(time.Minute)) {
+		t.Error("Prime: newer results did not replace the cache")
+	}
+	got, _, _ = d.Cached()
+	if diff := cmp.Diff(got, newer); diff != "" {
+		t.Errorf("Cached: mismatch (-got, +want):\n%v", diff)
+	}
+}
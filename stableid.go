@@ -0,0 +1,64 @@
+package tailscalesd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// StableIDDiscoverer wraps a Discoverer, setting the StableID of each device.
+// The public and local APIs report different IDs for the same machine, so
+// stable IDs are instead derived from node keys, which both report. A device
+// keeps its stable ID when its node key is rotated, as long as it is
+// discovered by the same API with the same ID meanwhile. Devices without a node
+// key have no stable ID.
+type StableIDDiscoverer struct {
+	Wrap Discoverer
+
+	mu       sync.Mutex
+	byKey    map[string]string // node key to stable ID
+	byDevice map[string]string // API and ID to stable ID
+}
+
+// stableID derived from the node key.
+func stableID(nodeKey string) string {
+	sum := sha256.Sum256([]byte(nodeKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Devices reported by the wrapped Discoverer, with their stable IDs.
+func (sd *StableIDDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	devices, err := sd.Wrap.Devices(ctx)
+	if len(devices) == 0 {
+		return devices, err
+	}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	// Only mappings for the devices just discovered are kept, so that those
+	// for departed devices do not accumulate.
+	byKey := make(map[string]string)
+	byDevice := make(map[string]string)
+	identified := make([]Device, len(devices))
+	for i, d := range devices {
+		if d.NodeKey != "" {
+			device := d.API + "/" + d.ID
+			id, ok := byKey[d.NodeKey]
+			if !ok {
+				id, ok = sd.byKey[d.NodeKey]
+			}
+			if !ok {
+				id, ok = sd.byDevice[device]
+			}
+			if !ok {
+				id = stableID(d.NodeKey)
+			}
+			byKey[d.NodeKey] = id
+			byDevice[device] = id
+			d.StableID = id
+		}
+		identified[i] = d
+	}
+	sd.byKey, sd.byDevice = byKey, byDevice
+	return identified, err
+}
@@ -0,0 +1,57 @@
+package tailscalesd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStableIDDiscoverer(t *testing.T) {
+	d := &testDiscoverer{
+		discovered: []Device{
+			{API: "api.tailscale.com", ID: "12345", NodeKey: "nodekey:a"},
+			{API: "localhost", ID: "nStableCNTRL", NodeKey: "nodekey:a"},
+			{API: "localhost", ID: "nokey"},
+		},
+	}
+	sd := &StableIDDiscoverer{Wrap: d}
+	devices, err := sd.Devices(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := devices[0].StableID
+	if id == "" || devices[1].StableID != id {
+		t.Errorf("StableIDDiscoverer: want same stable ID across APIs, got: %q and %q", id, devices[1].StableID)
+	}
+	if got := devices[2].StableID; got != "" {
+		t.Errorf("StableIDDiscoverer: want no stable ID without a node key, got: %q", got)
+	}
+	if d.discovered[0].StableID != "" {
+		t.Error("StableIDDiscoverer: modified the wrapped Discoverer's devices")
+	}
+
+	// The local API reports the rotated node key first, and the public API
+	// has yet to catch up.
+	d.discovered = []Device{
+		{API: "localhost", ID: "nStableCNTRL", NodeKey: "nodekey:rotated"},
+		{API: "api.tailscale.com", ID: "12345", NodeKey: "nodekey:a"},
+	}
+	if devices, err = sd.Devices(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range devices {
+		if d.StableID != id {
+			t.Errorf("StableIDDiscoverer: stable ID of %v/%v changed with node key rotation: got: %q want: %q", d.API, d.ID, d.StableID, id)
+		}
+	}
+
+	// Both APIs report the rotated key.
+	d.discovered = []Device{
+		{API: "api.tailscale.com", ID: "12345", NodeKey: "nodekey:rotated"},
+	}
+	if devices, err = sd.Devices(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if got := devices[0].StableID; got != id {
+		t.Errorf("StableIDDiscoverer: stable ID changed after node key rotation: got: %q want: %q", got, id)
+	}
+}
@@ -0,0 +1,54 @@
+package tailscalesd
+
+import (
+	"slices"
+	"strings"
+)
+
+// maxTagCombinationSeries bounds the number of combinations of tags for which
+// devices are counted in tagCombinationDevicesGauge. Devices carrying less
+// common combinations are counted under otherTags for their tailnet, so that
+// a tailnet tagged in many ways cannot overwhelm Prometheus.
+const maxTagCombinationSeries = 100
+
+// tagCombination of a tailnet, identifying a series of
+// tagCombinationDevicesGauge.
+type tagCombination struct {
+	tailnet string
+	tags    string
+}
+
+// compareTagCombinations by tailnet, then tags.
+func compareTagCombinations(a, b tagCombination) int {
+	if c := strings.Compare(a.tailnet, b.tailnet); c != 0 {
+		return c
+	}
+	return strings.Compare(a.tags, b.tags)
+}
+
+// combinationOf tags, sorted and comma-separated.
+func combinationOf(tags []string) string {
+	sorted := slices.Clone(tags)
+	slices.Sort(sorted)
+	return strings.Join(slices.Compact(sorted), ",")
+}
+
+// exportTagCombinations of the devices in tagCombinationDevicesGauge, so that
+// devices missing expected tags can be noticed. Devices carrying combinations
+// beyond the maxTagCombinationSeries most common are counted under otherTags
+// for their tailnet.
+func exportTagCombinations(totals map[tagCombination]int) {
+	tagCombinationDevicesGauge.Reset()
+	other := make(map[string]int)
+	kept := mostCommon(totals, maxTagCombinationSeries, compareTagCombinations)
+	for combination, n := range totals {
+		if !slices.Contains(kept, combination) {
+			other[combination.tailnet] += n
+			continue
+		}
+		tagCombinationDevicesGauge.WithLabelValues(combination.tailnet, combination.tags).Set(float64(n))
+	}
+	for tailnet, n := range other {
+		tagCombinationDevicesGauge.WithLabelValues(tailnet, otherTags).Set(float64(n))
+	}
+}
@@ -0,0 +1,57 @@
+package tailscalesd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordTagCombinations(t *testing.T) {
+	resetFleetCounts()
+	local, public := &RateLimitedDiscoverer{}, &RateLimitedDiscoverer{}
+	recordFleetCounts(local, []Device{
+		{Tailnet: "tagcombinations.example", Tags: []string{"tag:web", "tag:prom"}},
+		{Tailnet: "tagcombinations.example", Tags: []string{"tag:prom", "tag:web"}},
+		{Tailnet: "tagcombinations.example"},
+	})
+	recordFleetCounts(public, []Device{
+		{Tailnet: "tagcombinations.example", Tags: []string{"tag:web"}},
+		{Tailnet: "tagcombinations.example"},
+	})
+	// Refreshes replace the discoverer's previous counts.
+	recordFleetCounts(local, []Device{
+		{Tailnet: "tagcombinations.example", Tags: []string{"tag:prom", "tag:web"}},
+		{Tailnet: "tagcombinations.example"},
+	})
+	for tags, want := range map[string]float64{
+		"tag:prom,tag:web": 1,
+		"tag:web":          1,
+		"":                 2,
+	} {
+		if got := testutil.ToFloat64(tagCombinationDevicesGauge.WithLabelValues("tagcombinations.example", tags)); got != want {
+			t.Errorf("recordFleetCounts: devices tagged %q mismatch: got: %v want: %v", tags, got, want)
+		}
+	}
+}
+
+func TestRecordTagCombinationsBoundsSeries(t *testing.T) {
+	resetFleetCounts()
+	var devices []Device
+	for i := 0; i < maxTagCombinationSeries; i++ {
+		devices = append(devices, Device{Tailnet: "tagcombinations.example", Tags: []string{"tag:common"}})
+	}
+	for i := 0; i < maxTagCombinationSeries+10; i++ {
+		devices = append(devices, Device{Tailnet: "tagcombinations.example", Tags: []string{fmt.Sprintf("tag:rare%03d", i)}})
+	}
+	recordFleetCounts(&RateLimitedDiscoverer{}, devices)
+	if got := testutil.CollectAndCount(tagCombinationDevicesGauge); got != maxTagCombinationSeries+1 {
+		t.Errorf("recordFleetCounts: series count mismatch: got: %v want: %v", got, maxTagCombinationSeries+1)
+	}
+	if got := testutil.ToFloat64(tagCombinationDevicesGauge.WithLabelValues("tagcombinations.example", "tag:common")); got != maxTagCombinationSeries {
+		t.Errorf("recordFleetCounts: common combination count mismatch: got: %v want: %v", got, maxTagCombinationSeries)
+	}
+	if got := testutil.ToFloat64(tagCombinationDevicesGauge.WithLabelValues("tagcombinations.example", otherTags)); got != 11 {
+		t.Errorf("recordFleetCounts: other combinations count mismatch: got: %v want: 11", got)
+	}
+}
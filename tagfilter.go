@@ -0,0 +1,43 @@
+package tailscalesd
+
+import (
+	"context"
+	"slices"
+)
+
+// TagFilteringDiscoverer wraps a Discoverer, keeping only the devices selected
+// by their ACL tags.
+type TagFilteringDiscoverer struct {
+	Wrap Discoverer
+
+	// Include, if not empty, keeps only devices carrying at least one of
+	// these tags.
+	Include []string
+	// Exclude drops devices carrying any of these tags, even if included.
+	Exclude []string
+}
+
+func (tf *TagFilteringDiscoverer) keep(d Device) bool {
+	if len(tf.Include) > 0 && !slices.ContainsFunc(d.Tags, func(t string) bool {
+		return slices.Contains(tf.Include, t)
+	}) {
+		return false
+	}
+	return !slices.ContainsFunc(d.Tags, func(t string) bool {
+		return slices.Contains(tf.Exclude, t)
+	})
+}
+
+// Devices reported by the wrapped Discoverer, filtered by tag. Dropped devices
+// are counted in metrics as dropped by the "tags" filter.
+func (tf *TagFilteringDiscoverer) Devices(ctx context.Context) ([]Device, error) {
+	devices, err := tf.Wrap.Devices(ctx)
+	var kept []Device
+	for _, d := range devices {
+		if tf.keep(d) {
+			kept = append(kept, d)
+		}
+	}
+	deviceFilterDroppedCounter.WithLabelValues("tags").Add(float64(len(devices) - len(kept)))
+	return kept, err
+}
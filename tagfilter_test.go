@@ -0,0 +1,58 @@
+package tailscalesd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTagFilteringDiscoverer(t *testing.T) {
+	devices := []Device{
+		{ID: "untagged"},
+		{ID: "prometheus", Tags: []string{"tag:prometheus"}},
+		{ID: "prometheus-test", Tags: []string{"tag:prometheus", "tag:test"}},
+		{ID: "other", Tags: []string{"tag:other"}},
+	}
+	for tn, tc := range map[string]struct {
+		include []string
+		exclude []string
+		want    []string
+	}{
+		"no filters keeps all": {
+			want: []string{"untagged", "prometheus", "prometheus-test", "other"},
+		},
+		"include": {
+			include: []string{"tag:prometheus", "tag:other"},
+			want:    []string{"prometheus", "prometheus-test", "other"},
+		},
+		"exclude": {
+			exclude: []string{"tag:test"},
+			want:    []string{"untagged", "prometheus", "other"},
+		},
+		"exclude wins over include": {
+			include: []string{"tag:prometheus"},
+			exclude: []string{"tag:test"},
+			want:    []string{"prometheus"},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			d := &TagFilteringDiscoverer{
+				Wrap:    &testDiscoverer{discovered: devices},
+				Include: tc.include,
+				Exclude: tc.exclude,
+			}
+			got, err := d.Devices(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, d := range got {
+				ids = append(ids, d.ID)
+			}
+			if diff := cmp.Diff(ids, tc.want); diff != "" {
+				t.Errorf("TagFilteringDiscoverer: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -8,62 +8,271 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
+	// LabelMetaAddressFamily is the address family, "ipv4" or "ipv6", of the
+	// targets in the descriptor. Only reported when descriptors are split by
+	// address family using SplitAddressFamilies.
+	LabelMetaAddressFamily = "__meta_tailscale_address_family"
+
 	// LabelMetaAPI is the host which provided the details about this device.
 	// Will be "localhost" for the local API.
 	LabelMetaAPI = "__meta_tailscale_api"
 
+	// LabelMetaDeviceAttributePrefix is prepended to the name of each custom
+	// posture attribute of the target, without its "custom:" prefix, to form a
+	// label with the attribute's value. Only reported by the public API, when
+	// posture attributes are requested.
+	LabelMetaDeviceAttributePrefix = "__meta_tailscale_device_attr_"
+
 	// LabelMetaDeviceAuthorized is whether the target is currently authorized
 	// on the Tailnet. Will always be true when using the local API.
 	LabelMetaDeviceAuthorized = "__meta_tailscale_device_authorized"
 
+	// LabelMetaDeviceCapabilityPrefix is prepended to the name of each
+	// capability advertised by the target, such as "file_sharing" or "funnel",
+	// to form a label with the value "true". Only reported by the local API.
+	LabelMetaDeviceCapabilityPrefix = "__meta_tailscale_device_cap_"
+
 	// LabelMetaDeviceClientVersion is the Tailscale client version in use on
 	// target. Not reported when using the local API.
 	LabelMetaDeviceClientVersion = "__meta_tailscale_device_client_version"
 
+	// LabelMetaDeviceClientTrack is the release track, "stable" or
+	// "unstable", of the Tailscale client in use on the target. Derived from
+	// the client version, in which stable releases have an even minor version.
+	// Not reported when the client version is unknown.
+	LabelMetaDeviceClientTrack = "__meta_tailscale_device_client_track"
+
+	// LabelMetaDeviceConnection is "direct" for targets to which the local
+	// host has a direct connection, and "relayed" for those reached via DERP.
+	// Only reported by the local API.
+	LabelMetaDeviceConnection = "__meta_tailscale_device_connection"
+
+	// LabelMetaDeviceCreated is when the target was added to the tailnet,
+	// formatted as RFC3339. Not reported when using the local API, or for
+	// targets shared in from other tailnets.
+	LabelMetaDeviceCreated = "__meta_tailscale_device_created"
+
+	// LabelMetaDeviceDiscoveredAt is when the target's details were retrieved
+	// from the API, formatted as RFC3339. When cached or stale results are
+	// served, this is the time of the refresh which produced them.
+	LabelMetaDeviceDiscoveredAt = "__meta_tailscale_device_discovered_at"
+
+	// LabelMetaDeviceExitNode is "true" for targets offering to act as an exit
+	// node, which have been approved to do so. Not reported for other targets.
+	LabelMetaDeviceExitNode = "__meta_tailscale_device_exit_node"
+
+	// LabelMetaDeviceExitNodeInUse is "true" for the target currently used as
+	// an exit node by the node running tailscalesd. Only reported when using
+	// the local API.
+	LabelMetaDeviceExitNodeInUse = "__meta_tailscale_device_exit_node_in_use"
+
+	// LabelMetaDeviceExpiresInSeconds is the number of seconds until the
+	// target's node key expires, computed when the target is served. Negative
+	// if the key has already expired. Not reported for devices with key
+	// expiry disabled.
+	LabelMetaDeviceExpiresInSeconds = "__meta_tailscale_device_expires_in_seconds"
+
+	// LabelMetaDeviceHealth is the comma-separated health hints of the device
+	// as seen by the local node, such as "key-expired". Only set for devices
+	// discovered with WithLocalAPIPeerHealth which have health problems.
+	LabelMetaDeviceHealth = "__meta_tailscale_device_health"
+
 	// LabelMetaDeviceHostname is the short hostname of the device.
 	LabelMetaDeviceHostname = "__meta_tailscale_device_hostname"
 
+	// LabelMetaDeviceHostnameIndex is the position, from 1, of the target
+	// among the devices sharing its hostname, oldest first. Only reported for
+	// devices sharing their hostname, when indexing them.
+	LabelMetaDeviceHostnameIndex = "__meta_tailscale_device_hostname_index"
+
 	// LabelMetaDeviceID is the target's unique ID within Tailscale, as reported
 	// by the API. The public API reports this as a large integer. The local API
 	// reports a base64 string.
 	// string.
 	LabelMetaDeviceID = "__meta_tailscale_device_id"
 
-	// LabelMetaDeviceName is the name of the device as reported by the API. Not
-	// reported when using the local API.
+	// LabelMetaDeviceIsExternal is "true" for targets shared into the tailnet
+	// from another tailnet, and not reported for other targets. Not reported
+	// when using the local API.
+	LabelMetaDeviceIsExternal = "__meta_tailscale_device_is_external"
+
+	// LabelMetaDeviceLastSeen is when the target was last connected to the
+	// Tailscale control plane, formatted as RFC3339. Not reported when using
+	// the local API.
+	LabelMetaDeviceLastSeen = "__meta_tailscale_device_last_seen"
+
+	// LabelMetaDeviceLastHandshakeAgeSeconds is the number of seconds since
+	// the last WireGuard handshake between the local host and the target. Only
+	// reported by the local API, for peers with which a handshake happened.
+	LabelMetaDeviceLastHandshakeAgeSeconds = "__meta_tailscale_device_last_handshake_age_seconds"
+
+	// LabelMetaDeviceName is the MagicDNS name of the device, such as
+	// "foo.example.ts.net", as reported by the API.
 	LabelMetaDeviceName = "__meta_tailscale_device_name"
 
+	// LabelMetaDeviceOnline is whether the target is currently connected to
+	// the Tailscale control plane, "true" or "false". Not reported when using
+	// OAuth clients, which do not report connectivity.
+	LabelMetaDeviceOnline = "__meta_tailscale_device_online"
+
 	// LabelMetaDeviceOS is the OS of the target.
 	LabelMetaDeviceOS = "__meta_tailscale_device_os"
 
+	// LabelMetaDeviceRelay is the DERP region, such as "nyc", through which
+	// the target is reached when not connected directly. Only reported by the
+	// local API.
+	LabelMetaDeviceRelay = "__meta_tailscale_device_relay"
+
+	// LabelMetaDeviceStableID identifies the target across the public and
+	// local APIs, which report different device IDs. Only reported when
+	// discovered through a StableIDDiscoverer.
+	LabelMetaDeviceStableID = "__meta_tailscale_device_stable_id"
+
 	// LabelMetaDeviceTag is a Tailscale ACL tag applied to the target.
 	LabelMetaDeviceTag = "__meta_tailscale_device_tag"
 
+	// LabelMetaDeviceUser is the login name of the user who owns the target.
+	// Not reported when using the local API.
+	LabelMetaDeviceUser = "__meta_tailscale_device_user"
+
+	// LabelMetaPort is the port appended to the targets in the descriptor.
+	// Only reported when ports are derived from tags using PortsFromTags or
+	// ExportersFromTags.
+	LabelMetaPort = "__meta_tailscale_port"
+
+	// LabelMetaRoute is the approved subnet route through which a RouteTarget
+	// is reached, such as "10.0.0.0/24".
+	LabelMetaRoute = "__meta_tailscale_route"
+
+	// LabelMetaRouterHostname is the hostname of the subnet router through
+	// which a RouteTarget is reached.
+	LabelMetaRouterHostname = "__meta_tailscale_router_hostname"
+
+	// LabelMetaRouterID is the ID of the subnet router through which a
+	// RouteTarget is reached.
+	LabelMetaRouterID = "__meta_tailscale_router_id"
+
+	// LabelMetaStale is "true" when the target was discovered by a refresh
+	// which has since failed, so its metadata may be outdated. Not reported
+	// otherwise.
+	LabelMetaStale = "__meta_tailscale_stale"
+
 	// LabelMetaTailnet is the name of the Tailnet from which this target
 	// information was retrieved. Not reported when using the local API.
 	LabelMetaTailnet = "__meta_tailscale_tailnet"
 )
 
 // Device in a Tailnet, as reported by one of the various Tailscale APIs.
+// OnlineUnknown is set for devices discovered from APIs which do not report
+// whether they are online, in which case Online is meaningless.
 type Device struct {
-	Addresses     []string `json:"addresses"`
-	API           string   `json:"api"`
-	Authorized    bool     `json:"authorized"`
-	ClientVersion string   `json:"clientVersion,omitempty"`
-	Hostname      string   `json:"hostname"`
-	ID            string   `json:"id"`
-	Name          string   `json:"name"`
-	OS            string   `json:"os"`
-	Tailnet       string   `json:"tailnet"`
-	Tags          []string `json:"tags"`
+	Addresses         []string          `json:"addresses"`
+	API               string            `json:"api"`
+	Attributes        map[string]string `json:"attributes,omitempty"`
+	Authorized        bool              `json:"authorized"`
+	Capabilities      []string          `json:"capabilities,omitempty"`
+	ClientVersion     string            `json:"clientVersion,omitempty"`
+	CurAddr           string            `json:"curAddr,omitempty"`
+	Created           time.Time         `json:"created"`
+	DiscoveredAt      time.Time         `json:"discoveredAt"`
+	EnabledRoutes     []string          `json:"enabledRoutes,omitempty"`
+	ExitNodeOption    bool              `json:"exitNodeOption"`
+	ExitNodeInUse     bool              `json:"exitNodeInUse"`
+	Expires           time.Time         `json:"expires"`
+	Health            []string          `json:"health,omitempty"`
+	Hostname          string            `json:"hostname"`
+	HostnameIndex     int               `json:"hostnameIndex,omitempty"`
+	ID                string            `json:"id"`
+	IsExternal        bool              `json:"isExternal"`
+	KeyExpiryDisabled bool              `json:"keyExpiryDisabled"`
+	LastHandshake     time.Time         `json:"lastHandshake"`
+	LastSeen          time.Time         `json:"lastSeen"`
+	Name              string            `json:"name"`
+	NodeKey           string            `json:"nodeKey,omitempty"`
+	Online            bool              `json:"connectedToControl"`
+	OnlineUnknown     bool              `json:"onlineUnknown,omitempty"`
+	OpenPorts         []OpenPort        `json:"openPorts,omitempty"`
+	OS                string            `json:"os"`
+	Relay             string            `json:"relay,omitempty"`
+	StableID          string            `json:"stableId,omitempty"`
+	Tailnet           string            `json:"tailnet"`
+	Tags              []string          `json:"tags"`
+	User              string            `json:"user,omitempty"`
+}
+
+// isExitNode reports whether the routes include a default route, which is how
+// the public API reports exit nodes.
+func isExitNode(routes []string) bool {
+	for _, r := range routes {
+		if r == "0.0.0.0/0" || r == "::/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTime reported by the public API, returning the zero time for missing or
+// unparseable values.
+func parseTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t
+}
+
+// UnmarshalJSON decodes a Device, accepting the empty timestamps which the
+// public API reports for some devices.
+func (d *Device) UnmarshalJSON(b []byte) error {
+	type device Device
+	aux := struct {
+		*device
+		Created  string `json:"created"`
+		Expires  string `json:"expires"`
+		LastSeen string `json:"lastSeen"`
+	}{device: (*device)(d)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	d.Created = parseTime(aux.Created)
+	d.Expires = parseTime(aux.Expires)
+	d.LastSeen = parseTime(aux.LastSeen)
+	return nil
+}
+
+// expiresInSeconds returns the label value for LabelMetaDeviceExpiresInSeconds
+// at the time at, which is empty if the device's key does not expire.
+func expiresInSeconds(d Device, at time.Time) string {
+	if d.KeyExpiryDisabled || d.Expires.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(int64(d.Expires.Sub(at).Seconds()))
+}
+
+// ageInSeconds returns the number of seconds from t to the time at, which is
+// empty for the zero time.
+func ageInSeconds(t, at time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(int64(at.Sub(t).Seconds()))
 }
 
 // Discoverer of things exposed by the various Tailscale APIs.
@@ -80,9 +289,51 @@ type TargetDescriptor struct {
 	Labels  map[string]string `json:"labels,omitempty"`
 }
 
+// VolatileLabels change whenever targets are discovered or served, even when
+// nothing else about the devices has, so are ignored when comparing targets.
+var VolatileLabels = []string{
+	LabelMetaDeviceDiscoveredAt,
+	LabelMetaDeviceExpiresInSeconds,
+	LabelMetaDeviceLastHandshakeAgeSeconds,
+}
+
+// WithoutVolatileLabels returns a copy of td without any of the
+// VolatileLabels, for comparison with other targets.
+func WithoutVolatileLabels(td TargetDescriptor) TargetDescriptor {
+	if td.Labels == nil {
+		return td
+	}
+	labels := maps.Clone(td.Labels)
+	for _, name := range VolatileLabels {
+		delete(labels, name)
+	}
+	return TargetDescriptor{Targets: td.Targets, Labels: labels}
+}
+
 // TargetFilter maniupulates TargetDescriptors before being served.
 type TargetFilter func(TargetDescriptor) TargetDescriptor
 
+// NamedFilter associates a name with a TargetFilter, so that the effects of the
+// filter are reported in metrics under that name. Descriptors which have
+// targets before filtering and none after are counted as dropped. Descriptors
+// with changed targets or labels are counted as modified.
+func NamedFilter(name string, filter TargetFilter) TargetFilter {
+	lv := prometheus.Labels{"filter": name}
+	return func(td TargetDescriptor) TargetDescriptor {
+		// Filters may modify the labels in place, so compare against a copy.
+		targets := slices.Clone(td.Targets)
+		labels := maps.Clone(td.Labels)
+		out := filter(td)
+		switch {
+		case len(targets) > 0 && len(out.Targets) == 0:
+			filterDroppedCounter.With(lv).Inc()
+		case !slices.Equal(targets, out.Targets) || !maps.Equal(labels, out.Labels):
+			filterModifiedCounter.With(lv).Inc()
+		}
+		return out
+	}
+}
+
 // FilterIPv6Addresses from TargetDescriptors. Results in only IPv4 targets.
 func FilterIPv6Addresses(td TargetDescriptor) TargetDescriptor {
 	var targets []string
@@ -105,6 +356,259 @@ func FilterIPv6Addresses(td TargetDescriptor) TargetDescriptor {
 	}
 }
 
+// FilterIPv4Addresses from TargetDescriptors. Results in only IPv6 targets,
+// for tailnets standardized on the Tailscale ULA range.
+func FilterIPv4Addresses(td TargetDescriptor) TargetDescriptor {
+	var targets []string
+	for _, target := range td.Targets {
+		ip := net.ParseIP(target)
+		if ip == nil {
+			// As in FilterIPv6Addresses, garbage is left in place.
+			targets = append(targets, target)
+			continue
+		}
+		if ip.To4() == nil {
+			targets = append(targets, target)
+		}
+	}
+	return TargetDescriptor{
+		Targets: targets,
+		Labels:  td.Labels,
+	}
+}
+
+// TargetExpander expands a TargetDescriptor into any number of
+// TargetDescriptors before being served.
+type TargetExpander func(TargetDescriptor) []TargetDescriptor
+
+// DNSNameTargets replaces the addresses of TargetDescriptors with the device's
+// MagicDNS name, from LabelMetaDeviceName. Useful when scraped endpoints use
+// TLS certificates issued for those names. Targets of devices without a name
+// are left alone.
+func DNSNameTargets(td TargetDescriptor) TargetDescriptor {
+	name := strings.TrimSuffix(td.Labels[LabelMetaDeviceName], ".")
+	if name == "" {
+		return td
+	}
+	return TargetDescriptor{
+		Targets: []string{name},
+		Labels:  td.Labels,
+	}
+}
+
+// copyLabels returns a copy of labels which may be safely modified.
+func copyLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+// addressFamily of a target, which may be a bare IP address or an IP address
+// and port. Returns the empty string for targets which are neither.
+func addressFamily(target string) string {
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		ap, err := netip.ParseAddrPort(target)
+		if err != nil {
+			return ""
+		}
+		addr = ap.Addr()
+	}
+	if addr.Unmap().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// SplitAddressFamilies is a TargetExpander producing a separate TargetDescriptor
+// for each address family present in the targets, labeled with
+// LabelMetaAddressFamily. Targets which are not IP addresses are kept together
+// in a descriptor without the address family label.
+func SplitAddressFamilies(td TargetDescriptor) []TargetDescriptor {
+	var families []string
+	byFamily := make(map[string][]string)
+	for _, target := range td.Targets {
+		family := addressFamily(target)
+		if _, ok := byFamily[family]; !ok {
+			families = append(families, family)
+		}
+		byFamily[family] = append(byFamily[family], target)
+	}
+	if len(families) == 0 {
+		return []TargetDescriptor{td}
+	}
+	out := make([]TargetDescriptor, len(families))
+	for i, family := range families {
+		out[i] = TargetDescriptor{
+			Targets: byFamily[family],
+			Labels:  copyLabels(td.Labels),
+		}
+		if family != "" {
+			out[i].Labels[LabelMetaAddressFamily] = family
+		}
+	}
+	return out
+}
+
+// withPort returns target with port appended, if target is a bare IP address.
+// Other targets are returned unmodified.
+func withPort(target string, port uint16) string {
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		return target
+	}
+	return netip.AddrPortFrom(addr, port).String()
+}
+
+// withPorts returns a copy of td with port appended to its targets, labeled
+// with LabelMetaPort.
+func withPorts(td TargetDescriptor, port uint16) TargetDescriptor {
+	out := TargetDescriptor{
+		Targets: make([]string, len(td.Targets)),
+		Labels:  copyLabels(td.Labels),
+	}
+	for i, target := range td.Targets {
+		out.Targets[i] = withPort(target, port)
+	}
+	out.Labels[LabelMetaPort] = fmt.Sprint(port)
+	return out
+}
+
+// PortsFromTags returns a TargetExpander which appends a port to the targets
+// of descriptors whose tag is prefix followed by a port number. For example,
+// with prefix "tag:prom-" a device tagged "tag:prom-9100" and "tag:prom-9090"
+// is served as targets on both ports. The port is reported in LabelMetaPort.
+// Descriptors with other tags, or without tags, are returned unmodified.
+func PortsFromTags(prefix string) TargetExpander {
+	return func(td TargetDescriptor) []TargetDescriptor {
+		tag, ok := td.Labels[LabelMetaDeviceTag]
+		if !ok || !strings.HasPrefix(tag, prefix) {
+			return []TargetDescriptor{td}
+		}
+		port, err := strconv.ParseUint(strings.TrimPrefix(tag, prefix), 10, 16)
+		if err != nil || port == 0 {
+			return []TargetDescriptor{td}
+		}
+		return []TargetDescriptor{withPorts(td, uint16(port))}
+	}
+}
+
+// Exporter describes how to scrape a Prometheus exporter running on devices.
+type Exporter struct {
+	// Port on which the exporter listens. Required.
+	Port uint16
+	// MetricsPath, if set, is served as the __metrics_path__ label.
+	MetricsPath string
+	// Scheme, if set, is served as the __scheme__ label.
+	Scheme string
+	// Job, if set, is served as the job label.
+	Job string
+}
+
+// ExportersFromTags returns a TargetExpander which makes descriptors carrying
+// one of the tags in exporters ready to scrape: the exporter's port is appended
+// to the targets, and its metrics path, scheme and job are set as labels.
+// Descriptors with other tags, or without tags, are returned unmodified.
+func ExportersFromTags(exporters map[string]Exporter) TargetExpander {
+	return func(td TargetDescriptor) []TargetDescriptor {
+		exporter, ok := exporters[td.Labels[LabelMetaDeviceTag]]
+		if !ok || exporter.Port == 0 {
+			return []TargetDescriptor{td}
+		}
+		return []TargetDescriptor{withExporter(td, exporter)}
+	}
+}
+
+// withExporter returns a copy of td ready to scrape the exporter.
+func withExporter(td TargetDescriptor, exporter Exporter) TargetDescriptor {
+	out := withPorts(td, exporter.Port)
+	setIfNotEmpty(out.Labels, "__metrics_path__", exporter.MetricsPath)
+	setIfNotEmpty(out.Labels, "__scheme__", exporter.Scheme)
+	setIfNotEmpty(out.Labels, "job", exporter.Job)
+	return out
+}
+
+// DefaultOSExporters are the exporters conventionally run on each OS, as
+// reported in LabelMetaDeviceOS, for use with ExportersFromOS.
+var DefaultOSExporters = map[string]Exporter{
+	"linux":   {Port: 9100, Job: "node"},
+	"freebsd": {Port: 9100, Job: "node"},
+	"macos":   {Port: 9100, Job: "node"},
+	"windows": {Port: 9182, Job: "windows"},
+}
+
+// ExportersFromOS returns a TargetExpander which makes descriptors ready to
+// scrape the exporter for their device's OS, as ExportersFromTags does for
+// tags. OS names are matched case-insensitively. It should follow any
+// expanders deriving ports from tags: descriptors already given a port are
+// returned unmodified, as are those for other OSes.
+func ExportersFromOS(exporters map[string]Exporter) TargetExpander {
+	byOS := make(map[string]Exporter, len(exporters))
+	for os, e := range exporters {
+		byOS[strings.ToLower(os)] = e
+	}
+	return func(td TargetDescriptor) []TargetDescriptor {
+		if _, ok := td.Labels[LabelMetaPort]; ok {
+			return []TargetDescriptor{td}
+		}
+		exporter, ok := byOS[strings.ToLower(td.Labels[LabelMetaDeviceOS])]
+		if !ok || exporter.Port == 0 {
+			return []TargetDescriptor{td}
+		}
+		return []TargetDescriptor{withExporter(td, exporter)}
+	}
+}
+
+// DefaultPorts returns a TargetExpander which serves descriptors not already
+// given a port, such as by PortsFromTags or ExportersFromOS, once for each of
+// the ports, so that they need not be relabeled before scraping. It should
+// follow all other expanders which give ports.
+func DefaultPorts(ports ...uint16) TargetExpander {
+	return func(td TargetDescriptor) []TargetDescriptor {
+		if _, ok := td.Labels[LabelMetaPort]; ok {
+			return []TargetDescriptor{td}
+		}
+		return withEachPort(td, ports)
+	}
+}
+
+// PortsForTags returns a TargetExpander which serves descriptors carrying one
+// of the tags in ports once for each of the ports listed for it. For example,
+// a device tagged "tag:web" may be scraped on both 9100 and 9115. Descriptors
+// with other tags, or without tags, are returned unmodified.
+func PortsForTags(ports map[string][]uint16) TargetExpander {
+	return func(td TargetDescriptor) []TargetDescriptor {
+		return withEachPort(td, ports[td.Labels[LabelMetaDeviceTag]])
+	}
+}
+
+// withEachPort returns one copy of td for each of the ports. td is returned
+// alone if there are none.
+func withEachPort(td TargetDescriptor, ports []uint16) []TargetDescriptor {
+	if len(ports) == 0 {
+		return []TargetDescriptor{td}
+	}
+	out := make([]TargetDescriptor, len(ports))
+	for i, port := range ports {
+		out[i] = withPorts(td, port)
+	}
+	return out
+}
+
+// expand all TargetDescriptors using each of the expanders in turn.
+func expand(tds []TargetDescriptor, expanders ...TargetExpander) []TargetDescriptor {
+	for _, expander := range expanders {
+		var expanded []TargetDescriptor
+		for _, td := range tds {
+			expanded = append(expanded, expander(td)...)
+		}
+		tds = expanded
+	}
+	return tds
+}
+
 // excludeEmptyMapEntries removes entries in a map which have either an empty
 // key or empty value.
 func excludeEmptyMapEntries(in map[string]string) map[string]string {
@@ -128,8 +632,111 @@ func filterEmptyLabels(td TargetDescriptor) TargetDescriptor {
 	}
 }
 
-// translate Devices to Prometheus TargetDescriptor, filtering empty labels.
-func translate(devices []Device, filters ...TargetFilter) (found []TargetDescriptor) {
+func setIfNotEmpty(labels map[string]string, key, value string) {
+	if value != "" {
+		labels[key] = value
+	}
+}
+
+// clientTrack returns the label value for LabelMetaDeviceClientTrack, derived
+// from a client version like "1.62.0-t1234abcd".
+func clientTrack(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ""
+	}
+	if minor%2 == 0 {
+		return "stable"
+	}
+	return "unstable"
+}
+
+// connection returns the label value for LabelMetaDeviceConnection, which is
+// empty when the connection path is not known.
+func connection(d Device) string {
+	switch {
+	case d.CurAddr != "":
+		return "direct"
+	case d.Relay != "":
+		return "relayed"
+	}
+	return ""
+}
+
+// capabilityURLPrefix is common to the capabilities defined by Tailscale, and
+// is omitted from their labels.
+const capabilityURLPrefix = "https://tailscale.com/cap/"
+
+// labelSafe replaces the characters of name which are not allowed in label
+// names with underscores.
+func labelSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// capabilityLabel returns the label reporting the capability, such as
+// "__meta_tailscale_device_cap_file_sharing" for
+// "https://tailscale.com/cap/file-sharing". Characters not allowed in label
+// names are replaced with underscores.
+func capabilityLabel(capability string) string {
+	return LabelMetaDeviceCapabilityPrefix + labelSafe(strings.TrimPrefix(capability, capabilityURLPrefix))
+}
+
+// formatTime as a label value, which is empty for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// sortDevices returns a copy of devices sorted by ID, then API, with their
+// addresses sorted IPv4 first, so that the served payload is byte-stable
+// across refreshes. Unparseable addresses sort last, lexically.
+func sortDevices(devices []Device) []Device {
+	sorted := slices.Clone(devices)
+	for i := range sorted {
+		sorted[i].Addresses = slices.Clone(sorted[i].Addresses)
+		slices.SortStableFunc(sorted[i].Addresses, compareAddresses)
+	}
+	slices.SortStableFunc(sorted, func(a, b Device) int {
+		if c := strings.Compare(a.ID, b.ID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.API, b.API)
+	})
+	return sorted
+}
+
+func compareAddresses(a, b string) int {
+	aa, aErr := netip.ParseAddr(a)
+	ba, bErr := netip.ParseAddr(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return aa.Compare(ba)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// translate Devices to Prometheus TargetDescriptor at the time at, filtering
+// empty labels.
+func translate(at time.Time, devices []Device, filters ...TargetFilter) (found []TargetDescriptor) {
+	var filtering time.Duration
+	defer func() {
+		filterLatencyHistogram.Observe(float64(filtering.Microseconds()) / 1000)
+	}()
 	for _, d := range devices {
 		target := TargetDescriptor{
 			Targets: d.Addresses,
@@ -145,29 +752,113 @@ func translate(devices []Device, filters ...TargetFilter) (found []TargetDescrip
 				LabelMetaTailnet:             d.Tailnet,
 			},
 		}
+		// Labels which are not reported for every device are only added when
+		// they have a value.
+		if !d.OnlineUnknown {
+			target.Labels[LabelMetaDeviceOnline] = fmt.Sprint(d.Online)
+		}
+		for k, v := range d.Attributes {
+			if label, ok := attributeLabel(k); ok {
+				target.Labels[label] = v
+			}
+		}
+		for _, c := range d.Capabilities {
+			target.Labels[capabilityLabel(c)] = "true"
+		}
+		setIfNotEmpty(target.Labels, LabelMetaDeviceClientTrack, clientTrack(d.ClientVersion))
+		setIfNotEmpty(target.Labels, LabelMetaDeviceConnection, connection(d))
+		setIfNotEmpty(target.Labels, LabelMetaDeviceCreated, formatTime(d.Created))
+		setIfNotEmpty(target.Labels, LabelMetaDeviceDiscoveredAt, formatTime(d.DiscoveredAt))
+		setIfNotEmpty(target.Labels, LabelMetaDeviceExpiresInSeconds, expiresInSeconds(d, at))
+		setIfNotEmpty(target.Labels, LabelMetaDeviceHealth, strings.Join(d.Health, ","))
+		if d.HostnameIndex > 0 {
+			target.Labels[LabelMetaDeviceHostnameIndex] = strconv.Itoa(d.HostnameIndex)
+		}
+		if d.ExitNodeOption {
+			target.Labels[LabelMetaDeviceExitNode] = "true"
+		}
+		if d.ExitNodeInUse {
+			target.Labels[LabelMetaDeviceExitNodeInUse] = "true"
+		}
+		if d.IsExternal {
+			target.Labels[LabelMetaDeviceIsExternal] = "true"
+		}
+		setIfNotEmpty(target.Labels, LabelMetaDeviceLastHandshakeAgeSeconds, ageInSeconds(d.LastHandshake, at))
+		setIfNotEmpty(target.Labels, LabelMetaDeviceLastSeen, formatTime(d.LastSeen))
+		setIfNotEmpty(target.Labels, LabelMetaDeviceRelay, d.Relay)
+		setIfNotEmpty(target.Labels, LabelMetaDeviceStableID, d.StableID)
+		setIfNotEmpty(target.Labels, LabelMetaDeviceUser, d.User)
+		start := time.Now()
 		for _, filter := range filters {
 			target = filter(target)
 		}
-		if l := len(d.Tags); l == 0 {
-			found = append(found, target)
-			continue
-		}
-		for _, t := range d.Tags {
-			lt := target
-			lt.Labels = make(map[string]string)
-			for k, v := range target.Labels {
-				lt.Labels[k] = v
+		filtering += time.Since(start)
+		for _, td := range withOpenPorts(target, d.OpenPorts) {
+			if l := len(d.Tags); l == 0 {
+				found = append(found, td)
+				continue
+			}
+			for _, t := range d.Tags {
+				lt := td
+				lt.Labels = copyLabels(td.Labels)
+				lt.Labels[LabelMetaDeviceTag] = t
+				found = append(found, lt)
 			}
-			lt.Labels[LabelMetaDeviceTag] = t
-			found = append(found, lt)
 		}
 	}
 	return
 }
 
 type discoveryHandler struct {
-	d       Discoverer
-	filters []TargetFilter
+	d         Discoverer
+	filters   []TargetFilter
+	expanders []TargetExpander
+	static    []TargetDescriptor
+
+	// routes describe targets behind subnet routers.
+	routes []RouteTarget
+
+	// noAddress determines how devices without addresses are served.
+	noAddress NoAddressPolicy
+
+	// duplicates determines how devices sharing hostnames are served.
+	duplicates DuplicateHostnamePolicy
+
+	// addresses selects the addresses of each device served as targets. All
+	// of them if nil.
+	addresses AddressSelector
+
+	// serializers available to clients, the first of which is the default.
+	serializers []Serializer
+
+	clock Clock
+
+	// refreshInterval with which discovery results are refreshed, advertised
+	// to clients if set.
+	refreshInterval time.Duration
+
+	// logEveryStale logs each stale response, rather than only transitions
+	// into and out of serving stale results.
+	logEveryStale bool
+	stale         atomic.Bool
+
+	// snapshots records the targets served, if set.
+	snapshots *TargetSnapshots
+}
+
+// noteStaleness logs and records whether results being served are stale.
+func (h *discoveryHandler) noteStaleness(stale bool, err error) {
+	if !stale {
+		servingStaleGauge.Set(0)
+		if h.stale.Swap(false) {
+			log.Print("Serving fresh results again")
+		}
+		return
+	}
+	servingStaleGauge.Set(1)
+	if !h.stale.Swap(true) || h.logEveryStale {
+		log.Printf("Serving potentially stale results: %v", err)
+	}
 }
 
 func serveAndLog(w io.Writer, msg string) {
@@ -181,43 +872,274 @@ func (h *discoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveAndLog(w, "Attempted to serve with an improperly initialized handler.")
 		return
 	}
-	devices, err := h.d.Devices(r.Context())
+	start := time.Now()
+	ctx, span := startRequestSpan(r, "discovery")
+	defer span.End()
+	sel, err := parseSelector(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	devices, err := h.d.Devices(ctx)
 	if err != nil {
-		if err != errStaleResults {
+		if errors.Is(err, ErrTooStale) {
+			failSpan(span, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			serveAndLog(w, fmt.Sprintf("Failed to discover Tailscale devices: %v", err))
+			return
+		}
+		if !errors.Is(err, errStaleResults) {
+			failSpan(span, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			serveAndLog(w, fmt.Sprintf("Failed to discover Tailscale devices: %v", err))
 			return
 		}
-		// TODO(cfunkhouser): Investigate whether Prometheus respects cache
-		// control headers, and implement accordingly here.
-		log.Print("Serving potentially stale results")
 	}
-	targets := translate(devices, h.filters...)
+	stale := err != nil
+	h.noteStaleness(stale, err)
+	span.SetAttributes(attribute.Int("tailscalesd.devices", len(devices)), attribute.Bool("tailscalesd.stale", stale))
+	devices = applyDuplicateHostnamePolicy(sortDevices(devices), h.duplicates)
+	served := selectAddresses(applyNoAddressPolicy(devices, h.noAddress), h.addresses)
+	targets := expand(translate(h.clock.Now(), served, h.filters...), h.expanders...)
+	targets = append(targets, routeTargets(devices, h.routes)...)
+	if stale {
+		markStale(targets)
+		w.Header().Set(StaleHeader, "true")
+	}
+	h.setCacheHeaders(w.Header(), stale)
+	targets = append(targets, h.static...)
+	h.snapshots.record(h.clock.Now(), targets)
+	targetGroupsGauge.Set(float64(len(targets)))
+	targets = selectTargets(targets, sel)
+
+	total := len(targets)
+	if targets, err = paginate(targets, r.URL.Query()); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
 
+	s := negotiate(r.Header.Get("Accept"), h.serializers)
 	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(targets); err != nil {
+	if err := s.Serialize(&buf, targets); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		serveAndLog(w, fmt.Sprintf("Failed encoding targets to JSON: %v", err))
+		serveAndLog(w, fmt.Sprintf("Failed encoding targets as %v: %v", s.ContentType(), err))
 		return
 	}
+	observeLatency(ctx, discoveryLatencyHistogram, start)
+	var count int
+	for _, td := range targets {
+		count += len(td.Targets)
+	}
+	targetsServedGauge.Set(float64(count))
+	span.SetAttributes(attribute.Int("tailscalesd.targets", count))
 
-	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Header().Add("Content-Type", s.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add(TotalCountHeader, strconv.Itoa(total))
 	if _, err := io.Copy(w, &buf); err != nil {
 		// The transaction with the client is already started, so there's
 		// nothing graceful to do here. Log any errors for troubleshooting
 		// later.
-		log.Printf("Failed sending JSON payload to the client: %v", err)
+		log.Printf("Failed sending payload to the client: %v", err)
+	}
+}
+
+// RefreshIntervalHeader advertises the interval, in seconds, with which
+// discovery results are refreshed, so that clients may align their own.
+const RefreshIntervalHeader = "X-Prometheus-Refresh-Interval-Seconds"
+
+// setCacheHeaders allowing responses to be cached for the refresh interval,
+// unless they are stale, in which case fresh results may come at any time.
+func (h *discoveryHandler) setCacheHeaders(header http.Header, stale bool) {
+	if stale {
+		header.Set("Cache-Control", "no-cache")
+	}
+	if h.refreshInterval <= 0 {
+		return
+	}
+	seconds := strconv.FormatInt(int64(h.refreshInterval/time.Second), 10)
+	header.Set(RefreshIntervalHeader, seconds)
+	if !stale {
+		header.Set("Cache-Control", "max-age="+seconds)
 	}
 }
 
+// StaleHeader is set to "true" on responses serving stale results, whose
+// target groups are also labeled with LabelMetaStale.
+const StaleHeader = "X-Tailscale-SD-Stale"
+
+// markStale labels the targets with LabelMetaStale.
+func markStale(targets []TargetDescriptor) {
+	for i := range targets {
+		targets[i].Labels = copyLabels(targets[i].Labels)
+		targets[i].Labels[LabelMetaStale] = "true"
+	}
+}
+
+// TotalCountHeader reports the total number of target groups available, when
+// only some of them are served by pagination.
+const TotalCountHeader = "X-Total-Count"
+
+// paginate the targets according to the optional offset and limit query
+// parameters. Results are consistent between pages only while discovery
+// results are unchanged, so clients should fetch all pages within the poll
+// limit.
+func paginate(targets []TargetDescriptor, query url.Values) ([]TargetDescriptor, error) {
+	param := func(name string, def int) (int, error) {
+		v := query.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%v must be a non-negative integer", name)
+		}
+		return n, nil
+	}
+	offset, err := param("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := param("limit", len(targets))
+	if err != nil {
+		return nil, err
+	}
+	offset = min(offset, len(targets))
+	// Compared before adding, as offset+limit may overflow.
+	end := len(targets)
+	if limit < end-offset {
+		end = offset + limit
+	}
+	return targets[offset:end], nil
+}
+
 // Empty labels must always be removed.
-var defaultFilters = []TargetFilter{filterEmptyLabels}
+var defaultFilters = []TargetFilter{NamedFilter("empty_labels", filterEmptyLabels)}
+
+// HandlerOption configures the http.Handler returned by Handler.
+type HandlerOption func(*discoveryHandler)
+
+// WithFilters is a HandlerOption which applies filters to the discovery
+// results, in addition to the default filters.
+func WithFilters(filters ...TargetFilter) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.filters = append(h.filters, filters...)
+	}
+}
+
+// WithExpanders is a HandlerOption which expands the discovery results, after
+// filters are applied.
+func WithExpanders(expanders ...TargetExpander) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.expanders = append(h.expanders, expanders...)
+	}
+}
+
+// WithStaticTargets is a HandlerOption which serves the static target groups
+// alongside the discovery results. Filters are not applied to static targets.
+func WithStaticTargets(static ...TargetDescriptor) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.static = append(h.static, static...)
+	}
+}
+
+// WithRouteTargets is a HandlerOption which serves targets behind subnet
+// routers, described by the rules. Filters and expanders are not applied to
+// them.
+func WithRouteTargets(rules ...RouteTarget) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.routes = append(h.routes, rules...)
+	}
+}
+
+// WithStaleLogEveryRequest is a HandlerOption which logs every response
+// serving stale results. By default, only transitions into and out of serving
+// stale results are logged.
+func WithStaleLogEveryRequest(every bool) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.logEveryStale = every
+	}
+}
+
+// WithTargetSnapshots is a HandlerOption which records the targets served in
+// s whenever they change.
+func WithTargetSnapshots(s *TargetSnapshots) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.snapshots = s
+	}
+}
+
+// WithNoAddressPolicy is a HandlerOption which determines how devices which
+// report no addresses are served. By default, they are dropped.
+func WithNoAddressPolicy(policy NoAddressPolicy) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.noAddress = policy
+	}
+}
+
+// WithAddressSelector is a HandlerOption which determines which addresses of
+// each device are served as its targets. By default, all of them are.
+func WithAddressSelector(s AddressSelector) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.addresses = s
+	}
+}
+
+// WithDuplicateHostnamePolicy is a HandlerOption which determines how devices
+// sharing hostnames are served. By default, they are all served.
+func WithDuplicateHostnamePolicy(policy DuplicateHostnamePolicy) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.duplicates = policy
+	}
+}
+
+// WithSerializers is a HandlerOption which makes additional encodings of the
+// discovery results available, selected by the Accept header of each request.
+// JSON is always available, and is served when no other encoding is accepted.
+func WithSerializers(serializers ...Serializer) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.serializers = append(h.serializers, serializers...)
+	}
+}
+
+// WithClock is a HandlerOption which sets the Clock against which labels
+// relative to the current time are computed. By default, the system clock is
+// used.
+func WithClock(clock Clock) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.clock = clock
+	}
+}
+
+// WithRefreshInterval is a HandlerOption which advertises the interval with
+// which discovery results are refreshed, typically the Frequency of a
+// RateLimitedDiscoverer, in the Cache-Control and RefreshIntervalHeader
+// headers of responses.
+func WithRefreshInterval(interval time.Duration) HandlerOption {
+	return func(h *discoveryHandler) {
+		h.refreshInterval = interval
+	}
+}
+
+// Handler exports the Tailscale Discoverer for Service Discovery via HTTP,
+// configured by opts.
+func Handler(d Discoverer, opts ...HandlerOption) http.Handler {
+	h := &discoveryHandler{
+		d:           d,
+		filters:     slices.Clone(defaultFilters),
+		serializers: []Serializer{JSONSerializer},
+		clock:       defaultClock,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
 
 // Export the Tailscale Discoverer for Service Discovery via HTTP, optionally
 // applying filters to the discovery results.
 func Export(d Discoverer, with ...TargetFilter) http.Handler {
-	return &discoveryHandler{
-		d:       d,
-		filters: append(defaultFilters[:], with...),
-	}
+	return Handler(d, WithFilters(with...))
 }
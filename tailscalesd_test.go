@@ -2,15 +2,23 @@ package tailscalesd
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestMain(m *testing.M) {
@@ -111,6 +119,82 @@ func TestFilterIPv6Addresses(t *testing.T) {
 	}
 }
 
+func TestFilterIPv4Addresses(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       TargetDescriptor
+	}{
+		"zero": {},
+		"leaves ipv6 addresses alone while removing ipv4 addresses": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4", "fd7a::1234", "100.5.6.7", "fd7a::5678"},
+			},
+			want: TargetDescriptor{
+				Targets: []string{"fd7a::1234", "fd7a::5678"},
+			},
+		},
+		"leaves garbage alone without panicking while removing ipv4 addresses": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4", "GARBAGE", "fd7a::1234"},
+			},
+			want: TargetDescriptor{
+				Targets: []string{"GARBAGE", "fd7a::1234"},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := FilterIPv4Addresses(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("FilterIPv4Addresses: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestDNSNameTargets(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       TargetDescriptor
+	}{
+		"zero": {},
+		"replaces addresses with name": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4", "fd7a::1234"},
+				Labels:  map[string]string{LabelMetaDeviceName: "foo.example.ts.net"},
+			},
+			want: TargetDescriptor{
+				Targets: []string{"foo.example.ts.net"},
+				Labels:  map[string]string{LabelMetaDeviceName: "foo.example.ts.net"},
+			},
+		},
+		"strips trailing dot": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceName: "foo.example.ts.net."},
+			},
+			want: TargetDescriptor{
+				Targets: []string{"foo.example.ts.net"},
+				Labels:  map[string]string{LabelMetaDeviceName: "foo.example.ts.net."},
+			},
+		},
+		"leaves devices without names alone": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+			},
+			want: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := DNSNameTargets(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("DNSNameTargets: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
 func TestTranslate(t *testing.T) {
 	for tn, tc := range map[string]struct {
 		devices []Device
@@ -144,12 +228,38 @@ func TestTranslate(t *testing.T) {
 						"__meta_tailscale_device_hostname":       "somethingclever",
 						"__meta_tailscale_device_id":             "id",
 						"__meta_tailscale_device_name":           "somethingclever",
+						"__meta_tailscale_device_online":         "false",
 						"__meta_tailscale_device_os":             "beos",
 						"__meta_tailscale_tailnet":               "example@gmail.com",
 					},
 				},
 			},
 		},
+		"device of unknown online status is not labeled online or offline": {
+			devices: []Device{
+				{
+					Addresses:     []string{"100.2.3.4"},
+					API:           "foo.example.com",
+					ID:            "id",
+					OnlineUnknown: true,
+				},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels: map[string]string{
+						"__meta_tailscale_api":                   "foo.example.com",
+						"__meta_tailscale_device_authorized":     "false",
+						"__meta_tailscale_device_client_version": "",
+						"__meta_tailscale_device_hostname":       "",
+						"__meta_tailscale_device_id":             "id",
+						"__meta_tailscale_device_name":           "",
+						"__meta_tailscale_device_os":             "",
+						"__meta_tailscale_tailnet":               "",
+					},
+				},
+			},
+		},
 		"single device with two tags expands to two descriptors": {
 			devices: []Device{
 				{
@@ -180,6 +290,7 @@ func TestTranslate(t *testing.T) {
 						"__meta_tailscale_device_hostname":       "somethingclever",
 						"__meta_tailscale_device_id":             "id",
 						"__meta_tailscale_device_name":           "somethingclever",
+						"__meta_tailscale_device_online":         "false",
 						"__meta_tailscale_device_os":             "beos",
 						"__meta_tailscale_device_tag":            "tag:foo",
 						"__meta_tailscale_tailnet":               "example@gmail.com",
@@ -194,6 +305,7 @@ func TestTranslate(t *testing.T) {
 						"__meta_tailscale_device_hostname":       "somethingclever",
 						"__meta_tailscale_device_id":             "id",
 						"__meta_tailscale_device_name":           "somethingclever",
+						"__meta_tailscale_device_online":         "false",
 						"__meta_tailscale_device_os":             "beos",
 						"__meta_tailscale_device_tag":            "tag:bar",
 						"__meta_tailscale_tailnet":               "example@gmail.com",
@@ -201,6 +313,96 @@ func TestTranslate(t *testing.T) {
 				},
 			},
 		},
+		"device owner is reported when known": {
+			devices: []Device{
+				{
+					Addresses: []string{"100.2.3.4"},
+					API:       "foo.example.com",
+					Hostname:  "somethingclever",
+					ID:        "id",
+					OS:        "beos",
+					Tailnet:   "example@gmail.com",
+					User:      "amelie@example.com",
+				},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels: map[string]string{
+						"__meta_tailscale_api":                   "foo.example.com",
+						"__meta_tailscale_device_authorized":     "false",
+						"__meta_tailscale_device_client_version": "",
+						"__meta_tailscale_device_hostname":       "somethingclever",
+						"__meta_tailscale_device_id":             "id",
+						"__meta_tailscale_device_name":           "",
+						"__meta_tailscale_device_online":         "false",
+						"__meta_tailscale_device_os":             "beos",
+						"__meta_tailscale_device_user":           "amelie@example.com",
+						"__meta_tailscale_tailnet":               "example@gmail.com",
+					},
+				},
+			},
+		},
+		"online devices and their capabilities are labeled": {
+			devices: []Device{
+				{
+					Addresses:    []string{"100.2.3.4"},
+					API:          "localhost",
+					Capabilities: []string{"funnel", "https://tailscale.com/cap/file-sharing"},
+					ID:           "id",
+					Online:       true,
+				},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels: map[string]string{
+						"__meta_tailscale_api":                     "localhost",
+						"__meta_tailscale_device_authorized":       "false",
+						"__meta_tailscale_device_cap_file_sharing": "true",
+						"__meta_tailscale_device_cap_funnel":       "true",
+						"__meta_tailscale_device_client_version":   "",
+						"__meta_tailscale_device_hostname":         "",
+						"__meta_tailscale_device_id":               "id",
+						"__meta_tailscale_device_name":             "",
+						"__meta_tailscale_device_online":           "true",
+						"__meta_tailscale_device_os":               "",
+						"__meta_tailscale_tailnet":                 "",
+					},
+				},
+			},
+		},
+		"devices shared in from other tailnets are labeled external": {
+			devices: []Device{
+				{
+					Addresses:  []string{"100.2.3.4"},
+					API:        "foo.example.com",
+					Authorized: true,
+					Hostname:   "somethingclever",
+					ID:         "id",
+					IsExternal: true,
+					OS:         "beos",
+					Tailnet:    "example@gmail.com",
+				},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels: map[string]string{
+						"__meta_tailscale_api":                   "foo.example.com",
+						"__meta_tailscale_device_authorized":     "true",
+						"__meta_tailscale_device_client_version": "",
+						"__meta_tailscale_device_hostname":       "somethingclever",
+						"__meta_tailscale_device_id":             "id",
+						"__meta_tailscale_device_is_external":    "true",
+						"__meta_tailscale_device_name":           "",
+						"__meta_tailscale_device_online":         "false",
+						"__meta_tailscale_device_os":             "beos",
+						"__meta_tailscale_tailnet":               "example@gmail.com",
+					},
+				},
+			},
+		},
 		"filters apply to all descriptors expanded from device": {
 			devices: []Device{
 				{
@@ -237,6 +439,7 @@ func TestTranslate(t *testing.T) {
 						"__meta_tailscale_device_hostname":       "somethingclever",
 						"__meta_tailscale_device_id":             "id",
 						"__meta_tailscale_device_name":           "somethingclever",
+						"__meta_tailscale_device_online":         "false",
 						"__meta_tailscale_device_os":             "beos",
 						"__meta_tailscale_device_tag":            "tag:foo",
 						"__meta_tailscale_tailnet":               "example@gmail.com",
@@ -252,6 +455,7 @@ func TestTranslate(t *testing.T) {
 						"__meta_tailscale_device_hostname":       "somethingclever",
 						"__meta_tailscale_device_id":             "id",
 						"__meta_tailscale_device_name":           "somethingclever",
+						"__meta_tailscale_device_online":         "false",
 						"__meta_tailscale_device_os":             "beos",
 						"__meta_tailscale_device_tag":            "tag:bar",
 						"__meta_tailscale_tailnet":               "example@gmail.com",
@@ -262,7 +466,7 @@ func TestTranslate(t *testing.T) {
 		},
 	} {
 		t.Run(tn, func(t *testing.T) {
-			got := translate(tc.devices, tc.filters...)
+			got := translate(time.Now(), tc.devices, tc.filters...)
 			if diff := cmp.Diff(got, tc.want); diff != "" {
 				t.Errorf("translate: mismatch (-got, +want):\n%v", diff)
 			}
@@ -307,6 +511,15 @@ func TestDiscoveryHandler(t *testing.T) {
 				body: "Failed to discover Tailscale devices: this is a test error",
 			},
 		},
+		"results exceeding the staleness cutoff are unavailable": {
+			discoverer: &testDiscoverer{
+				err: fmt.Errorf("%w: this is a test error", ErrTooStale),
+			},
+			want: httpWant{
+				code: http.StatusServiceUnavailable,
+				body: "Failed to discover Tailscale devices: discovery results too stale to serve: this is a test error",
+			},
+		},
 		"stale results are still served": {
 			discoverer: &testDiscoverer{
 				discovered: []Device{
@@ -333,7 +546,7 @@ func TestDiscoveryHandler(t *testing.T) {
 			want: httpWant{
 				code:        http.StatusOK,
 				contentType: "application/json; charset=utf-8",
-				body:        `[{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:foo","__meta_tailscale_tailnet":"example@gmail.com"}},{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:bar","__meta_tailscale_tailnet":"example@gmail.com"}}]` + "\n",
+				body:        `[{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_online":"false","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:foo","__meta_tailscale_stale":"true","__meta_tailscale_tailnet":"example@gmail.com"}},{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_online":"false","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:bar","__meta_tailscale_stale":"true","__meta_tailscale_tailnet":"example@gmail.com"}}]` + "\n",
 			},
 		},
 		"results with no errors are served": {
@@ -361,7 +574,7 @@ func TestDiscoveryHandler(t *testing.T) {
 			want: httpWant{
 				code:        http.StatusOK,
 				contentType: "application/json; charset=utf-8",
-				body:        `[{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:foo","__meta_tailscale_tailnet":"example@gmail.com"}},{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:bar","__meta_tailscale_tailnet":"example@gmail.com"}}]` + "\n",
+				body:        `[{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_online":"false","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:foo","__meta_tailscale_tailnet":"example@gmail.com"}},{"targets":["100.2.3.4","fd7a::1234"],"labels":{"__meta_tailscale_api":"foo.example.com","__meta_tailscale_device_authorized":"false","__meta_tailscale_device_client_version":"420.69","__meta_tailscale_device_hostname":"somethingclever","__meta_tailscale_device_id":"id","__meta_tailscale_device_name":"somethingclever","__meta_tailscale_device_online":"false","__meta_tailscale_device_os":"beos","__meta_tailscale_device_tag":"tag:bar","__meta_tailscale_tailnet":"example@gmail.com"}}]` + "\n",
 			},
 		},
 	} {
@@ -380,3 +593,819 @@ func TestDiscoveryHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestNamedFilter(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		filter       TargetFilter
+		in           TargetDescriptor
+		wantDropped  float64
+		wantModified float64
+	}{
+		"unchanged": {
+			filter: func(td TargetDescriptor) TargetDescriptor { return td },
+			in:     TargetDescriptor{Targets: []string{"100.2.3.4"}},
+		},
+		"targets removed": {
+			filter: FilterIPv6Addresses,
+			in:     TargetDescriptor{Targets: []string{"fd7a::1234"}},
+
+			wantDropped: 1,
+		},
+		"labels modified in place": {
+			filter: func(td TargetDescriptor) TargetDescriptor {
+				td.Labels["test_label"] = "IT WORKED"
+				return td
+			},
+			in: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{},
+			},
+			wantModified: 1,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			name := "test " + tn
+			_ = NamedFilter(name, tc.filter)(tc.in)
+			if got := testutil.ToFloat64(filterDroppedCounter.WithLabelValues(name)); got != tc.wantDropped {
+				t.Errorf("NamedFilter: dropped count mismatch: got: %v want: %v", got, tc.wantDropped)
+			}
+			if got := testutil.ToFloat64(filterModifiedCounter.WithLabelValues(name)); got != tc.wantModified {
+				t.Errorf("NamedFilter: modified count mismatch: got: %v want: %v", got, tc.wantModified)
+			}
+		})
+	}
+}
+
+func TestHandlerServesStaticTargetsAfterFilters(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	Handler(&testDiscoverer{
+		discovered: []Device{
+			{
+				Addresses: []string{"fd7a::1234"},
+				ID:        "id",
+			},
+		},
+	},
+		WithFilters(FilterIPv6Addresses),
+		WithStaticTargets(TargetDescriptor{
+			Targets: []string{"fd00::1", "legacy.example.com:9100"},
+			Labels:  map[string]string{"env": ""},
+		}),
+	).ServeHTTP(w, r)
+
+	want := `[{"targets":null,"labels":{"__meta_tailscale_device_authorized":"false","__meta_tailscale_device_id":"id","__meta_tailscale_device_online":"false"}},{"targets":["fd00::1","legacy.example.com:9100"],"labels":{"env":""}}]` + "\n"
+	if diff := cmp.Diff(w.Body.String(), want); diff != "" {
+		t.Errorf("Handler: content mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestSplitAddressFamilies(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       []TargetDescriptor
+	}{
+		"zero": {
+			want: []TargetDescriptor{{}},
+		},
+		"single family is labeled": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{"foo": "bar"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels: map[string]string{
+						"foo":                             "bar",
+						"__meta_tailscale_address_family": "ipv4",
+					},
+				},
+			},
+		},
+		"dual stack with ports and garbage is split": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4:9100", "[fd7a::1234]:9100", "GARBAGE", "fd7a::5678"},
+				Labels:  map[string]string{"foo": "bar"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9100"},
+					Labels: map[string]string{
+						"foo":                             "bar",
+						"__meta_tailscale_address_family": "ipv4",
+					},
+				},
+				{
+					Targets: []string{"[fd7a::1234]:9100", "fd7a::5678"},
+					Labels: map[string]string{
+						"foo":                             "bar",
+						"__meta_tailscale_address_family": "ipv6",
+					},
+				},
+				{
+					Targets: []string{"GARBAGE"},
+					Labels:  map[string]string{"foo": "bar"},
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := SplitAddressFamilies(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("SplitAddressFamilies: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestExpiresInSeconds(t *testing.T) {
+	fixed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for tn, tc := range map[string]struct {
+		device Device
+		want   string
+	}{
+		"unknown expiry": {},
+		"expiry disabled": {
+			device: Device{
+				Expires:           fixed.Add(time.Hour),
+				KeyExpiryDisabled: true,
+			},
+		},
+		"expires in the future": {
+			device: Device{Expires: fixed.Add(90 * time.Minute)},
+			want:   "5400",
+		},
+		"already expired": {
+			device: Device{Expires: fixed.Add(-time.Minute)},
+			want:   "-60",
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := expiresInSeconds(tc.device, fixed); got != tc.want {
+				t.Errorf("expiresInSeconds: mismatch: got: %q want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandlerUsesClock(t *testing.T) {
+	fixed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h := Handler(&testDiscoverer{
+		discovered: []Device{
+			{
+				Addresses: []string{"100.2.3.4"},
+				Expires:   fixed.Add(time.Minute),
+				ID:        "id",
+			},
+		},
+	}, WithClock(ClockFunc(func() time.Time { return fixed })))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	want := `[{"targets":["100.2.3.4"],"labels":{"__meta_tailscale_device_authorized":"false","__meta_tailscale_device_expires_in_seconds":"60","__meta_tailscale_device_id":"id","__meta_tailscale_device_online":"false"}}]` + "\n"
+	if diff := cmp.Diff(w.Body.String(), want); diff != "" {
+		t.Errorf("Handler: content mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestAgeInSeconds(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for tn, tc := range map[string]struct {
+		t    time.Time
+		want string
+	}{
+		"zero":    {},
+		"an hour": {t: at.Add(-time.Hour), want: "3600"},
+		"now":     {t: at, want: "0"},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := ageInSeconds(tc.t, at); got != tc.want {
+				t.Errorf("ageInSeconds: mismatch: got: %q want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientTrack(t *testing.T) {
+	for version, want := range map[string]string{
+		"":                  "",
+		"420.69":            "",
+		"1.62.0":            "stable",
+		"1.62.1-t1234abcd":  "stable",
+		"1.63.12-t1234abcd": "unstable",
+		"1.x.0":             "",
+	} {
+		if got := clientTrack(version); got != want {
+			t.Errorf("clientTrack(%q): mismatch: got: %q want: %q", version, got, want)
+		}
+	}
+}
+
+func TestCapabilityLabel(t *testing.T) {
+	for capability, want := range map[string]string{
+		"funnel":                                 "__meta_tailscale_device_cap_funnel",
+		"https":                                  "__meta_tailscale_device_cap_https",
+		"https://tailscale.com/cap/file-sharing": "__meta_tailscale_device_cap_file_sharing",
+		"https://example.com/cap/thing":          "__meta_tailscale_device_cap_https___example_com_cap_thing",
+	} {
+		if got := capabilityLabel(capability); got != want {
+			t.Errorf("capabilityLabel(%q): mismatch: got: %q want: %q", capability, got, want)
+		}
+	}
+}
+
+func TestConnection(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		d    Device
+		want string
+	}{
+		"unknown": {},
+		"direct": {
+			d:    Device{CurAddr: "192.0.2.1:41641", Relay: "nyc"},
+			want: "direct",
+		},
+		"relayed": {
+			d:    Device{Relay: "nyc"},
+			want: "relayed",
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := connection(tc.d); got != tc.want {
+				t.Errorf("connection: mismatch: got: %q want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsExitNode(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		routes []string
+		want   bool
+	}{
+		"no routes":     {},
+		"subnet routes": {routes: []string{"192.168.0.0/24"}},
+		"ipv4 default route": {
+			routes: []string{"192.168.0.0/24", "0.0.0.0/0"},
+			want:   true,
+		},
+		"ipv6 default route": {
+			routes: []string{"::/0"},
+			want:   true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := isExitNode(tc.routes); got != tc.want {
+				t.Errorf("isExitNode: mismatch: got: %v want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		t    time.Time
+		want string
+	}{
+		"zero time is empty": {},
+		"formatted in UTC": {
+			t:    time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("test", 3600)),
+			want: "2024-03-01T11:00:00Z",
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			if got := formatTime(tc.t); got != tc.want {
+				t.Errorf("formatTime: mismatch: got: %q want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPortsFromTags(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       []TargetDescriptor
+	}{
+		"untagged descriptor is unmodified": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+			},
+			want: []TargetDescriptor{
+				{Targets: []string{"100.2.3.4"}},
+			},
+		},
+		"unrelated tag is unmodified": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:server"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels:  map[string]string{LabelMetaDeviceTag: "tag:server"},
+				},
+			},
+		},
+		"invalid port is unmodified": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:prom-99999"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels:  map[string]string{LabelMetaDeviceTag: "tag:prom-99999"},
+				},
+			},
+		},
+		"port tag is appended to addresses": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4", "fd7a::1234", "GARBAGE"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:prom-9100"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9100", "[fd7a::1234]:9100", "GARBAGE"},
+					Labels: map[string]string{
+						LabelMetaDeviceTag: "tag:prom-9100",
+						LabelMetaPort:      "9100",
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := PortsFromTags("tag:prom-")(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("PortsFromTags: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestExportersFromTags(t *testing.T) {
+	expander := ExportersFromTags(map[string]Exporter{
+		"tag:node-exporter": {Port: 9100, Job: "node"},
+		"tag:postgres-exporter": {
+			Port:        9187,
+			MetricsPath: "/pgmetrics",
+			Scheme:      "https",
+			Job:         "postgres",
+		},
+	})
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       []TargetDescriptor
+	}{
+		"unrelated tag is unmodified": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:server"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels:  map[string]string{LabelMetaDeviceTag: "tag:server"},
+				},
+			},
+		},
+		"minimal exporter": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:node-exporter"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9100"},
+					Labels: map[string]string{
+						LabelMetaDeviceTag: "tag:node-exporter",
+						LabelMetaPort:      "9100",
+						"job":              "node",
+					},
+				},
+			},
+		},
+		"fully specified exporter": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:postgres-exporter"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9187"},
+					Labels: map[string]string{
+						LabelMetaDeviceTag: "tag:postgres-exporter",
+						LabelMetaPort:      "9187",
+						"__metrics_path__": "/pgmetrics",
+						"__scheme__":       "https",
+						"job":              "postgres",
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := expander(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("ExportersFromTags: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestExportersFromOS(t *testing.T) {
+	expander := ExportersFromOS(map[string]Exporter{
+		"linux":   {Port: 9100, Job: "node"},
+		"Windows": {Port: 9182, Job: "windows"},
+	})
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       []TargetDescriptor
+	}{
+		"unrelated os is unmodified": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceOS: "iOS"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels:  map[string]string{LabelMetaDeviceOS: "iOS"},
+				},
+			},
+		},
+		"os default": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceOS: "windows"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9182"},
+					Labels: map[string]string{
+						LabelMetaDeviceOS: "windows",
+						LabelMetaPort:     "9182",
+						"job":             "windows",
+					},
+				},
+			},
+		},
+		"port from tag wins": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4:9187"},
+				Labels: map[string]string{
+					LabelMetaDeviceOS: "linux",
+					LabelMetaPort:     "9187",
+				},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9187"},
+					Labels: map[string]string{
+						LabelMetaDeviceOS: "linux",
+						LabelMetaPort:     "9187",
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := expander(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("ExportersFromOS: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestDefaultPorts(t *testing.T) {
+	expander := DefaultPorts(9100, 9115)
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       []TargetDescriptor
+	}{
+		"bare addresses": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4", "fd7a:115c:a1e0::1"},
+				Labels:  map[string]string{},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9100", "[fd7a:115c:a1e0::1]:9100"},
+					Labels:  map[string]string{LabelMetaPort: "9100"},
+				},
+				{
+					Targets: []string{"100.2.3.4:9115", "[fd7a:115c:a1e0::1]:9115"},
+					Labels:  map[string]string{LabelMetaPort: "9115"},
+				},
+			},
+		},
+		"port already given": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4:9187"},
+				Labels:  map[string]string{LabelMetaPort: "9187"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9187"},
+					Labels:  map[string]string{LabelMetaPort: "9187"},
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := expander(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("DefaultPorts: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestPortsForTags(t *testing.T) {
+	expander := PortsForTags(map[string][]uint16{
+		"tag:web": {9100, 9115},
+	})
+	for tn, tc := range map[string]struct {
+		descriptor TargetDescriptor
+		want       []TargetDescriptor
+	}{
+		"tag with ports": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:web"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4:9100"},
+					Labels:  map[string]string{LabelMetaDeviceTag: "tag:web", LabelMetaPort: "9100"},
+				},
+				{
+					Targets: []string{"100.2.3.4:9115"},
+					Labels:  map[string]string{LabelMetaDeviceTag: "tag:web", LabelMetaPort: "9115"},
+				},
+			},
+		},
+		"other tag": {
+			descriptor: TargetDescriptor{
+				Targets: []string{"100.2.3.4"},
+				Labels:  map[string]string{LabelMetaDeviceTag: "tag:db"},
+			},
+			want: []TargetDescriptor{
+				{
+					Targets: []string{"100.2.3.4"},
+					Labels:  map[string]string{LabelMetaDeviceTag: "tag:db"},
+				},
+			},
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			got := expander(tc.descriptor)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("PortsForTags: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestDiscoveryHandlerTracksStaleness(t *testing.T) {
+	d := &testDiscoverer{err: errStaleResults}
+	h := Handler(d)
+	for _, tc := range []struct {
+		err  error
+		want float64
+	}{
+		{err: errStaleResults, want: 1},
+		{err: errStaleResults, want: 1},
+		{want: 0},
+	} {
+		d.err = tc.err
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := testutil.ToFloat64(servingStaleGauge); got != tc.want {
+			t.Errorf("discoveryHandler: stale gauge mismatch after error %v: got: %v want: %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDiscoveryHandlerLabelsStaleResults(t *testing.T) {
+	d := &testDiscoverer{
+		discovered: []Device{{ID: "a", Addresses: []string{"100.2.3.4"}}},
+	}
+	h := Handler(d, WithStaticTargets(TargetDescriptor{Targets: []string{"static:9100"}}))
+	for _, tc := range []struct {
+		err        error
+		wantHeader string
+		wantStale  []string
+	}{
+		{err: errStaleResults, wantHeader: "true", wantStale: []string{"true", ""}},
+		{wantStale: []string{"", ""}},
+	} {
+		d.err = tc.err
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := w.Header().Get(StaleHeader); got != tc.wantHeader {
+			t.Errorf("discoveryHandler: stale header mismatch after error %v: got: %q want: %q", tc.err, got, tc.wantHeader)
+		}
+		var got []TargetDescriptor
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		var stale []string
+		for _, td := range got {
+			stale = append(stale, td.Labels[LabelMetaStale])
+		}
+		if diff := cmp.Diff(stale, tc.wantStale); diff != "" {
+			t.Errorf("discoveryHandler: stale labels mismatch after error %v (-got, +want):\n%v", tc.err, diff)
+		}
+	}
+}
+
+func TestDiscoveryHandlerSetsCacheHeaders(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		interval         time.Duration
+		err              error
+		wantCacheControl string
+		wantInterval     string
+	}{
+		"no interval": {},
+		"fresh": {
+			interval:         5 * time.Minute,
+			wantCacheControl: "max-age=300",
+			wantInterval:     "300",
+		},
+		"stale": {
+			interval:         5 * time.Minute,
+			err:              errStaleResults,
+			wantCacheControl: "no-cache",
+			wantInterval:     "300",
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			d := &testDiscoverer{discovered: []Device{{ID: "a"}}, err: tc.err}
+			w := httptest.NewRecorder()
+			Handler(d, WithRefreshInterval(tc.interval)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if got := w.Header().Get("Cache-Control"); got != tc.wantCacheControl {
+				t.Errorf("discoveryHandler: Cache-Control mismatch: got: %q want: %q", got, tc.wantCacheControl)
+			}
+			if got := w.Header().Get(RefreshIntervalHeader); got != tc.wantInterval {
+				t.Errorf("discoveryHandler: %v mismatch: got: %q want: %q", RefreshIntervalHeader, got, tc.wantInterval)
+			}
+		})
+	}
+}
+
+func TestSortDevices(t *testing.T) {
+	devices := []Device{
+		{ID: "b", API: "api.tailscale.com", Addresses: []string{"fd7a::1", "bogus", "100.2.3.4"}},
+		{ID: "a", API: "localhost", Addresses: []string{"100.2.3.5"}},
+		{ID: "a", API: "api.tailscale.com", Addresses: []string{"100.10.0.1", "100.9.0.1"}},
+	}
+	want := []Device{
+		{ID: "a", API: "api.tailscale.com", Addresses: []string{"100.9.0.1", "100.10.0.1"}},
+		{ID: "a", API: "localhost", Addresses: []string{"100.2.3.5"}},
+		{ID: "b", API: "api.tailscale.com", Addresses: []string{"100.2.3.4", "fd7a::1", "bogus"}},
+	}
+	got := sortDevices(devices)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("sortDevices: mismatch (-got, +want):\n%v", diff)
+	}
+	if devices[0].ID != "b" || devices[0].Addresses[0] != "fd7a::1" {
+		t.Error("sortDevices: modified its input")
+	}
+}
+
+func TestDiscoveryHandlerIsByteStable(t *testing.T) {
+	d := &testDiscoverer{
+		discovered: []Device{
+			{ID: "b", Addresses: []string{"fd7a::1", "100.2.3.4"}, Tags: []string{"tag:web", "tag:prom"}},
+			{ID: "a", Addresses: []string{"100.2.3.5"}},
+		},
+	}
+	h := Handler(d)
+	serve := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Body.String()
+	}
+	first := serve()
+	slices.Reverse(d.discovered)
+	slices.Reverse(d.discovered[1].Addresses)
+	if got := serve(); got != first {
+		t.Errorf("discoveryHandler: payload changed with device order:\n%v\n%v", first, got)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	targets := []TargetDescriptor{
+		{Targets: []string{"a"}},
+		{Targets: []string{"b"}},
+		{Targets: []string{"c"}},
+	}
+	for tn, tc := range map[string]struct {
+		query   string
+		want    []TargetDescriptor
+		wantErr bool
+	}{
+		"no pagination": {
+			want: targets,
+		},
+		"limit": {
+			query: "limit=2",
+			want:  targets[:2],
+		},
+		"offset and limit": {
+			query: "offset=1&limit=1",
+			want:  targets[1:2],
+		},
+		"limit beyond end": {
+			query: "offset=2&limit=10",
+			want:  targets[2:],
+		},
+		"largest limit": {
+			query: fmt.Sprintf("offset=1&limit=%d", math.MaxInt),
+			want:  targets[1:],
+		},
+		"offset beyond end": {
+			query: "offset=5",
+			want:  []TargetDescriptor{},
+		},
+		"negative offset": {
+			query:   "offset=-1",
+			wantErr: true,
+		},
+		"non-numeric limit": {
+			query:   "limit=lots",
+			wantErr: true,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := paginate(targets, query)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("paginate: error mismatch: got: %v want error: %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("paginate: mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerReportsTotalCount(t *testing.T) {
+	h := Handler(&testDiscoverer{
+		discovered: []Device{
+			{Addresses: []string{"100.2.3.4"}, ID: "one"},
+			{Addresses: []string{"100.2.3.5"}, ID: "two"},
+		},
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/?limit=1", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got, want := w.Header().Get(TotalCountHeader), "2"; got != want {
+		t.Errorf("Handler: total count mismatch: got: %q want: %q", got, want)
+	}
+	want := `[{"targets":["100.2.3.4"],"labels":{"__meta_tailscale_device_authorized":"false","__meta_tailscale_device_id":"one","__meta_tailscale_device_online":"false"}}]` + "\n"
+	if diff := cmp.Diff(w.Body.String(), want); diff != "" {
+		t.Errorf("Handler: content mismatch (-got, +want):\n%v", diff)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/?offset=nope", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("Handler: status mismatch: got: %v want: %v", got, want)
+	}
+}
+
+func TestDiscoveryHandlerObservesServing(t *testing.T) {
+	var before dto.Metric
+	if err := discoveryLatencyHistogram.Write(&before); err != nil {
+		t.Fatal(err)
+	}
+	d := &testDiscoverer{discovered: []Device{
+		{ID: "one", Addresses: []string{"100.2.3.4"}},
+		{ID: "two", Addresses: []string{"100.2.3.5"}},
+	}}
+	h := Handler(d, WithStaticTargets(TargetDescriptor{Targets: []string{"static"}}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?limit=1", nil))
+
+	var after dto.Metric
+	if err := discoveryLatencyHistogram.Write(&after); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.GetHistogram().GetSampleCount() - before.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("Handler: observed latency count mismatch: got: %v want: 1", got)
+	}
+	if got := testutil.ToFloat64(targetGroupsGauge); got != 3 {
+		t.Errorf("Handler: target groups mismatch: got: %v want: 3", got)
+	}
+	if got := testutil.ToFloat64(targetsServedGauge); got != 1 {
+		t.Errorf("Handler: targets served mismatch: got: %v want: 1", got)
+	}
+}
@@ -0,0 +1,149 @@
+package tailscalesd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetSnapshot is the JSON payload of all targets served at a time.
+type targetSnapshot struct {
+	at      time.Time
+	count   int
+	payload []byte
+
+	// stable is the JSON encoding of the targets without VolatileLabels, by
+	// which snapshots are compared.
+	stable []byte
+}
+
+// TargetSnapshots retains the most recent distinct sets of targets served by
+// a discovery Handler, before selection or pagination, so that unexpected
+// changes may be debugged by comparing exactly what was served before and
+// after them. A set of targets is recorded only when it differs from the
+// previous one in more than its VolatileLabels.
+type TargetSnapshots struct {
+	limit int
+
+	mu        sync.Mutex       // protects following members
+	snapshots []targetSnapshot // oldest first
+}
+
+// NewTargetSnapshots retaining up to limit sets of targets.
+func NewTargetSnapshots(limit int) *TargetSnapshots {
+	return &TargetSnapshots{limit: limit}
+}
+
+// record the targets served at the time at, unless they are unchanged but for
+// their VolatileLabels. A nil TargetSnapshots records nothing.
+func (s *TargetSnapshots) record(at time.Time, targets []TargetDescriptor) {
+	if s == nil || s.limit <= 0 {
+		return
+	}
+	if targets == nil {
+		targets = []TargetDescriptor{}
+	}
+	payload, err := json.Marshal(targets)
+	if err != nil {
+		log.Printf("Failed encoding targets snapshot: %v", err)
+		return
+	}
+	stableTargets := make([]TargetDescriptor, len(targets))
+	for i, td := range targets {
+		stableTargets[i] = WithoutVolatileLabels(td)
+	}
+	stable, err := json.Marshal(stableTargets)
+	if err != nil {
+		log.Printf("Failed encoding targets snapshot: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.snapshots); n > 0 && bytes.Equal(s.snapshots[n-1].stable, stable) {
+		return
+	}
+	s.snapshots = append(s.snapshots, targetSnapshot{at: at, count: len(targets), payload: payload, stable: stable})
+	if len(s.snapshots) > s.limit {
+		s.snapshots = s.snapshots[len(s.snapshots)-s.limit:]
+	}
+}
+
+// snapshot n, counting back from the most recent, which is 0.
+func (s *TargetSnapshots) snapshot(n int) (targetSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 0 || n >= len(s.snapshots) {
+		return targetSnapshot{}, false
+	}
+	return s.snapshots[len(s.snapshots)-1-n], true
+}
+
+// TargetSnapshotSummary describes a snapshot listed by TargetSnapshotsHandler.
+type TargetSnapshotSummary struct {
+	N            int       `json:"n"`
+	Time         time.Time `json:"time"`
+	TargetGroups int       `json:"targetGroups"`
+}
+
+// Summaries of the retained snapshots, most recent first.
+func (s *TargetSnapshots) Summaries() []TargetSnapshotSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summaries := make([]TargetSnapshotSummary, len(s.snapshots))
+	for i := range summaries {
+		snap := s.snapshots[len(s.snapshots)-1-i]
+		summaries[i] = TargetSnapshotSummary{N: i, Time: snap.at, TargetGroups: snap.count}
+	}
+	return summaries
+}
+
+// TargetSnapshotsPath is the path prefix under which TargetSnapshotsHandler
+// serves snapshots, such as "/debug/snapshots/1".
+const TargetSnapshotsPath = "/debug/snapshots/"
+
+type targetSnapshotsHandler struct {
+	s *TargetSnapshots
+}
+
+func (h targetSnapshotsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if rest := strings.TrimPrefix(r.URL.Path, TargetSnapshotsPath); rest == "" {
+		var err error
+		if body, err = json.Marshal(h.s.Summaries()); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			serveAndLog(w, fmt.Sprintf("Failed encoding snapshots: %v", err))
+			return
+		}
+	} else {
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		snap, ok := h.s.snapshot(n)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body = snap.payload
+		w.Header().Set("Last-Modified", snap.at.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Failed sending snapshot to the client: %v", err)
+	}
+}
+
+// TargetSnapshotsHandler serves the snapshots retained by s. At
+// TargetSnapshotsPath it lists them as JSON, most recent first, and at
+// TargetSnapshotsPath followed by n it serves the targets of snapshot n as
+// JSON, where 0 is the most recent, 1 the one before it, and so on.
+func TargetSnapshotsHandler(s *TargetSnapshots) http.Handler {
+	return targetSnapshotsHandler{s}
+}
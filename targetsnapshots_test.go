@@ -0,0 +1,109 @@
+package tailscalesd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTargetSnapshotsRecordsChanges(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewTargetSnapshots(2)
+	one := []TargetDescriptor{{Targets: []string{"100.2.3.4"}, Labels: map[string]string{"a": "1"}}}
+	two := []TargetDescriptor{{Targets: []string{"100.2.3.4"}, Labels: map[string]string{"a": "2"}}}
+	s.record(at, one)
+	s.record(at.Add(time.Minute), one)
+	s.record(at.Add(2*time.Minute), two)
+	s.record(at.Add(3*time.Minute), nil)
+	want := []TargetSnapshotSummary{
+		{N: 0, Time: at.Add(3 * time.Minute), TargetGroups: 0},
+		{N: 1, Time: at.Add(2 * time.Minute), TargetGroups: 1},
+	}
+	if diff := cmp.Diff(s.Summaries(), want); diff != "" {
+		t.Errorf("TargetSnapshots: mismatch (-got, +want):\n%v", diff)
+	}
+
+	var disabled *TargetSnapshots
+	disabled.record(at, one)
+}
+
+func TestTargetSnapshotsIgnoreVolatileLabels(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewTargetSnapshots(10)
+	wrapped := &testDiscoverer{discovered: []Device{
+		{ID: "one", Hostname: "foo", Addresses: []string{"100.2.3.4"}, Expires: at.Add(24 * time.Hour)},
+	}}
+	sd := Handler(wrapped, WithTargetSnapshots(s), WithClock(ClockFunc(func() time.Time { return at })))
+	for i := 0; i < 3; i++ {
+		sd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		at = at.Add(time.Second)
+	}
+	want := []TargetSnapshotSummary{
+		{N: 0, Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), TargetGroups: 1},
+	}
+	if diff := cmp.Diff(s.Summaries(), want); diff != "" {
+		t.Errorf("TargetSnapshots: mismatch (-got, +want):\n%v", diff)
+	}
+}
+
+func TestTargetSnapshotsHandler(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewTargetSnapshots(10)
+	wrapped := &testDiscoverer{discovered: []Device{
+		{ID: "one", Hostname: "foo", Addresses: []string{"100.2.3.4"}},
+	}}
+	sd := Handler(wrapped, WithTargetSnapshots(s), WithClock(ClockFunc(func() time.Time { return at })))
+	for _, target := range []string{"/", "/?tag=absent"} {
+		sd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	wrapped.discovered = nil
+	at = at.Add(time.Minute)
+	sd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	for tn, tc := range map[string]struct {
+		path string
+		code int
+		body string
+	}{
+		"list": {
+			path: "/debug/snapshots/",
+			code: http.StatusOK,
+			body: `[{"n":0,"time":"2024-03-01T12:01:00Z","targetGroups":0},{"n":1,"time":"2024-03-01T12:00:00Z","targetGroups":1}]`,
+		},
+		"most recent": {
+			path: "/debug/snapshots/0",
+			code: http.StatusOK,
+			body: `[]`,
+		},
+		"previous": {
+			path: "/debug/snapshots/1",
+			code: http.StatusOK,
+			body: `[{"targets":["100.2.3.4"],"labels":{"__meta_tailscale_device_authorized":"false","__meta_tailscale_device_hostname":"foo","__meta_tailscale_device_id":"one","__meta_tailscale_device_online":"false"}}]`,
+		},
+		"out of range": {
+			path: "/debug/snapshots/2",
+			code: http.StatusNotFound,
+		},
+		"not a number": {
+			path: "/debug/snapshots/latest",
+			code: http.StatusNotFound,
+		},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			TargetSnapshotsHandler(s).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.code {
+				t.Fatalf("TargetSnapshotsHandler: status mismatch: got: %v want: %v", w.Code, tc.code)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			if diff := cmp.Diff(w.Body.String(), tc.body); diff != "" {
+				t.Errorf("TargetSnapshotsHandler: content mismatch (-got, +want):\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package tailscalesd
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans of tailscalesd in OpenTelemetry.
+const instrumentationName = "github.com/cfunkhouser/tailscalesd"
+
+// tracer of spans around serving discovery and requesting the Tailscale APIs.
+// They are recorded by the globally registered otel TracerProvider, so are
+// discarded unless one has been set.
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// traceIDKey is the context key of trace IDs.
+type traceIDKey struct{}
+
+// WithTraceID returns a copy of ctx carrying the traceID, which is attached as
+// an exemplar to the API latency histograms observed while discovering with
+// it, so that slow refreshes can be found in the tracing backend.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// traceID carried by ctx, if any, or else that of the sampled span it carries.
+func traceID(ctx context.Context) string {
+	if id, ok := ctx.Value(traceIDKey{}).(string); ok {
+		return id
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// traceparentID returns the trace ID from the W3C Trace Context traceparent
+// header, such as "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+// of a request which is being traced.
+func traceparentID(h http.Header) (string, bool) {
+	parts := strings.Split(h.Get("traceparent"), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || strings.Trim(parts[1], "0") == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// withRequestTraceID returns the context of r, carrying the ID of the trace it
+// is part of, if any.
+func withRequestTraceID(r *http.Request) context.Context {
+	if id, ok := traceparentID(r.Header); ok {
+		return WithTraceID(r.Context(), id)
+	}
+	return r.Context()
+}
+
+// startRequestSpan starts the server span of serving r, continuing the trace
+// propagated by the client, if any.
+func startRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(withRequestTraceID(r), propagation.HeaderCarrier(r.Header))
+	return tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("url.query", r.URL.RawQuery),
+		))
+}
+
+// failSpan marks span as failed by err.
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// tracedAPI wraps the requests made to a Tailscale API in client spans, so a
+// slow discovery can be traced to the request responsible. It is both an
+// HTTPDoer and a http.RoundTripper.
+type tracedAPI struct {
+	api  string
+	next func(*http.Request) (*http.Response, error)
+}
+
+func (t tracedAPI) Do(req *http.Request) (*http.Response, error) {
+	// The URL is not recorded in full, as it may carry credentials.
+	ctx, span := tracer().Start(req.Context(), req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("tailscale.api", t.api),
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.path", req.URL.Path),
+		))
+	defer span.End()
+	resp, err := t.next(req.WithContext(ctx))
+	if err != nil {
+		failSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+func (t tracedAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.Do(req)
+}
+
+// observeLatency since start in milliseconds, with the trace ID carried by
+// ctx as an exemplar if there is one.
+func observeLatency(ctx context.Context, o prometheus.Observer, start time.Time) {
+	ms := float64(time.Since(start).Milliseconds())
+	if id := traceID(ctx); id != "" {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(ms, prometheus.Labels{"trace_id": id})
+			return
+		}
+	}
+	o.Observe(ms)
+}
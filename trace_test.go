@@ -0,0 +1,135 @@
+package tailscalesd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceparentID(t *testing.T) {
+	for tn, tc := range map[string]struct {
+		header string
+		want   string
+		wantOK bool
+	}{
+		"valid": {
+			header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantOK: true,
+		},
+		"missing":       {},
+		"short":         {header: "00-4bf92f35-00f067aa0ba902b7-01"},
+		"not hex":       {header: "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01"},
+		"all zero":      {header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		"missing parts": {header: "00-4bf92f3577b34da6a3ce929d0e0e4736"},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			h := make(http.Header)
+			if tc.header != "" {
+				h.Set("traceparent", tc.header)
+			}
+			got, ok := traceparentID(h)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("traceparentID(%q): got: (%q, %v) want: (%q, %v)", tc.header, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestObserveLatencyAttachesExemplar(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_latency_ms",
+		Buckets: []float64{1, 10},
+	})
+	observeLatency(WithTraceID(context.TODO(), "4bf92f3577b34da6a3ce929d0e0e4736"), h, time.Now())
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, b := range m.GetHistogram().GetBucket() {
+		for _, l := range b.GetExemplar().GetLabel() {
+			if l.GetName() == "trace_id" && l.GetValue() == "4bf92f3577b34da6a3ce929d0e0e4736" {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("observeLatency: no exemplar with the trace ID in %v", m.GetHistogram())
+	}
+}
+
+// recordSpans registers a TracerProvider recording spans, and the W3C Trace
+// Context propagator, for the duration of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return sr
+}
+
+func TestDiscoveryTracesAPIRequests(t *testing.T) {
+	sr := recordSpans(t)
+	d := PublicAPI("testTailnet", "testToken", WithHTTPClient(doerFunc(func(r *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		fmt.Fprint(rec, `{"devices":[{"id":"id","hostname":"somethingclever"}]}`)
+		return rec.Result(), nil
+	})))
+	r := httptest.NewRequest(http.MethodGet, "/?tag=prom", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Handler(d).ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ServeHTTP: want 2 spans, got: %v", spans)
+	}
+	api, served := spans[0], spans[1]
+	if got, want := served.Name(), "discovery"; got != want {
+		t.Errorf("ServeHTTP: span name mismatch: got: %q want: %q", got, want)
+	}
+	if got, want := served.Parent().TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736"; got != want {
+		t.Errorf("ServeHTTP: propagated trace mismatch: got: %q want: %q", got, want)
+	}
+	if got, want := api.Name(), "GET /api/v2/tailnet/testTailnet/devices"; got != want {
+		t.Errorf("Devices: span name mismatch: got: %q want: %q", got, want)
+	}
+	if got, want := api.Parent().SpanID(), served.SpanContext().SpanID(); got != want {
+		t.Errorf("Devices: span parent mismatch: got: %v want: %v", got, want)
+	}
+}
+
+func TestTracedAPIRecordsFailures(t *testing.T) {
+	sr := recordSpans(t)
+	client := tracedAPI{api: "public", next: func(*http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		rec.WriteHeader(http.StatusUnauthorized)
+		return rec.Result(), nil
+	}}
+	if _, err := client.Do(httptest.NewRequest(http.MethodGet, "https://api.tailscale.com/api/v2/tailnet/-/devices", nil)); err != nil {
+		t.Fatal(err)
+	}
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Do: want 1 span, got: %v", spans)
+	}
+	if got, want := spans[0].Status().Code, codes.Error; got != want {
+		t.Errorf("Do: span status mismatch: got: %v want: %v", got, want)
+	}
+}